@@ -0,0 +1,50 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// alpで集計できるようLTSVで出力する
+var accessLogger = log.New(os.Stdout, "", 0)
+
+var accessLogCounter atomic.Uint64
+
+// 成功したリクエストはAccessLogSampleRate件に1件だけ、エラーは全件記録する
+func accessLogMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		rate := currentTunables().AccessLogSampleRate
+		if rate == 0 {
+			return next(c)
+		}
+
+		start := time.Now()
+		err := next(c)
+		if err != nil {
+			// ステータスコードを確定させる
+			c.Error(err)
+		}
+
+		res := c.Response()
+		if res.Status < 400 && accessLogCounter.Add(1)%uint64(rate) != 0 {
+			return nil
+		}
+
+		req := c.Request()
+		accessLogger.Printf("time:%s\tmethod:%s\turi:%s\tstatus:%d\tsize:%d\treqtime:%.3f\tsampling:%d\treqid:%s",
+			start.Format(time.RFC3339),
+			req.Method,
+			req.RequestURI,
+			res.Status,
+			res.Size,
+			time.Since(start).Seconds(),
+			rate,
+			res.Header().Get(echo.HeaderXRequestID),
+		)
+		return nil
+	}
+}
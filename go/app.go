@@ -0,0 +1,40 @@
+package main
+
+import (
+	"github.com/jmoiron/sqlx"
+)
+
+// ハンドラが使うDB接続・外部APIのクライアント・時計・ID生成・リポジトリ・サービスをまとめる。mainで組み立ててregisterRoutesに渡す
+// 移してあるのはAppのメソッドになっているハンドラとサービスだけで、それらはグローバルのdbConnを使わない
+// それ以外のハンドラ・バックグラウンドの処理とキャッシュ (XByYCache) はまだパッケージのグローバルのまま
+type App struct {
+	db       *sqlx.DB
+	powerDNS *PowerDNSClient
+	clock    Clock
+	ids      IDGenerator
+	users    UserRepository
+	icons    IconRepository
+
+	userService        *UserService
+	livestreamService  *LivestreamService
+	livecommentService *LivecommentService
+	reactionService    *ReactionService
+}
+
+func newApp(db *sqlx.DB, powerDNS *PowerDNSClient, clock Clock, ids IDGenerator, hasher Hasher) *App {
+	icons := newIconRepository(hasher)
+	users := newUserRepository(icons)
+	return &App{
+		db:       db,
+		powerDNS: powerDNS,
+		clock:    clock,
+		ids:      ids,
+		users:    users,
+		icons:    icons,
+
+		userService:        &UserService{db: db, powerDNS: powerDNS, users: users, icons: icons},
+		livestreamService:  &LivestreamService{db: db, clock: clock},
+		livecommentService: &LivecommentService{db: db, clock: clock},
+		reactionService:    &ReactionService{db: db, clock: clock},
+	}
+}
@@ -0,0 +1,25 @@
+package main
+
+import "testing"
+
+type fakeHasher struct{}
+
+func (fakeHasher) Sum(b []byte) string {
+	return "fake:" + string(b)
+}
+
+// mainから渡したHasherがハンドラとサービスのリポジトリまで届く
+func TestNewAppInjectsHasher(t *testing.T) {
+	app := newApp(nil, nil, systemClock{}, uuidGenerator{}, fakeHasher{})
+
+	for name, icons := range map[string]IconRepository{
+		"app":               app.icons,
+		"users":             app.users.icons,
+		"userService":       app.userService.icons,
+		"userService.users": app.userService.users.icons,
+	} {
+		if got := icons.Hash([]byte("x")); got != "fake:x" {
+			t.Errorf("%s: hash = %q, want fake:x", name, got)
+		}
+	}
+}
@@ -0,0 +1,242 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+type ArchiveModel struct {
+	ID           int64        `db:"id"`
+	LivestreamID LivestreamID `db:"livestream_id"`
+	PlaylistUrl  string       `db:"playlist_url"`
+	Duration     int64        `db:"duration"`
+	CreatedAt    int64        `db:"created_at"`
+}
+
+type Archive struct {
+	ID          int64      `json:"id"`
+	Livestream  Livestream `json:"livestream"`
+	PlaylistUrl string     `json:"playlist_url"`
+	// 秒
+	Duration  int64 `json:"duration"`
+	CreatedAt int64 `json:"created_at"`
+}
+
+type PostArchiveRequest struct {
+	PlaylistUrl string `json:"playlist_url"`
+	Duration    int64  `json:"duration"`
+}
+
+// 終了した配信の録画セグメントを登録するAPI
+// POST /api/livestream/:livestream_id/archive
+func postArchiveHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	var req *PostArchiveRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidJSON, "failed to decode the request body as json")
+	}
+	if req.PlaylistUrl == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "playlist_url must not be empty")
+	}
+	if req.Duration <= 0 {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "duration must be positive")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "not found livestream that has the given id")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return newCodedHTTPError(http.StatusForbidden, errorCodeNotLivestreamOwner, "can't register archive of other streamer's livestream")
+	}
+	if livestreamModel.EndAt > time.Now().Unix() {
+		return echo.NewHTTPError(http.StatusBadRequest, "livestream has not ended yet")
+	}
+
+	archiveModel := ArchiveModel{
+		LivestreamID: LivestreamID(livestreamID),
+		PlaylistUrl:  req.PlaylistUrl,
+		Duration:     req.Duration,
+		CreatedAt:    time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO archives (livestream_id, playlist_url, duration, created_at) VALUES (:livestream_id, :playlist_url, :duration, :created_at)", archiveModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert archive: "+err.Error())
+	}
+	archiveID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted archive id: "+err.Error())
+	}
+	archiveModel.ID = archiveID
+
+	archives, err := fillArchiveResponseBulk(ctx, tx, []*ArchiveModel{&archiveModel})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill archive: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, archives[0])
+}
+
+// 配信の録画セグメント一覧API
+// GET /api/livestream/:livestream_id/archive
+func getArchivesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var archiveModels []*ArchiveModel
+	if err := tx.SelectContext(ctx, &archiveModels, "SELECT * FROM archives WHERE livestream_id = ? ORDER BY id", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get archives: "+err.Error())
+	}
+
+	archives, err := fillArchiveResponseBulk(ctx, tx, archiveModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill archives: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, archives)
+}
+
+// ユーザページ向けに、そのユーザの配信の録画を新しい順に返すAPI
+// GET /api/user/:username/archive
+func getUserArchivesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	username := c.Param("username")
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel, err := userRepository.GetByName(ctx, tx, username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeUserNotFound, "user not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	var archiveModels []*ArchiveModel
+	if err := tx.SelectContext(ctx, &archiveModels, "SELECT a.* FROM archives a INNER JOIN livestreams l ON l.id = a.livestream_id WHERE l.user_id = ? ORDER BY a.id DESC", userModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get archives: "+err.Error())
+	}
+
+	archives, err := fillArchiveResponseBulk(ctx, tx, archiveModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill archives: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, archives)
+}
+
+func fillArchiveResponseBulk(ctx context.Context, tx *sqlx.Tx, archiveModels []*ArchiveModel) ([]Archive, error) {
+	if len(archiveModels) == 0 {
+		return []Archive{}, nil
+	}
+
+	livestreamIDSet := make(map[LivestreamID]struct{})
+	for _, archiveModel := range archiveModels {
+		livestreamIDSet[archiveModel.LivestreamID] = struct{}{}
+	}
+	livestreamIDs := make([]LivestreamID, 0, len(livestreamIDSet))
+	for id := range livestreamIDSet {
+		livestreamIDs = append(livestreamIDs, id)
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, tx.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	livestreams, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
+	if err != nil {
+		return nil, err
+	}
+	livestreamMap := make(map[LivestreamID]Livestream, len(livestreams))
+	for _, livestream := range livestreams {
+		livestreamMap[livestream.ID] = livestream
+	}
+
+	archives := make([]Archive, len(archiveModels))
+	for i, archiveModel := range archiveModels {
+		archives[i] = Archive{
+			ID:          archiveModel.ID,
+			Livestream:  livestreamMap[archiveModel.LivestreamID],
+			PlaylistUrl: archiveModel.PlaylistUrl,
+			Duration:    archiveModel.Duration,
+			CreatedAt:   archiveModel.CreatedAt,
+		}
+	}
+
+	return archives, nil
+}
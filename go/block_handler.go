@@ -0,0 +1,75 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ユーザのブロックAPI
+// POST /api/user/:username/block
+func blockUserHandler(c echo.Context) error {
+	return changeBlock(c, true)
+}
+
+// ユーザのブロック解除API
+// DELETE /api/user/:username/block
+func unblockUserHandler(c echo.Context) error {
+	return changeBlock(c, false)
+}
+
+func changeBlock(c echo.Context, block bool) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	username := c.Param("username")
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	blockedUserID, err := userRepository.GetIDByName(ctx, tx, username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeUserNotFound, "user not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if blockedUserID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't block yourself")
+	}
+
+	if block {
+		_, err = tx.ExecContext(ctx, "INSERT IGNORE INTO user_blocks (user_id, blocked_user_id, created_at) VALUES (?, ?, ?)", userID, blockedUserID, time.Now().Unix())
+	} else {
+		_, err = tx.ExecContext(ctx, "DELETE FROM user_blocks WHERE user_id = ? AND blocked_user_id = ?", userID, blockedUserID)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update block: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 閲覧者がブロックしているユーザの行を除く条件。引数に閲覧者のユーザIDを渡す
+// 一覧はLIMITより前に除かないと件数が足りなくなるので、取得後ではなくSQLで絞る
+const notBlockedCondition = " AND user_id NOT IN (SELECT blocked_user_id FROM user_blocks WHERE user_id = ?)"
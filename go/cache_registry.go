@@ -0,0 +1,26 @@
+package main
+
+import "sync"
+
+// /api/initializeで初期状態に戻すキャッシュ・キュー
+// キャッシュを追加したら定義したファイルのinit()で登録する
+var (
+	cacheResetHooks      []func()
+	cacheResetHooksMutex = sync.Mutex{}
+)
+
+func registerCacheReset(reset func()) {
+	cacheResetHooksMutex.Lock()
+	defer cacheResetHooksMutex.Unlock()
+
+	cacheResetHooks = append(cacheResetHooks, reset)
+}
+
+func resetCaches() {
+	cacheResetHooksMutex.Lock()
+	defer cacheResetHooksMutex.Unlock()
+
+	for _, reset := range cacheResetHooks {
+		reset()
+	}
+}
@@ -0,0 +1,257 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信ごとのチャット (ライブコメント) の設定。行が無い配信は全てデフォルト値
+type ChatSettingsModel struct {
+	LivestreamID    LivestreamID `db:"livestream_id"`
+	SlowModeSeconds int64        `db:"slow_mode_seconds"`
+	EmoteOnly       bool         `db:"emote_only"`
+	FollowersOnly   bool         `db:"followers_only"`
+}
+
+type ChatSettings struct {
+	// 0なら無効。同じユーザが次にコメントできるまでの秒数 (配信者には適用しない)
+	SlowModeSeconds int64 `json:"slow_mode_seconds"`
+	// 配信者のエモート (:name:) だけのコメントしか許さない
+	EmoteOnly bool `json:"emote_only"`
+	// 配信者をフォローしているユーザしかコメントできない
+	FollowersOnly bool `json:"followers_only"`
+}
+
+type PatchChatSettingsRequest struct {
+	SlowModeSeconds *int64 `json:"slow_mode_seconds" validate:"min=0,max=3600"`
+	EmoteOnly       *bool  `json:"emote_only"`
+	FollowersOnly   *bool  `json:"followers_only"`
+}
+
+func fillChatSettingsResponse(model ChatSettingsModel) ChatSettings {
+	return ChatSettings{
+		SlowModeSeconds: model.SlowModeSeconds,
+		EmoteOnly:       model.EmoteOnly,
+		FollowersOnly:   model.FollowersOnly,
+	}
+}
+
+var (
+	ChatSettingsByLivestreamIDCache      = make(map[LivestreamID]ChatSettings)
+	ChatSettingsByLivestreamIDCacheMutex = sync.RWMutex{}
+
+	// スローモードの判定に使う、ユーザが配信に最後にコメントした時刻
+	LivecommentPostedAtByKeyCache      = make(map[livecommentLimiterKey]time.Time)
+	LivecommentPostedAtByKeyCacheMutex = sync.Mutex{}
+)
+
+// スローモードの間隔の上限 (PatchChatSettingsRequestのmax)。これより前の投稿時刻は判定に使われない
+const maxSlowModeInterval = 3600 * time.Second
+
+type livecommentLimiterKey struct {
+	UserID       UserID
+	LivestreamID LivestreamID
+}
+
+func init() {
+	registerCacheReset(func() {
+		ChatSettingsByLivestreamIDCacheMutex.Lock()
+		ChatSettingsByLivestreamIDCache = make(map[LivestreamID]ChatSettings)
+		ChatSettingsByLivestreamIDCacheMutex.Unlock()
+
+		LivecommentPostedAtByKeyCacheMutex.Lock()
+		LivecommentPostedAtByKeyCache = make(map[livecommentLimiterKey]time.Time)
+		LivecommentPostedAtByKeyCacheMutex.Unlock()
+	})
+}
+
+func getChatSettings(ctx context.Context, q sqlx.QueryerContext, livestreamID LivestreamID) (ChatSettings, error) {
+	ChatSettingsByLivestreamIDCacheMutex.RLock()
+	settings, ok := ChatSettingsByLivestreamIDCache[livestreamID]
+	ChatSettingsByLivestreamIDCacheMutex.RUnlock()
+	if ok {
+		return settings, nil
+	}
+
+	var model ChatSettingsModel
+	err := sqlx.GetContext(ctx, q, &model, "SELECT * FROM livestream_chat_settings WHERE livestream_id = ?", livestreamID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return ChatSettings{}, err
+	}
+	settings = fillChatSettingsResponse(model)
+
+	ChatSettingsByLivestreamIDCacheMutex.Lock()
+	ChatSettingsByLivestreamIDCache[livestreamID] = settings
+	ChatSettingsByLivestreamIDCacheMutex.Unlock()
+	return settings, nil
+}
+
+// スローモードの間隔が空いていれば投稿時刻を記録する
+// 空いていなければ待つ必要のある時間を返す。投稿できなかった場合はrelease()で記録を戻す
+func takeLivecommentSlot(userID UserID, livestreamID LivestreamID, interval time.Duration, now time.Time) (time.Duration, func()) {
+	key := livecommentLimiterKey{UserID: userID, LivestreamID: livestreamID}
+
+	LivecommentPostedAtByKeyCacheMutex.Lock()
+	defer LivecommentPostedAtByKeyCacheMutex.Unlock()
+	last, ok := LivecommentPostedAtByKeyCache[key]
+	if ok {
+		if elapsed := now.Sub(last); elapsed < interval {
+			return interval - elapsed, nil
+		}
+	}
+	LivecommentPostedAtByKeyCache[key] = now
+
+	release := func() {
+		LivecommentPostedAtByKeyCacheMutex.Lock()
+		defer LivecommentPostedAtByKeyCacheMutex.Unlock()
+		// 後から別の投稿で記録し直されていれば触らない
+		if LivecommentPostedAtByKeyCache[key] != now {
+			return
+		}
+		if ok {
+			LivecommentPostedAtByKeyCache[key] = last
+		} else {
+			delete(LivecommentPostedAtByKeyCache, key)
+		}
+	}
+	return 0, release
+}
+
+// どのスローモードの判定にも使われなくなった投稿時刻を捨てる
+func sweepExpiredLivecommentSlots(now time.Time) {
+	LivecommentPostedAtByKeyCacheMutex.Lock()
+	defer LivecommentPostedAtByKeyCacheMutex.Unlock()
+
+	for key, postedAt := range LivecommentPostedAtByKeyCache {
+		if now.Sub(postedAt) >= maxSlowModeInterval {
+			delete(LivecommentPostedAtByKeyCache, key)
+		}
+	}
+}
+
+// チャット設定の取得API
+// GET /api/livestream/:livestream_id/chat_settings
+func getChatSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	var exists int
+	if err := dbConn.GetContext(ctx, &exists, "SELECT 1 FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	settings, err := getChatSettings(ctx, dbConn, LivestreamID(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get chat settings: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, settings)
+}
+
+// チャット設定の変更API (配信者のみ)。省略した項目は変えない
+// PATCH /api/livestream/:livestream_id/chat_settings
+func patchChatSettingsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	req := PatchChatSettingsRequest{}
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var ownerID UserID
+	if err := tx.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if ownerID != userID {
+		return newCodedHTTPError(http.StatusForbidden, errorCodeNotLivestreamOwner, "can't change chat settings of other streamer's livestream")
+	}
+
+	var model ChatSettingsModel
+	err = tx.GetContext(ctx, &model, "SELECT * FROM livestream_chat_settings WHERE livestream_id = ? FOR UPDATE", livestreamID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get chat settings: "+err.Error())
+	}
+	model.LivestreamID = LivestreamID(livestreamID)
+	if req.SlowModeSeconds != nil {
+		model.SlowModeSeconds = *req.SlowModeSeconds
+	}
+	if req.EmoteOnly != nil {
+		model.EmoteOnly = *req.EmoteOnly
+	}
+	if req.FollowersOnly != nil {
+		model.FollowersOnly = *req.FollowersOnly
+	}
+
+	if _, err := tx.NamedExecContext(ctx, "INSERT INTO livestream_chat_settings (livestream_id, slow_mode_seconds, emote_only, followers_only) VALUES (:livestream_id, :slow_mode_seconds, :emote_only, :followers_only) ON DUPLICATE KEY UPDATE slow_mode_seconds = VALUES(slow_mode_seconds), emote_only = VALUES(emote_only), followers_only = VALUES(followers_only)", model); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update chat settings: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	settings := fillChatSettingsResponse(model)
+	ChatSettingsByLivestreamIDCacheMutex.Lock()
+	ChatSettingsByLivestreamIDCache[LivestreamID(livestreamID)] = settings
+	ChatSettingsByLivestreamIDCacheMutex.Unlock()
+
+	return c.JSON(http.StatusOK, settings)
+}
+
+// 配信者のエモートと空白だけでできているか (空のコメントは投げ銭のみとして許す)
+func isEmoteOnlyComment(comment string, emotes map[string]EmoteModel) bool {
+	rest := emoteTokenPattern.ReplaceAllStringFunc(comment, func(token string) string {
+		if _, ok := emotes[strings.Trim(token, ":")]; ok {
+			return ""
+		}
+		return token
+	})
+	return strings.TrimSpace(rest) == ""
+}
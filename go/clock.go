@@ -0,0 +1,42 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// 現在時刻・ID・ハッシュの生成元。サービスのテストで固定した値を返せるよう、Appやリポジトリに持たせて使う
+
+type Clock interface {
+	Now() time.Time
+}
+
+type systemClock struct{}
+
+func (systemClock) Now() time.Time {
+	return time.Now()
+}
+
+type IDGenerator interface {
+	NewString() string
+}
+
+type uuidGenerator struct{}
+
+func (uuidGenerator) NewString() string {
+	return uuid.NewString()
+}
+
+// アイコンのicon_hash・ETagに使う
+type Hasher interface {
+	Sum(b []byte) string
+}
+
+type sha256Hasher struct{}
+
+func (sha256Hasher) Sum(b []byte) string {
+	return fmt.Sprintf("%x", sha256.Sum256(b))
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ライブ配信ごとの共同配信者のユーザID
+var (
+	CollaboratorIDsByLivestreamIDCache      = make(map[LivestreamID]map[UserID]struct{})
+	CollaboratorIDsByLivestreamIDCacheMutex = sync.RWMutex{}
+	// 消すたびに進める。読んでいる間に進んだら読んだ結果をキャッシュに載せない
+	collaboratorIDsCacheGeneration atomic.Uint64
+)
+
+func init() {
+	registerCacheReset(func() {
+		CollaboratorIDsByLivestreamIDCacheMutex.Lock()
+		CollaboratorIDsByLivestreamIDCache = make(map[LivestreamID]map[UserID]struct{})
+		CollaboratorIDsByLivestreamIDCacheMutex.Unlock()
+	})
+}
+
+type LivestreamCollaboratorModel struct {
+	ID           int64        `db:"id"`
+	LivestreamID LivestreamID `db:"livestream_id"`
+	UserID       UserID       `db:"user_id"`
+	CreatedAt    int64        `db:"created_at"`
+}
+
+type PostCollaboratorRequest struct {
+	Username string `json:"username"`
+}
+
+// 共同配信者の追加API (配信者のみ)
+// POST /api/livestream/:livestream_id/collaborators
+func postCollaboratorHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	var req *PostCollaboratorRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidJSON, "failed to decode the request body as json")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return newCodedHTTPError(http.StatusForbidden, errorCodeNotLivestreamOwner, "can't add collaborators to other streamer's livestream")
+	}
+
+	collaboratorModel, err := userRepository.GetByName(ctx, tx, req.Username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeUserNotFound, "user not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if collaboratorModel.ID == livestreamModel.UserID {
+		return echo.NewHTTPError(http.StatusBadRequest, "owner can't be a collaborator")
+	}
+
+	if _, err := tx.ExecContext(ctx, "INSERT IGNORE INTO livestream_collaborators (livestream_id, user_id, created_at) VALUES (?, ?, ?)", livestreamID, collaboratorModel.ID, time.Now().Unix()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert collaborator: "+err.Error())
+	}
+
+	collaborators, err := getCollaborators(ctx, tx, LivestreamID(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborators: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	deleteCollaboratorIDsCache(LivestreamID(livestreamID))
+
+	return c.JSON(http.StatusCreated, collaborators)
+}
+
+// 共同配信者の一覧API
+// GET /api/livestream/:livestream_id/collaborators
+func getCollaboratorsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	sel, err := parseFieldSelection(c, User{})
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	collaborators, err := getCollaborators(ctx, tx, LivestreamID(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborators: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return respondFieldSelected(c, http.StatusOK, collaborators, sel)
+}
+
+func getCollaborators(ctx context.Context, tx *sqlx.Tx, livestreamID LivestreamID) ([]User, error) {
+	var userModels []*UserModel
+	if err := tx.SelectContext(ctx, &userModels, "SELECT u.* FROM users u INNER JOIN livestream_collaborators lc ON lc.user_id = u.id WHERE lc.livestream_id = ? ORDER BY lc.id", livestreamID); err != nil {
+		return nil, err
+	}
+	return userRepository.FillBulk(ctx, tx, userModels)
+}
+
+// 共同配信者を変えたトランザクションのコミット後に呼ぶ
+func deleteCollaboratorIDsCache(livestreamID LivestreamID) {
+	CollaboratorIDsByLivestreamIDCacheMutex.Lock()
+	collaboratorIDsCacheGeneration.Add(1)
+	delete(CollaboratorIDsByLivestreamIDCache, livestreamID)
+	CollaboratorIDsByLivestreamIDCacheMutex.Unlock()
+}
+
+// 配信者本人か共同配信者であればモデレーションできる
+func canModerateLivestream(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel, userID UserID) (bool, error) {
+	if livestreamModel.UserID == userID {
+		return true, nil
+	}
+
+	CollaboratorIDsByLivestreamIDCacheMutex.RLock()
+	collaboratorIDs, ok := CollaboratorIDsByLivestreamIDCache[livestreamModel.ID]
+	CollaboratorIDsByLivestreamIDCacheMutex.RUnlock()
+	if !ok {
+		// 呼び出し元のトランザクションのスナップショットは古いことがあるので、キャッシュに載せる分はdbConnで最新を読む
+		generation := collaboratorIDsCacheGeneration.Load()
+		var ids []UserID
+		if err := dbConn.SelectContext(ctx, &ids, "SELECT user_id FROM livestream_collaborators WHERE livestream_id = ?", livestreamModel.ID); err != nil {
+			return false, err
+		}
+		collaboratorIDs = make(map[UserID]struct{}, len(ids))
+		for _, id := range ids {
+			collaboratorIDs[id] = struct{}{}
+		}
+
+		CollaboratorIDsByLivestreamIDCacheMutex.Lock()
+		if collaboratorIDsCacheGeneration.Load() == generation {
+			CollaboratorIDsByLivestreamIDCache[livestreamModel.ID] = collaboratorIDs
+		}
+		CollaboratorIDsByLivestreamIDCacheMutex.Unlock()
+	}
+
+	_, ok = collaboratorIDs[userID]
+	return ok, nil
+}
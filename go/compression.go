@@ -0,0 +1,33 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// 画像は既に圧縮済み、ストリームはgzipのバッファで配信が遅れるので圧縮しない
+var gzipSkippedPathSuffixes = []string{
+	"/icon",
+	"/emote/:emote_name",
+	"/stream",
+	"/ws",
+}
+
+func newGzipMiddleware(cfg *Config) echo.MiddlewareFunc {
+	return middleware.GzipWithConfig(middleware.GzipConfig{
+		Skipper: func(c echo.Context) bool {
+			// ルーティング後なのでc.Path()はルートのパターン
+			for _, suffix := range gzipSkippedPathSuffixes {
+				if strings.HasSuffix(c.Path(), suffix) {
+					return true
+				}
+			}
+			return false
+		},
+		Level: cfg.GzipLevel,
+		// これより小さいレスポンスは圧縮しても得をしない
+		MinLength: cfg.GzipMinLength,
+	})
+}
@@ -0,0 +1,602 @@
+package main
+
+import (
+	"compress/gzip"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"strconv"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	echolog "github.com/labstack/gommon/log"
+	"golang.org/x/time/rate"
+)
+
+// 起動時に読む環境変数
+const (
+	listenPortEnvKey = "ISUCON13_LISTEN_PORT"
+	socketPathEnvKey = "ISU_SOCKET_PATH"
+	h2cEnabledEnvKey = "ISUCON13_H2C_ENABLED"
+	// ローカル開発用。設定されていればこのディレクトリのフロントエンドも配信する
+	staticDirEnvKey = "ISUCON13_STATIC_DIR"
+	// 1ホストで複数プロセスを動かす設定 (未対応)
+	multiprocessEnvKey = "ISU_MULTIPROCESS"
+	// 遅いクエリをログに出してEXPLAINする (デバッグ用)
+	debugExplainEnvKey = "ISU_DEBUG_EXPLAIN"
+
+	jsonSerializerEnvKey = "ISUCON13_JSON_SERIALIZER"
+
+	serverReadTimeoutEnvKey       = "ISUCON13_SERVER_READ_TIMEOUT_SECONDS"
+	serverReadHeaderTimeoutEnvKey = "ISUCON13_SERVER_READ_HEADER_TIMEOUT_SECONDS"
+	serverWriteTimeoutEnvKey      = "ISUCON13_SERVER_WRITE_TIMEOUT_SECONDS"
+	serverIdleTimeoutEnvKey       = "ISUCON13_SERVER_IDLE_TIMEOUT_SECONDS"
+
+	gzipLevelEnvKey     = "ISUCON13_GZIP_LEVEL"
+	gzipMinLengthEnvKey = "ISUCON13_GZIP_MIN_LENGTH"
+
+	mysqlNetworkTypeEnvKey  = "ISUCON13_MYSQL_DIALCONFIG_NET"
+	mysqlAddrEnvKey         = "ISUCON13_MYSQL_DIALCONFIG_ADDRESS"
+	mysqlPortEnvKey         = "ISUCON13_MYSQL_DIALCONFIG_PORT"
+	mysqlUserEnvKey         = "ISUCON13_MYSQL_DIALCONFIG_USER"
+	mysqlPasswordEnvKey     = "ISUCON13_MYSQL_DIALCONFIG_PASSWORD"
+	mysqlDBNameEnvKey       = "ISUCON13_MYSQL_DIALCONFIG_DATABASE"
+	mysqlParseTimeEnvKey    = "ISUCON13_MYSQL_DIALCONFIG_PARSETIME"
+	mysqlMaxOpenConnsEnvKey = "ISUCON13_MYSQL_MAX_OPEN_CONNS"
+	initParallelismEnvKey   = "ISUCON13_INIT_PARALLELISM"
+	// 重いエンドポイントの同時処理数。未設定ならMySQLのコネクション数から決める
+	iconInFlightLimitEnvKey  = "ISUCON13_ICON_INFLIGHT_LIMIT"
+	statsInFlightLimitEnvKey = "ISUCON13_STATS_INFLIGHT_LIMIT"
+
+	goMaxProcsEnvKey = "ISUCON13_GOMAXPROCS"
+	goGCEnvKey       = "ISUCON13_GOGC"
+	goMemLimitEnvKey = "ISUCON13_GOMEMLIMIT"
+
+	sessionSecretKeyEnvKey    = "ISUCON13_SESSION_SECRETKEY"
+	sessionCookieDomainEnvKey = "ISUCON13_SESSION_COOKIE_DOMAIN"
+
+	powerDNSSubdomainAddressEnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"
+	powerDNSAPIEndpointEnvKey      = "ISUCON13_POWERDNS_API_ENDPOINT"
+	powerDNSAPIKeyEnvKey           = "ISUCON13_POWERDNS_API_KEY"
+	// メディアサーバなどから呼ぶ/api/internal/*の認証に使う
+	internalAPITokenEnvKey = "ISUCON13_INTERNAL_API_TOKEN"
+	// 配信の取り込み・再生URLに使うメディアサーバのポート
+	mediaRTMPPortEnvKey = "ISUCON13_MEDIA_RTMP_PORT"
+	mediaHLSPortEnvKey  = "ISUCON13_MEDIA_HLS_PORT"
+
+	reactionEmojiWhitelistPathEnvKey = "ISUCON13_REACTION_EMOJI_WHITELIST_PATH"
+	reactionRateLimitEnvKey          = "ISUCON13_REACTION_RATE_LIMIT"
+	reactionRateBurstEnvKey          = "ISUCON13_REACTION_RATE_BURST"
+	tipTiersPathEnvKey               = "ISUCON13_TIP_TIERS_PATH"
+	viewerHeartbeatTTLEnvKey         = "ISUCON13_VIEWER_HEARTBEAT_TTL_SECONDS"
+	trendingWindowEnvKey             = "ISUCON13_TRENDING_WINDOW_MINUTES"
+	rankingSnapshotTTLEnvKey         = "ISUCON13_RANKING_SNAPSHOT_TTL_MILLISECONDS"
+	reservationSlotsCacheTTLEnvKey   = "ISUCON13_RESERVATION_SLOTS_CACHE_TTL_MILLISECONDS"
+	logLevelEnvKey                   = "ISUCON13_LOG_LEVEL"
+	accessLogSampleRateEnvKey        = "ISUCON13_ACCESS_LOG_SAMPLE_RATE"
+	featureFlagsEnvKey               = "ISUCON13_FEATURE_FLAGS"
+	tipCurrencyNameEnvKey            = "ISUCON13_TIP_CURRENCY_NAME"
+	tipDisplayMultiplierEnvKey       = "ISUCON13_TIP_DISPLAY_MULTIPLIER"
+	tipMaxEnvKey                     = "ISUCON13_TIP_MAX"
+	ngWordMuteThresholdEnvKey        = "ISUCON13_NG_WORD_MUTE_THRESHOLD"
+	ngWordMuteSecondsEnvKey          = "ISUCON13_NG_WORD_MUTE_SECONDS"
+	passwordMinLengthEnvKey          = "ISUCON13_PASSWORD_MIN_LENGTH"
+	passwordMinCharClassesEnvKey     = "ISUCON13_PASSWORD_MIN_CHAR_CLASSES"
+	// SIGHUPで読み直すファイル
+	envFilePathEnvKey = "ISUCON13_ENV_FILE"
+)
+
+var logLevels = map[string]echolog.Lvl{
+	"debug": echolog.DEBUG,
+	"info":  echolog.INFO,
+	"warn":  echolog.WARN,
+	"error": echolog.ERROR,
+	"off":   echolog.OFF,
+}
+
+const (
+	defaultListenPort   = 8080
+	defaultEnvFilePath  = "/home/isucon/env.sh"
+	jsonSerializerStd   = "std"
+	jsonSerializerGoccy = "goccy"
+
+	defaultServerReadTimeout       = 30 * time.Second
+	defaultServerReadHeaderTimeout = 5 * time.Second
+	defaultServerWriteTimeout      = 60 * time.Second
+	defaultServerIdleTimeout       = 120 * time.Second
+
+	defaultGzipLevel           = gzip.BestSpeed
+	defaultGzipMinLength       = 1024
+	defaultMySQLMaxOpenConns   = 10
+	defaultSessionSecretKey    = "isucon13_session_cookiestore_defaultsecret"
+	defaultSessionCookieDomain = "*.u.isucon.local"
+	defaultMediaRTMPPort       = 1935
+	defaultMediaHLSPort        = 8081
+	defaultPowerDNSAPIEndpoint = "http://192.168.0.4:8081/api/v1/servers/localhost"
+	defaultPowerDNSAPIKey      = "isudns"
+)
+
+// 起動時に一度だけ読み込む設定
+type Config struct {
+	ListenPort int
+	// 設定されていればTCPの代わりにこのunixソケットで待ち受ける
+	SocketPath string
+	// nginxからHTTP/2で繋ぐ場合のみ有効にする (ベンチマーカーはHTTP/1.1のみかもしれない)
+	H2CEnabled bool
+	// 空ならフロントエンドは配信しない (nginxが配信する)
+	StaticDir string
+	// キャッシュや視聴者数はプロセスごとのメモリにあり、共有するバックエンドが無いので有効にできない
+	Multiprocess bool
+	// 遅いクエリの計測とEXPLAINのため、DB接続のドライバを包む
+	DebugExplain bool
+
+	// std | goccy
+	JSONSerializer string
+
+	// 0なら無制限。SSEとWebSocketは接続ごとに解除する
+	ServerReadTimeout       time.Duration
+	ServerReadHeaderTimeout time.Duration
+	ServerWriteTimeout      time.Duration
+	ServerIdleTimeout       time.Duration
+
+	GzipLevel int
+	// このバイト数未満のレスポンスは圧縮しない
+	GzipMinLength int
+
+	MySQL             *mysql.Config
+	MySQLMaxOpenConns int
+	// /api/initializeで同時に流すSQLファイルの数
+	InitParallelism int
+	// アイコンの取得と登録、ユーザと配信の統計それぞれの同時処理数の上限
+	// 合計がMySQLMaxOpenConnsを下回るようにし、軽いAPIの分のコネクションを残す
+	IconInFlightLimit  int
+	StatsInFlightLimit int
+
+	// 0ならcgroupのCPUクォータに合わせる
+	GoMaxProcs int
+	// -1ならGCを止める
+	GoGC       int
+	GoMemLimit int64
+
+	SessionSecret       []byte
+	SessionCookieDomain string
+
+	// 必須
+	PowerDNSSubdomainAddress string
+	PowerDNSAPIEndpoint      string
+	PowerDNSAPIKey           string
+
+	// 空なら/api/internal/*と/api/admin/*、機能フラグの切り替えを登録しない
+	InternalAPIToken string
+
+	MediaRTMPPort int
+	MediaHLSPort  int
+
+	ReactionEmojiWhitelistPath string
+	TipTiersPath               string
+	EnvFilePath                string
+
+	// SIGHUPで読み込み直せる設定
+	Tunables
+}
+
+// 再起動せずに変更できる設定。参照はcurrentTunables()から行う
+type Tunables struct {
+	LogLevel                 echolog.Lvl
+	ReactionRateLimit        rate.Limit
+	ReactionRateBurst        int
+	ViewerHeartbeatTTL       time.Duration
+	TrendingWindow           time.Duration
+	RankingSnapshotTTL       time.Duration
+	ReservationSlotsCacheTTL time.Duration
+	// 成功したリクエストのアクセスログをN件に1件残す。0ならアクセスログを出さない
+	AccessLogSampleRate int
+	// 環境変数で指定されたフラグのみ。参照はfeatureEnabled()から行う
+	FeatureFlags map[FeatureFlag]bool
+	// チップの単位と1回の上限 (ベンチマークのルールに合わせて変える)
+	TipCurrency TipCurrency
+	// 同じ配信でNGワードにこの回数ヒットしたらミュートする。0ならミュートしない
+	NGWordMuteThreshold int
+	NGWordMuteDuration  time.Duration
+	// 本番相当の環境では厳しくする
+	PasswordPolicy PasswordPolicy
+}
+
+// 環境変数から設定を読み込む。未設定の項目はデフォルト値になる
+func loadConfig() (*Config, error) {
+	cfg := &Config{
+		ListenPort:                 defaultListenPort,
+		JSONSerializer:             jsonSerializerStd,
+		ServerReadTimeout:          defaultServerReadTimeout,
+		ServerReadHeaderTimeout:    defaultServerReadHeaderTimeout,
+		ServerWriteTimeout:         defaultServerWriteTimeout,
+		ServerIdleTimeout:          defaultServerIdleTimeout,
+		GzipLevel:                  defaultGzipLevel,
+		GzipMinLength:              defaultGzipMinLength,
+		MySQLMaxOpenConns:          defaultMySQLMaxOpenConns,
+		InitParallelism:            defaultInitParallelism,
+		GoMaxProcs:                 autoGoMaxProcs,
+		GoGC:                       currentGCPercent(),
+		GoMemLimit:                 currentMemoryLimit(),
+		SessionSecret:              []byte(defaultSessionSecretKey),
+		SessionCookieDomain:        defaultSessionCookieDomain,
+		PowerDNSAPIEndpoint:        defaultPowerDNSAPIEndpoint,
+		PowerDNSAPIKey:             defaultPowerDNSAPIKey,
+		ReactionEmojiWhitelistPath: defaultReactionEmojiWhitelistPath,
+		TipTiersPath:               defaultTipTiersPath,
+		EnvFilePath:                defaultEnvFilePath,
+		MediaRTMPPort:              defaultMediaRTMPPort,
+		MediaHLSPort:               defaultMediaHLSPort,
+		Tunables: Tunables{
+			LogLevel:                 echolog.ERROR,
+			ReactionRateLimit:        defaultReactionRateLimit,
+			ReactionRateBurst:        defaultReactionRateBurst,
+			ViewerHeartbeatTTL:       defaultViewerHeartbeatTTL,
+			TrendingWindow:           defaultTrendingWindow,
+			RankingSnapshotTTL:       defaultRankingSnapshotTTL,
+			ReservationSlotsCacheTTL: defaultReservationSlotsCacheTTL,
+			TipCurrency:              defaultTipCurrency,
+			NGWordMuteThreshold:      defaultNGWordMuteThreshold,
+			NGWordMuteDuration:       defaultNGWordMuteDuration,
+			PasswordPolicy: PasswordPolicy{
+				MinLength:      defaultPasswordMinLength,
+				MinCharClasses: defaultPasswordMinCharClasses,
+			},
+		},
+	}
+
+	var err error
+	if cfg.ListenPort, err = lookupEnvInt(listenPortEnvKey, cfg.ListenPort); err != nil {
+		return nil, err
+	}
+	if v, ok := os.LookupEnv(socketPathEnvKey); ok {
+		cfg.SocketPath = v
+	}
+	if v, ok := os.LookupEnv(h2cEnabledEnvKey); ok {
+		enabled, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", h2cEnabledEnvKey, err)
+		}
+		cfg.H2CEnabled = enabled
+	}
+	if v, ok := os.LookupEnv(jsonSerializerEnvKey); ok {
+		cfg.JSONSerializer = v
+	}
+	for key, timeout := range map[string]*time.Duration{
+		serverReadTimeoutEnvKey:       &cfg.ServerReadTimeout,
+		serverReadHeaderTimeoutEnvKey: &cfg.ServerReadHeaderTimeout,
+		serverWriteTimeoutEnvKey:      &cfg.ServerWriteTimeout,
+		serverIdleTimeoutEnvKey:       &cfg.ServerIdleTimeout,
+	} {
+		seconds, err := lookupEnvInt(key, int(*timeout/time.Second))
+		if err != nil {
+			return nil, err
+		}
+		if seconds < 0 {
+			return nil, fmt.Errorf("environ %s must not be negative", key)
+		}
+		*timeout = time.Duration(seconds) * time.Second
+	}
+	if v, ok := os.LookupEnv(staticDirEnvKey); ok {
+		cfg.StaticDir = v
+	}
+	if v, ok := os.LookupEnv(multiprocessEnvKey); ok {
+		multiprocess, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", multiprocessEnvKey, err)
+		}
+		cfg.Multiprocess = multiprocess
+	}
+	if v, ok := os.LookupEnv(debugExplainEnvKey); ok {
+		debugExplain, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", debugExplainEnvKey, err)
+		}
+		cfg.DebugExplain = debugExplain
+	}
+	if cfg.GzipLevel, err = lookupEnvInt(gzipLevelEnvKey, cfg.GzipLevel); err != nil {
+		return nil, err
+	}
+	if cfg.GzipMinLength, err = lookupEnvInt(gzipMinLengthEnvKey, cfg.GzipMinLength); err != nil {
+		return nil, err
+	}
+
+	if cfg.MySQL, err = loadMySQLConfig(); err != nil {
+		return nil, err
+	}
+	if cfg.MySQLMaxOpenConns, err = lookupEnvInt(mysqlMaxOpenConnsEnvKey, cfg.MySQLMaxOpenConns); err != nil {
+		return nil, err
+	}
+	if cfg.InitParallelism, err = lookupEnvInt(initParallelismEnvKey, cfg.InitParallelism); err != nil {
+		return nil, err
+	}
+	cfg.IconInFlightLimit, cfg.StatsInFlightLimit = defaultInFlightLimits(cfg.MySQLMaxOpenConns)
+	if cfg.IconInFlightLimit, err = lookupEnvInt(iconInFlightLimitEnvKey, cfg.IconInFlightLimit); err != nil {
+		return nil, err
+	}
+	if cfg.StatsInFlightLimit, err = lookupEnvInt(statsInFlightLimitEnvKey, cfg.StatsInFlightLimit); err != nil {
+		return nil, err
+	}
+
+	if cfg.GoMaxProcs, err = lookupEnvInt(goMaxProcsEnvKey, cfg.GoMaxProcs); err != nil {
+		return nil, err
+	}
+	if v, ok := os.LookupEnv(goGCEnvKey); ok {
+		if cfg.GoGC, err = parseGCPercent(v); err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s': %+v", goGCEnvKey, err)
+		}
+	}
+	if v, ok := os.LookupEnv(goMemLimitEnvKey); ok {
+		if cfg.GoMemLimit, err = parseMemoryLimit(v); err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s': %+v", goMemLimitEnvKey, err)
+		}
+	}
+
+	if v, ok := os.LookupEnv(sessionSecretKeyEnvKey); ok {
+		cfg.SessionSecret = []byte(v)
+	}
+	if v, ok := os.LookupEnv(sessionCookieDomainEnvKey); ok {
+		cfg.SessionCookieDomain = v
+	}
+
+	if v, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey); ok {
+		cfg.PowerDNSSubdomainAddress = v
+	}
+	if v, ok := os.LookupEnv(powerDNSAPIEndpointEnvKey); ok {
+		cfg.PowerDNSAPIEndpoint = v
+	}
+	if v, ok := os.LookupEnv(powerDNSAPIKeyEnvKey); ok {
+		cfg.PowerDNSAPIKey = v
+	}
+
+	if v, ok := os.LookupEnv(reactionEmojiWhitelistPathEnvKey); ok {
+		cfg.ReactionEmojiWhitelistPath = v
+	}
+	if v, ok := os.LookupEnv(reactionRateLimitEnvKey); ok {
+		limit, err := strconv.ParseFloat(v, 64)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as float: %+v", reactionRateLimitEnvKey, err)
+		}
+		cfg.ReactionRateLimit = rate.Limit(limit)
+	}
+	if cfg.ReactionRateBurst, err = lookupEnvInt(reactionRateBurstEnvKey, cfg.ReactionRateBurst); err != nil {
+		return nil, err
+	}
+	if v, ok := os.LookupEnv(tipTiersPathEnvKey); ok {
+		cfg.TipTiersPath = v
+	}
+
+	seconds, err := lookupEnvInt(viewerHeartbeatTTLEnvKey, int(cfg.ViewerHeartbeatTTL/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	cfg.ViewerHeartbeatTTL = time.Duration(seconds) * time.Second
+	minutes, err := lookupEnvInt(trendingWindowEnvKey, int(cfg.TrendingWindow/time.Minute))
+	if err != nil {
+		return nil, err
+	}
+	cfg.TrendingWindow = time.Duration(minutes) * time.Minute
+	milliseconds, err := lookupEnvInt(rankingSnapshotTTLEnvKey, int(cfg.RankingSnapshotTTL/time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	cfg.RankingSnapshotTTL = time.Duration(milliseconds) * time.Millisecond
+	milliseconds, err = lookupEnvInt(reservationSlotsCacheTTLEnvKey, int(cfg.ReservationSlotsCacheTTL/time.Millisecond))
+	if err != nil {
+		return nil, err
+	}
+	cfg.ReservationSlotsCacheTTL = time.Duration(milliseconds) * time.Millisecond
+	if v, ok := os.LookupEnv(envFilePathEnvKey); ok {
+		cfg.EnvFilePath = v
+	}
+	if v, ok := os.LookupEnv(internalAPITokenEnvKey); ok {
+		cfg.InternalAPIToken = v
+	}
+	if cfg.MediaRTMPPort, err = lookupEnvInt(mediaRTMPPortEnvKey, cfg.MediaRTMPPort); err != nil {
+		return nil, err
+	}
+	if cfg.MediaHLSPort, err = lookupEnvInt(mediaHLSPortEnvKey, cfg.MediaHLSPort); err != nil {
+		return nil, err
+	}
+	if v, ok := os.LookupEnv(tipCurrencyNameEnvKey); ok {
+		cfg.TipCurrency.Name = v
+	}
+	if v, ok := os.LookupEnv(tipDisplayMultiplierEnvKey); ok {
+		if cfg.TipCurrency.DisplayMultiplier, err = strconv.ParseFloat(v, 64); err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as float: %+v", tipDisplayMultiplierEnvKey, err)
+		}
+	}
+	maxTip, err := lookupEnvInt(tipMaxEnvKey, int(cfg.TipCurrency.MaxSingleTip))
+	if err != nil {
+		return nil, err
+	}
+	cfg.TipCurrency.MaxSingleTip = int64(maxTip)
+	if cfg.NGWordMuteThreshold, err = lookupEnvInt(ngWordMuteThresholdEnvKey, cfg.NGWordMuteThreshold); err != nil {
+		return nil, err
+	}
+	seconds, err = lookupEnvInt(ngWordMuteSecondsEnvKey, int(cfg.NGWordMuteDuration/time.Second))
+	if err != nil {
+		return nil, err
+	}
+	cfg.NGWordMuteDuration = time.Duration(seconds) * time.Second
+	if cfg.PasswordPolicy.MinLength, err = lookupEnvInt(passwordMinLengthEnvKey, cfg.PasswordPolicy.MinLength); err != nil {
+		return nil, err
+	}
+	if cfg.PasswordPolicy.MinCharClasses, err = lookupEnvInt(passwordMinCharClassesEnvKey, cfg.PasswordPolicy.MinCharClasses); err != nil {
+		return nil, err
+	}
+	if cfg.AccessLogSampleRate, err = lookupEnvInt(accessLogSampleRateEnvKey, cfg.AccessLogSampleRate); err != nil {
+		return nil, err
+	}
+	if v, ok := os.LookupEnv(featureFlagsEnvKey); ok {
+		if cfg.FeatureFlags, err = parseFeatureFlags(v); err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s': %+v", featureFlagsEnvKey, err)
+		}
+	}
+	if v, ok := os.LookupEnv(logLevelEnvKey); ok {
+		lvl, ok := logLevels[v]
+		if !ok {
+			return nil, fmt.Errorf("environ %s must be one of debug, info, warn, error, off", logLevelEnvKey)
+		}
+		cfg.LogLevel = lvl
+	}
+
+	if err := cfg.validate(); err != nil {
+		return nil, err
+	}
+
+	return cfg, nil
+}
+
+// DB接続の設定だけを読む。テストからも使う
+func loadMySQLConfig() (*mysql.Config, error) {
+	// 環境変数がセットされていなかった場合でも一旦動かせるように、デフォルト値を入れておく
+	conf := mysql.NewConfig()
+	conf.Net = "tcp"
+	conf.Addr = net.JoinHostPort("127.0.0.1", "3306")
+	conf.User = "isucon"
+	conf.Passwd = "isucon"
+	conf.DBName = "isupipe"
+	conf.ParseTime = true
+	if v, ok := os.LookupEnv(mysqlNetworkTypeEnvKey); ok {
+		conf.Net = v
+	}
+	if addr, ok := os.LookupEnv(mysqlAddrEnvKey); ok {
+		if port, ok2 := os.LookupEnv(mysqlPortEnvKey); ok2 {
+			conf.Addr = net.JoinHostPort(addr, port)
+		} else {
+			conf.Addr = net.JoinHostPort(addr, "3306")
+		}
+	}
+	if v, ok := os.LookupEnv(mysqlUserEnvKey); ok {
+		conf.User = v
+	}
+	if v, ok := os.LookupEnv(mysqlPasswordEnvKey); ok {
+		conf.Passwd = v
+	}
+	if v, ok := os.LookupEnv(mysqlDBNameEnvKey); ok {
+		conf.DBName = v
+	}
+	if v, ok := os.LookupEnv(mysqlParseTimeEnvKey); ok {
+		parseTime, err := strconv.ParseBool(v)
+		if err != nil {
+			return nil, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", mysqlParseTimeEnvKey, err)
+		}
+		conf.ParseTime = parseTime
+	}
+	return conf, nil
+}
+
+func (cfg *Config) validate() error {
+	var errs []error
+	if cfg.ListenPort <= 0 || cfg.ListenPort > 65535 {
+		errs = append(errs, fmt.Errorf("environ %s must be a valid port number", listenPortEnvKey))
+	}
+	if cfg.StaticDir != "" {
+		if fi, err := os.Stat(cfg.StaticDir); err != nil || !fi.IsDir() {
+			errs = append(errs, fmt.Errorf("environ %s must be an existing directory", staticDirEnvKey))
+		}
+	}
+	if cfg.Multiprocess {
+		errs = append(errs, fmt.Errorf("environ %s is not supported: caches are per process and there is no shared state backend", multiprocessEnvKey))
+	}
+	if cfg.JSONSerializer != jsonSerializerStd && cfg.JSONSerializer != jsonSerializerGoccy {
+		errs = append(errs, fmt.Errorf("environ %s must be %q or %q", jsonSerializerEnvKey, jsonSerializerStd, jsonSerializerGoccy))
+	}
+	if cfg.GzipLevel < gzip.HuffmanOnly || cfg.GzipLevel > gzip.BestCompression {
+		errs = append(errs, fmt.Errorf("environ %s must be between %d and %d", gzipLevelEnvKey, gzip.HuffmanOnly, gzip.BestCompression))
+	}
+	if cfg.GzipMinLength < 0 {
+		errs = append(errs, fmt.Errorf("environ %s must not be negative", gzipMinLengthEnvKey))
+	}
+	if cfg.MySQLMaxOpenConns <= 0 {
+		errs = append(errs, fmt.Errorf("environ %s must be positive", mysqlMaxOpenConnsEnvKey))
+	}
+	if cfg.InitParallelism <= 0 {
+		errs = append(errs, fmt.Errorf("environ %s must be positive", initParallelismEnvKey))
+	}
+	if cfg.IconInFlightLimit <= 0 {
+		errs = append(errs, fmt.Errorf("environ %s must be positive", iconInFlightLimitEnvKey))
+	}
+	if cfg.StatsInFlightLimit <= 0 {
+		errs = append(errs, fmt.Errorf("environ %s must be positive", statsInFlightLimitEnvKey))
+	}
+	if total := inFlightLimitTotal(cfg.IconInFlightLimit, cfg.StatsInFlightLimit); cfg.MySQLMaxOpenConns > 0 && total >= cfg.MySQLMaxOpenConns {
+		errs = append(errs, fmt.Errorf("environ %s and %s must leave connections for other requests: %d in flight for %d connections", iconInFlightLimitEnvKey, statsInFlightLimitEnvKey, total, cfg.MySQLMaxOpenConns))
+	}
+	if cfg.GoMaxProcs < 0 {
+		errs = append(errs, fmt.Errorf("environ %s must not be negative", goMaxProcsEnvKey))
+	}
+	if len(cfg.SessionSecret) == 0 {
+		errs = append(errs, fmt.Errorf("environ %s must not be empty", sessionSecretKeyEnvKey))
+	}
+	if cfg.PowerDNSSubdomainAddress == "" {
+		errs = append(errs, fmt.Errorf("environ %s must be provided", powerDNSSubdomainAddressEnvKey))
+	}
+	if cfg.MediaRTMPPort <= 0 || cfg.MediaRTMPPort > 65535 {
+		errs = append(errs, fmt.Errorf("environ %s must be a valid port number", mediaRTMPPortEnvKey))
+	}
+	if cfg.MediaHLSPort <= 0 || cfg.MediaHLSPort > 65535 {
+		errs = append(errs, fmt.Errorf("environ %s must be a valid port number", mediaHLSPortEnvKey))
+	}
+	if cfg.PowerDNSAPIEndpoint == "" {
+		errs = append(errs, fmt.Errorf("environ %s must not be empty", powerDNSAPIEndpointEnvKey))
+	}
+	if cfg.ReactionRateLimit <= 0 {
+		errs = append(errs, fmt.Errorf("environ %s must be positive", reactionRateLimitEnvKey))
+	}
+	if cfg.ReactionRateBurst <= 0 {
+		errs = append(errs, fmt.Errorf("environ %s must be positive", reactionRateBurstEnvKey))
+	}
+	if cfg.ViewerHeartbeatTTL <= 0 {
+		errs = append(errs, fmt.Errorf("environ %s must be positive", viewerHeartbeatTTLEnvKey))
+	}
+	if cfg.TrendingWindow <= 0 {
+		errs = append(errs, fmt.Errorf("environ %s must be positive", trendingWindowEnvKey))
+	}
+	if cfg.TipCurrency.Name == "" {
+		errs = append(errs, fmt.Errorf("environ %s must not be empty", tipCurrencyNameEnvKey))
+	}
+	if cfg.TipCurrency.DisplayMultiplier <= 0 {
+		errs = append(errs, fmt.Errorf("environ %s must be positive", tipDisplayMultiplierEnvKey))
+	}
+	if cfg.TipCurrency.MaxSingleTip < 0 {
+		errs = append(errs, fmt.Errorf("environ %s must not be negative", tipMaxEnvKey))
+	}
+	if cfg.NGWordMuteThreshold < 0 {
+		errs = append(errs, fmt.Errorf("environ %s must not be negative", ngWordMuteThresholdEnvKey))
+	}
+	if cfg.NGWordMuteThreshold > 0 && cfg.NGWordMuteDuration <= 0 {
+		errs = append(errs, fmt.Errorf("environ %s must be positive", ngWordMuteSecondsEnvKey))
+	}
+	// bcryptは72バイトまでしか扱えない
+	if cfg.PasswordPolicy.MinLength < 1 || cfg.PasswordPolicy.MinLength > 72 {
+		errs = append(errs, fmt.Errorf("environ %s must be between 1 and 72", passwordMinLengthEnvKey))
+	}
+	if cfg.PasswordPolicy.MinCharClasses < 0 || cfg.PasswordPolicy.MinCharClasses > passwordCharClasses {
+		errs = append(errs, fmt.Errorf("environ %s must be between 0 and %d", passwordMinCharClassesEnvKey, passwordCharClasses))
+	}
+	if cfg.AccessLogSampleRate < 0 {
+		errs = append(errs, fmt.Errorf("environ %s must not be negative", accessLogSampleRateEnvKey))
+	}
+	if cfg.RankingSnapshotTTL < 0 {
+		errs = append(errs, fmt.Errorf("environ %s must not be negative", rankingSnapshotTTLEnvKey))
+	}
+	if cfg.ReservationSlotsCacheTTL < 0 {
+		errs = append(errs, fmt.Errorf("environ %s must not be negative", reservationSlotsCacheTTLEnvKey))
+	}
+	return errors.Join(errs...)
+}
+
+func lookupEnvInt(key string, defaultValue int) (int, error) {
+	v, ok := os.LookupEnv(key)
+	if !ok {
+		return defaultValue, nil
+	}
+	n, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, fmt.Errorf("failed to parse environment variable '%s' as int: %+v", key, err)
+	}
+	return n, nil
+}
@@ -0,0 +1,217 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"net/http"
+	"regexp"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+var (
+	// コメント中の :emote: 記法
+	emoteTokenPattern = regexp.MustCompile(`:([A-Za-z0-9_]{1,32}):`)
+	emoteNamePattern  = regexp.MustCompile(`^[A-Za-z0-9_]{1,32}$`)
+
+	EmotesByUserIDCache      = make(map[UserID]map[string]EmoteModel)
+	EmotesByUserIDCacheMutex = sync.RWMutex{}
+)
+
+func init() {
+	registerCacheReset(func() {
+		EmotesByUserIDCacheMutex.Lock()
+		EmotesByUserIDCache = make(map[UserID]map[string]EmoteModel)
+		EmotesByUserIDCacheMutex.Unlock()
+	})
+}
+
+type EmoteModel struct {
+	ID     int64  `db:"id"`
+	UserID UserID `db:"user_id"`
+	Name   string `db:"name"`
+}
+
+type Emote struct {
+	ID       int64  `json:"id"`
+	Name     string `json:"name"`
+	ImageURL string `json:"image_url"`
+}
+
+type PostEmoteRequest struct {
+	Name  string `json:"name"`
+	Image []byte `json:"image"`
+}
+
+// 配信者のエモート登録API (同名のエモートは画像を差し替える)
+// POST /api/emote
+func postEmoteHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+	username := sess.Values[defaultUsernameKey].(string)
+
+	var req *PostEmoteRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidJSON, "failed to decode the request body as json")
+	}
+	if !emoteNamePattern.MatchString(req.Name) {
+		return echo.NewHTTPError(http.StatusBadRequest, "emote name must be 1-32 characters of alphanumerics or underscore")
+	}
+	if len(req.Image) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "emote image must not be empty")
+	}
+
+	if _, err := dbConn.ExecContext(ctx, "INSERT INTO emotes (user_id, name, image) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE image = VALUES(image)", userID, req.Name, req.Image); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert emote: "+err.Error())
+	}
+
+	var emoteModel EmoteModel
+	if err := dbConn.GetContext(ctx, &emoteModel, "SELECT id, user_id, name FROM emotes WHERE user_id = ? AND name = ?", userID, req.Name); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get emote: "+err.Error())
+	}
+
+	EmotesByUserIDCacheMutex.Lock()
+	delete(EmotesByUserIDCache, userID)
+	EmotesByUserIDCacheMutex.Unlock()
+	// 過去のコメントでも新しいエモートが解決されるようにする
+	deleteLivecommentByIDCacheByOwnerID(userID)
+
+	return c.JSON(http.StatusCreated, fillEmoteResponse(username, emoteModel))
+}
+
+// 配信者のエモート一覧API
+// GET /api/user/:username/emote
+func getEmotesHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	username := c.Param("username")
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	userModel, err := userRepository.GetByName(ctx, tx, username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeUserNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	emoteModels, err := getEmotesByUserID(ctx, tx, userModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get emotes: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	emotes := make([]Emote, 0, len(emoteModels))
+	for _, emoteModel := range emoteModels {
+		emotes = append(emotes, fillEmoteResponse(username, emoteModel))
+	}
+
+	return c.JSON(http.StatusOK, emotes)
+}
+
+// エモート画像取得API
+// GET /api/user/:username/emote/:emote_name
+func getEmoteImageHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	username := c.Param("username")
+	emoteName := c.Param("emote_name")
+
+	var image []byte
+	if err := dbConn.GetContext(ctx, &image, "SELECT e.image FROM emotes e INNER JOIN users u ON u.id = e.user_id WHERE u.name = ? AND e.name = ?", username, emoteName); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "emote not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get emote image: "+err.Error())
+	}
+
+	return c.Blob(http.StatusOK, "image/png", image)
+}
+
+func fillEmoteResponse(username string, emoteModel EmoteModel) Emote {
+	return Emote{
+		ID:       emoteModel.ID,
+		Name:     emoteModel.Name,
+		ImageURL: fmt.Sprintf("/api/user/%s/emote/%s", username, emoteModel.Name),
+	}
+}
+
+func getEmotesByUserID(ctx context.Context, tx *sqlx.Tx, userID UserID) (map[string]EmoteModel, error) {
+	EmotesByUserIDCacheMutex.RLock()
+	emotes, ok := EmotesByUserIDCache[userID]
+	EmotesByUserIDCacheMutex.RUnlock()
+	if ok {
+		return emotes, nil
+	}
+
+	var emoteModels []EmoteModel
+	if err := tx.SelectContext(ctx, &emoteModels, "SELECT id, user_id, name FROM emotes WHERE user_id = ?", userID); err != nil {
+		return nil, err
+	}
+	emotes = make(map[string]EmoteModel, len(emoteModels))
+	for _, emoteModel := range emoteModels {
+		emotes[emoteModel.Name] = emoteModel
+	}
+
+	EmotesByUserIDCacheMutex.Lock()
+	EmotesByUserIDCache[userID] = emotes
+	EmotesByUserIDCacheMutex.Unlock()
+
+	return emotes, nil
+}
+
+// コメント中の :emote: を配信者のエモートとして解決する
+func resolveEmotes(ctx context.Context, tx *sqlx.Tx, comment string, streamer User) ([]Emote, error) {
+	matches := emoteTokenPattern.FindAllStringSubmatch(comment, -1)
+	if len(matches) == 0 {
+		return nil, nil
+	}
+
+	emoteModels, err := getEmotesByUserID(ctx, tx, streamer.ID)
+	if err != nil {
+		return nil, err
+	}
+
+	var emotes []Emote
+	seen := make(map[string]struct{}, len(matches))
+	for _, match := range matches {
+		name := match[1]
+		if _, ok := seen[name]; ok {
+			continue
+		}
+		seen[name] = struct{}{}
+		if emoteModel, ok := emoteModels[name]; ok {
+			emotes = append(emotes, fillEmoteResponse(streamer.Name, emoteModel))
+		}
+	}
+
+	return emotes, nil
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// エラーレスポンスのcode。クライアントやベンチマークの調査スクリプトがメッセージの文字列を見ずに分岐できるよう、一度決めた値は変えない
+type ErrorCode string
+
+const (
+	// 個別のコードを付けていないエラーはステータスコードから決める
+	errorCodeBadRequest       ErrorCode = "bad_request"
+	errorCodeUnauthorized     ErrorCode = "unauthorized"
+	errorCodeForbidden        ErrorCode = "forbidden"
+	errorCodeNotFound         ErrorCode = "not_found"
+	errorCodeMethodNotAllowed ErrorCode = "method_not_allowed"
+	errorCodeConflict         ErrorCode = "conflict"
+	errorCodeTooManyRequests  ErrorCode = "too_many_requests"
+	errorCodeUnavailable      ErrorCode = "service_unavailable"
+	errorCodeInternal         ErrorCode = "internal_error"
+
+	errorCodeInvalidJSON         ErrorCode = "invalid_json"
+	errorCodeInvalidParameter    ErrorCode = "invalid_parameter"
+	errorCodeValidationFailed    ErrorCode = "validation_failed"
+	errorCodeInvalidCredentials  ErrorCode = "invalid_credentials"
+	errorCodeSessionExpired      ErrorCode = "session_expired"
+	errorCodeUserNotFound        ErrorCode = "user_not_found"
+	errorCodeLivestreamNotFound  ErrorCode = "livestream_not_found"
+	errorCodeLivecommentNotFound ErrorCode = "livecomment_not_found"
+	errorCodeUsernameReserved    ErrorCode = "username_reserved"
+	errorCodeUsernameTaken       ErrorCode = "username_taken"
+	errorCodeSlotUnavailable     ErrorCode = "slot_unavailable"
+	errorCodeNGWordMatched       ErrorCode = "ng_word_matched"
+	errorCodeTipOutOfRange       ErrorCode = "tip_out_of_range"
+	errorCodeEmojiNotAllowed     ErrorCode = "emoji_not_allowed"
+	errorCodeReactionRateLimited ErrorCode = "reaction_rate_limited"
+	errorCodeNotLivestreamOwner  ErrorCode = "not_livestream_owner"
+	errorCodeFeatureDisabled     ErrorCode = "feature_disabled"
+	// 同じIdempotency-Keyで内容の違うリクエストが来た
+	errorCodeIdempotencyKeyReused ErrorCode = "idempotency_key_reused"
+	// 同じIdempotency-Keyのリクエストをまだ処理している
+	errorCodeIdempotencyKeyInProgress ErrorCode = "idempotency_key_in_progress"
+	errorCodeInvalidStreamKey         ErrorCode = "invalid_stream_key"
+	// スローモード中に間隔を空けずにコメントした
+	errorCodeSlowMode ErrorCode = "slow_mode"
+	// エモートだけのコメントしか許されていない配信にそれ以外をコメントした
+	errorCodeEmoteOnly ErrorCode = "emote_only"
+	// 配信者をフォローしていないユーザがフォロワー限定の配信にコメントした
+	errorCodeFollowersOnly ErrorCode = "followers_only"
+	// NGワードに繰り返しヒットしてミュートされている
+	errorCodeMuted ErrorCode = "muted"
+	// 同じ配信を既に報告している
+	errorCodeAlreadyReported ErrorCode = "already_reported"
+	// 自分の配信を報告しようとした
+	errorCodeOwnLivestream ErrorCode = "own_livestream"
+	// 同時に処理できるリクエスト数の上限を超えた (Retry-Afterの後に再試行できる)
+	errorCodeServerBusy ErrorCode = "server_busy"
+)
+
+// echo.HTTPErrorにcodeを付けたもの。Error()やerrors.Asでの扱いはecho.HTTPErrorと同じ
+type codedHTTPError struct {
+	*echo.HTTPError
+	code ErrorCode
+	// validation_failedの場合に違反したフィールド
+	fields []FieldError
+	// 再試行できるまでの時間 (0なら返さない)
+	retryAfter time.Duration
+}
+
+func (e *codedHTTPError) Unwrap() error {
+	return e.HTTPError
+}
+
+func newCodedHTTPError(status int, code ErrorCode, message string) error {
+	return &codedHTTPError{HTTPError: echo.NewHTTPError(status, message), code: code}
+}
+
+// 待てば成功するエラー。Retry-Afterヘッダとretry_afterで待つ秒数を返す
+func newRetryAfterHTTPError(status int, code ErrorCode, message string, retryAfter time.Duration) error {
+	return &codedHTTPError{HTTPError: echo.NewHTTPError(status, message), code: code, retryAfter: retryAfter}
+}
+
+func errorCodeOf(err error) ErrorCode {
+	var coded *codedHTTPError
+	if errors.As(err, &coded) {
+		return coded.code
+	}
+
+	status := http.StatusInternalServerError
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		status = he.Code
+	}
+	switch status {
+	case http.StatusBadRequest:
+		return errorCodeBadRequest
+	case http.StatusUnauthorized:
+		return errorCodeUnauthorized
+	case http.StatusForbidden:
+		return errorCodeForbidden
+	case http.StatusNotFound:
+		return errorCodeNotFound
+	case http.StatusMethodNotAllowed:
+		return errorCodeMethodNotAllowed
+	case http.StatusConflict:
+		return errorCodeConflict
+	case http.StatusTooManyRequests:
+		return errorCodeTooManyRequests
+	case http.StatusServiceUnavailable:
+		return errorCodeUnavailable
+	}
+	return errorCodeInternal
+}
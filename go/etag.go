@@ -0,0 +1,88 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// プロフィール・配信詳細のETag。内容のハッシュではなく、更新のたびに上げるバージョンから作る
+// バージョンはプロセスのメモリにしか無いので、再起動・initializeをまたいで同じ値にならないよう世代を含める
+// gzipで中身が変わってもよいよう弱いETagにする
+var (
+	etagGeneration atomic.Int64
+
+	userVersions        = map[UserID]uint64{}
+	livestreamVersions  = map[LivestreamID]uint64{}
+	entityVersionsMutex = sync.RWMutex{}
+)
+
+func init() {
+	etagGeneration.Store(time.Now().UnixNano())
+	registerCacheReset(func() {
+		entityVersionsMutex.Lock()
+		defer entityVersionsMutex.Unlock()
+		userVersions = map[UserID]uint64{}
+		livestreamVersions = map[LivestreamID]uint64{}
+		etagGeneration.Store(time.Now().UnixNano())
+	})
+}
+
+// キャッシュを消すときと、トランザクション内で消した場合はコミット後にも呼ぶ
+// (コミット前のデータを読んだリクエストに新しいバージョンを付けさせない)
+func bumpUserVersion(userID UserID) {
+	entityVersionsMutex.Lock()
+	defer entityVersionsMutex.Unlock()
+	userVersions[userID]++
+}
+
+func bumpLivestreamVersion(livestreamID LivestreamID) {
+	entityVersionsMutex.Lock()
+	defer entityVersionsMutex.Unlock()
+	livestreamVersions[livestreamID]++
+}
+
+// レスポンスの元になるデータを読む前に呼ぶこと
+func userETag(userID UserID) string {
+	entityVersionsMutex.RLock()
+	defer entityVersionsMutex.RUnlock()
+	return fmt.Sprintf(`W/"%x-u%d.%d"`, etagGeneration.Load(), userID, userVersions[userID])
+}
+
+// 配信には配信者のユーザ情報も埋め込まれるので、両方のバージョンを含める
+func livestreamETag(livestreamID LivestreamID, livestreamVersion uint64, ownerID UserID) string {
+	entityVersionsMutex.RLock()
+	defer entityVersionsMutex.RUnlock()
+	return fmt.Sprintf(`W/"%x-l%d.%d-u%d.%d"`, etagGeneration.Load(), livestreamID, livestreamVersion, ownerID, userVersions[ownerID])
+}
+
+func currentLivestreamVersion(livestreamID LivestreamID) uint64 {
+	entityVersionsMutex.RLock()
+	defer entityVersionsMutex.RUnlock()
+	return livestreamVersions[livestreamID]
+}
+
+// ETagヘッダを付け、If-None-Matchのいずれかが一致するかを返す (弱い比較)
+// trueなら呼び出し側で304を返す
+func notModified(c echo.Context, etag string) bool {
+	c.Response().Header().Set("ETag", etag)
+
+	ifNoneMatch := c.Request().Header.Get("If-None-Match")
+	if ifNoneMatch == "" {
+		return false
+	}
+	if strings.TrimSpace(ifNoneMatch) == "*" {
+		return true
+	}
+	want := strings.TrimPrefix(etag, "W/")
+	for _, candidate := range strings.Split(ifNoneMatch, ",") {
+		if strings.TrimPrefix(strings.TrimSpace(candidate), "W/") == want {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,192 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	livestreamEventLivecomment        = "livecomment"
+	livestreamEventLivecommentDeleted = "livecomment_deleted"
+	livestreamEventReaction           = "reaction"
+	livestreamEventReactionDeleted    = "reaction_deleted"
+	livestreamEventViewersCount       = "viewers_count"
+
+	// 購読者ごとの送信バッファ。溢れた購読者は遅いクライアントとして切断する
+	livestreamEventBufferSize = 64
+)
+
+type LivestreamEvent struct {
+	Type string
+	Data interface{}
+}
+
+type LivecommentDeletedEvent struct {
+	LivecommentIDs []LivecommentID `json:"livecomment_ids"`
+}
+
+type ViewersCountEvent struct {
+	ViewersCount int64 `json:"viewers_count"`
+	// ハートビートで生存確認できている同時視聴者数
+	ConcurrentViewersCount int64 `json:"concurrent_viewers_count"`
+}
+
+// ライブ配信ごとのイベントをプロセス内で配信するハブ
+type LivestreamEventHub struct {
+	mu          sync.RWMutex
+	subscribers map[LivestreamID]map[chan LivestreamEvent]struct{}
+	// 購読者の有無に関わらず全イベントを受け取る集計処理
+	observers []func(livestreamID LivestreamID, event LivestreamEvent)
+}
+
+func NewLivestreamEventHub() *LivestreamEventHub {
+	return &LivestreamEventHub{
+		subscribers: make(map[LivestreamID]map[chan LivestreamEvent]struct{}),
+	}
+}
+
+var livestreamEventHub = NewLivestreamEventHub()
+
+func (h *LivestreamEventHub) Subscribe(livestreamID LivestreamID) (<-chan LivestreamEvent, func()) {
+	ch := make(chan LivestreamEvent, livestreamEventBufferSize)
+
+	h.mu.Lock()
+	if _, ok := h.subscribers[livestreamID]; !ok {
+		h.subscribers[livestreamID] = make(map[chan LivestreamEvent]struct{})
+	}
+	h.subscribers[livestreamID][ch] = struct{}{}
+	h.mu.Unlock()
+
+	unsubscribe := func() {
+		h.evict(livestreamID, ch)
+	}
+
+	return ch, unsubscribe
+}
+
+// 集計用に全配信のイベントを同期的に受け取る。Publishを遅くしないよう軽い処理にすること
+func (h *LivestreamEventHub) Observe(observer func(livestreamID LivestreamID, event LivestreamEvent)) {
+	h.mu.Lock()
+	h.observers = append(h.observers, observer)
+	h.mu.Unlock()
+}
+
+func (h *LivestreamEventHub) HasSubscribers(livestreamID LivestreamID) bool {
+	h.mu.RLock()
+	defer h.mu.RUnlock()
+	return len(h.subscribers[livestreamID]) > 0
+}
+
+func (h *LivestreamEventHub) Publish(livestreamID LivestreamID, event LivestreamEvent) {
+	var slow []chan LivestreamEvent
+
+	h.mu.RLock()
+	for _, observer := range h.observers {
+		observer(livestreamID, event)
+	}
+	for ch := range h.subscribers[livestreamID] {
+		select {
+		case ch <- event:
+		default:
+			slow = append(slow, ch)
+		}
+	}
+	h.mu.RUnlock()
+
+	for _, ch := range slow {
+		h.evict(livestreamID, ch)
+	}
+}
+
+// 購読を解除してチャネルを閉じる。購読側はチャネルのcloseで切断を検知する
+func (h *LivestreamEventHub) evict(livestreamID LivestreamID, ch chan LivestreamEvent) {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+
+	subs, ok := h.subscribers[livestreamID]
+	if !ok {
+		return
+	}
+	if _, ok := subs[ch]; !ok {
+		return
+	}
+	delete(subs, ch)
+	close(ch)
+	if len(subs) == 0 {
+		delete(h.subscribers, livestreamID)
+	}
+}
+
+// 指定した種類のイベントだけをSSEで流し続ける
+func serveLivestreamEventStream(c echo.Context, livestreamID LivestreamID, eventTypes ...string) error {
+	ctx := c.Request().Context()
+
+	// 無効の間はクライアントにポーリングへ戻ってもらう
+	if !featureEnabled(featureSSE) {
+		return newCodedHTTPError(http.StatusServiceUnavailable, errorCodeFeatureDisabled, "event stream is disabled")
+	}
+
+	wanted := make(map[string]struct{}, len(eventTypes))
+	for _, eventType := range eventTypes {
+		wanted[eventType] = struct{}{}
+	}
+
+	var exists bool
+	if err := dbConn.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM livestreams WHERE id = ?)", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if !exists {
+		return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "livestream not found")
+	}
+
+	events, unsubscribe := livestreamEventHub.Subscribe(livestreamID)
+	defer unsubscribe()
+
+	clearConnDeadlines(c)
+
+	res := c.Response()
+	res.Header().Set(echo.HeaderContentType, "text/event-stream")
+	res.Header().Set("Cache-Control", "no-cache")
+	res.Header().Set("Connection", "keep-alive")
+	// nginxでバッファリングされないようにする
+	res.Header().Set("X-Accel-Buffering", "no")
+	res.WriteHeader(http.StatusOK)
+	res.Flush()
+
+	keepalive := time.NewTicker(15 * time.Second)
+	defer keepalive.Stop()
+
+	for {
+		select {
+		case <-ctx.Done():
+			return nil
+		case <-keepalive.C:
+			if _, err := fmt.Fprint(res, ": keepalive\n\n"); err != nil {
+				return nil
+			}
+			res.Flush()
+		case event, ok := <-events:
+			if !ok {
+				// 送信が追いつかず購読を打ち切られた
+				return nil
+			}
+			if _, ok := wanted[event.Type]; !ok {
+				continue
+			}
+			data, err := json.Marshal(event.Data)
+			if err != nil {
+				c.Logger().Errorf("failed to marshal livestream event: %+v", err)
+				continue
+			}
+			if _, err := fmt.Fprintf(res, "event: %s\ndata: %s\n\n", event.Type, data); err != nil {
+				return nil
+			}
+			res.Flush()
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 壊れると困る最適化をベンチマークの合間に再デプロイせず切り替えるためのフラグ
+// 値は /api/debug/flags で上書きしたもの > 環境変数 (SIGHUPで読み直す) > デフォルト値 の順に決まる
+type FeatureFlag string
+
+const (
+	// ユーザ登録時のDNSレコード登録をコミット後にバックグラウンドで行う
+	featureAsyncDNS FeatureFlag = "async_dns"
+	// チップ合計をメモリに溜めてまとめて書き込む
+	featureWriteBehindStats FeatureFlag = "write_behind_stats"
+	// ライブコメント・リアクションのSSEストリーム
+	featureSSE FeatureFlag = "sse"
+	// ライブコメント・リアクション・視聴者数をまとめて流すWebSocket
+	featureWebSocket FeatureFlag = "websocket"
+)
+
+var defaultFeatureFlags = map[FeatureFlag]bool{
+	featureAsyncDNS:         false,
+	featureWriteBehindStats: false,
+	featureSSE:              true,
+	featureWebSocket:        true,
+}
+
+// /api/debug/flags で上書きした値。initializeでは消さない (ベンチマークをまたいで同じ設定で比べたい)
+var (
+	featureFlagOverrides      = map[FeatureFlag]bool{}
+	featureFlagOverridesMutex = sync.RWMutex{}
+)
+
+func featureEnabled(flag FeatureFlag) bool {
+	featureFlagOverridesMutex.RLock()
+	enabled, ok := featureFlagOverrides[flag]
+	featureFlagOverridesMutex.RUnlock()
+	if ok {
+		return enabled
+	}
+	if enabled, ok := currentTunables().FeatureFlags[flag]; ok {
+		return enabled
+	}
+	return defaultFeatureFlags[flag]
+}
+
+// "async_dns=1,sse=false" の形式。値を省略した場合は有効にする
+func parseFeatureFlags(s string) (map[FeatureFlag]bool, error) {
+	flags := make(map[FeatureFlag]bool)
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		name, value, hasValue := strings.Cut(item, "=")
+		flag := FeatureFlag(strings.TrimSpace(name))
+		if _, ok := defaultFeatureFlags[flag]; !ok {
+			return nil, fmt.Errorf("unknown feature flag %q", flag)
+		}
+		enabled := true
+		if hasValue {
+			var err error
+			if enabled, err = strconv.ParseBool(strings.TrimSpace(value)); err != nil {
+				return nil, fmt.Errorf("invalid value for feature flag %q: %w", flag, err)
+			}
+		}
+		flags[flag] = enabled
+	}
+	return flags, nil
+}
+
+type FeatureFlagState struct {
+	Name    FeatureFlag `json:"name"`
+	Enabled bool        `json:"enabled"`
+	// override | env | default
+	Source string `json:"source"`
+}
+
+type PutFeatureFlagRequest struct {
+	Enabled bool `json:"enabled"`
+}
+
+func featureFlagState(flag FeatureFlag) FeatureFlagState {
+	featureFlagOverridesMutex.RLock()
+	enabled, ok := featureFlagOverrides[flag]
+	featureFlagOverridesMutex.RUnlock()
+	if ok {
+		return FeatureFlagState{Name: flag, Enabled: enabled, Source: "override"}
+	}
+	if enabled, ok := currentTunables().FeatureFlags[flag]; ok {
+		return FeatureFlagState{Name: flag, Enabled: enabled, Source: "env"}
+	}
+	return FeatureFlagState{Name: flag, Enabled: defaultFeatureFlags[flag], Source: "default"}
+}
+
+func featureFlagParam(c echo.Context) (FeatureFlag, error) {
+	flag := FeatureFlag(c.Param("name"))
+	if _, ok := defaultFeatureFlags[flag]; !ok {
+		return "", echo.NewHTTPError(http.StatusNotFound, "unknown feature flag")
+	}
+	return flag, nil
+}
+
+// GET /api/debug/flags
+func getFeatureFlagsHandler(c echo.Context) error {
+	states := make([]FeatureFlagState, 0, len(defaultFeatureFlags))
+	for flag := range defaultFeatureFlags {
+		states = append(states, featureFlagState(flag))
+	}
+	sort.Slice(states, func(i, j int) bool {
+		return states[i].Name < states[j].Name
+	})
+	return c.JSON(http.StatusOK, states)
+}
+
+// 運営向け (internalAPIMiddleware)
+// PUT /api/debug/flags/:name
+func putFeatureFlagHandler(c echo.Context) error {
+	defer c.Request().Body.Close()
+
+	flag, err := featureFlagParam(c)
+	if err != nil {
+		return err
+	}
+
+	var req *PutFeatureFlagRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidJSON, "failed to decode the request body as json")
+	}
+
+	featureFlagOverridesMutex.Lock()
+	featureFlagOverrides[flag] = req.Enabled
+	featureFlagOverridesMutex.Unlock()
+
+	c.Logger().Infof("feature flag %s is overridden to %t", flag, req.Enabled)
+	return c.JSON(http.StatusOK, featureFlagState(flag))
+}
+
+// 上書きをやめて環境変数・デフォルト値に戻す
+// 運営向け (internalAPIMiddleware)
+// DELETE /api/debug/flags/:name
+func deleteFeatureFlagHandler(c echo.Context) error {
+	flag, err := featureFlagParam(c)
+	if err != nil {
+		return err
+	}
+
+	featureFlagOverridesMutex.Lock()
+	delete(featureFlagOverrides, flag)
+	featureFlagOverridesMutex.Unlock()
+
+	return c.JSON(http.StatusOK, featureFlagState(flag))
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	feedReasonFollowing = "following"
+	feedReasonTrending  = "trending"
+
+	defaultFeedLimit = 20
+)
+
+type FeedItem struct {
+	Livestream Livestream `json:"livestream"`
+	// following | trending
+	Reason string `json:"reason"`
+}
+
+type FeedResponse struct {
+	Items []FeedItem `json:"items"`
+	// 続きが無い場合は空
+	NextCursor string `json:"next_cursor"`
+}
+
+// フィードは (rank昇順, key降順, id降順) に並べ、最後に返した要素の "rank_key_id" をカーソルにする
+// 勢いの値が変わっても、位置ではなく値で続きを決めるので同じ配信が重複しにくい
+type feedEntry struct {
+	livestreamID LivestreamID
+	reason       string
+	rank         int64
+	key          int64
+}
+
+const (
+	feedRankFollowingLive int64 = iota
+	feedRankFollowingUpcoming
+	feedRankTrending
+)
+
+func (e feedEntry) cursor() string {
+	return fmt.Sprintf("%d_%d_%d", e.rank, e.key, e.livestreamID)
+}
+
+// カーソルの要素より後ろに並ぶか
+func (e feedEntry) after(rank, key, id int64) bool {
+	if e.rank != rank {
+		return e.rank > rank
+	}
+	if e.key != key {
+		return e.key < key
+	}
+	return int64(e.livestreamID) < id
+}
+
+func parseFeedCursor(cursor string) (int64, int64, int64, error) {
+	parts := strings.Split(cursor, "_")
+	if len(parts) != 3 {
+		return 0, 0, 0, errors.New("cursor must be rank_key_id")
+	}
+	var values [3]int64
+	for i, part := range parts {
+		v, err := strconv.ParseInt(part, 10, 64)
+		if err != nil {
+			return 0, 0, 0, err
+		}
+		values[i] = v
+	}
+	return values[0], values[1], values[2], nil
+}
+
+// フォロー中の配信者の配信中・配信予定の枠と、勢いのある配信を並べたフィード
+// GET /api/feed?cursor=&limit=
+func getFeedHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	limit := defaultFeedLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l <= 0 {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "limit query parameter must be positive integer")
+		}
+		limit = l
+	}
+	var (
+		hasCursor                       bool
+		cursorRank, cursorKey, cursorID int64
+	)
+	if c.QueryParam("cursor") != "" {
+		var err error
+		cursorRank, cursorKey, cursorID, err = parseFeedCursor(c.QueryParam("cursor"))
+		if err != nil {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid cursor")
+		}
+		hasCursor = true
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	streamerIDs, err := getFollowingStreamerIDs(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get following users: "+err.Error())
+	}
+
+	livestreamModelMap := make(map[LivestreamID]*LivestreamModel)
+	var entries []feedEntry
+	if len(streamerIDs) > 0 {
+		query, args, err := sqlx.In("SELECT * FROM livestreams WHERE user_id IN (?) AND status IN (?)", streamerIDs, []string{livestreamStatusLive, livestreamStatusUpcoming})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+		}
+		var followingModels []*LivestreamModel
+		if err := tx.SelectContext(ctx, &followingModels, tx.Rebind(query), args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		// 配信中 (開始が新しい順) → 配信予定 (開始が近い順)
+		sort.Slice(followingModels, func(i, j int) bool {
+			a, b := followingModels[i], followingModels[j]
+			if a.Status != b.Status {
+				return a.Status == livestreamStatusLive
+			}
+			if a.StartAt != b.StartAt {
+				if a.Status == livestreamStatusLive {
+					return a.StartAt > b.StartAt
+				}
+				return a.StartAt < b.StartAt
+			}
+			return a.ID > b.ID
+		})
+		for _, livestreamModel := range followingModels {
+			livestreamModelMap[livestreamModel.ID] = livestreamModel
+			// 配信予定は開始が近い順なので符号を反転して降順に揃える
+			entry := feedEntry{livestreamID: livestreamModel.ID, reason: feedReasonFollowing, rank: feedRankFollowingLive, key: livestreamModel.StartAt}
+			if livestreamModel.Status == livestreamStatusUpcoming {
+				entry.rank, entry.key = feedRankFollowingUpcoming, -livestreamModel.StartAt
+			}
+			entries = append(entries, entry)
+		}
+	}
+
+	// フォロー中の配信と重複しない勢いのある配信を後ろに足す。終了・キャンセル済みの配信は出さない
+	counts := getRecentActivityCounts(time.Now())
+	trendingIDs := make([]LivestreamID, 0, len(counts))
+	for livestreamID := range counts {
+		if _, ok := livestreamModelMap[livestreamID]; !ok {
+			trendingIDs = append(trendingIDs, livestreamID)
+		}
+	}
+	if len(trendingIDs) > 0 {
+		query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?) AND status IN (?)", trendingIDs, []string{livestreamStatusLive, livestreamStatusUpcoming})
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+		}
+		var trendingModels []*LivestreamModel
+		if err := tx.SelectContext(ctx, &trendingModels, tx.Rebind(query), args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		sort.Slice(trendingModels, func(i, j int) bool {
+			a, b := trendingModels[i], trendingModels[j]
+			if counts[a.ID] != counts[b.ID] {
+				return counts[a.ID] > counts[b.ID]
+			}
+			return a.ID > b.ID
+		})
+		for _, livestreamModel := range trendingModels {
+			livestreamModelMap[livestreamModel.ID] = livestreamModel
+			entries = append(entries, feedEntry{livestreamID: livestreamModel.ID, reason: feedReasonTrending, rank: feedRankTrending, key: counts[livestreamModel.ID]})
+		}
+	}
+
+	start := 0
+	if hasCursor {
+		for start < len(entries) && !entries[start].after(cursorRank, cursorKey, cursorID) {
+			start++
+		}
+	}
+	end := min(start+limit, len(entries))
+	page := entries[start:end]
+
+	pageModels := make([]*LivestreamModel, 0, len(page))
+	pageReasons := make([]string, 0, len(page))
+	for _, entry := range page {
+		pageModels = append(pageModels, livestreamModelMap[entry.livestreamID])
+		pageReasons = append(pageReasons, entry.reason)
+	}
+
+	livestreams, err := fillLivestreamResponseBulk(ctx, tx, pageModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	items := make([]FeedItem, len(livestreams))
+	for i := range livestreams {
+		items[i] = FeedItem{
+			Livestream: livestreams[i],
+			Reason:     pageReasons[i],
+		}
+	}
+	res := FeedResponse{Items: items}
+	if end < len(entries) {
+		res.NextCursor = page[len(page)-1].cursor()
+	}
+
+	setPageHeaders(c, pageInfo{total: int64(len(entries)), cursorParam: "cursor", nextCursor: res.NextCursor})
+	return c.JSON(http.StatusOK, res)
+}
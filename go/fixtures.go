@@ -0,0 +1,189 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"log"
+	"math/rand"
+	"sort"
+	"time"
+)
+
+// ベンチマーカーを使わずにプロファイルできるよう、手元のDBに計測用のデータを作るサブコマンド
+//
+//	go run . gen-fixtures -users 1000 -livestreams 3 -comments 50 -reactions 30
+//
+// ユーザ登録・配信予約・コメント・リアクションはどれもサービス経由で作るので、
+// DNSレコード・予約枠・チップの集計も本番と同じように更新される (通知とwebhookのワーカーは起動しない)
+
+// 1ユーザが1つの配信を予約する時間の上限
+const fixtureMaxLivestreamHours = 3
+
+// 予約枠が埋まっていた場合に取り直す回数
+const fixtureReserveAttempts = 10
+
+type fixtureOptions struct {
+	users                  int
+	livestreamsPerUser     int
+	commentsPerLivestream  int
+	reactionsPerLivestream int
+	// 繰り返し実行する場合はユーザ名が重複しないよう変える
+	namePrefix string
+	password   string
+	// 同じ値なら同じ内容のデータを作る
+	seed int64
+}
+
+func parseFixtureOptions(args []string) (fixtureOptions, error) {
+	var opts fixtureOptions
+	fs := flag.NewFlagSet("gen-fixtures", flag.ContinueOnError)
+	fs.IntVar(&opts.users, "users", 100, "number of users to register")
+	fs.IntVar(&opts.livestreamsPerUser, "livestreams", 2, "number of livestreams reserved by each user")
+	fs.IntVar(&opts.commentsPerLivestream, "comments", 30, "number of livecomments posted to each livestream")
+	fs.IntVar(&opts.reactionsPerLivestream, "reactions", 20, "number of reactions posted to each livestream")
+	fs.StringVar(&opts.namePrefix, "prefix", "fixture", "prefix of the generated usernames")
+	fs.StringVar(&opts.password, "password", "password", "password of the generated users")
+	fs.Int64Var(&opts.seed, "seed", 1, "random seed")
+	if err := fs.Parse(args); err != nil {
+		return fixtureOptions{}, err
+	}
+	if opts.users <= 0 {
+		return fixtureOptions{}, fmt.Errorf("-users must be positive")
+	}
+	if opts.livestreamsPerUser < 0 || opts.commentsPerLivestream < 0 || opts.reactionsPerLivestream < 0 {
+		return fixtureOptions{}, fmt.Errorf("-livestreams, -comments and -reactions must not be negative")
+	}
+	return opts, nil
+}
+
+func runGenFixtures(ctx context.Context, app *App, args []string) error {
+	opts, err := parseFixtureOptions(args)
+	if err != nil {
+		return err
+	}
+	rng := rand.New(rand.NewSource(opts.seed))
+	startedAt := time.Now()
+
+	userIDs := make([]UserID, 0, opts.users)
+	for i := 0; i < opts.users; i++ {
+		name := fmt.Sprintf("%s%d", opts.namePrefix, i)
+		user, err := app.userService.Register(ctx, PostUserRequest{
+			Name:        name,
+			DisplayName: fmt.Sprintf("Fixture User %d", i),
+			Description: fmt.Sprintf("%sは計測用に作られたユーザです", name),
+			Password:    opts.password,
+			Theme:       PostUserRequestTheme{DarkMode: rng.Intn(2) == 0},
+		})
+		if err != nil {
+			return fmt.Errorf("failed to register %s: %w", name, err)
+		}
+		userIDs = append(userIDs, user.ID)
+	}
+	log.Printf("gen-fixtures: registered %d users", len(userIDs))
+
+	var livestreamIDs []LivestreamID
+	for _, userID := range userIDs {
+		for i := 0; i < opts.livestreamsPerUser; i++ {
+			livestream, err := reserveFixtureLivestream(ctx, app, rng, userID, len(livestreamIDs))
+			if err != nil {
+				return err
+			}
+			livestreamIDs = append(livestreamIDs, livestream.ID)
+		}
+	}
+	log.Printf("gen-fixtures: reserved %d livestreams", len(livestreamIDs))
+
+	tips := fixtureTipAmounts()
+	var livecommentCount int
+	for _, livestreamID := range livestreamIDs {
+		for i := 0; i < opts.commentsPerLivestream; i++ {
+			req := PostLivecommentRequest{
+				Comment: fmt.Sprintf("fixture comment %d", i),
+			}
+			// コメントの1割にチップを付ける
+			if len(tips) > 0 && rng.Intn(10) == 0 {
+				req.Tip = tips[rng.Intn(len(tips))]
+			}
+			if _, err := app.livecommentService.Post(ctx, userIDs[rng.Intn(len(userIDs))], livestreamID, req); err != nil {
+				return fmt.Errorf("failed to post livecomment to livestream %d: %w", livestreamID, err)
+			}
+			livecommentCount++
+		}
+	}
+	log.Printf("gen-fixtures: posted %d livecomments", livecommentCount)
+
+	emojiNames := make([]string, 0, len(reactionEmojiWhitelist))
+	for name := range reactionEmojiWhitelist {
+		emojiNames = append(emojiNames, name)
+	}
+	// mapの順序に依存させない
+	sort.Strings(emojiNames)
+	var reactionCount int
+	if len(emojiNames) > 0 {
+		for _, livestreamID := range livestreamIDs {
+			for i := 0; i < opts.reactionsPerLivestream; i++ {
+				userID := userIDs[rng.Intn(len(userIDs))]
+				emojiName := emojiNames[rng.Intn(len(emojiNames))]
+				_, added, err := app.reactionService.Toggle(ctx, userID, livestreamID, emojiName)
+				if err != nil {
+					return fmt.Errorf("failed to post reaction to livestream %d: %w", livestreamID, err)
+				}
+				// 同じリアクションを引いた場合は取り消されている
+				if added {
+					reactionCount++
+				} else {
+					reactionCount--
+				}
+			}
+		}
+	}
+	log.Printf("gen-fixtures: posted %d reactions", reactionCount)
+
+	// write_behind_statsが有効だとチップ合計がメモリに残っている
+	if err := flushTipAggregates(ctx); err != nil {
+		return fmt.Errorf("failed to flush tip aggregates: %w", err)
+	}
+
+	log.Printf("gen-fixtures: done in %s", time.Since(startedAt).Round(time.Millisecond))
+	return nil
+}
+
+// 予約期間内からランダムに1〜3時間を選んで予約する。予約枠が埋まっていれば選び直す
+func reserveFixtureLivestream(ctx context.Context, app *App, rng *rand.Rand, userID UserID, n int) (Livestream, error) {
+	termStartAt := time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
+	termHours := int(time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC).Sub(termStartAt) / time.Hour)
+
+	var lastErr error
+	for attempt := 0; attempt < fixtureReserveAttempts; attempt++ {
+		hours := 1 + rng.Intn(fixtureMaxLivestreamHours)
+		startAt := termStartAt.Add(time.Duration(rng.Intn(termHours-hours)) * time.Hour)
+		livestream, err := app.livestreamService.Reserve(ctx, userID, ReserveLivestreamRequest{
+			Title:        fmt.Sprintf("Fixture Livestream %d", n),
+			Description:  fmt.Sprintf("計測用の配信 %d です", n),
+			PlaylistUrl:  "https://media.xiii.isucon.dev/api/4/playlist.m3u8",
+			ThumbnailUrl: "https://media.xiii.isucon.dev/isucon12_final.webp",
+			StartAt:      startAt.Unix(),
+			EndAt:        startAt.Add(time.Duration(hours) * time.Hour).Unix(),
+		})
+		if err == nil {
+			return livestream, nil
+		}
+		if errorCodeOf(err) != errorCodeSlotUnavailable {
+			return Livestream{}, fmt.Errorf("failed to reserve livestream for user %d: %w", userID, err)
+		}
+		lastErr = err
+	}
+	return Livestream{}, fmt.Errorf("failed to find a free reservation slot for user %d: %w", userID, lastErr)
+}
+
+// チップの区分ごとの下限額。区分が無ければチップは付けない
+func fixtureTipAmounts() []int64 {
+	amounts := make([]int64, 0, len(tipTiers))
+	for _, tier := range tipTiers {
+		if tier.Min > 0 && tipAllowed(tier.Min) {
+			amounts = append(amounts, tier.Min)
+		}
+	}
+	return amounts
+}
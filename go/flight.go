@@ -0,0 +1,50 @@
+package main
+
+import (
+	"errors"
+	"sync"
+)
+
+// 同じキーの処理が実行中なら、新しく始めずにその結果を待って共有する (x/syncのsingleflightと同じ)
+// 結果は共有されるので、呼び出し側で書き換えないこと
+type flightGroup struct {
+	mu    sync.Mutex
+	calls map[string]*flightCall
+}
+
+type flightCall struct {
+	wg  sync.WaitGroup
+	val interface{}
+	err error
+}
+
+func (g *flightGroup) Do(key string, fn func() (interface{}, error)) (interface{}, error) {
+	g.mu.Lock()
+	if g.calls == nil {
+		g.calls = make(map[string]*flightCall)
+	}
+	if call, ok := g.calls[key]; ok {
+		g.mu.Unlock()
+		call.wg.Wait()
+		return call.val, call.err
+	}
+	call := &flightCall{}
+	call.wg.Add(1)
+	g.calls[key] = call
+	g.mu.Unlock()
+
+	// fnがpanicしても待っている側を解放する
+	normalReturn := false
+	defer func() {
+		if !normalReturn {
+			call.err = errors.New("shared call panicked")
+		}
+		g.mu.Lock()
+		delete(g.calls, key)
+		g.mu.Unlock()
+		call.wg.Done()
+	}()
+	call.val, call.err = fn()
+	normalReturn = true
+	return call.val, call.err
+}
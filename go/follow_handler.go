@@ -0,0 +1,190 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ユーザごとのフォローしている配信者のID (フォローグラフ)
+var (
+	FollowingIDsByUserIDCache      = make(map[UserID][]UserID)
+	FollowingIDsByUserIDCacheMutex = sync.RWMutex{}
+)
+
+func init() {
+	registerCacheReset(func() {
+		FollowingIDsByUserIDCacheMutex.Lock()
+		FollowingIDsByUserIDCache = make(map[UserID][]UserID)
+		FollowingIDsByUserIDCacheMutex.Unlock()
+	})
+}
+
+type FollowModel struct {
+	ID         int64  `db:"id"`
+	FollowerID UserID `db:"follower_id"`
+	StreamerID UserID `db:"streamer_id"`
+	CreatedAt  int64  `db:"created_at"`
+}
+
+// 配信者のフォローAPI
+// POST /api/user/:username/follow
+func followHandler(c echo.Context) error {
+	return changeFollow(c, true)
+}
+
+// 配信者のフォロー解除API
+// DELETE /api/user/:username/follow
+func unfollowHandler(c echo.Context) error {
+	return changeFollow(c, false)
+}
+
+func changeFollow(c echo.Context, follow bool) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	username := c.Param("username")
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	streamerModel, err := userRepository.GetByName(ctx, tx, username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeUserNotFound, "user not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	if streamerModel.ID == userID {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't follow yourself")
+	}
+
+	var rs sql.Result
+	delta := 1
+	if follow {
+		rs, err = tx.ExecContext(ctx, "INSERT IGNORE INTO follows (follower_id, streamer_id, created_at) VALUES (?, ?, ?)", userID, streamerModel.ID, time.Now().Unix())
+	} else {
+		rs, err = tx.ExecContext(ctx, "DELETE FROM follows WHERE follower_id = ? AND streamer_id = ?", userID, streamerModel.ID)
+		delta = -1
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update follow: "+err.Error())
+	}
+	affected, err := rs.RowsAffected()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	}
+
+	// 既にフォロー済み/未フォローなら件数は変えない
+	if affected > 0 {
+		if _, err := tx.ExecContext(ctx, "UPDATE users SET followers_count = followers_count + ? WHERE id = ?", delta, streamerModel.ID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update followers count: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// コミット前に消すと、並行するリクエストが古いfollowers_countをキャッシュに戻してしまう
+	if affected > 0 {
+		invalidateUserCaches(streamerModel.ID)
+		FollowingIDsByUserIDCacheMutex.Lock()
+		delete(FollowingIDsByUserIDCache, userID)
+		FollowingIDsByUserIDCacheMutex.Unlock()
+	}
+
+	// 並行するフォローの分も含めた件数を返すため、コミット後に読み直す
+	streamerModel, err = userRepository.GetByID(ctx, dbConn, streamerModel.ID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	streamer, err := userRepository.Fill(ctx, dbConn, streamerModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, streamer)
+}
+
+// フォロー中の配信者一覧API
+// GET /api/user/me/following
+func getFollowingHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	sel, err := parseFieldSelection(c, User{})
+	if err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var userModels []*UserModel
+	if err := tx.SelectContext(ctx, &userModels, "SELECT u.* FROM users u INNER JOIN follows f ON f.streamer_id = u.id WHERE f.follower_id = ? ORDER BY f.id DESC", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get following users: "+err.Error())
+	}
+
+	users, err := fillUsersSelected(ctx, tx, userRepository, userModels, sel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return respondFieldSelected(c, http.StatusOK, users, sel)
+}
+
+func getFollowingStreamerIDs(ctx context.Context, tx *sqlx.Tx, userID UserID) ([]UserID, error) {
+	FollowingIDsByUserIDCacheMutex.RLock()
+	streamerIDs, ok := FollowingIDsByUserIDCache[userID]
+	FollowingIDsByUserIDCacheMutex.RUnlock()
+	if ok {
+		return streamerIDs, nil
+	}
+
+	streamerIDs = []UserID{}
+	if err := tx.SelectContext(ctx, &streamerIDs, "SELECT streamer_id FROM follows WHERE follower_id = ?", userID); err != nil {
+		return nil, err
+	}
+
+	FollowingIDsByUserIDCacheMutex.Lock()
+	FollowingIDsByUserIDCache[userID] = streamerIDs
+	FollowingIDsByUserIDCacheMutex.Unlock()
+
+	return streamerIDs, nil
+}
@@ -0,0 +1,743 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信ページの描画に必要なユーザ・配信・ライブコメント・統計を1リクエストで取るためのGraphQL
+// ライブラリは使わず、クエリ操作のフィールド選択・エイリアス・引数・変数だけを扱う (フラグメント、ディレクティブ、mutationは非対応)
+//
+//	query Stream($id: Int!) {
+//	  livestream(id: $id) { title owner { name } }
+//	  stats: livestreamStatistics(livestream_id: $id) { rank }
+//	  livecomments(livestream_id: $id, limit: 20) { comment tip user { name } }
+//	}
+//
+// フィールド名はRESTのJSONと同じキー名で、選べるフィールドもRESTのレスポンスと同じ
+
+type GraphQLRequest struct {
+	Query         string         `json:"query"`
+	OperationName string         `json:"operationName"`
+	Variables     map[string]any `json:"variables"`
+}
+
+type GraphQLError struct {
+	Message string `json:"message"`
+	Path    []any  `json:"path,omitempty"`
+}
+
+type GraphQLResponse struct {
+	Data   map[string]any `json:"data"`
+	Errors []GraphQLError `json:"errors,omitempty"`
+}
+
+const (
+	// エイリアスで同じフィールドを並べて1リクエストに重い処理を詰め込めないようにする
+	maxGraphQLRootFields = 10
+	// 入れ子の深さ。パーサと選択の適用は再帰するので、深すぎるクエリでスタックを使い切らないようにする
+	maxGraphQLSelectionDepth = 10
+	// クエリ本体と変数を合わせたリクエストボディの上限
+	maxGraphQLRequestBodySize = 64 << 10
+
+	defaultGraphQLLivecommentLimit = 20
+	maxGraphQLLivecommentLimit     = 100
+)
+
+// ルートのフィールドを解決する。返した値はJSONに直してから選択されたフィールドだけを残す
+type graphQLResolver func(ctx context.Context, tx *sqlx.Tx, userID UserID, args graphQLArgs) (any, error)
+
+var graphQLQueryResolvers = map[string]graphQLResolver{
+	"user":                 resolveGraphQLUser,
+	"livestream":           resolveGraphQLLivestream,
+	"livecomments":         resolveGraphQLLivecomments,
+	"userStatistics":       resolveGraphQLUserStatistics,
+	"livestreamStatistics": resolveGraphQLLivestreamStatistics,
+}
+
+// POST /api/graphql
+func postGraphQLHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	c.Request().Body = http.MaxBytesReader(c.Response(), c.Request().Body, maxGraphQLRequestBodySize)
+	var req GraphQLRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		var tooLarge *http.MaxBytesError
+		if errors.As(err, &tooLarge) {
+			return echo.NewHTTPError(http.StatusRequestEntityTooLarge, fmt.Sprintf("request body must be at most %d bytes", maxGraphQLRequestBodySize))
+		}
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidJSON, "failed to decode the request body as json")
+	}
+
+	op, err := parseGraphQLOperation(req.Query, req.OperationName)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusBadRequest, "invalid graphql query: "+err.Error())
+	}
+	if len(op.selections) > maxGraphQLRootFields {
+		return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("invalid graphql query: at most %d root fields are allowed", maxGraphQLRootFields))
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	variables := op.variables(req.Variables)
+	res := GraphQLResponse{Data: make(map[string]any, len(op.selections))}
+	for _, field := range op.selections {
+		key := field.responseKey()
+		// フィールド単位のエラーはそのフィールドだけnullにして残りは返す
+		value, err := executeGraphQLField(ctx, tx, userID, field, variables)
+		if err != nil {
+			res.Data[key] = nil
+			res.Errors = append(res.Errors, GraphQLError{Message: graphQLErrorMessage(c, err), Path: []any{key}})
+			continue
+		}
+		res.Data[key] = value
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, res)
+}
+
+func executeGraphQLField(ctx context.Context, tx *sqlx.Tx, userID UserID, field *graphQLField, variables map[string]any) (any, error) {
+	resolve, ok := graphQLQueryResolvers[field.name]
+	if !ok {
+		return nil, newGraphQLQueryError("cannot query field %q on type Query", field.name)
+	}
+	args, err := field.resolveArgs(variables)
+	if err != nil {
+		return nil, err
+	}
+	value, err := resolve(ctx, tx, userID, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// レスポンスの構造体はJSONのキーで選ぶので、一度JSONに直す。数値はint64の精度を保つためjson.Numberで持つ
+	b, err := json.Marshal(value)
+	if err != nil {
+		return nil, fmt.Errorf("failed to marshal %s: %w", field.name, err)
+	}
+	dec := json.NewDecoder(bytes.NewReader(b))
+	dec.UseNumber()
+	var node any
+	if err := dec.Decode(&node); err != nil {
+		return nil, fmt.Errorf("failed to unmarshal %s: %w", field.name, err)
+	}
+	return selectGraphQLFields(node, field)
+}
+
+// 選択されたフィールドだけを残す。omitemptyで落ちたキーはnullとして返す
+func selectGraphQLFields(node any, field *graphQLField) (any, error) {
+	switch v := node.(type) {
+	case []any:
+		out := make([]any, 0, len(v))
+		for _, elem := range v {
+			selected, err := selectGraphQLFields(elem, field)
+			if err != nil {
+				return nil, err
+			}
+			out = append(out, selected)
+		}
+		return out, nil
+	case map[string]any:
+		if len(field.selections) == 0 {
+			return nil, newGraphQLQueryError("field %q must have a selection of subfields", field.name)
+		}
+		out := make(map[string]any, len(field.selections))
+		for _, sub := range field.selections {
+			selected, err := selectGraphQLFields(v[sub.name], sub)
+			if err != nil {
+				return nil, err
+			}
+			out[sub.responseKey()] = selected
+		}
+		return out, nil
+	case nil:
+		return nil, nil
+	default:
+		if len(field.selections) > 0 {
+			return nil, newGraphQLQueryError("field %q must not have a selection since it is a scalar", field.name)
+		}
+		return v, nil
+	}
+}
+
+// RESTのエラーレスポンスと同じく、500系の詳細はログにだけ出す
+func graphQLErrorMessage(c echo.Context, err error) string {
+	var he *echo.HTTPError
+	if errors.As(err, &he) && he.Code < http.StatusInternalServerError {
+		return fmt.Sprint(he.Message)
+	}
+	var qe graphQLQueryError
+	if errors.As(err, &qe) {
+		return qe.Error()
+	}
+	c.Logger().Errorf("graphql error at %s (request_id=%s): %+v", c.Path(), c.Response().Header().Get(echo.HeaderXRequestID), err)
+	return internalErrorMessage
+}
+
+// クエリの誤りなど、そのままクライアントに返してよいエラー
+type graphQLQueryError string
+
+func (e graphQLQueryError) Error() string {
+	return string(e)
+}
+
+func newGraphQLQueryError(format string, args ...any) error {
+	return graphQLQueryError(fmt.Sprintf(format, args...))
+}
+
+// RESTの統計APIと同じ上限に達している。そのフィールドだけnullにして返す
+var errGraphQLStatisticsBusy = newGraphQLQueryError("too many statistics requests in flight, retry later")
+
+func resolveGraphQLUser(ctx context.Context, tx *sqlx.Tx, _ UserID, args graphQLArgs) (any, error) {
+	username, err := args.string("name")
+	if err != nil {
+		return nil, err
+	}
+
+	userModel, err := userRepository.GetByName(ctx, tx, username)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	user, err := userRepository.Fill(ctx, tx, userModel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fill user: %w", err)
+	}
+	return user, nil
+}
+
+func resolveGraphQLLivestream(ctx context.Context, tx *sqlx.Tx, _ UserID, args graphQLArgs) (any, error) {
+	livestreamID, err := args.int64("id")
+	if err != nil {
+		return nil, err
+	}
+
+	livestreamModel := LivestreamModel{}
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil, nil
+		}
+		return nil, fmt.Errorf("failed to get livestream: %w", err)
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fill livestream: %w", err)
+	}
+	return livestream, nil
+}
+
+// GET /api/livestream/:livestream_id/livecomment と同じく新しい順で、ブロックしたユーザのものは除く
+func resolveGraphQLLivecomments(ctx context.Context, tx *sqlx.Tx, userID UserID, args graphQLArgs) (any, error) {
+	livestreamID, err := args.int64("livestream_id")
+	if err != nil {
+		return nil, err
+	}
+
+	// 省略時も全件は返さない。多すぎる指定は上限に丸める
+	limit := int64(defaultGraphQLLivecommentLimit)
+	if args.has("limit") {
+		if limit, err = args.int64("limit"); err != nil {
+			return nil, err
+		}
+		if limit <= 0 {
+			return nil, newGraphQLQueryError("argument %q must be positive", "limit")
+		}
+		limit = min(limit, maxGraphQLLivecommentLimit)
+	}
+
+	livecommentModels := []*LivecommentModel{}
+	if err := tx.SelectContext(ctx, &livecommentModels, "SELECT * FROM livecomments WHERE livestream_id = ? AND deleted_at IS NULL"+notBlockedCondition+" ORDER BY id DESC LIMIT ?", livestreamID, userID, limit); err != nil {
+		return nil, fmt.Errorf("failed to get livecomments: %w", err)
+	}
+
+	livecomments, err := fillLivecommentResponseBulk(ctx, tx, livecommentModels)
+	if err != nil {
+		return nil, fmt.Errorf("failed to fill livecomments: %w", err)
+	}
+	return livecomments, nil
+}
+
+func resolveGraphQLUserStatistics(ctx context.Context, tx *sqlx.Tx, _ UserID, args graphQLArgs) (any, error) {
+	username, err := args.string("username")
+	if err != nil {
+		return nil, err
+	}
+	if !userStatisticsInFlight.tryAcquire() {
+		return nil, errGraphQLStatisticsBusy
+	}
+	defer userStatisticsInFlight.release()
+	return getUserStatistics(ctx, tx, username)
+}
+
+func resolveGraphQLLivestreamStatistics(ctx context.Context, tx *sqlx.Tx, _ UserID, args graphQLArgs) (any, error) {
+	livestreamID, err := args.int64("livestream_id")
+	if err != nil {
+		return nil, err
+	}
+	if !livestreamStatisticsInFlight.tryAcquire() {
+		return nil, errGraphQLStatisticsBusy
+	}
+	defer livestreamStatisticsInFlight.release()
+	return getLivestreamStatistics(ctx, tx, LivestreamID(livestreamID))
+}
+
+// 変数を埋めた後の引数
+type graphQLArgs map[string]any
+
+func (a graphQLArgs) has(name string) bool {
+	v, ok := a[name]
+	return ok && v != nil
+}
+
+func (a graphQLArgs) int64(name string) (int64, error) {
+	switch v := a[name].(type) {
+	case int64:
+		return v, nil
+	case float64:
+		// JSONの変数はfloat64で来る
+		if v == float64(int64(v)) {
+			return int64(v), nil
+		}
+	case json.Number:
+		if n, err := v.Int64(); err == nil {
+			return n, nil
+		}
+	case nil:
+		return 0, newGraphQLQueryError("argument %q is required", name)
+	}
+	return 0, newGraphQLQueryError("argument %q must be Int", name)
+}
+
+func (a graphQLArgs) string(name string) (string, error) {
+	switch v := a[name].(type) {
+	case string:
+		return v, nil
+	case nil:
+		return "", newGraphQLQueryError("argument %q is required", name)
+	}
+	return "", newGraphQLQueryError("argument %q must be String", name)
+}
+
+type graphQLOperation struct {
+	// 変数名 -> デフォルト値 (無ければnil)
+	variableDefaults map[string]any
+	selections       []*graphQLField
+}
+
+// リクエストの変数にデフォルト値を補う
+func (op *graphQLOperation) variables(given map[string]any) map[string]any {
+	vars := make(map[string]any, len(op.variableDefaults))
+	for name, def := range op.variableDefaults {
+		if v, ok := given[name]; ok {
+			vars[name] = v
+		} else {
+			vars[name] = def
+		}
+	}
+	return vars
+}
+
+type graphQLField struct {
+	alias      string
+	name       string
+	args       map[string]any
+	selections []*graphQLField
+}
+
+func (f *graphQLField) responseKey() string {
+	if f.alias != "" {
+		return f.alias
+	}
+	return f.name
+}
+
+func (f *graphQLField) resolveArgs(variables map[string]any) (graphQLArgs, error) {
+	args := make(graphQLArgs, len(f.args))
+	for name, v := range f.args {
+		if ref, ok := v.(graphQLVariable); ok {
+			value, ok := variables[string(ref)]
+			if !ok {
+				return nil, newGraphQLQueryError("variable $%s is not defined", ref)
+			}
+			v = value
+		}
+		args[name] = v
+	}
+	return args, nil
+}
+
+// 引数の値として書かれた$name
+type graphQLVariable string
+
+type graphQLParser struct {
+	src string
+	pos int
+	// 今読んでいる選択セットの深さ
+	depth int
+}
+
+// operationNameが空ならドキュメント中の操作は1つでなければならない
+func parseGraphQLOperation(src, operationName string) (*graphQLOperation, error) {
+	p := &graphQLParser{src: src}
+	var ops []*graphQLOperation
+	var names []string
+	for {
+		tok, err := p.peek()
+		if err != nil {
+			return nil, err
+		}
+		if tok == "" {
+			break
+		}
+		name, op, err := p.parseOperation()
+		if err != nil {
+			return nil, err
+		}
+		ops = append(ops, op)
+		names = append(names, name)
+	}
+
+	if len(ops) == 0 {
+		return nil, fmt.Errorf("no operation found")
+	}
+	if operationName == "" {
+		if len(ops) > 1 {
+			return nil, fmt.Errorf("operationName is required when the document has multiple operations")
+		}
+		return ops[0], nil
+	}
+	for i, name := range names {
+		if name == operationName {
+			return ops[i], nil
+		}
+	}
+	return nil, fmt.Errorf("unknown operation %q", operationName)
+}
+
+func (p *graphQLParser) parseOperation() (string, *graphQLOperation, error) {
+	op := &graphQLOperation{variableDefaults: map[string]any{}}
+	tok, _ := p.peek()
+	if tok == "{" {
+		// 省略記法のクエリ
+		selections, err := p.parseSelectionSet()
+		op.selections = selections
+		return "", op, err
+	}
+
+	keyword, err := p.next()
+	if err != nil {
+		return "", nil, err
+	}
+	switch keyword {
+	case "query":
+	case "mutation", "subscription":
+		return "", nil, fmt.Errorf("%s is not supported", keyword)
+	case "fragment":
+		return "", nil, fmt.Errorf("fragments are not supported")
+	default:
+		return "", nil, fmt.Errorf("unexpected %q", keyword)
+	}
+
+	var name string
+	if tok, _ := p.peek(); isGraphQLName(tok) {
+		name, _ = p.next()
+	}
+	if tok, _ := p.peek(); tok == "(" {
+		if err := p.parseVariableDefinitions(op); err != nil {
+			return "", nil, err
+		}
+	}
+	if tok, _ := p.peek(); tok == "@" {
+		return "", nil, fmt.Errorf("directives are not supported")
+	}
+	op.selections, err = p.parseSelectionSet()
+	return name, op, err
+}
+
+// ($id: Int!, $limit: Int = 20) 型は読み飛ばし、引数を使うときに検査する
+func (p *graphQLParser) parseVariableDefinitions(op *graphQLOperation) error {
+	if err := p.expect("("); err != nil {
+		return err
+	}
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return err
+		}
+		if tok == ")" {
+			return nil
+		}
+		if tok != "$" {
+			return fmt.Errorf("expected variable but got %q", tok)
+		}
+		name, err := p.next()
+		if err != nil {
+			return err
+		}
+		if err := p.expect(":"); err != nil {
+			return err
+		}
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		var def any
+		if tok, _ := p.peek(); tok == "=" {
+			p.next()
+			if def, err = p.parseValue(); err != nil {
+				return err
+			}
+		}
+		op.variableDefaults[name] = def
+	}
+}
+
+func (p *graphQLParser) skipType() error {
+	tok, err := p.next()
+	if err != nil {
+		return err
+	}
+	if tok == "[" {
+		if err := p.skipType(); err != nil {
+			return err
+		}
+		if err := p.expect("]"); err != nil {
+			return err
+		}
+	} else if !isGraphQLName(tok) {
+		return fmt.Errorf("expected type but got %q", tok)
+	}
+	if tok, _ := p.peek(); tok == "!" {
+		p.next()
+	}
+	return nil
+}
+
+func (p *graphQLParser) parseSelectionSet() ([]*graphQLField, error) {
+	if err := p.expect("{"); err != nil {
+		return nil, err
+	}
+	p.depth++
+	defer func() { p.depth-- }()
+	if p.depth > maxGraphQLSelectionDepth {
+		return nil, fmt.Errorf("selections must be nested at most %d levels deep", maxGraphQLSelectionDepth)
+	}
+	var fields []*graphQLField
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		switch {
+		case tok == "}":
+			if len(fields) == 0 {
+				return nil, fmt.Errorf("selection set must not be empty")
+			}
+			return fields, nil
+		case tok == "...":
+			return nil, fmt.Errorf("fragments are not supported")
+		case !isGraphQLName(tok):
+			return nil, fmt.Errorf("expected field but got %q", tok)
+		}
+
+		field := &graphQLField{name: tok}
+		if next, _ := p.peek(); next == ":" {
+			p.next()
+			if field.name, err = p.next(); err != nil {
+				return nil, err
+			}
+			if !isGraphQLName(field.name) {
+				return nil, fmt.Errorf("expected field but got %q", field.name)
+			}
+			field.alias = tok
+		}
+		if next, _ := p.peek(); next == "(" {
+			if field.args, err = p.parseArguments(); err != nil {
+				return nil, err
+			}
+		}
+		if next, _ := p.peek(); next == "@" {
+			return nil, fmt.Errorf("directives are not supported")
+		}
+		if next, _ := p.peek(); next == "{" {
+			if field.selections, err = p.parseSelectionSet(); err != nil {
+				return nil, err
+			}
+		}
+		fields = append(fields, field)
+	}
+}
+
+func (p *graphQLParser) parseArguments() (map[string]any, error) {
+	if err := p.expect("("); err != nil {
+		return nil, err
+	}
+	args := map[string]any{}
+	for {
+		tok, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if tok == ")" {
+			return args, nil
+		}
+		if !isGraphQLName(tok) {
+			return nil, fmt.Errorf("expected argument but got %q", tok)
+		}
+		if err := p.expect(":"); err != nil {
+			return nil, err
+		}
+		if args[tok], err = p.parseValue(); err != nil {
+			return nil, err
+		}
+	}
+}
+
+// Int・String・Boolean・null・変数だけ扱う
+func (p *graphQLParser) parseValue() (any, error) {
+	tok, err := p.next()
+	if err != nil {
+		return nil, err
+	}
+	switch {
+	case tok == "":
+		return nil, fmt.Errorf("unexpected end of query")
+	case tok == "$":
+		name, err := p.next()
+		if err != nil {
+			return nil, err
+		}
+		if !isGraphQLName(name) {
+			return nil, fmt.Errorf("expected variable name but got %q", name)
+		}
+		return graphQLVariable(name), nil
+	case tok == "true":
+		return true, nil
+	case tok == "false":
+		return false, nil
+	case tok == "null":
+		return nil, nil
+	case strings.HasPrefix(tok, `"`):
+		var s string
+		if err := json.Unmarshal([]byte(tok), &s); err != nil {
+			return nil, fmt.Errorf("invalid string %s", tok)
+		}
+		return s, nil
+	case tok[0] == '-' || ('0' <= tok[0] && tok[0] <= '9'):
+		return json.Number(tok), nil
+	}
+	return nil, fmt.Errorf("unsupported value %q", tok)
+}
+
+func (p *graphQLParser) expect(want string) error {
+	tok, err := p.next()
+	if err != nil {
+		return err
+	}
+	if tok != want {
+		return fmt.Errorf("expected %q but got %q", want, tok)
+	}
+	return nil
+}
+
+func (p *graphQLParser) peek() (string, error) {
+	pos := p.pos
+	tok, err := p.next()
+	p.pos = pos
+	return tok, err
+}
+
+// 次のトークン。終端なら空文字列。カンマと#から行末までのコメントは読み飛ばす
+func (p *graphQLParser) next() (string, error) {
+	for p.pos < len(p.src) {
+		ch := p.src[p.pos]
+		if ch == '#' {
+			for p.pos < len(p.src) && p.src[p.pos] != '\n' {
+				p.pos++
+			}
+			continue
+		}
+		if ch != ' ' && ch != '\t' && ch != '\n' && ch != '\r' && ch != ',' {
+			break
+		}
+		p.pos++
+	}
+	if p.pos >= len(p.src) {
+		return "", nil
+	}
+
+	start := p.pos
+	ch := p.src[p.pos]
+	switch {
+	case strings.HasPrefix(p.src[p.pos:], "..."):
+		p.pos += 3
+	case strings.IndexByte("{}():!$=[]@", ch) >= 0:
+		p.pos++
+	case ch == '"':
+		p.pos++
+		for p.pos < len(p.src) && p.src[p.pos] != '"' {
+			if p.src[p.pos] == '\\' {
+				p.pos++
+			}
+			p.pos++
+		}
+		if p.pos >= len(p.src) {
+			return "", fmt.Errorf("unterminated string")
+		}
+		p.pos++
+	case ch == '-' || ('0' <= ch && ch <= '9'):
+		p.pos++
+		for p.pos < len(p.src) && '0' <= p.src[p.pos] && p.src[p.pos] <= '9' {
+			p.pos++
+		}
+		if p.pos < len(p.src) && (p.src[p.pos] == '.' || p.src[p.pos] == 'e' || p.src[p.pos] == 'E') {
+			return "", fmt.Errorf("float values are not supported")
+		}
+	case isGraphQLNameByte(ch, true):
+		for p.pos < len(p.src) && isGraphQLNameByte(p.src[p.pos], false) {
+			p.pos++
+		}
+	default:
+		return "", fmt.Errorf("unexpected character %q", ch)
+	}
+	return p.src[start:p.pos], nil
+}
+
+func isGraphQLName(tok string) bool {
+	return tok != "" && isGraphQLNameByte(tok[0], true)
+}
+
+func isGraphQLNameByte(ch byte, first bool) bool {
+	return ch == '_' || ('a' <= ch && ch <= 'z') || ('A' <= ch && ch <= 'Z') || (!first && '0' <= ch && ch <= '9')
+}
@@ -0,0 +1,211 @@
+package main
+
+import (
+	"encoding/json"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// テストで比べやすいよう、フィールドを "alias:name(args){...}" の形に直す
+func formatGraphQLFields(fields []*graphQLField) string {
+	parts := make([]string, 0, len(fields))
+	for _, f := range fields {
+		s := f.name
+		if f.alias != "" {
+			s = f.alias + ":" + s
+		}
+		if len(f.args) > 0 {
+			b, _ := json.Marshal(f.args)
+			s += string(b)
+		}
+		if len(f.selections) > 0 {
+			s += "{" + formatGraphQLFields(f.selections) + "}"
+		}
+		parts = append(parts, s)
+	}
+	return strings.Join(parts, " ")
+}
+
+func TestParseGraphQLOperation(t *testing.T) {
+	tests := []struct {
+		name          string
+		query         string
+		operationName string
+		want          string
+		wantDefaults  map[string]any
+	}{
+		{
+			name:  "shorthand",
+			query: `{ user(name: "alice") { name theme { dark_mode } } }`,
+			want:  `user{"name":"alice"}{name theme{dark_mode}}`,
+		},
+		{
+			name: "named query with variables and aliases",
+			query: `query Stream($id: Int!, $limit: Int = 20) {
+				livestream(id: $id) { title }
+				stats: livestreamStatistics(livestream_id: $id) { rank }
+				livecomments(livestream_id: $id, limit: $limit) { comment }
+			}`,
+			want:         `livestream{"id":"id"}{title} stats:livestreamStatistics{"livestream_id":"id"}{rank} livecomments{"limit":"limit","livestream_id":"id"}{comment}`,
+			wantDefaults: map[string]any{"id": nil, "limit": json.Number("20")},
+		},
+		{
+			name:  "commas and comments are ignored",
+			query: "{ # comment\n a, b, c }",
+			want:  "a b c",
+		},
+		{
+			name:  "literal values",
+			query: `{ f(a: -1, b: true, c: false, d: null, e: "x\"y") }`,
+			want:  `f{"a":-1,"b":true,"c":false,"d":null,"e":"x\"y"}`,
+		},
+		{
+			name:          "select by operation name",
+			query:         `query A { a } query B { b }`,
+			operationName: "B",
+			want:          "b",
+		},
+		{
+			name:         "list type",
+			query:        `query ($ids: [Int!]!) { a }`,
+			want:         "a",
+			wantDefaults: map[string]any{"ids": nil},
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			op, err := parseGraphQLOperation(tt.query, tt.operationName)
+			if err != nil {
+				t.Fatalf("parseGraphQLOperation: %v", err)
+			}
+			if got := formatGraphQLFields(op.selections); got != tt.want {
+				t.Errorf("selections = %s, want %s", got, tt.want)
+			}
+			if tt.wantDefaults != nil && !reflect.DeepEqual(op.variableDefaults, tt.wantDefaults) {
+				t.Errorf("variable defaults = %v, want %v", op.variableDefaults, tt.wantDefaults)
+			}
+		})
+	}
+}
+
+func TestParseGraphQLOperationErrors(t *testing.T) {
+	for _, query := range []string{
+		``,
+		`{}`,
+		`{ a`,
+		`{ a(b: 1 }`,
+		`{ a(b: 1.5) }`,
+		`{ a(b: "x) }`,
+		`{ a(b: [1]) }`,
+		`{ ...F }`,
+		`fragment F on User { name }`,
+		`mutation { a }`,
+		`subscription { a }`,
+		`query @skip { a }`,
+		`{ a @include(if: true) }`,
+		`{ a: }`,
+		`{ 1a }`,
+		`query ($id) { a }`,
+		`query A { a } query B { b }`,
+		`{ a } }`,
+	} {
+		if _, err := parseGraphQLOperation(query, ""); err == nil {
+			t.Errorf("parseGraphQLOperation(%q) succeeded, want error", query)
+		}
+	}
+	if _, err := parseGraphQLOperation(`query A { a }`, "B"); err == nil {
+		t.Error("unknown operation name succeeded, want error")
+	}
+}
+
+func TestParseGraphQLOperationDepth(t *testing.T) {
+	nested := func(depth int) string {
+		return strings.Repeat("{a", depth) + strings.Repeat("}", depth)
+	}
+	if _, err := parseGraphQLOperation(nested(maxGraphQLSelectionDepth), ""); err != nil {
+		t.Errorf("depth %d: %v", maxGraphQLSelectionDepth, err)
+	}
+	if _, err := parseGraphQLOperation(nested(maxGraphQLSelectionDepth+1), ""); err == nil {
+		t.Errorf("depth %d succeeded, want error", maxGraphQLSelectionDepth+1)
+	}
+	// スタックを使い切る前に弾く
+	if _, err := parseGraphQLOperation(nested(1_000_000), ""); err == nil {
+		t.Error("deeply nested query succeeded, want error")
+	}
+}
+
+func TestGraphQLVariablesAndArgs(t *testing.T) {
+	op, err := parseGraphQLOperation(`query ($id: Int!, $limit: Int = 20) { livecomments(livestream_id: $id, limit: $limit, missing: $nope) { id } }`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	// JSONの変数はfloat64で来る
+	vars := op.variables(map[string]any{"id": float64(3), "extra": "ignored"})
+	if _, ok := vars["extra"]; ok {
+		t.Error("undefined variable was passed through")
+	}
+
+	field := op.selections[0]
+	if _, err := field.resolveArgs(vars); err == nil {
+		t.Error("resolveArgs succeeded with an undefined variable")
+	}
+	delete(field.args, "missing")
+	args, err := field.resolveArgs(vars)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if id, err := args.int64("livestream_id"); err != nil || id != 3 {
+		t.Errorf("livestream_id = %d, %v", id, err)
+	}
+	if limit, err := args.int64("limit"); err != nil || limit != 20 {
+		t.Errorf("limit = %d, %v", limit, err)
+	}
+
+	if _, err := (graphQLArgs{"a": 1.5}).int64("a"); err == nil {
+		t.Error("non-integer float was accepted as Int")
+	}
+	if _, err := (graphQLArgs{"a": "1"}).int64("a"); err == nil {
+		t.Error("string was accepted as Int")
+	}
+	if _, err := (graphQLArgs{}).string("a"); err == nil {
+		t.Error("missing required argument was accepted")
+	}
+	if (graphQLArgs{"a": nil}).has("a") {
+		t.Error("null argument is reported as present")
+	}
+}
+
+func TestSelectGraphQLFields(t *testing.T) {
+	op, err := parseGraphQLOperation(`{ user { display: display_name theme { dark_mode } missing } }`, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	var node any
+	dec := json.NewDecoder(strings.NewReader(`{"id": 1, "display_name": "Alice", "theme": {"id": 2, "dark_mode": true}}`))
+	dec.UseNumber()
+	if err := dec.Decode(&node); err != nil {
+		t.Fatal(err)
+	}
+
+	got, err := selectGraphQLFields(node, op.selections[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]any{
+		"display": "Alice",
+		"theme":   map[string]any{"dark_mode": true},
+		"missing": nil,
+	}
+	if !reflect.DeepEqual(got, want) {
+		t.Errorf("selected = %v, want %v", got, want)
+	}
+
+	// オブジェクトにはサブフィールドが、スカラーにはサブフィールドが無いことが必要
+	if _, err := selectGraphQLFields(map[string]any{"a": 1}, &graphQLField{name: "user"}); err == nil {
+		t.Error("object without selection succeeded")
+	}
+	if _, err := selectGraphQLFields("x", &graphQLField{name: "name", selections: []*graphQLField{{name: "a"}}}); err == nil {
+		t.Error("scalar with selection succeeded")
+	}
+}
@@ -0,0 +1,74 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync/atomic"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// readyzで各依存先の確認に使う時間の上限
+const readinessCheckTimeout = 1 * time.Second
+
+// 起動時・initialize時のキャッシュ読み込みが終わっているか
+var cachesReady atomic.Bool
+
+type ReadinessResponse struct {
+	Status string            `json:"status"`
+	Checks map[string]string `json:"checks"`
+}
+
+// プロセスが生きているか
+// GET /healthz
+func healthzHandler(c echo.Context) error {
+	return c.String(http.StatusOK, "ok")
+}
+
+// トラフィックを受けられる状態か (DB、PowerDNS、キャッシュ)
+// GET /readyz
+func (app *App) readyzHandler(c echo.Context) error {
+	ctx, cancel := context.WithTimeout(c.Request().Context(), readinessCheckTimeout)
+	defer cancel()
+
+	// 失敗の理由は内部の情報を含むのでレスポンスには出さず、errorResponseHandlerでログにだけ残す
+	var failed []string
+	var errs []error
+	if err := app.db.PingContext(ctx); err != nil {
+		failed = append(failed, "db")
+		errs = append(errs, fmt.Errorf("db: %w", err))
+	}
+	if err := app.powerDNS.Ping(ctx); err != nil {
+		failed = append(failed, "powerdns")
+		errs = append(errs, fmt.Errorf("powerdns: %w", err))
+	}
+	if !cachesReady.Load() {
+		failed = append(failed, "caches")
+		errs = append(errs, errors.New("caches: not initialized"))
+	}
+	if len(failed) > 0 {
+		return &codedHTTPError{
+			HTTPError: echo.NewHTTPError(http.StatusServiceUnavailable, "not ready: "+strings.Join(failed, ", ")).SetInternal(errors.Join(errs...)),
+			code:      errorCodeUnavailable,
+		}
+	}
+
+	return c.JSON(http.StatusOK, ReadinessResponse{
+		Status: "ok",
+		Checks: map[string]string{
+			"db":       "ok",
+			"powerdns": "ok",
+			"caches":   "ok",
+		},
+	})
+}
+
+// PowerDNSへのリクエストを止めているか
+// GET /api/debug/powerdns
+func (app *App) getPowerDNSStateHandler(c echo.Context) error {
+	return c.JSON(http.StatusOK, app.powerDNS.BreakerState())
+}
@@ -0,0 +1,162 @@
+package main
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"io"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// Idempotency-Keyヘッダ付きで再送されたリクエストには、処理し直さずに最初のレスポンスを返す
+// (ユーザ登録・配信予約の二重実行を防ぐ)
+// 成功したレスポンスだけを覚える。エラーの場合は同じキーでやり直せる
+const (
+	idempotencyKeyHeader = "Idempotency-Key"
+	// 再送されたレスポンスに付ける
+	idempotentReplayedHeader = "Idempotent-Replayed"
+
+	idempotencyKeyTTL       = 24 * time.Hour
+	maxIdempotencyKeyLength = 255
+	// 期限切れのキーを掃除する間隔
+	idempotencySweepPeriod = 1 * time.Minute
+)
+
+type idempotencyRecord struct {
+	// 同じキーで違うリクエストが来た場合に弾く
+	requestHash [sha256.Size]byte
+	// 処理中はfalse
+	done        bool
+	status      int
+	contentType string
+	body        []byte
+	expiresAt   time.Time
+}
+
+var (
+	IdempotencyRecordByKeyCache      = make(map[string]*idempotencyRecord)
+	IdempotencyRecordByKeyCacheMutex = sync.Mutex{}
+	idempotencyLastSweptAt           time.Time
+)
+
+func init() {
+	registerCacheReset(func() {
+		IdempotencyRecordByKeyCacheMutex.Lock()
+		defer IdempotencyRecordByKeyCacheMutex.Unlock()
+		IdempotencyRecordByKeyCache = make(map[string]*idempotencyRecord)
+	})
+}
+
+// レスポンスを書きながら本体を控える
+type idempotencyRecorder struct {
+	http.ResponseWriter
+	body bytes.Buffer
+}
+
+func (r *idempotencyRecorder) Write(b []byte) (int, error) {
+	r.body.Write(b)
+	return r.ResponseWriter.Write(b)
+}
+
+func idempotencyMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		key := c.Request().Header.Get(idempotencyKeyHeader)
+		if key == "" {
+			return next(c)
+		}
+		if len(key) > maxIdempotencyKeyLength {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "Idempotency-Key is too long")
+		}
+
+		body, err := io.ReadAll(c.Request().Body)
+		if err != nil {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidJSON, "failed to read the request body")
+		}
+		c.Request().Body = io.NopCloser(bytes.NewReader(body))
+
+		// 別のユーザのキーと混ざらないよう、ログイン中ならユーザIDも含める
+		cacheKey := c.Request().Method + " " + c.Path() + " "
+		if sess, err := session.Get(defaultSessionIDKey, c); err == nil {
+			if userID, ok := sess.Values[defaultUserIDKey].(int64); ok {
+				cacheKey += strconv.FormatInt(userID, 10)
+			}
+		}
+		cacheKey += " " + key
+		requestHash := sha256.Sum256(body)
+		now := time.Now()
+
+		IdempotencyRecordByKeyCacheMutex.Lock()
+		sweepIdempotencyRecords(now)
+		record, ok := IdempotencyRecordByKeyCache[cacheKey]
+		if ok && record.expiresAt.After(now) {
+			IdempotencyRecordByKeyCacheMutex.Unlock()
+			if record.requestHash != requestHash {
+				return newCodedHTTPError(http.StatusUnprocessableEntity, errorCodeIdempotencyKeyReused, "Idempotency-Key was already used for a different request")
+			}
+			if !record.done {
+				return newCodedHTTPError(http.StatusConflict, errorCodeIdempotencyKeyInProgress, "a request with the same Idempotency-Key is in progress")
+			}
+			c.Response().Header().Set(idempotentReplayedHeader, "true")
+			return c.Blob(record.status, record.contentType, record.body)
+		}
+		record = &idempotencyRecord{
+			requestHash: requestHash,
+			expiresAt:   now.Add(idempotencyKeyTTL),
+		}
+		IdempotencyRecordByKeyCache[cacheKey] = record
+		IdempotencyRecordByKeyCacheMutex.Unlock()
+
+		res := c.Response()
+		recorder := &idempotencyRecorder{ResponseWriter: res.Writer}
+		res.Writer = recorder
+		// 完了として記録しなかった場合 (エラーやpanicを含む) はキーを解放し、同じキーでやり直せるようにする
+		defer func() {
+			res.Writer = recorder.ResponseWriter
+
+			IdempotencyRecordByKeyCacheMutex.Lock()
+			defer IdempotencyRecordByKeyCacheMutex.Unlock()
+			// initializeで消された後なら触らない
+			if !record.done && IdempotencyRecordByKeyCache[cacheKey] == record {
+				delete(IdempotencyRecordByKeyCache, cacheKey)
+			}
+		}()
+
+		if err := next(c); err != nil {
+			return err
+		}
+		if res.Status < 200 || res.Status >= 300 {
+			return nil
+		}
+
+		IdempotencyRecordByKeyCacheMutex.Lock()
+		defer IdempotencyRecordByKeyCacheMutex.Unlock()
+		// initializeで消された後なら覚え直さない
+		if IdempotencyRecordByKeyCache[cacheKey] != record {
+			return nil
+		}
+		record.done = true
+		record.status = res.Status
+		record.contentType = res.Header().Get(echo.HeaderContentType)
+		record.body = recorder.body.Bytes()
+		return nil
+	}
+}
+
+// IdempotencyRecordByKeyCacheMutexを取った状態で呼ぶ
+func sweepIdempotencyRecords(now time.Time) {
+	if now.Sub(idempotencyLastSweptAt) < idempotencySweepPeriod {
+		return
+	}
+	idempotencyLastSweptAt = now
+	for key, record := range IdempotencyRecordByKeyCache {
+		// 処理中のまま残ったものも期限が来たら消す
+		if !record.expiresAt.After(now) {
+			delete(IdempotencyRecordByKeyCache, key)
+		}
+	}
+}
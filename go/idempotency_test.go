@@ -0,0 +1,55 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func newIdempotentRequest(e *echo.Echo, key string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(http.MethodPost, "/api/test", strings.NewReader(`{}`))
+	req.Header.Set(idempotencyKeyHeader, key)
+	rec := httptest.NewRecorder()
+	return e.NewContext(req, rec), rec
+}
+
+// panicしてもキーは処理中のまま残らず、同じキーでやり直せる
+func TestIdempotencyMiddlewareReleasesKeyOnPanic(t *testing.T) {
+	e := echo.New()
+	const key = "panic-key"
+
+	panicking := idempotencyMiddleware(func(c echo.Context) error {
+		panic("boom")
+	})
+	c, _ := newIdempotentRequest(e, key)
+	func() {
+		defer func() {
+			if recover() == nil {
+				t.Fatal("handler did not panic")
+			}
+		}()
+		panicking(c)
+	}()
+
+	calls := 0
+	ok := idempotencyMiddleware(func(c echo.Context) error {
+		calls++
+		return c.String(http.StatusCreated, "created")
+	})
+	for i := 0; i < 2; i++ {
+		c, rec := newIdempotentRequest(e, key)
+		if err := ok(c); err != nil {
+			t.Fatalf("retry %d: %v", i, err)
+		}
+		if rec.Code != http.StatusCreated || rec.Body.String() != "created" {
+			t.Errorf("retry %d: got %d %q", i, rec.Code, rec.Body.String())
+		}
+	}
+	// 2回目は最初のレスポンスを返す
+	if calls != 1 {
+		t.Errorf("handler called %d times, want 1", calls)
+	}
+}
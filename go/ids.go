@@ -0,0 +1,10 @@
+package main
+
+// 取り違えてもコンパイルが通らないよう、エンティティごとにIDの型を分ける
+// (以前、ユーザIDを渡すべきキャッシュのキーに配信IDを渡していた)
+// DB・JSON・セッション上の表現はどれもint64のまま
+type (
+	UserID        int64
+	LivestreamID  int64
+	LivecommentID int64
+)
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 重いエンドポイントに同時に処理するリクエスト数の上限を設ける
+// アイコンや統計に大量のリクエストが来てもDBのコネクションを使い切らず、ログインなどの軽いAPIが待たされないようにする
+// 上限を超えたリクエストは待たせずに503で返す
+const (
+	// 上限を超えたときにRetry-Afterで返す秒数
+	inFlightRetryAfterSeconds = 1
+)
+
+// 統計はGraphQLからも引けるので、RESTのルートとGraphQLのフィールドで上限を共有する
+// ルートの登録前にinitInFlightLimitersで設定に合わせて作り直す
+var (
+	iconInFlight                 inFlightLimiter
+	iconUploadInFlight           inFlightLimiter
+	userStatisticsInFlight       inFlightLimiter
+	livestreamStatisticsInFlight inFlightLimiter
+)
+
+func init() {
+	initInFlightLimiters(defaultInFlightLimits(defaultMySQLMaxOpenConns))
+}
+
+func initInFlightLimiters(iconLimit, statsLimit int) {
+	iconInFlight = newInFlightLimiter(iconLimit)
+	iconUploadInFlight = newInFlightLimiter(iconLimit)
+	userStatisticsInFlight = newInFlightLimiter(statsLimit)
+	livestreamStatisticsInFlight = newInFlightLimiter(statsLimit)
+}
+
+// コネクションの4割ほどを重いエンドポイントに回し、残りを軽いAPIに残す
+func defaultInFlightLimits(maxOpenConns int) (iconLimit, statsLimit int) {
+	return max(1, maxOpenConns/5), max(1, maxOpenConns/10)
+}
+
+// アイコンと統計はそれぞれ2つのリミッタを持つ
+func inFlightLimitTotal(iconLimit, statsLimit int) int {
+	return 2*iconLimit + 2*statsLimit
+}
+
+type inFlightLimiter chan struct{}
+
+func newInFlightLimiter(limit int) inFlightLimiter {
+	return make(inFlightLimiter, limit)
+}
+
+// 空きが無ければ待たずにfalseを返す。trueならreleaseすること
+func (l inFlightLimiter) tryAcquire() bool {
+	select {
+	case l <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (l inFlightLimiter) release() {
+	<-l
+}
+
+func (l inFlightLimiter) middleware() echo.MiddlewareFunc {
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		return func(c echo.Context) error {
+			if !l.tryAcquire() {
+				return inFlightBusyError(c)
+			}
+			defer l.release()
+			return next(c)
+		}
+	}
+}
+
+// ハンドラの途中でtryAcquireに失敗したときもミドルウェアと同じレスポンスにする
+func inFlightBusyError(c echo.Context) error {
+	c.Response().Header().Set(echo.HeaderRetryAfter, strconv.Itoa(inFlightRetryAfterSeconds))
+	return newCodedHTTPError(http.StatusServiceUnavailable, errorCodeServerBusy, "too many requests in flight")
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"sync"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	initSQLDir             = "../sql"
+	initZoneScript         = "../pdns/init_zone.sh"
+	defaultInitParallelism = 4
+)
+
+// init.sqlで空にした後に流し込む初期データ。テーブル間に外部キーは無いので並列に入れてよい
+var initialDataFiles = []string{
+	"initial_users.sql",
+	"initial_livestreams.sql",
+	"initial_tags.sql",
+	"initial_livestream_tags.sql",
+	"initial_reservation_slots.sql",
+	"initial_reactions.sql",
+	"initial_ngwords.sql",
+	"initial_livecomments.sql",
+}
+
+var (
+	// 初期データのSQLファイルを1回のExecで流すため、multiStatementsを有効にした別の接続を使う
+	initDBConn      *sqlx.DB
+	initParallelism = defaultInitParallelism
+)
+
+func connectInitDB(conf *mysql.Config, parallelism int) (*sqlx.DB, error) {
+	conf = conf.Clone()
+	conf.MultiStatements = true
+
+	db, err := sqlx.Open("mysql", conf.FormatDSN())
+	if err != nil {
+		return nil, err
+	}
+	db.SetMaxOpenConns(parallelism)
+	db.SetMaxIdleConns(parallelism)
+
+	if err := db.Ping(); err != nil {
+		return nil, err
+	}
+
+	return db, nil
+}
+
+// init.shの代わりにDBとDNSのゾーンを初期状態に戻す
+func resetDatabase(ctx context.Context) error {
+	// 全テーブルを空にしてから読み込む
+	if err := execSQLFile(ctx, "init.sql"); err != nil {
+		return err
+	}
+
+	jobs := make([]func(ctx context.Context) error, 0, len(initialDataFiles)+1)
+	for _, name := range initialDataFiles {
+		jobs = append(jobs, func(ctx context.Context) error {
+			return execSQLFile(ctx, name)
+		})
+	}
+	jobs = append(jobs, func(ctx context.Context) error {
+		if out, err := exec.CommandContext(ctx, initZoneScript).CombinedOutput(); err != nil {
+			return fmt.Errorf("failed to run init_zone.sh: %w: %s", err, string(out))
+		}
+		return nil
+	})
+
+	return runParallel(ctx, initParallelism, jobs)
+}
+
+func execSQLFile(ctx context.Context, name string) error {
+	b, err := os.ReadFile(filepath.Join(initSQLDir, name))
+	if err != nil {
+		return fmt.Errorf("failed to read %s: %w", name, err)
+	}
+	if _, err := initDBConn.ExecContext(ctx, string(b)); err != nil {
+		return fmt.Errorf("failed to exec %s: %w", name, err)
+	}
+	return nil
+}
+
+// 同時にparallelism個までjobsを実行し、最初のエラーを返す。エラーが出たら残りは中断する
+func runParallel(ctx context.Context, parallelism int, jobs []func(ctx context.Context) error) error {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	var (
+		wg       sync.WaitGroup
+		once     sync.Once
+		firstErr error
+	)
+	sem := make(chan struct{}, parallelism)
+	for _, job := range jobs {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			select {
+			case sem <- struct{}{}:
+			case <-ctx.Done():
+				return
+			}
+			defer func() { <-sem }()
+
+			if err := job(ctx); err != nil {
+				once.Do(func() {
+					firstErr = err
+					cancel()
+				})
+			}
+		}()
+	}
+	wg.Wait()
+
+	if firstErr != nil {
+		return firstErr
+	}
+	return ctx.Err()
+}
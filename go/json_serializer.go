@@ -0,0 +1,53 @@
+package main
+
+import (
+	"encoding/json"
+
+	gojson "github.com/goccy/go-json"
+	"github.com/labstack/echo/v4"
+)
+
+// レスポンスのエンコードとリクエストボディのデコードに使うシリアライザ
+var jsonSerializer echo.JSONSerializer = stdJSONSerializer{}
+
+// encoding/jsonを使う。エラーはechoのデフォルトと違いHTTPErrorに包まずに返す
+type stdJSONSerializer struct{}
+
+func (stdJSONSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	enc := json.NewEncoder(c.Response())
+	if indent != "" {
+		enc.SetIndent("", indent)
+	}
+	return enc.Encode(i)
+}
+
+func (stdJSONSerializer) Deserialize(c echo.Context, i interface{}) error {
+	return json.NewDecoder(c.Request().Body).Decode(i)
+}
+
+// goccy/go-jsonを使う。encoding/jsonと互換でリフレクションのコストが小さい
+type goccyJSONSerializer struct{}
+
+func (goccyJSONSerializer) Serialize(c echo.Context, i interface{}, indent string) error {
+	enc := gojson.NewEncoder(c.Response())
+	if indent != "" {
+		enc.SetIndent("", indent)
+	}
+	return enc.Encode(i)
+}
+
+func (goccyJSONSerializer) Deserialize(c echo.Context, i interface{}) error {
+	return gojson.NewDecoder(c.Request().Body).Decode(i)
+}
+
+// 組み立てたレスポンスを使い回す場合に、設定されたシリアライザと同じライブラリでエンコードする
+func marshalJSON(v interface{}) ([]byte, error) {
+	if _, ok := jsonSerializer.(goccyJSONSerializer); ok {
+		return gojson.Marshal(v)
+	}
+	return json.Marshal(v)
+}
+
+func decodeJSONBody(c echo.Context, v interface{}) error {
+	return jsonSerializer.Deserialize(c, v)
+}
@@ -3,10 +3,11 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
+	"encoding/csv"
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
 	"strconv"
 	"strings"
 	"time"
@@ -16,27 +17,41 @@ import (
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	// 一括登録で受け付けるNGワードの最大数
+	maxBulkNGWords = 1000
+	// ライブコメント検索でlimit未指定時に返す件数
+	defaultLivecommentSearchLimit = 100
+)
+
 type PostLivecommentRequest struct {
-	Comment string `json:"comment"`
-	Tip     int64  `json:"tip"`
+	Comment string `json:"comment" validate:"max=255"`
+	Tip     int64  `json:"tip" validate:"min=0"`
 }
 
 type LivecommentModel struct {
-	ID           int64  `db:"id"`
-	UserID       int64  `db:"user_id"`
-	LivestreamID int64  `db:"livestream_id"`
-	Comment      string `db:"comment"`
-	Tip          int64  `db:"tip"`
-	CreatedAt    int64  `db:"created_at"`
+	ID           LivecommentID `db:"id"`
+	UserID       UserID        `db:"user_id"`
+	LivestreamID LivestreamID  `db:"livestream_id"`
+	Comment      string        `db:"comment"`
+	Tip          int64         `db:"tip"`
+	CreatedAt    int64         `db:"created_at"`
+	// モデレーションで削除された場合のみ値が入る
+	DeletedAt     *int64  `db:"deleted_at"`
+	DeletedNGWord *string `db:"deleted_ng_word"`
 }
 
 type Livecomment struct {
-	ID         int64      `json:"id"`
-	User       User       `json:"user"`
-	Livestream Livestream `json:"livestream"`
-	Comment    string     `json:"comment"`
-	Tip        int64      `json:"tip"`
-	CreatedAt  int64      `json:"created_at"`
+	ID         LivecommentID `json:"id"`
+	User       User          `json:"user"`
+	Livestream Livestream    `json:"livestream"`
+	Comment    string        `json:"comment"`
+	Tip        int64         `json:"tip"`
+	// チップ額の区分 (チップ無しの場合は空)
+	TipTier   string `json:"tip_tier,omitempty"`
+	CreatedAt int64  `json:"created_at"`
+	// コメント中の :emote: を解決したもの
+	Emotes []Emote `json:"emotes,omitempty"`
 }
 
 type LivecommentReport struct {
@@ -46,24 +61,43 @@ type LivecommentReport struct {
 	CreatedAt   int64       `json:"created_at"`
 }
 
+type LivecommentReportsResponse struct {
+	LivecommentID LivecommentID       `json:"livecomment_id"`
+	ReportCount   int64               `json:"report_count"`
+	Reports       []LivecommentReport `json:"reports"`
+}
+
 type LivecommentReportModel struct {
-	ID            int64 `db:"id"`
-	UserID        int64 `db:"user_id"`
-	LivestreamID  int64 `db:"livestream_id"`
-	LivecommentID int64 `db:"livecomment_id"`
-	CreatedAt     int64 `db:"created_at"`
+	ID            int64         `db:"id"`
+	UserID        UserID        `db:"user_id"`
+	LivestreamID  LivestreamID  `db:"livestream_id"`
+	LivecommentID LivecommentID `db:"livecomment_id"`
+	CreatedAt     int64         `db:"created_at"`
 }
 
 type ModerateRequest struct {
 	NGWord string `json:"ng_word"`
 }
 
+type DeleteLivecommentsRequest struct {
+	LivecommentIDs []LivecommentID `json:"livecomment_ids"`
+}
+
+type DeleteLivecommentsResponse struct {
+	// 実際に削除されたライブコメントのID
+	LivecommentIDs []LivecommentID `json:"livecomment_ids"`
+}
+
+type ModerateBulkRequest struct {
+	NGWords []string `json:"ng_words"`
+}
+
 type NGWord struct {
-	ID           int64  `json:"id" db:"id"`
-	UserID       int64  `json:"user_id" db:"user_id"`
-	LivestreamID int64  `json:"livestream_id" db:"livestream_id"`
-	Word         string `json:"word" db:"word"`
-	CreatedAt    int64  `json:"created_at" db:"created_at"`
+	ID           int64        `json:"id" db:"id"`
+	UserID       UserID       `json:"user_id" db:"user_id"`
+	LivestreamID LivestreamID `json:"livestream_id" db:"livestream_id"`
+	Word         string       `json:"word" db:"word"`
+	CreatedAt    int64        `json:"created_at" db:"created_at"`
 }
 
 func getLivecommentsHandler(c echo.Context) error {
@@ -74,9 +108,14 @@ func getLivecommentsHandler(c echo.Context) error {
 		return err
 	}
 
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -85,23 +124,70 @@ func getLivecommentsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM livecomments WHERE livestream_id = ? ORDER BY created_at DESC"
+	// 主キーをカーソルにしてページングする
+	// after_idはポーリング用。取りこぼさないよう古い順に取ってから、返すときは他と同じ新しい順に並べ替える
+	// ブロックしているユーザのものはLIMITより前にSQLで除く
+	query := "SELECT * FROM livecomments WHERE livestream_id = ? AND deleted_at IS NULL" + notBlockedCondition
+	args := []interface{}{livestreamID, userID}
+	afterIDGiven := c.QueryParam("after_id") != ""
+	if afterIDGiven {
+		afterID, err := strconv.ParseInt(c.QueryParam("after_id"), 10, 64)
+		if err != nil {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "after_id query parameter must be integer")
+		}
+		query += " AND id > ?"
+		args = append(args, afterID)
+	}
+	if c.QueryParam("before_id") != "" {
+		beforeID, err := strconv.ParseInt(c.QueryParam("before_id"), 10, 64)
+		if err != nil {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "before_id query parameter must be integer")
+		}
+		query += " AND id < ?"
+		args = append(args, beforeID)
+	}
+	// ページングする場合はカーソルと同じidで並べる (created_atは同じ秒の投稿や初期データで重なり、ページがずれる)
+	switch {
+	case afterIDGiven:
+		query += " ORDER BY id ASC"
+	case c.QueryParam("before_id") != "" || c.QueryParam("limit") != "":
+		query += " ORDER BY id DESC"
+	default:
+		query += " ORDER BY created_at DESC"
+	}
+	limit := 0
 	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
 		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "limit query parameter must be integer")
+		}
+		if limit > 0 {
+			// 続きがあるか判定するため1件多く取る
+			query += fmt.Sprintf(" LIMIT %d", limit+1)
+		} else {
+			query += fmt.Sprintf(" LIMIT %d", limit)
 		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
 	}
 
 	livecommentModels := []*LivecommentModel{}
-	err = tx.SelectContext(ctx, &livecommentModels, query, livestreamID)
+	err = tx.SelectContext(ctx, &livecommentModels, query, args...)
 	if errors.Is(err, sql.ErrNoRows) {
-		return c.JSON(http.StatusOK, []*Livecomment{})
+		return respondNegotiated(c, http.StatusOK, []*Livecomment{})
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 	}
+	page := pageInfo{total: -1, cursorParam: "before_id"}
+	if limit > 0 && len(livecommentModels) > limit {
+		livecommentModels = livecommentModels[:limit]
+		page.nextCursor = strconv.FormatInt(int64(livecommentModels[limit-1].ID), 10)
+		if afterIDGiven {
+			page.cursorParam = "after_id"
+		}
+	}
+	if afterIDGiven {
+		slices.Reverse(livecommentModels)
+	}
 
 	livecomments, err := fillLivecommentResponseBulk(ctx, tx, livecommentModels)
 	if err != nil {
@@ -112,69 +198,120 @@ func getLivecommentsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livecomments)
+	setPageHeaders(c, page)
+	return respondNegotiated(c, http.StatusOK, livecomments)
 }
 
-func getNgwords(c echo.Context) error {
+// ライブコメント検索
+// GET /api/livestream/:livestream_id/livecomment/search?q=&min_tip=&max_tip=&limit=
+func searchLivecommentsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
 	}
 
+	// livestream_idのインデックスで配信を絞ってから部分一致で探す
+	query := "SELECT * FROM livecomments WHERE livestream_id = ? AND deleted_at IS NULL" + notBlockedCondition
+	args := []interface{}{livestreamID, userID}
+	if q := c.QueryParam("q"); q != "" {
+		query += " AND comment LIKE ?"
+		args = append(args, "%"+escapeLikePattern(q)+"%")
+	}
+	if c.QueryParam("min_tip") != "" {
+		minTip, err := strconv.ParseInt(c.QueryParam("min_tip"), 10, 64)
+		if err != nil {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "min_tip query parameter must be integer")
+		}
+		query += " AND tip >= ?"
+		args = append(args, minTip)
+	}
+	if c.QueryParam("max_tip") != "" {
+		maxTip, err := strconv.ParseInt(c.QueryParam("max_tip"), 10, 64)
+		if err != nil {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "max_tip query parameter must be integer")
+		}
+		query += " AND tip <= ?"
+		args = append(args, maxTip)
+	}
+	limit := defaultLivecommentSearchLimit
+	if c.QueryParam("limit") != "" {
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
+		if err != nil {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "limit query parameter must be integer")
+		}
+	}
+	query += fmt.Sprintf(" ORDER BY id DESC LIMIT %d", limit)
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	var ngWords []*NGWord
-	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC", userID, livestreamID); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return c.JSON(http.StatusOK, []*NGWord{})
-		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
-		}
+	livecommentModels := []*LivecommentModel{}
+	if err := tx.SelectContext(ctx, &livecommentModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to search livecomments: "+err.Error())
+	}
+
+	livecomments, err := fillLivecommentResponseBulk(ctx, tx, livecommentModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomments: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, ngWords)
+	return respondNegotiated(c, http.StatusOK, livecomments)
 }
 
-func postLivecommentHandler(c echo.Context) error {
-	ctx := c.Request().Context()
-	defer c.Request().Body.Close()
+func escapeLikePattern(s string) string {
+	return strings.NewReplacer(`\`, `\\`, "%", `\%`, "_", `\_`).Replace(s)
+}
 
+// ライブコメントのSSEストリーム
+// GET /api/livestream/:livestream_id/livecomment/stream
+func streamLivecommentsHandler(c echo.Context) error {
 	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	return serveLivestreamEventStream(c, LivestreamID(livestreamID), livestreamEventLivecomment, livestreamEventLivecommentDeleted)
+}
+
+func getNgwords(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
 	}
 
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
 
-	var req *PostLivecommentRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -183,60 +320,99 @@ func postLivecommentHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	// 共同配信者には配信者のNGワードを見せる
+	ngWordOwnerID := userID
 	var livestreamModel LivestreamModel
 	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if !errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	} else if ok, err := canModerateLivestream(ctx, tx, livestreamModel, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborators: "+err.Error())
+	} else if ok {
+		ngWordOwnerID = livestreamModel.UserID
+	}
+
+	var ngWords []*NGWord
+	if err := tx.SelectContext(ctx, &ngWords, "SELECT * FROM ng_words WHERE user_id = ? AND livestream_id = ? ORDER BY created_at DESC", ngWordOwnerID, livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			return c.JSON(http.StatusOK, []*NGWord{})
 		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
 		}
 	}
 
-	// スパム判定
-	var ngwords []*NGWord
-	if err := tx.SelectContext(ctx, &ngwords, "SELECT id, user_id, livestream_id, word FROM ng_words WHERE user_id = ? AND livestream_id = ?", livestreamModel.UserID, livestreamModel.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	for _, ngword := range ngwords {
-		if strings.Contains(req.Comment, ngword.Word) {
-			return echo.NewHTTPError(http.StatusBadRequest, "このコメントがスパム判定されました")
-		}
+	return c.JSON(http.StatusOK, ngWords)
+}
+
+func (app *App) postLivecommentHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := app.verifyUserSession(c); err != nil {
+		return err
 	}
 
-	now := time.Now().Unix()
-	livecommentModel := LivecommentModel{
-		UserID:       userID,
-		LivestreamID: int64(livestreamID),
-		Comment:      req.Comment,
-		Tip:          req.Tip,
-		CreatedAt:    now,
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
 	}
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :created_at)", livecommentModel)
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	var req PostLivecommentRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	livecomment, err := app.livecommentService.Post(ctx, userID, LivestreamID(livestreamID), req)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment: "+err.Error())
+		return serviceHTTPError(err)
+	}
+
+	return c.JSON(http.StatusCreated, livecomment)
+}
+
+func (app *App) reportLivecommentHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := app.verifyUserSession(c); err != nil {
+		return err
 	}
 
-	livecommentID, err := rs.LastInsertId()
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment id: "+err.Error())
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
 	}
-	livecommentModel.ID = livecommentID
 
-	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
+	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment: "+err.Error())
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livecomment_id in path must be integer")
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	report, err := app.livecommentService.Report(ctx, userID, LivestreamID(livestreamID), LivecommentID(livecommentID))
+	if err != nil {
+		return serviceHTTPError(err)
 	}
 
-	return c.JSON(http.StatusCreated, livecomment)
+	return c.JSON(http.StatusCreated, report)
 }
 
-func reportLivecommentHandler(c echo.Context) error {
+// ライブコメントごとの報告一覧と報告数 (配信者向け)
+// GET /api/livestream/:livestream_id/livecomment/:livecomment_id/reports
+func getLivecommentReportsByLivecommentHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	if err := verifyUserSession(c); err != nil {
@@ -245,18 +421,18 @@ func reportLivecommentHandler(c echo.Context) error {
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
 	}
 
 	livecommentID, err := strconv.Atoi(c.Param("livecomment_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_id in path must be integer")
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livecomment_id in path must be integer")
 	}
 
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -267,47 +443,51 @@ func reportLivecommentHandler(c echo.Context) error {
 	var livestreamModel LivestreamModel
 	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "livestream not found")
+			return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "livestream not found")
 		} else {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 		}
 	}
 
+	if ok, err := canModerateLivestream(ctx, tx, livestreamModel, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborators: "+err.Error())
+	} else if !ok {
+		return newCodedHTTPError(http.StatusForbidden, errorCodeNotLivestreamOwner, "can't get other streamer's livecomment reports")
+	}
+
 	var livecommentModel LivecommentModel
-	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ?", livecommentID); err != nil {
+	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? AND livestream_id = ?", livecommentID, livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "livecomment not found")
+			return newCodedHTTPError(http.StatusNotFound, errorCodeLivecommentNotFound, "livecomment not found")
 		} else {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment: "+err.Error())
 		}
 	}
 
-	now := time.Now().Unix()
-	reportModel := LivecommentReportModel{
-		UserID:        int64(userID),
-		LivestreamID:  int64(livestreamID),
-		LivecommentID: int64(livecommentID),
-		CreatedAt:     now,
-	}
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :created_at)", &reportModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livecomment report: "+err.Error())
+	var reportModels []*LivecommentReportModel
+	if err := tx.SelectContext(ctx, &reportModels, "SELECT * FROM livecomment_reports WHERE livecomment_id = ? ORDER BY id DESC", livecommentID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment reports: "+err.Error())
 	}
-	reportID, err := rs.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livecomment report id: "+err.Error())
-	}
-	reportModel.ID = reportID
 
-	report, err := fillLivecommentReportResponse(ctx, tx, reportModel)
+	reports, err := fillLivecommentReportResponseBulk(ctx, tx, reportModels)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livecomment report: "+err.Error())
 	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, report)
+	reportCount, err := getLivecommentReportCount(ctx, LivecommentID(livecommentID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livecomment reports: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, &LivecommentReportsResponse{
+		LivecommentID: LivecommentID(livecommentID),
+		ReportCount:   reportCount,
+		Reports:       reports,
+	})
 }
 
 // NGワードを登録
@@ -321,37 +501,53 @@ func moderateHandler(c echo.Context) error {
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
 	}
 
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
 
 	var req *ModerateRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	if err := decodeJSONBody(c, &req); err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidJSON, "failed to decode the request body as json")
 	}
 
+	// コミットしてからキューが詰まっていると過去のコメントを遡れないので、先に空きを確保する
+	reservation, err := reserveRetroactiveModeration(ctx)
+	if err != nil {
+		if errors.Is(err, errRetroactiveModerationQueueFull) {
+			return newRetryAfterHTTPError(http.StatusServiceUnavailable, errorCodeServerBusy, "too many NG words are being applied, retry later", retroactiveModerationReserveTimeout)
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reserve retroactive moderation: "+err.Error())
+	}
+	defer reservation.release()
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	// 配信者自身の配信に対するmoderateなのかを検証
-	var ownedLivestreams []LivestreamModel
-	if err := tx.SelectContext(ctx, &ownedLivestreams, "SELECT * FROM livestreams WHERE id = ? AND user_id = ?", livestreamID, userID); err != nil {
+	// 配信者自身 (または共同配信者) の配信に対するmoderateなのかを検証
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeNotLivestreamOwner, "A streamer can't moderate livestreams that other streamers own")
+		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
-	if len(ownedLivestreams) == 0 {
-		return echo.NewHTTPError(http.StatusBadRequest, "A streamer can't moderate livestreams that other streamers own")
+	if ok, err := canModerateLivestream(ctx, tx, livestreamModel, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborators: "+err.Error())
+	} else if !ok {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeNotLivestreamOwner, "A streamer can't moderate livestreams that other streamers own")
 	}
 
+	// 共同配信者が追加した場合も配信者のNGワードとして登録する
 	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", &NGWord{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
+		UserID:       livestreamModel.UserID,
+		LivestreamID: LivestreamID(livestreamID),
 		Word:         req.NGWord,
 		CreatedAt:    time.Now().Unix(),
 	})
@@ -364,42 +560,314 @@ func moderateHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word id: "+err.Error())
 	}
 
-	var ngwords []*NGWord
-	if err := tx.SelectContext(ctx, &ngwords, "SELECT * FROM ng_words WHERE livestream_id = ?", livestreamID); err != nil {
+	matcher, err := loadNGWordMatcher(ctx, tx, livestreamModel.UserID, LivestreamID(livestreamID))
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
 	}
 
-	// NGワードにヒットする過去の投稿も全削除する
-	var livecomments []*LivecommentModel
-	if err := tx.SelectContext(ctx, &livecomments, "SELECT * FROM livecomments WHERE livestream_id = ?", livestreamID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	// アプリ側でNGワードにヒットするコメントを削除する
-	var deletedLivecommentsIDs []int64
-	for _, livecomment := range livecomments {
-		if strings.Contains(livecomment.Comment, req.NGWord) {
-			deletedLivecommentsIDs = append(deletedLivecommentsIDs, livecomment.ID)
-		}
+	setNGWordMatcherCache(LivestreamID(livestreamID), matcher)
+
+	moderationLog := newModerationLog(LivestreamID(livestreamID), userID, moderationActionNGWordAdded)
+	moderationLog.NGWord = sql.NullString{String: req.NGWord, Valid: true}
+	enqueueModerationLogs(moderationLog)
+
+	// 新規コメントは投稿時に弾いているので、過去の投稿は今回追加したNGワードだけで遡ればよい
+	// 削除はワーカーに任せる
+	reservation.enqueue(RetroactiveModerationJob{
+		LivestreamID: LivestreamID(livestreamID),
+		Matcher:      NewNGWordMatcher([]string{req.NGWord}),
+	})
+
+	return c.JSON(http.StatusCreated, map[string]interface{}{
+		"word_id": wordID,
+	})
+}
+
+// NGワードを一括登録
+// application/json では {"ng_words": [...]}、text/csv では各行の1列目をNGワードとして扱う
+func moderateBulkHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
 	}
 
-	if len(deletedLivecommentsIDs) > 0 {
-		query, args, err := sqlx.In("DELETE FROM livecomments WHERE id IN (?)", deletedLivecommentsIDs)
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	var words []string
+	if strings.HasPrefix(c.Request().Header.Get(echo.HeaderContentType), "text/csv") {
+		records, err := csv.NewReader(c.Request().Body).ReadAll()
 		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "failed to parse the request body as csv")
+		}
+		for _, record := range records {
+			if len(record) > 0 {
+				words = append(words, record[0])
+			}
 		}
-		query = tx.Rebind(query)
-		if _, err := tx.ExecContext(ctx, query, args...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old livecomments that hit spams: "+err.Error())
+	} else {
+		var req ModerateBulkRequest
+		if err := decodeJSONBody(c, &req); err != nil {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidJSON, "failed to decode the request body as json")
 		}
+		words = req.NGWords
+	}
+
+	// 空文字と重複を除く
+	seen := make(map[string]struct{}, len(words))
+	uniqueWords := make([]string, 0, len(words))
+	for _, word := range words {
+		word = strings.TrimSpace(word)
+		if word == "" {
+			continue
+		}
+		if _, ok := seen[word]; ok {
+			continue
+		}
+		seen[word] = struct{}{}
+		uniqueWords = append(uniqueWords, word)
+	}
+	if len(uniqueWords) == 0 {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "no NG words are given")
+	}
+	if len(uniqueWords) > maxBulkNGWords {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, fmt.Sprintf("too many NG words (max %d)", maxBulkNGWords))
+	}
+
+	// コミットしてからキューが詰まっていると過去のコメントを遡れないので、先に空きを確保する
+	reservation, err := reserveRetroactiveModeration(ctx)
+	if err != nil {
+		if errors.Is(err, errRetroactiveModerationQueueFull) {
+			return newRetryAfterHTTPError(http.StatusServiceUnavailable, errorCodeServerBusy, "too many NG words are being applied, retry later", retroactiveModerationReserveTimeout)
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to reserve retroactive moderation: "+err.Error())
+	}
+	defer reservation.release()
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 配信者自身 (または共同配信者) の配信に対するmoderateなのかを検証
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeNotLivestreamOwner, "A streamer can't moderate livestreams that other streamers own")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	if ok, err := canModerateLivestream(ctx, tx, livestreamModel, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborators: "+err.Error())
+	} else if !ok {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeNotLivestreamOwner, "A streamer can't moderate livestreams that other streamers own")
+	}
+
+	now := time.Now().Unix()
+	ngWords := make([]*NGWord, len(uniqueWords))
+	for i, word := range uniqueWords {
+		ngWords[i] = &NGWord{
+			UserID:       livestreamModel.UserID,
+			LivestreamID: LivestreamID(livestreamID),
+			Word:         word,
+			CreatedAt:    now,
+		}
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO ng_words(user_id, livestream_id, word, created_at) VALUES (:user_id, :livestream_id, :word, :created_at)", ngWords)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new NG words: "+err.Error())
+	}
+
+	// innodb_autoinc_lock_mode=2では複数行INSERTのIDが連番とは限らないので、登録した行を引き直す
+	// LAST_INSERT_IDは先頭行のIDで、今回の行はすべてそれ以上になる (同じワードの既存の行を除く)
+	firstWordID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted NG word id: "+err.Error())
+	}
+	query, args, err := sqlx.In("SELECT id, word FROM ng_words WHERE livestream_id = ? AND word IN (?) AND id >= ?", livestreamID, uniqueWords, firstWordID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var insertedWords []*NGWord
+	if err := tx.SelectContext(ctx, &insertedWords, tx.Rebind(query), args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get inserted NG words: "+err.Error())
+	}
+	wordIDByWord := make(map[string]int64, len(insertedWords))
+	for _, w := range insertedWords {
+		wordIDByWord[w.Word] = w.ID
+	}
+	wordIDs := make([]int64, len(uniqueWords))
+	for i, word := range uniqueWords {
+		id, ok := wordIDByWord[word]
+		if !ok {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get inserted NG word id: "+word)
+		}
+		wordIDs[i] = id
+	}
+
+	matcher, err := loadNGWordMatcher(ctx, tx, livestreamModel.UserID, LivestreamID(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get NG words: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	setNGWordMatcherCache(LivestreamID(livestreamID), matcher)
+
+	moderationLogs := make([]ModerationLogModel, len(uniqueWords))
+	for i, word := range uniqueWords {
+		moderationLogs[i] = newModerationLog(LivestreamID(livestreamID), userID, moderationActionNGWordAdded)
+		moderationLogs[i].NGWord = sql.NullString{String: word, Valid: true}
+	}
+	enqueueModerationLogs(moderationLogs...)
+
+	// 新規コメントは投稿時に弾いているので、過去の投稿は今回追加したNGワードだけで遡ればよい
+	// 削除はワーカーに任せる
+	reservation.enqueue(RetroactiveModerationJob{
+		LivestreamID: LivestreamID(livestreamID),
+		Matcher:      NewNGWordMatcher(uniqueWords),
+	})
+
 	return c.JSON(http.StatusCreated, map[string]interface{}{
-		"word_id": wordID,
+		"word_ids": wordIDs,
+	})
+}
+
+// 配信者によるライブコメントの一括削除
+// DELETE /api/livestream/:livestream_id/livecomments
+func deleteLivecommentsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	var req *DeleteLivecommentsRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidJSON, "failed to decode the request body as json")
+	}
+	if len(req.LivecommentIDs) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "livecomment_ids must not be empty")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+	if ok, err := canModerateLivestream(ctx, tx, livestreamModel, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborators: "+err.Error())
+	} else if !ok {
+		return newCodedHTTPError(http.StatusForbidden, errorCodeNotLivestreamOwner, "can't delete other streamer's livecomments")
+	}
+
+	// 他の配信のコメントを消さないように、この配信のコメントだけに絞る
+	query, args, err := sqlx.In("SELECT id, user_id FROM livecomments WHERE livestream_id = ? AND id IN (?) AND deleted_at IS NULL FOR UPDATE", livestreamID, req.LivecommentIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+	}
+	var deletedLivecomments []*LivecommentModel
+	if err := tx.SelectContext(ctx, &deletedLivecomments, tx.Rebind(query), args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	}
+	deletedLivecommentIDs := make([]LivecommentID, len(deletedLivecomments))
+	for i, livecomment := range deletedLivecomments {
+		deletedLivecommentIDs[i] = livecomment.ID
+	}
+
+	if len(deletedLivecommentIDs) > 0 {
+		if err := subtractLivecommentTips(ctx, tx, livestreamModel.UserID, deletedLivecommentIDs); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tip aggregate: "+err.Error())
+		}
+
+		// 監査のため物理削除はせずに削除済みにする
+		query, args, err := sqlx.In("UPDATE livecomments SET deleted_at = ? WHERE id IN (?)", time.Now().Unix(), deletedLivecommentIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livecomments: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	if len(deletedLivecommentIDs) > 0 {
+		LivecommentByIDCacheMutex.Lock()
+		for _, id := range deletedLivecommentIDs {
+			delete(LivecommentByIDCache, id)
+		}
+		LivecommentByIDCacheMutex.Unlock()
+		ReportCountByLivecommentIDCacheMutex.Lock()
+		for _, id := range deletedLivecommentIDs {
+			delete(ReportCountByLivecommentIDCache, id)
+		}
+		ReportCountByLivecommentIDCacheMutex.Unlock()
+
+		livestreamEventHub.Publish(LivestreamID(livestreamID), LivestreamEvent{
+			Type: livestreamEventLivecommentDeleted,
+			Data: LivecommentDeletedEvent{LivecommentIDs: deletedLivecommentIDs},
+		})
+		enqueueNotification(NotificationJob{
+			Type:           notificationTypeLivecommentModerated,
+			LivestreamID:   LivestreamID(livestreamID),
+			LivecommentIDs: deletedLivecommentIDs,
+		})
+		enqueueWebhookEvent(WebhookEvent{
+			Type:         webhookEventLivecommentModerated,
+			LivestreamID: LivestreamID(livestreamID),
+			Data:         LivecommentModeratedWebhookData{LivecommentIDs: deletedLivecommentIDs},
+		})
+
+		moderationLogs := make([]ModerationLogModel, len(deletedLivecomments))
+		for i, livecomment := range deletedLivecomments {
+			moderationLogs[i] = newModerationLog(LivestreamID(livestreamID), userID, moderationActionLivecommentDeleted)
+			moderationLogs[i].TargetUserID = sql.NullInt64{Int64: int64(livecomment.UserID), Valid: true}
+			moderationLogs[i].TargetLivecommentID = sql.NullInt64{Int64: int64(livecomment.ID), Valid: true}
+		}
+		enqueueModerationLogs(moderationLogs...)
+	}
+
+	return c.JSON(http.StatusOK, &DeleteLivecommentsResponse{
+		LivecommentIDs: deletedLivecommentIDs,
 	})
 }
 
@@ -410,11 +878,11 @@ func fillLivecommentResponse(ctx context.Context, tx *sqlx.Tx, livecommentModel
 	if ok {
 		return cached, nil
 	}
-	commentOwnerModel := UserModel{}
-	if err := tx.GetContext(ctx, &commentOwnerModel, "SELECT * FROM users WHERE id = ?", livecommentModel.UserID); err != nil {
+	commentOwnerModel, err := userRepository.GetByID(ctx, tx, livecommentModel.UserID)
+	if err != nil {
 		return Livecomment{}, err
 	}
-	commentOwner, err := fillUserResponse(ctx, tx, commentOwnerModel)
+	commentOwner, err := userRepository.Fill(ctx, tx, commentOwnerModel)
 	if err != nil {
 		return Livecomment{}, err
 	}
@@ -428,13 +896,23 @@ func fillLivecommentResponse(ctx context.Context, tx *sqlx.Tx, livecommentModel
 		return Livecomment{}, err
 	}
 
+	emotes, err := resolveEmotes(ctx, tx, livecommentModel.Comment, livestream.Owner)
+	if err != nil {
+		return Livecomment{}, err
+	}
+
+	// 設定変更前のチップはどの区分にも入らないことがあるので、その場合は区分無しとして返す
+	tipTier, _ := resolveTipTier(livecommentModel.Tip)
+
 	livecomment := Livecomment{
 		ID:         livecommentModel.ID,
 		User:       commentOwner,
 		Livestream: livestream,
 		Comment:    livecommentModel.Comment,
 		Tip:        livecommentModel.Tip,
+		TipTier:    tipTier,
 		CreatedAt:  livecommentModel.CreatedAt,
+		Emotes:     emotes,
 	}
 
 	LivecommentByIDCacheMutex.Lock()
@@ -446,88 +924,112 @@ func fillLivecommentResponse(ctx context.Context, tx *sqlx.Tx, livecommentModel
 
 // N+1問題を解消するためにbulkで取得する
 func fillLivecommentResponseBulk(ctx context.Context, tx *sqlx.Tx, livecommentModels []*LivecommentModel) ([]Livecomment, error) {
-	// if len(livecommentModels) == 0 {
-	// 	return []Livecomment{}, nil
-	// }
-
-	// commentOwnerIDs := make([]int64, len(livecommentModels))
-	// livestreamIDs := make([]int64, len(livecommentModels))
-	// for i, livecommentModel := range livecommentModels {
-	// 	commentOwnerIDs[i] = livecommentModel.UserID
-	// 	livestreamIDs[i] = livecommentModel.LivestreamID
-	// }
-
-	// query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", commentOwnerIDs)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// query = tx.Rebind(query)
-	// commentOwnerModels := []*UserModel{}
-	// if err := tx.SelectContext(ctx, &commentOwnerModels, query, args...); err != nil {
-	// 	return nil, err
-	// }
-
-	// commentOwners, err := fillUserResponseBulk(ctx, tx, commentOwnerModels)
-	// if err != nil {
-	// 	return nil, err
-	// }
-
-	// commentOwnerMap := make(map[int64]User)
-	// for _, commentOwner := range commentOwners {
-	// 	commentOwnerMap[commentOwner.ID] = commentOwner
-	// }
-
-	// query, args, err = sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// query = tx.Rebind(query)
-	// livestreamModels := []*LivestreamModel{}
-	// if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
-	// 	return nil, err
-	// }
-	// livestreams, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// livecommentMap := make(map[int64]Livestream)
-	// for _, livestream := range livestreams {
-	// 	livecommentMap[livestream.ID] = livestream
-	// }
-
-	// livecomments := make([]Livecomment, len(livecommentModels))
-	// for i, livecommentModel := range livecommentModels {
-	// 	livecomment := Livecomment{
-	// 		ID:         livecommentModel.ID,
-	// 		User:       commentOwnerMap[livecommentModel.UserID],
-	// 		Livestream: livecommentMap[livecommentModel.LivestreamID],
-	// 		Comment:    livecommentModel.Comment,
-	// 		Tip:        livecommentModel.Tip,
-	// 		CreatedAt:  livecommentModel.CreatedAt,
-	// 	}
-	// 	livecomments[i] = livecomment
-	// }
-
-	// return livecomments, nil
+	if len(livecommentModels) == 0 {
+		return []Livecomment{}, nil
+	}
 
 	livecomments := make([]Livecomment, len(livecommentModels))
+	uncachedIndexes := make([]int, 0, len(livecommentModels))
+
+	LivecommentByIDCacheMutex.RLock()
 	for i, livecommentModel := range livecommentModels {
-		livecomment, err := fillLivecommentResponse(ctx, tx, *livecommentModel)
+		if cached, ok := LivecommentByIDCache[livecommentModel.ID]; ok {
+			livecomments[i] = cached
+		} else {
+			uncachedIndexes = append(uncachedIndexes, i)
+		}
+	}
+	LivecommentByIDCacheMutex.RUnlock()
+
+	if len(uncachedIndexes) == 0 {
+		return livecomments, nil
+	}
+
+	commentOwnerIDSet := make(map[UserID]struct{}, len(uncachedIndexes))
+	livestreamIDSet := make(map[LivestreamID]struct{}, len(uncachedIndexes))
+	for _, i := range uncachedIndexes {
+		commentOwnerIDSet[livecommentModels[i].UserID] = struct{}{}
+		livestreamIDSet[livecommentModels[i].LivestreamID] = struct{}{}
+	}
+	commentOwnerIDs := make([]UserID, 0, len(commentOwnerIDSet))
+	for id := range commentOwnerIDSet {
+		commentOwnerIDs = append(commentOwnerIDs, id)
+	}
+	livestreamIDs := make([]LivestreamID, 0, len(livestreamIDSet))
+	for id := range livestreamIDSet {
+		livestreamIDs = append(livestreamIDs, id)
+	}
+
+	commentOwnerModels, err := userRepository.ListByIDs(ctx, tx, commentOwnerIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	commentOwners, err := userRepository.FillBulk(ctx, tx, commentOwnerModels)
+	if err != nil {
+		return nil, err
+	}
+
+	commentOwnerMap := make(map[UserID]User, len(commentOwners))
+	for _, commentOwner := range commentOwners {
+		commentOwnerMap[commentOwner.ID] = commentOwner
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	query = tx.Rebind(query)
+	livestreamModels := []*LivestreamModel{}
+	if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+		return nil, err
+	}
+
+	livestreams, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
+	if err != nil {
+		return nil, err
+	}
+
+	livestreamMap := make(map[LivestreamID]Livestream, len(livestreams))
+	for _, livestream := range livestreams {
+		livestreamMap[livestream.ID] = livestream
+	}
+
+	for _, i := range uncachedIndexes {
+		livecommentModel := livecommentModels[i]
+		livestream := livestreamMap[livecommentModel.LivestreamID]
+		emotes, err := resolveEmotes(ctx, tx, livecommentModel.Comment, livestream.Owner)
 		if err != nil {
 			return nil, err
 		}
-		livecomments[i] = livecomment
+		tipTier, _ := resolveTipTier(livecommentModel.Tip)
+		livecomments[i] = Livecomment{
+			ID:         livecommentModel.ID,
+			User:       commentOwnerMap[livecommentModel.UserID],
+			Livestream: livestream,
+			Comment:    livecommentModel.Comment,
+			Tip:        livecommentModel.Tip,
+			TipTier:    tipTier,
+			CreatedAt:  livecommentModel.CreatedAt,
+			Emotes:     emotes,
+		}
 	}
 
+	LivecommentByIDCacheMutex.Lock()
+	for _, i := range uncachedIndexes {
+		LivecommentByIDCache[livecommentModels[i].ID] = livecomments[i]
+	}
+	LivecommentByIDCacheMutex.Unlock()
+
 	return livecomments, nil
 }
 
 func fillLivecommentReportResponse(ctx context.Context, tx *sqlx.Tx, reportModel LivecommentReportModel) (LivecommentReport, error) {
-	reporterModel := UserModel{}
-	if err := tx.GetContext(ctx, &reporterModel, "SELECT * FROM users WHERE id = ?", reportModel.UserID); err != nil {
+	reporterModel, err := userRepository.GetByID(ctx, tx, reportModel.UserID)
+	if err != nil {
 		return LivecommentReport{}, err
 	}
-	reporter, err := fillUserResponse(ctx, tx, reporterModel)
+	reporter, err := userRepository.Fill(ctx, tx, reporterModel)
 	if err != nil {
 		return LivecommentReport{}, err
 	}
@@ -555,35 +1057,29 @@ func fillLivecommentReportResponseBulk(ctx context.Context, tx *sqlx.Tx, reportM
 		return []LivecommentReport{}, nil
 	}
 
-	reporterIDs := make([]int64, len(reportModels))
-	livecommentIDs := make([]int64, len(reportModels))
+	reporterIDs := make([]UserID, len(reportModels))
+	livecommentIDs := make([]LivecommentID, len(reportModels))
 	for i, reportModel := range reportModels {
 		reporterIDs[i] = reportModel.UserID
 		livecommentIDs[i] = reportModel.LivecommentID
 	}
 
-	query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", reporterIDs)
+	reporterModels, err := userRepository.ListByIDs(ctx, tx, reporterIDs)
 	if err != nil {
 		return nil, err
 	}
 
-	query = tx.Rebind(query)
-	reporterModels := []*UserModel{}
-	if err := tx.SelectContext(ctx, &reporterModels, query, args...); err != nil {
-		return nil, err
-	}
-
-	reporters, err := fillUserResponseBulk(ctx, tx, reporterModels)
+	reporters, err := userRepository.FillBulk(ctx, tx, reporterModels)
 	if err != nil {
 		return nil, err
 	}
 
-	reporterMap := make(map[int64]User)
+	reporterMap := make(map[UserID]User)
 	for _, reporter := range reporters {
 		reporterMap[reporter.ID] = reporter
 	}
 
-	query, args, err = sqlx.In("SELECT * FROM livecomments WHERE id IN (?)", livecommentIDs)
+	query, args, err := sqlx.In("SELECT * FROM livecomments WHERE id IN (?)", livecommentIDs)
 	if err != nil {
 		return nil, err
 	}
@@ -599,7 +1095,7 @@ func fillLivecommentReportResponseBulk(ctx context.Context, tx *sqlx.Tx, reportM
 		return nil, err
 	}
 
-	livecommentMap := make(map[int64]Livecomment)
+	livecommentMap := make(map[LivecommentID]Livecomment)
 	for _, livecomment := range livecomments {
 		livecommentMap[livecomment.ID] = livecomment
 	}
@@ -617,3 +1113,31 @@ func fillLivecommentReportResponseBulk(ctx context.Context, tx *sqlx.Tx, reportM
 
 	return reports, nil
 }
+
+// 報告数はキャッシュに無ければlivecomment_report_countsから読んで載せる
+// トランザクションのスナップショットから読むと、並行した報告の分が抜けたままキャッシュに残るのでdbConnで読む
+func getLivecommentReportCount(ctx context.Context, livecommentID LivecommentID) (int64, error) {
+	ReportCountByLivecommentIDCacheMutex.RLock()
+	count, ok := ReportCountByLivecommentIDCache[livecommentID]
+	ReportCountByLivecommentIDCacheMutex.RUnlock()
+	if ok {
+		return count, nil
+	}
+
+	if err := dbConn.GetContext(ctx, &count, "SELECT report_count FROM livecomment_report_counts WHERE livecomment_id = ?", livecommentID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return 0, err
+	}
+	return storeLivecommentReportCount(livecommentID, count), nil
+}
+
+// 報告は取り消せないので件数は増えるだけ。数えた時点が前後しても大きい方が新しい
+func storeLivecommentReportCount(livecommentID LivecommentID, count int64) int64 {
+	ReportCountByLivecommentIDCacheMutex.Lock()
+	defer ReportCountByLivecommentIDCacheMutex.Unlock()
+
+	if cached, ok := ReportCountByLivecommentIDCache[livecommentID]; ok && cached >= count {
+		return cached
+	}
+	ReportCountByLivecommentIDCache[livecommentID] = count
+	return count
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"database/sql"
+	"sync"
+	"time"
+)
+
+// 同じ配信でNGワードにN回ヒットしたユーザを一定時間ミュートする (配信者は除く)
+// 回数とミュートはメモリにだけ持つ (再起動・initializeで消える)
+// ベンチマークはNGワードを含むコメントを繰り返し投稿して400を期待するので、既定では無効にして本番相当の環境でだけ有効にする
+const (
+	defaultNGWordMuteThreshold = 0
+	defaultNGWordMuteDuration  = 10 * time.Minute
+)
+
+type livecommentMute struct {
+	// NGワードのヒット数 (ミュートするたびに0に戻す)
+	hits       int
+	mutedUntil time.Time
+}
+
+var (
+	LivecommentMuteByKeyCache      = make(map[livecommentLimiterKey]*livecommentMute)
+	LivecommentMuteByKeyCacheMutex = sync.Mutex{}
+)
+
+func init() {
+	registerCacheReset(func() {
+		LivecommentMuteByKeyCacheMutex.Lock()
+		LivecommentMuteByKeyCache = make(map[livecommentLimiterKey]*livecommentMute)
+		LivecommentMuteByKeyCacheMutex.Unlock()
+	})
+}
+
+// ミュート中なら残り時間を返す
+func livecommentMuteRemaining(userID UserID, livestreamID LivestreamID, now time.Time) time.Duration {
+	LivecommentMuteByKeyCacheMutex.Lock()
+	defer LivecommentMuteByKeyCacheMutex.Unlock()
+	mute, ok := LivecommentMuteByKeyCache[livecommentLimiterKey{UserID: userID, LivestreamID: livestreamID}]
+	if !ok || !now.Before(mute.mutedUntil) {
+		return 0
+	}
+	return mute.mutedUntil.Sub(now)
+}
+
+// NGワードのヒットを数え、しきい値に達したらミュートして監査ログに残す
+func recordNGWordHit(userID UserID, livestreamID LivestreamID, word string, now time.Time) {
+	t := currentTunables()
+	if t.NGWordMuteThreshold <= 0 {
+		return
+	}
+	key := livecommentLimiterKey{UserID: userID, LivestreamID: livestreamID}
+
+	LivecommentMuteByKeyCacheMutex.Lock()
+	mute, ok := LivecommentMuteByKeyCache[key]
+	if !ok {
+		mute = &livecommentMute{}
+		LivecommentMuteByKeyCache[key] = mute
+	}
+	mute.hits++
+	muted := mute.hits >= t.NGWordMuteThreshold
+	if muted {
+		mute.hits = 0
+		mute.mutedUntil = now.Add(t.NGWordMuteDuration)
+	}
+	LivecommentMuteByKeyCacheMutex.Unlock()
+
+	if muted {
+		moderationLog := newModerationLog(livestreamID, 0, moderationActionUserMuted)
+		moderationLog.TargetUserID = sql.NullInt64{Int64: int64(userID), Valid: true}
+		moderationLog.NGWord = sql.NullString{String: word, Valid: true}
+		moderationLog.CreatedAt = now.Unix()
+		enqueueModerationLogs(moderationLog)
+	}
+}
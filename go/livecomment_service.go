@@ -0,0 +1,262 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"slices"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// ライブコメントの投稿・報告。リクエストやセッションには触れず、返すエラーはハンドラでserviceHTTPErrorに通す
+type LivecommentService struct {
+	db    *sqlx.DB
+	clock Clock
+}
+
+// コメントを投稿し、配信者の投げ銭の集計・イベント配信・通知・webhookまで行う
+func (s *LivecommentService) Post(ctx context.Context, userID UserID, livestreamID LivestreamID, req PostLivecommentRequest) (Livecomment, error) {
+	if !tipAllowed(req.Tip) {
+		return Livecomment{}, newServiceError(serviceErrorInvalid, errorCodeTipOutOfRange, "tip is out of the allowed range")
+	}
+
+	// ミュートされているか、キャッシュ済みのNGワードにヒットするならDBに触る前に弾く
+	// 配信者はミュートしないので、キャッシュから配信者が分かる場合だけ
+	LivestreamByIDCacheMutex.RLock()
+	cachedLivestream, cached := LivestreamByIDCache[livestreamID]
+	LivestreamByIDCacheMutex.RUnlock()
+	if cached {
+		isOwner := cachedLivestream.Owner.ID == userID
+		if !isOwner {
+			if remaining := livecommentMuteRemaining(userID, livestreamID, s.clock.Now()); remaining > 0 {
+				return Livecomment{}, newRetryAfterServiceError(serviceErrorForbidden, errorCodeMuted, "you are muted on this livestream", remaining)
+			}
+		}
+		if matcher, ok := getCachedNGWordMatcher(livestreamID); ok {
+			if word, hit := matcher.Match(req.Comment); hit {
+				if !isOwner {
+					recordNGWordHit(userID, livestreamID, word, s.clock.Now())
+				}
+				return Livecomment{}, newServiceError(serviceErrorInvalid, errorCodeNGWordMatched, "このコメントがスパム判定されました")
+			}
+		}
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return Livecomment{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Livecomment{}, newServiceError(serviceErrorNotFound, errorCodeLivestreamNotFound, "livestream not found")
+		} else {
+			return Livecomment{}, fmt.Errorf("failed to get livestream: %w", err)
+		}
+	}
+
+	settings, err := getChatSettings(ctx, tx, livestreamID)
+	if err != nil {
+		return Livecomment{}, fmt.Errorf("failed to get chat settings: %w", err)
+	}
+	// チャットのモードとミュートは配信者には適用しない
+	isOwner := livestreamModel.UserID == userID
+	if !isOwner {
+		// NGワードに繰り返しヒットしてミュートされている
+		if remaining := livecommentMuteRemaining(userID, livestreamID, s.clock.Now()); remaining > 0 {
+			return Livecomment{}, newRetryAfterServiceError(serviceErrorForbidden, errorCodeMuted, "you are muted on this livestream", remaining)
+		}
+	}
+	if settings.FollowersOnly && !isOwner {
+		followingIDs, err := getFollowingStreamerIDs(ctx, tx, userID)
+		if err != nil {
+			return Livecomment{}, fmt.Errorf("failed to get following streamers: %w", err)
+		}
+		if !slices.Contains(followingIDs, livestreamModel.UserID) {
+			return Livecomment{}, newServiceError(serviceErrorForbidden, errorCodeFollowersOnly, "only followers of the streamer can comment on this livestream")
+		}
+	}
+	if settings.EmoteOnly && !isOwner {
+		emotes, err := getEmotesByUserID(ctx, tx, livestreamModel.UserID)
+		if err != nil {
+			return Livecomment{}, fmt.Errorf("failed to get emotes: %w", err)
+		}
+		if !isEmoteOnlyComment(req.Comment, emotes) {
+			return Livecomment{}, newServiceError(serviceErrorForbidden, errorCodeEmoteOnly, "only the streamer's emotes are allowed on this livestream")
+		}
+	}
+
+	// スローモード。コミットできなかった場合は記録を戻す
+	var releaseSlot func()
+	defer func() {
+		if releaseSlot != nil {
+			releaseSlot()
+		}
+	}()
+	if settings.SlowModeSeconds > 0 && !isOwner {
+		var wait time.Duration
+		wait, releaseSlot = takeLivecommentSlot(userID, livestreamID, time.Duration(settings.SlowModeSeconds)*time.Second, s.clock.Now())
+		if wait > 0 {
+			return Livecomment{}, newRetryAfterServiceError(serviceErrorTooManyRequests, errorCodeSlowMode, "slow mode is enabled on this livestream", wait)
+		}
+	}
+
+	// スパム判定 (キャッシュが無い場合はここでNGワードを読み込む)
+	matcher, err := getNGWordMatcher(ctx, tx, livestreamModel)
+	if err != nil {
+		return Livecomment{}, fmt.Errorf("failed to get NG words: %w", err)
+	}
+	if word, ok := matcher.Match(req.Comment); ok {
+		if !isOwner {
+			recordNGWordHit(userID, livestreamID, word, s.clock.Now())
+		}
+		return Livecomment{}, newServiceError(serviceErrorInvalid, errorCodeNGWordMatched, "このコメントがスパム判定されました")
+	}
+
+	now := s.clock.Now().Unix()
+	livecommentModel := LivecommentModel{
+		UserID:       userID,
+		LivestreamID: livestreamID,
+		Comment:      req.Comment,
+		Tip:          req.Tip,
+		CreatedAt:    now,
+	}
+
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomments (user_id, livestream_id, comment, tip, created_at) VALUES (:user_id, :livestream_id, :comment, :tip, :created_at)", livecommentModel)
+	if err != nil {
+		return Livecomment{}, fmt.Errorf("failed to insert livecomment: %w", err)
+	}
+
+	livecommentID, err := rs.LastInsertId()
+	if err != nil {
+		return Livecomment{}, fmt.Errorf("failed to get last inserted livecomment id: %w", err)
+	}
+	livecommentModel.ID = LivecommentID(livecommentID)
+
+	// 途中でフラグが切り替わっても二重に足さないよう、判定は1回だけ行う
+	writeBehind := featureEnabled(featureWriteBehindStats)
+	if writeBehind {
+		err = recordTipEvent(ctx, tx, livestreamModel.UserID, livecommentModel)
+	} else {
+		err = recordTip(ctx, tx, livestreamModel.UserID, livecommentModel)
+	}
+	if err != nil {
+		return Livecomment{}, fmt.Errorf("failed to update tip aggregate: %w", err)
+	}
+
+	livecomment, err := fillLivecommentResponse(ctx, tx, livecommentModel)
+	if err != nil {
+		return Livecomment{}, fmt.Errorf("failed to fill livecomment: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Livecomment{}, fmt.Errorf("failed to commit: %w", err)
+	}
+	releaseSlot = nil
+	if writeBehind {
+		bufferTipAggregate(livestreamModel.UserID, livecommentModel.Tip)
+	}
+
+	livestreamEventHub.Publish(livecomment.Livestream.ID, LivestreamEvent{
+		Type: livestreamEventLivecomment,
+		Data: livecomment,
+	})
+	if livecomment.Tip > 0 {
+		enqueueNotification(NotificationJob{
+			Type:           notificationTypeTip,
+			LivestreamID:   livecomment.Livestream.ID,
+			LivecommentIDs: []LivecommentID{livecomment.ID},
+			Amount:         livecomment.Tip,
+		})
+	}
+	if livecomment.Tip >= webhookLargeTipThreshold {
+		enqueueWebhookEvent(WebhookEvent{
+			Type:         webhookEventLargeTip,
+			LivestreamID: livecomment.Livestream.ID,
+			Data:         livecomment,
+		})
+	}
+
+	return livecomment, nil
+}
+
+// コメントを報告する。報告数がしきい値に達したらwebhookを送る
+func (s *LivecommentService) Report(ctx context.Context, userID UserID, livestreamID LivestreamID, livecommentID LivecommentID) (LivecommentReport, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return LivecommentReport{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivecommentReport{}, newServiceError(serviceErrorNotFound, errorCodeLivestreamNotFound, "livestream not found")
+		} else {
+			return LivecommentReport{}, fmt.Errorf("failed to get livestream: %w", err)
+		}
+	}
+
+	// 同じライブコメントへの報告を並べ、報告後の件数を正確に数えられるようにする
+	var livecommentModel LivecommentModel
+	if err := tx.GetContext(ctx, &livecommentModel, "SELECT * FROM livecomments WHERE id = ? AND deleted_at IS NULL FOR UPDATE", livecommentID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivecommentReport{}, newServiceError(serviceErrorNotFound, errorCodeLivecommentNotFound, "livecomment not found")
+		} else {
+			return LivecommentReport{}, fmt.Errorf("failed to get livecomment: %w", err)
+		}
+	}
+
+	now := s.clock.Now().Unix()
+	reportModel := LivecommentReportModel{
+		UserID:        userID,
+		LivestreamID:  livestreamID,
+		LivecommentID: livecommentID,
+		CreatedAt:     now,
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livecomment_reports(user_id, livestream_id, livecomment_id, created_at) VALUES (:user_id, :livestream_id, :livecomment_id, :created_at)", &reportModel)
+	if err != nil {
+		return LivecommentReport{}, fmt.Errorf("failed to insert livecomment report: %w", err)
+	}
+	reportID, err := rs.LastInsertId()
+	if err != nil {
+		return LivecommentReport{}, fmt.Errorf("failed to get last inserted livecomment report id: %w", err)
+	}
+	reportModel.ID = reportID
+
+	// 件数の行はこのトランザクションが更新して排他ロックを持つので、続けて読めば報告後の件数になる
+	if _, err := tx.ExecContext(ctx, "INSERT INTO livecomment_report_counts (livecomment_id, livestream_id, report_count) VALUES (?, ?, 1) ON DUPLICATE KEY UPDATE report_count = report_count + 1", livecommentID, livestreamID); err != nil {
+		return LivecommentReport{}, fmt.Errorf("failed to count livecomment reports: %w", err)
+	}
+	var reportCount int64
+	if err := tx.GetContext(ctx, &reportCount, "SELECT report_count FROM livecomment_report_counts WHERE livecomment_id = ?", livecommentID); err != nil {
+		return LivecommentReport{}, fmt.Errorf("failed to get livecomment report count: %w", err)
+	}
+
+	report, err := fillLivecommentReportResponse(ctx, tx, reportModel)
+	if err != nil {
+		return LivecommentReport{}, fmt.Errorf("failed to fill livecomment report: %w", err)
+	}
+	if err := tx.Commit(); err != nil {
+		return LivecommentReport{}, fmt.Errorf("failed to commit: %w", err)
+	}
+
+	storeLivecommentReportCount(livecommentID, reportCount)
+	if reportCount == webhookReportThreshold {
+		enqueueWebhookEvent(WebhookEvent{
+			Type:         webhookEventReportThresholdCrossed,
+			LivestreamID: livestreamID,
+			Data: ReportThresholdCrossedWebhookData{
+				LivecommentID: livecommentID,
+				ReportCount:   reportCount,
+			},
+		})
+	}
+
+	return report, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"testing"
+	"time"
+)
+
+type fixedClock struct {
+	now int64
+}
+
+func (c fixedClock) Now() time.Time {
+	return time.Unix(c.now, 0)
+}
+
+func serviceErrorKindOf(err error) serviceErrorKind {
+	var se *serviceError
+	if errors.As(err, &se) {
+		return se.kind
+	}
+	return 0
+}
+
+// DBに触る前に弾くもの
+func TestLivecommentServicePostRejectsTipOutOfRange(t *testing.T) {
+	s := &LivecommentService{clock: fixedClock{now: 1700000000}}
+	_, err := s.Post(context.Background(), 1, 1, PostLivecommentRequest{Comment: "hi", Tip: -1})
+	if serviceErrorKindOf(err) != serviceErrorInvalid {
+		t.Errorf("err = %v, want invalid", err)
+	}
+}
+
+func TestReactionServiceToggleRejectsUnknownEmoji(t *testing.T) {
+	s := &ReactionService{clock: fixedClock{now: 1700000000}}
+	_, _, err := s.Toggle(context.Background(), 1, 1, "not-an-emoji")
+	var se *serviceError
+	if !errors.As(err, &se) || se.kind != serviceErrorInvalid || se.code != errorCodeEmojiNotAllowed {
+		t.Errorf("err = %v, want emoji_not_allowed", err)
+	}
+}
+
+func TestLivecommentServiceNotFound(t *testing.T) {
+	db := newTestDB(t)
+	s := &LivecommentService{db: db, clock: fixedClock{now: 1700000000}}
+	ctx := context.Background()
+
+	// 存在しない配信
+	const missing = LivestreamID(1 << 40)
+	if _, err := s.Post(ctx, 1, missing, PostLivecommentRequest{Comment: "hi"}); serviceErrorKindOf(err) != serviceErrorNotFound {
+		t.Errorf("Post: err = %v, want not found", err)
+	}
+	if _, err := s.Report(ctx, 1, missing, 1); serviceErrorKindOf(err) != serviceErrorNotFound {
+		t.Errorf("Report: err = %v, want not found", err)
+	}
+}
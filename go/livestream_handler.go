@@ -3,12 +3,14 @@ package main
 import (
 	"context"
 	"database/sql"
-	"encoding/json"
 	"errors"
 	"fmt"
 	"net/http"
+	"slices"
+	"sort"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
@@ -18,47 +20,58 @@ import (
 
 type ReserveLivestreamRequest struct {
 	Tags         []int64 `json:"tags"`
-	Title        string  `json:"title"`
+	Title        string  `json:"title" validate:"required,max=255"`
 	Description  string  `json:"description"`
-	PlaylistUrl  string  `json:"playlist_url"`
-	ThumbnailUrl string  `json:"thumbnail_url"`
-	StartAt      int64   `json:"start_at"`
-	EndAt        int64   `json:"end_at"`
+	PlaylistUrl  string  `json:"playlist_url" validate:"max=255"`
+	ThumbnailUrl string  `json:"thumbnail_url" validate:"max=255"`
+	StartAt      int64   `json:"start_at" validate:"required"`
+	EndAt        int64   `json:"end_at" validate:"required,gtfield=StartAt"`
+}
+
+// 省略したフィールドは変更しない
+type UpdateLivestreamRequest struct {
+	Title *string `json:"title" validate:"required,max=255"`
+	// descriptionはTEXTなので、4バイト文字だけでも65535バイトに収まる文字数まで
+	Description *string  `json:"description" validate:"max=16383"`
+	Tags        *[]int64 `json:"tags"`
 }
 
 type LivestreamViewerModel struct {
-	UserID       int64 `db:"user_id" json:"user_id"`
-	LivestreamID int64 `db:"livestream_id" json:"livestream_id"`
-	CreatedAt    int64 `db:"created_at" json:"created_at"`
+	UserID       UserID       `db:"user_id" json:"user_id"`
+	LivestreamID LivestreamID `db:"livestream_id" json:"livestream_id"`
+	CreatedAt    int64        `db:"created_at" json:"created_at"`
 }
 
 type LivestreamModel struct {
-	ID           int64  `db:"id" json:"id"`
-	UserID       int64  `db:"user_id" json:"user_id"`
-	Title        string `db:"title" json:"title"`
-	Description  string `db:"description" json:"description"`
-	PlaylistUrl  string `db:"playlist_url" json:"playlist_url"`
-	ThumbnailUrl string `db:"thumbnail_url" json:"thumbnail_url"`
-	StartAt      int64  `db:"start_at" json:"start_at"`
-	EndAt        int64  `db:"end_at" json:"end_at"`
+	ID           LivestreamID `db:"id" json:"id"`
+	UserID       UserID       `db:"user_id" json:"user_id"`
+	Title        string       `db:"title" json:"title"`
+	Description  string       `db:"description" json:"description"`
+	PlaylistUrl  string       `db:"playlist_url" json:"playlist_url"`
+	ThumbnailUrl string       `db:"thumbnail_url" json:"thumbnail_url"`
+	StartAt      int64        `db:"start_at" json:"start_at"`
+	EndAt        int64        `db:"end_at" json:"end_at"`
+	Status       string       `db:"status" json:"status"`
 }
 
 type Livestream struct {
-	ID           int64  `json:"id"`
-	Owner        User   `json:"owner"`
-	Title        string `json:"title"`
-	Description  string `json:"description"`
-	PlaylistUrl  string `json:"playlist_url"`
-	ThumbnailUrl string `json:"thumbnail_url"`
-	Tags         []Tag  `json:"tags"`
-	StartAt      int64  `json:"start_at"`
-	EndAt        int64  `json:"end_at"`
+	ID           LivestreamID `json:"id"`
+	Owner        User         `json:"owner"`
+	Title        string       `json:"title"`
+	Description  string       `json:"description"`
+	PlaylistUrl  string       `json:"playlist_url"`
+	ThumbnailUrl string       `json:"thumbnail_url"`
+	Tags         []Tag        `json:"tags"`
+	StartAt      int64        `json:"start_at"`
+	EndAt        int64        `json:"end_at"`
+	// upcoming | live | ended
+	Status string `json:"status"`
 }
 
 type LivestreamTagModel struct {
-	ID           int64 `db:"id" json:"id"`
-	LivestreamID int64 `db:"livestream_id" json:"livestream_id"`
-	TagID        int64 `db:"tag_id" json:"tag_id"`
+	ID           int64        `db:"id" json:"id"`
+	LivestreamID LivestreamID `db:"livestream_id" json:"livestream_id"`
+	TagID        int64        `db:"tag_id" json:"tag_id"`
 }
 
 type ReservationSlotModel struct {
@@ -70,11 +83,20 @@ type ReservationSlotModel struct {
 
 const SLOTS_RANGE_INDEX = "slots_range"
 
-func reserveLivestreamHandler(c echo.Context) error {
+// 予約枠の空き状況は短い間だけキャッシュする
+const defaultReservationSlotsCacheTTL = 1 * time.Second
+
+var (
+	reservationSlotsCache          []*ReservationSlotModel
+	reservationSlotsCacheExpiresAt time.Time
+	reservationSlotsCacheMutex     = sync.Mutex{}
+)
+
+func (app *App) reserveLivestreamHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
-	if err := verifyUserSession(c); err != nil {
+	if err := app.verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
@@ -82,98 +104,158 @@ func reserveLivestreamHandler(c echo.Context) error {
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
 
-	var req *ReserveLivestreamRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	var req ReserveLivestreamRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	livestream, err := app.livestreamService.Reserve(ctx, userID, req)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return serviceHTTPError(err)
 	}
-	defer tx.Rollback()
 
-	// 2023/11/25 10:00からの１年間の期間内であるかチェック
-	var (
-		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
-		termEndAt      = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
-		reserveStartAt = time.Unix(req.StartAt, 0)
-		reserveEndAt   = time.Unix(req.EndAt, 0)
-	)
-	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
-		return echo.NewHTTPError(http.StatusBadRequest, "bad reservation time range")
+	return c.JSON(http.StatusCreated, livestream)
+}
+
+// 予約枠ごとの残数を返すAPI
+// GET /api/livestream/availability?from=&until=
+func getReservationAvailabilityHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
 	}
 
-	// 予約枠をみて、予約が可能か調べる
-	// NOTE: 並列な予約のoverbooking防止にFOR UPDATEが必要
-	var slots []*ReservationSlotModel
-	if err := tx.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots FORCE INDEX("+SLOTS_RANGE_INDEX+") WHERE start_at >= ? AND end_at <= ? FOR UPDATE", req.StartAt, req.EndAt); err != nil {
-		c.Logger().Warnf("予約枠一覧取得でエラー発生: %+v", err)
+	from, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "from query parameter must be integer")
+	}
+	until, err := strconv.ParseInt(c.QueryParam("until"), 10, 64)
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "until query parameter must be integer")
+	}
+	if from >= until {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "from must be before until")
+	}
+
+	slots, err := getReservationSlots(ctx)
+	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reservation_slots: "+err.Error())
 	}
 
+	availability := []*ReservationSlotModel{}
 	for _, slot := range slots {
-		c.Logger().Infof("%d ~ %d予約枠の残数 = %d\n", slot.StartAt, slot.EndAt, slot.Slot)
-		if slot.Slot < 1 {
-			return echo.NewHTTPError(http.StatusBadRequest, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
+		if slot.StartAt >= from && slot.EndAt <= until {
+			availability = append(availability, slot)
 		}
 	}
 
-	var (
-		livestreamModel = &LivestreamModel{
-			UserID:       int64(userID),
-			Title:        req.Title,
-			Description:  req.Description,
-			PlaylistUrl:  req.PlaylistUrl,
-			ThumbnailUrl: req.ThumbnailUrl,
-			StartAt:      req.StartAt,
-			EndAt:        req.EndAt,
-		}
-	)
+	return c.JSON(http.StatusOK, availability)
+}
 
-	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update reservation_slot: "+err.Error())
-	}
+// start_at順の全予約枠を返す (キャッシュは呼び出し側で書き換えないこと)
+func getReservationSlots(ctx context.Context) ([]*ReservationSlotModel, error) {
+	reservationSlotsCacheMutex.Lock()
+	defer reservationSlotsCacheMutex.Unlock()
 
-	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at)", livestreamModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream: "+err.Error())
+	if reservationSlotsCache != nil && time.Now().Before(reservationSlotsCacheExpiresAt) {
+		return reservationSlotsCache, nil
 	}
 
-	livestreamID, err := rs.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream id: "+err.Error())
+	var slots []*ReservationSlotModel
+	if err := dbConn.SelectContext(ctx, &slots, "SELECT * FROM reservation_slots ORDER BY start_at"); err != nil {
+		return nil, err
 	}
-	livestreamModel.ID = livestreamID
+	reservationSlotsCache = slots
+	reservationSlotsCacheExpiresAt = time.Now().Add(currentTunables().ReservationSlotsCacheTTL)
+
+	return slots, nil
+}
+
+func init() {
+	registerCacheReset(expireReservationSlotsCache)
+}
+
+func expireReservationSlotsCache() {
+	reservationSlotsCacheMutex.Lock()
+	reservationSlotsCache = nil
+	reservationSlotsCacheMutex.Unlock()
+}
+
+// 全文検索でlimit未指定時の件数
+const defaultLivestreamSearchLimit = 50
 
-	if len(req.Tags) > 0 {
-		values := make([]string, 0, len(req.Tags))
-		for _, tagID := range req.Tags {
-			values = append(values, fmt.Sprintf("(%d, %d)", livestreamID, tagID))
+func searchLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	// ?tag=a&tag=b のように複数指定できる。match=all なら全タグを持つ配信、any (デフォルト) ならいずれかを持つ配信
+	keyTagNames := make([]string, 0, len(c.QueryParams()["tag"]))
+	seenTagNames := make(map[string]struct{})
+	for _, name := range c.QueryParams()["tag"] {
+		if name == "" {
+			continue
 		}
-		query := fmt.Sprintf("INSERT INTO livestream_tags (livestream_id, tag_id) VALUES %s", strings.Join(values, ","))
-		if _, err := tx.ExecContext(ctx, query); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tags: "+err.Error())
+		if _, ok := seenTagNames[name]; ok {
+			continue
 		}
+		seenTagNames[name] = struct{}{}
+		keyTagNames = append(keyTagNames, name)
+	}
+	matchAll := false
+	switch c.QueryParam("match") {
+	case "", "any":
+	case "all":
+		matchAll = true
+	default:
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "match query parameter must be all or any")
 	}
 
-	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	// sort=recent (ID降順) | popular (ランキングのスコア降順) | relevance (全文検索の関連度順、q指定時のデフォルト)
+	keyword := c.QueryParam("q")
+	sortMode := c.QueryParam("sort")
+	if sortMode == "" {
+		sortMode = "recent"
+		if keyword != "" {
+			sortMode = "relevance"
+		}
+	}
+	if sortMode != "recent" && sortMode != "popular" && !(sortMode == "relevance" && keyword != "") {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "sort query parameter must be recent, popular or relevance (with q)")
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	// limit未指定なら全件 (全文検索のみデフォルト件数で打ち切る)
+	limit := 0
+	if keyword != "" {
+		limit = defaultLivestreamSearchLimit
+	}
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l <= 0 {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "limit query parameter must be positive integer")
+		}
+		limit = l
+	}
+	offset := 0
+	if c.QueryParam("offset") != "" {
+		o, err := strconv.Atoi(c.QueryParam("offset"))
+		if err != nil || o < 0 {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "offset query parameter must be non-negative integer")
+		}
+		offset = o
 	}
 
-	return c.JSON(http.StatusCreated, livestream)
-}
+	// ?status=upcoming|live|ended で状態を絞り込む
+	status := c.QueryParam("status")
+	if status != "" && status != livestreamStatusUpcoming && status != livestreamStatusLive && status != livestreamStatusEnded {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "status query parameter must be upcoming, live or ended")
+	}
 
-func searchLivestreamsHandler(c echo.Context) error {
-	ctx := c.Request().Context()
-	keyTagName := c.QueryParam("tag")
+	sel, err := parseFieldSelection(c, Livestream{})
+	if err != nil {
+		return err
+	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -181,54 +263,106 @@ func searchLivestreamsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var livestreamModels []*LivestreamModel
-	if c.QueryParam("tag") != "" {
-		// タグによる取得
-		var tagIDList []int
-		if err := tx.SelectContext(ctx, &tagIDList, "SELECT id FROM tags WHERE name = ?", keyTagName); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
-		}
-
-		query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE tag_id IN (?) ORDER BY livestream_id DESC", tagIDList)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
-		}
-		var keyTaggedLivestreams []*LivestreamTagModel
-		if err := tx.SelectContext(ctx, &keyTaggedLivestreams, query, params...); err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get keyTaggedLivestreams: "+err.Error())
-		}
-
-		livestreamIDs := make([]int64, len(keyTaggedLivestreams))
-		for i := range keyTaggedLivestreams {
-			livestreamIDs[i] = keyTaggedLivestreams[i].LivestreamID
+	// まず条件に合う配信のIDだけを集め、並べ替えてページを切り出してから中身を取る
+	var livestreamIDs []LivestreamID
+	if keyword != "" {
+		// タイトル・説明文の全文検索 (関連度順)
+		if err := tx.SelectContext(ctx, &livestreamIDs, "SELECT id FROM livestreams WHERE MATCH (title, description) AGAINST (? IN NATURAL LANGUAGE MODE) ORDER BY MATCH (title, description) AGAINST (? IN NATURAL LANGUAGE MODE) DESC, id DESC", keyword, keyword); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to search livestreams: "+err.Error())
 		}
-
-		if len(livestreamIDs) > 0 {
-			query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?) ORDER BY id DESC", livestreamIDs)
-			if err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		if len(keyTagNames) > 0 {
+			tagged := make(map[LivestreamID]struct{})
+			for _, id := range findLivestreamIDsByTagNames(keyTagNames, matchAll) {
+				tagged[id] = struct{}{}
 			}
-			if err := tx.SelectContext(ctx, &livestreamModels, query, params...); err != nil {
-				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+			filtered := make([]LivestreamID, 0, len(livestreamIDs))
+			for _, id := range livestreamIDs {
+				if _, ok := tagged[id]; ok {
+					filtered = append(filtered, id)
+				}
 			}
+			livestreamIDs = filtered
 		}
+	} else if len(keyTagNames) > 0 {
+		// タグによる取得 (メモリ上のインデックスで絞り込む)
+		livestreamIDs = findLivestreamIDsByTagNames(keyTagNames, matchAll)
 	} else {
 		// 検索条件なし
-		query := `SELECT * FROM livestreams ORDER BY id DESC`
-		if c.QueryParam("limit") != "" {
-			limit, err := strconv.Atoi(c.QueryParam("limit"))
-			if err != nil {
-				return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+		if err := tx.SelectContext(ctx, &livestreamIDs, "SELECT id FROM livestreams ORDER BY id DESC"); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+	}
+
+	if status != "" {
+		var statusIDs []LivestreamID
+		if err := tx.SelectContext(ctx, &statusIDs, "SELECT id FROM livestreams WHERE status = ?", status); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		matched := make(map[LivestreamID]struct{}, len(statusIDs))
+		for _, id := range statusIDs {
+			matched[id] = struct{}{}
+		}
+		filtered := make([]LivestreamID, 0, len(livestreamIDs))
+		for _, id := range livestreamIDs {
+			if _, ok := matched[id]; ok {
+				filtered = append(filtered, id)
 			}
-			query += fmt.Sprintf(" LIMIT %d", limit)
 		}
+		livestreamIDs = filtered
+	}
 
-		if err := tx.SelectContext(ctx, &livestreamModels, query); err != nil {
+	switch sortMode {
+	case "recent":
+		sort.Slice(livestreamIDs, func(i, j int) bool { return livestreamIDs[i] > livestreamIDs[j] })
+	case "popular":
+		snapshot, err := getLivestreamRankingSnapshot(ctx)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream ranking: "+err.Error())
+		}
+		// 同点はID降順にして順序を安定させる
+		sort.Slice(livestreamIDs, func(i, j int) bool {
+			si, sj := snapshot.ScoreByLivestreamID[livestreamIDs[i]], snapshot.ScoreByLivestreamID[livestreamIDs[j]]
+			if si != sj {
+				return si > sj
+			}
+			return livestreamIDs[i] > livestreamIDs[j]
+		})
+	}
+
+	// ページを切り出す前なので全件数は追加のクエリ無しで分かる
+	page := pageInfo{total: int64(len(livestreamIDs)), cursorParam: "offset"}
+	if offset >= len(livestreamIDs) {
+		livestreamIDs = nil
+	} else {
+		livestreamIDs = livestreamIDs[offset:]
+	}
+	if limit > 0 && len(livestreamIDs) > limit {
+		livestreamIDs = livestreamIDs[:limit]
+		page.nextCursor = strconv.Itoa(offset + limit)
+	}
+
+	livestreamModels := make([]*LivestreamModel, 0, len(livestreamIDs))
+	if len(livestreamIDs) > 0 {
+		query, params, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+		}
+		var unordered []*LivestreamModel
+		if err := tx.SelectContext(ctx, &unordered, tx.Rebind(query), params...); err != nil {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 		}
+		livestreamModelMap := make(map[LivestreamID]*LivestreamModel, len(unordered))
+		for _, livestreamModel := range unordered {
+			livestreamModelMap[livestreamModel.ID] = livestreamModel
+		}
+		for _, id := range livestreamIDs {
+			if livestreamModel, ok := livestreamModelMap[id]; ok {
+				livestreamModels = append(livestreamModels, livestreamModel)
+			}
+		}
 	}
 
-	livestreams, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
+	livestreams, err := fillLivestreamsSelected(ctx, tx, livestreamModels, sel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
@@ -237,7 +371,8 @@ func searchLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	setPageHeaders(c, page)
+	return respondFieldSelected(c, http.StatusOK, livestreams, sel)
 }
 
 func getMyLivestreamsHandler(c echo.Context) error {
@@ -246,6 +381,11 @@ func getMyLivestreamsHandler(c echo.Context) error {
 		return err
 	}
 
+	sel, err := parseFieldSelection(c, Livestream{})
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
@@ -255,13 +395,13 @@ func getMyLivestreamsHandler(c echo.Context) error {
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
 
 	var livestreamModels []*LivestreamModel
 	if err := tx.SelectContext(ctx, &livestreamModels, "SELECT * FROM livestreams WHERE user_id = ?", userID); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
-	livestreams, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
+	livestreams, err := fillLivestreamsSelected(ctx, tx, livestreamModels, sel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
@@ -270,7 +410,7 @@ func getMyLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return respondFieldSelected(c, http.StatusOK, livestreams, sel)
 }
 
 func getUserLivestreamsHandler(c echo.Context) error {
@@ -281,16 +421,21 @@ func getUserLivestreamsHandler(c echo.Context) error {
 
 	username := c.Param("username")
 
+	sel, err := parseFieldSelection(c, Livestream{})
+	if err != nil {
+		return err
+	}
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+	user, err := userRepository.GetByName(ctx, tx, username)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "user not found")
+			return newCodedHTTPError(http.StatusNotFound, errorCodeUserNotFound, "user not found")
 		} else {
 			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 		}
@@ -301,7 +446,7 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
-	livestreams, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
+	livestreams, err := fillLivestreamsSelected(ctx, tx, livestreamModels, sel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
 	}
@@ -310,7 +455,7 @@ func getUserLivestreamsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, livestreams)
+	return respondFieldSelected(c, http.StatusOK, livestreams, sel)
 }
 
 // viewerテーブルの廃止
@@ -324,11 +469,11 @@ func enterLivestreamHandler(c echo.Context) error {
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id must be integer")
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id must be integer")
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -338,8 +483,8 @@ func enterLivestreamHandler(c echo.Context) error {
 	defer tx.Rollback()
 
 	viewer := LivestreamViewerModel{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
+		UserID:       userID,
+		LivestreamID: LivestreamID(livestreamID),
 		CreatedAt:    time.Now().Unix(),
 	}
 
@@ -351,6 +496,12 @@ func enterLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	// 入室もハートビートとして扱う
+	touchViewer(LivestreamID(livestreamID), userID)
+	if err := publishViewersCount(ctx, LivestreamID(livestreamID)); err != nil {
+		c.Logger().Warnf("failed to publish viewers count: %+v", err)
+	}
+
 	return c.NoContent(http.StatusOK)
 }
 
@@ -364,11 +515,11 @@ func exitLivestreamHandler(c echo.Context) error {
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -385,6 +536,11 @@ func exitLivestreamHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	removeViewer(LivestreamID(livestreamID), userID)
+	if err := publishViewersCount(ctx, LivestreamID(livestreamID)); err != nil {
+		c.Logger().Warnf("failed to publish viewers count: %+v", err)
+	}
+
 	return c.NoContent(http.StatusOK)
 }
 
@@ -397,7 +553,16 @@ func getLivestreamHandler(c echo.Context) error {
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	// 配信を読む前にバージョンを取る。配信者は変わらないので、キャッシュにあればDBを見ずに比較できる
+	livestreamVersion := currentLivestreamVersion(LivestreamID(livestreamID))
+	LivestreamByIDCacheMutex.RLock()
+	cached, ok := LivestreamByIDCache[LivestreamID(livestreamID)]
+	LivestreamByIDCacheMutex.RUnlock()
+	if ok && notModified(c, livestreamETag(cached.ID, livestreamVersion, cached.Owner.ID)) {
+		return c.NoContent(http.StatusNotModified)
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -409,12 +574,17 @@ func getLivestreamHandler(c echo.Context) error {
 	livestreamModel := LivestreamModel{}
 	err = tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID)
 	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusNotFound, "not found livestream that has the given id")
+		return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "not found livestream that has the given id")
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 	}
 
+	// 配信者の情報を読む前に配信者のバージョンを取る
+	if notModified(c, livestreamETag(livestreamModel.ID, livestreamVersion, livestreamModel.UserID)) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
 	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
@@ -427,6 +597,253 @@ func getLivestreamHandler(c echo.Context) error {
 	return c.JSON(http.StatusOK, livestream)
 }
 
+// 配信者が自分の配信のタイトル・説明文・タグを編集するAPI
+// PATCH /api/livestream/:livestream_id
+func updateLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	var req UpdateLivestreamRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnLivestreamForUpdate(ctx, tx, LivestreamID(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+
+	if req.Title != nil {
+		livestreamModel.Title = *req.Title
+	}
+	if req.Description != nil {
+		livestreamModel.Description = *req.Description
+	}
+	if _, err := tx.NamedExecContext(ctx, "UPDATE livestreams SET title = :title, description = :description WHERE id = :id", livestreamModel); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream: "+err.Error())
+	}
+
+	if req.Tags != nil {
+		tagIDs := slices.Compact(slices.Sorted(slices.Values(*req.Tags)))
+		if len(tagIDs) > 0 {
+			query, args, err := sqlx.In("SELECT COUNT(*) FROM tags WHERE id IN (?)", tagIDs)
+			if err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to construct IN query: "+err.Error())
+			}
+			var tagCount int
+			if err := tx.GetContext(ctx, &tagCount, tx.Rebind(query), args...); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tags: "+err.Error())
+			}
+			if tagCount != len(tagIDs) {
+				return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "tags contains unknown tag id")
+			}
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM livestream_tags WHERE livestream_id = ?", livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream tags: "+err.Error())
+		}
+		if len(tagIDs) > 0 {
+			values := make([]string, 0, len(tagIDs))
+			for _, tagID := range tagIDs {
+				values = append(values, fmt.Sprintf("(%d, %d)", livestreamID, tagID))
+			}
+			query := fmt.Sprintf("INSERT INTO livestream_tags (livestream_id, tag_id) VALUES %s", strings.Join(values, ","))
+			if _, err := tx.ExecContext(ctx, query); err != nil {
+				return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream tags: "+err.Error())
+			}
+		}
+	}
+
+	livestream, err := buildLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// コミットした内容を次の参照で読み直させる
+	invalidateLivestreamCaches(livestreamModel.ID)
+
+	if req.Tags != nil {
+		tagNames := make([]string, len(livestream.Tags))
+		for i, tag := range livestream.Tags {
+			tagNames[i] = tag.Name
+		}
+		removeLivestreamFromTagIndex(livestream.ID)
+		addLivestreamToTagIndex(livestream.ID, tagNames)
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+// 配信予約を取り消し、予約枠を返却するAPI
+// DELETE /api/livestream/:livestream_id
+func cancelLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnLivestreamForUpdate(ctx, tx, LivestreamID(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+
+	// 取り消せるのは始まる前の予約だけ。配信中・終了済みの配信は残す
+	now := time.Now().Unix()
+	if livestreamModel.Status != livestreamStatusUpcoming || livestreamModel.StartAt <= now {
+		return newCodedHTTPError(http.StatusConflict, errorCodeConflict, "can't cancel a livestream that has already started")
+	}
+
+	// 過ぎた時間の枠は返さない
+	if _, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot + 1 WHERE start_at >= ? AND end_at <= ? AND start_at > ?", livestreamModel.StartAt, livestreamModel.EndAt, now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to return reservation_slots: "+err.Error())
+	}
+
+	// 開始前に付いたライブコメントは、モデレーションでの削除と同じく監査のため削除済みにするだけにする
+	var canceledLivecommentIDs []LivecommentID
+	if err := tx.SelectContext(ctx, &canceledLivecommentIDs, "SELECT id FROM livecomments WHERE livestream_id = ? AND deleted_at IS NULL FOR UPDATE", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+	}
+	if len(canceledLivecommentIDs) > 0 {
+		if err := subtractLivecommentTips(ctx, tx, livestreamModel.UserID, canceledLivecommentIDs); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to update tip aggregate: "+err.Error())
+		}
+		if _, err := tx.ExecContext(ctx, "UPDATE livecomments SET deleted_at = ? WHERE livestream_id = ? AND deleted_at IS NULL", now, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livecomments: "+err.Error())
+		}
+	}
+
+	// 報告を消すと件数のキャッシュが古くなるので、削除済みのコメントの分も含めて消す
+	var reportedLivecommentIDs []LivecommentID
+	if err := tx.SelectContext(ctx, &reportedLivecommentIDs, "SELECT livecomment_id FROM livecomment_report_counts WHERE livestream_id = ?", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomment report counts: "+err.Error())
+	}
+
+	// 配信にぶら下がるデータのうち、監査に使わないものを消す
+	for _, query := range []string{
+		"DELETE FROM reactions WHERE livestream_id = ?",
+		"DELETE FROM ng_words WHERE livestream_id = ?",
+		"DELETE FROM livestream_viewers_history WHERE livestream_id = ?",
+		"DELETE FROM livestream_tags WHERE livestream_id = ?",
+		"DELETE FROM livestream_collaborators WHERE livestream_id = ?",
+		"DELETE FROM notifications WHERE livestream_id = ?",
+		"DELETE FROM livestream_reports WHERE livestream_id = ?",
+		"DELETE FROM livestream_report_counts WHERE livestream_id = ?",
+		"DELETE FROM livecomment_reports WHERE livestream_id = ?",
+		"DELETE FROM livecomment_report_counts WHERE livestream_id = ?",
+		"DELETE FROM livestream_chat_settings WHERE livestream_id = ?",
+		"DELETE FROM livestream_stream_keys WHERE livestream_id = ?",
+		"DELETE FROM livestreams WHERE id = ?",
+	} {
+		if _, err := tx.ExecContext(ctx, query, livestreamID); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete livestream: "+err.Error())
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	invalidateLivestreamCaches(livestreamModel.ID)
+	if len(canceledLivecommentIDs) > 0 || len(reportedLivecommentIDs) > 0 {
+		ReportCountByLivecommentIDCacheMutex.Lock()
+		for _, id := range append(canceledLivecommentIDs, reportedLivecommentIDs...) {
+			delete(ReportCountByLivecommentIDCache, id)
+		}
+		ReportCountByLivecommentIDCacheMutex.Unlock()
+	}
+	ChatSettingsByLivestreamIDCacheMutex.Lock()
+	delete(ChatSettingsByLivestreamIDCache, livestreamModel.ID)
+	ChatSettingsByLivestreamIDCacheMutex.Unlock()
+	removeLivestreamFromTagIndex(livestreamModel.ID)
+	expireReservationSlotsCache()
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 自分の配信であることを確かめつつ行ロックを取る
+func getOwnLivestreamForUpdate(ctx context.Context, tx *sqlx.Tx, livestreamID LivestreamID, userID UserID) (LivestreamModel, error) {
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ? FOR UPDATE", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return LivestreamModel{}, newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "not found livestream that has the given id")
+		}
+		return LivestreamModel{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return LivestreamModel{}, newCodedHTTPError(http.StatusForbidden, errorCodeNotLivestreamOwner, "can't modify other streamer's livestream")
+	}
+	return livestreamModel, nil
+}
+
+// 配信の内容が変わったときに、配信を埋め込んでいるキャッシュをまとめて消す
+func invalidateLivestreamCaches(livestreamID LivestreamID) {
+	bumpLivestreamVersion(livestreamID)
+	LivestreamByIDCacheMutex.Lock()
+	delete(LivestreamByIDCache, livestreamID)
+	LivestreamByIDCacheMutex.Unlock()
+
+	LivecommentByIDCacheMutex.Lock()
+	for id, lc := range LivecommentByIDCache {
+		if lc.Livestream.ID == livestreamID {
+			delete(LivecommentByIDCache, id)
+		}
+	}
+	LivecommentByIDCacheMutex.Unlock()
+
+	NGWordMatcherByLivestreamIDCacheMutex.Lock()
+	delete(NGWordMatcherByLivestreamIDCache, livestreamID)
+	NGWordMatcherByLivestreamIDCacheMutex.Unlock()
+
+	ReactionCountsByLivestreamIDCacheMutex.Lock()
+	delete(ReactionCountsByLivestreamIDCache, livestreamID)
+	ReactionCountsByLivestreamIDCacheMutex.Unlock()
+
+	deleteCollaboratorIDsCache(livestreamID)
+}
+
 func getLivecommentReportsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
@@ -436,7 +853,7 @@ func getLivecommentReportsHandler(c echo.Context) error {
 
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -453,10 +870,10 @@ func getLivecommentReportsHandler(c echo.Context) error {
 	// error already check
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already check
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
 
 	if livestreamModel.UserID != userID {
-		return echo.NewHTTPError(http.StatusForbidden, "can't get other streamer's livecomment reports")
+		return newCodedHTTPError(http.StatusForbidden, errorCodeNotLivestreamOwner, "can't get other streamer's livecomment reports")
 	}
 
 	var reportModels []*LivecommentReportModel
@@ -484,11 +901,25 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 		return cached, nil
 	}
 
-	ownerModel := UserModel{}
-	if err := tx.GetContext(ctx, &ownerModel, "SELECT * FROM users WHERE id = ?", livestreamModel.UserID); err != nil {
+	livestream, err := buildLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return Livestream{}, err
+	}
+
+	LivestreamByIDCacheMutex.Lock()
+	LivestreamByIDCache[livestreamModel.ID] = livestream
+	LivestreamByIDCacheMutex.Unlock()
+
+	return livestream, nil
+}
+
+// キャッシュを見ずに組み立てる。コミット前のトランザクションから読んだ内容はキャッシュに載せないよう、更新系のハンドラではこちらを使う
+func buildLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (Livestream, error) {
+	ownerModel, err := userRepository.GetByID(ctx, tx, livestreamModel.UserID)
+	if err != nil {
 		return Livestream{}, err
 	}
-	owner, err := fillUserResponse(ctx, tx, ownerModel)
+	owner, err := userRepository.Fill(ctx, tx, ownerModel)
 	if err != nil {
 		return Livestream{}, err
 	}
@@ -530,127 +961,126 @@ func fillLivestreamResponse(ctx context.Context, tx *sqlx.Tx, livestreamModel Li
 		ThumbnailUrl: livestreamModel.ThumbnailUrl,
 		StartAt:      livestreamModel.StartAt,
 		EndAt:        livestreamModel.EndAt,
+		Status:       livestreamModel.Status,
 	}
 
-	LivestreamByIDCacheMutex.Lock()
-	LivestreamByIDCache[livestreamModel.ID] = livestream
-	LivestreamByIDCacheMutex.Unlock()
-
 	return livestream, nil
 }
 
 // N+1問題を解消するためにbulkで取得する
 func fillLivestreamResponseBulk(ctx context.Context, tx *sqlx.Tx, livestreamModels []*LivestreamModel) ([]Livestream, error) {
-	// livestreams := make([]Livestream, len(livestreamModels))
-
-	// ownerIDs := make([]int64, len(livestreamModels))
-	// for i := range livestreamModels {
-	// 	ownerIDs[i] = livestreamModels[i].UserID
-	// }
-
-	// if len(ownerIDs) == 0 {
-	// 	return []Livestream{}, nil
-	// }
-
-	// query, params, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", ownerIDs)
-	// if err != nil {
-	// 	return []Livestream{}, err
-	// }
-
-	// userModels := make([]*UserModel, 0, len(ownerIDs))
-	// if err := tx.SelectContext(ctx, &userModels, query, params...); err != nil {
-	// 	return []Livestream{}, err
-	// }
-
-	// userMap := make(map[int64]User)
-
-	// users, err := fillUserResponseBulk(ctx, tx, userModels)
-	// if err != nil {
-	// 	return []Livestream{}, err
-	// }
-	// for _, user := range users {
-	// 	userMap[user.ID] = user
-	// }
-
-	// var allLivestreamTagModels []*LivestreamTagModel
-	// livestreamIDs := make([]int64, len(livestreamModels))
-	// for i := range livestreamModels {
-	// 	livestreamIDs[i] = livestreamModels[i].ID
-	// }
-	// livestreamTagModelsMap := make(map[int64][]*LivestreamTagModel)
-
-	// if len(livestreamIDs) > 0 {
-	// 	query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE livestream_id IN (?)", livestreamIDs)
-	// 	if err != nil {
-	// 		return []Livestream{}, err
-	// 	}
-	// 	if err := tx.SelectContext(ctx, &allLivestreamTagModels, query, params...); err != nil {
-	// 		return []Livestream{}, err
-	// 	}
-
-	// 	for i := range allLivestreamTagModels {
-	// 		livestreamTagModel := allLivestreamTagModels[i]
-	// 		livestreamTagModelsMap[livestreamTagModel.LivestreamID] = append(livestreamTagModelsMap[livestreamTagModel.LivestreamID], livestreamTagModel)
-	// 	}
-	// }
-
-	// var allTagIDs []int64
-	// for _, livestreamTagModels := range livestreamTagModelsMap {
-	// 	for _, livestreamTagModel := range livestreamTagModels {
-	// 		allTagIDs = append(allTagIDs, livestreamTagModel.TagID)
-	// 	}
-	// }
-
-	// tags := make([]Tag, 0, len(allTagIDs))
-	// tagsMap := map[int64][]Tag{}
-	// if len(allTagIDs) > 0 {
-	// 	query, params, err := sqlx.In("SELECT * FROM tags WHERE id IN (?)", allTagIDs)
-	// 	if err != nil {
-	// 		return []Livestream{}, err
-	// 	}
-	// 	if err := tx.SelectContext(ctx, &tags, query, params...); err != nil {
-	// 		return []Livestream{}, err
-	// 	}
-
-	// 	for _, tag := range tags {
-	// 		tagsMap[tag.ID] = append(tagsMap[tag.ID], tag)
-	// 	}
-	// }
-
-	// for i := range livestreamModels {
-	// 	livestreamModel := livestreamModels[i]
-	// 	owner := userMap[livestreamModel.UserID]
-	// 	livestreamTagModels := livestreamTagModelsMap[livestreamModel.ID]
-
-	// 	tags := make([]Tag, 0, len(livestreamTagModels))
-	// 	for _, livestreamTagModel := range livestreamTagModels {
-	// 		tags = append(tags, tagsMap[livestreamTagModel.TagID]...)
-	// 	}
-
-	// 	livestream := Livestream{
-	// 		ID:           livestreamModel.ID,
-	// 		Owner:        owner,
-	// 		Title:        livestreamModel.Title,
-	// 		Tags:         tags,
-	// 		Description:  livestreamModel.Description,
-	// 		PlaylistUrl:  livestreamModel.PlaylistUrl,
-	// 		ThumbnailUrl: livestreamModel.ThumbnailUrl,
-	// 		StartAt:      livestreamModel.StartAt,
-	// 		EndAt:        livestreamModel.EndAt,
-	// 	}
-
-	// 	livestreams[i] = livestream
-	// }
-
-	// return livestreams, nil
+	if len(livestreamModels) == 0 {
+		return []Livestream{}, nil
+	}
 
 	livestreams := make([]Livestream, len(livestreamModels))
-	for i, userModel := range livestreamModels {
-		livestream, err := fillLivestreamResponse(ctx, tx, *userModel)
+	uncachedIndexes := make([]int, 0, len(livestreamModels))
+
+	LivestreamByIDCacheMutex.RLock()
+	for i, livestreamModel := range livestreamModels {
+		if cached, ok := LivestreamByIDCache[livestreamModel.ID]; ok {
+			livestreams[i] = cached
+		} else {
+			uncachedIndexes = append(uncachedIndexes, i)
+		}
+	}
+	LivestreamByIDCacheMutex.RUnlock()
+
+	if len(uncachedIndexes) == 0 {
+		return livestreams, nil
+	}
+
+	ownerIDSet := make(map[UserID]struct{}, len(uncachedIndexes))
+	livestreamIDs := make([]LivestreamID, 0, len(uncachedIndexes))
+	for _, i := range uncachedIndexes {
+		ownerIDSet[livestreamModels[i].UserID] = struct{}{}
+		livestreamIDs = append(livestreamIDs, livestreamModels[i].ID)
+	}
+	ownerIDs := make([]UserID, 0, len(ownerIDSet))
+	for id := range ownerIDSet {
+		ownerIDs = append(ownerIDs, id)
+	}
+
+	// 配信者をまとめて取得
+	ownerModels, err := userRepository.ListByIDs(ctx, tx, ownerIDs)
+	if err != nil {
+		return nil, err
+	}
+	owners, err := userRepository.FillBulk(ctx, tx, ownerModels)
+	if err != nil {
+		return nil, err
+	}
+	ownerMap := make(map[UserID]User, len(owners))
+	for _, owner := range owners {
+		ownerMap[owner.ID] = owner
+	}
+
+	// タグをまとめて取得
+	var livestreamTagModels []*LivestreamTagModel
+	query, params, err := sqlx.In("SELECT * FROM livestream_tags WHERE livestream_id IN (?)", livestreamIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := tx.SelectContext(ctx, &livestreamTagModels, tx.Rebind(query), params...); err != nil {
+		return nil, err
+	}
+
+	tagIDSet := make(map[int64]struct{}, len(livestreamTagModels))
+	for _, livestreamTagModel := range livestreamTagModels {
+		tagIDSet[livestreamTagModel.TagID] = struct{}{}
+	}
+	tagMap := make(map[int64]Tag, len(tagIDSet))
+	if len(tagIDSet) > 0 {
+		tagIDs := make([]int64, 0, len(tagIDSet))
+		for id := range tagIDSet {
+			tagIDs = append(tagIDs, id)
+		}
+		query, params, err = sqlx.In("SELECT * FROM tags WHERE id IN (?)", tagIDs)
 		if err != nil {
-			return []Livestream{}, err
+			return nil, err
+		}
+		var tagModels []*TagModel
+		if err := tx.SelectContext(ctx, &tagModels, tx.Rebind(query), params...); err != nil {
+			return nil, err
+		}
+		for _, tagModel := range tagModels {
+			tagMap[tagModel.ID] = Tag{
+				ID:   tagModel.ID,
+				Name: tagModel.Name,
+			}
+		}
+	}
+
+	tagsByLivestreamID := make(map[LivestreamID][]Tag, len(livestreamIDs))
+	for _, livestreamTagModel := range livestreamTagModels {
+		if tag, ok := tagMap[livestreamTagModel.TagID]; ok {
+			tagsByLivestreamID[livestreamTagModel.LivestreamID] = append(tagsByLivestreamID[livestreamTagModel.LivestreamID], tag)
+		}
+	}
+
+	LivestreamByIDCacheMutex.Lock()
+	for _, i := range uncachedIndexes {
+		livestreamModel := livestreamModels[i]
+		tags := tagsByLivestreamID[livestreamModel.ID]
+		if tags == nil {
+			tags = []Tag{}
+		}
+		livestream := Livestream{
+			ID:           livestreamModel.ID,
+			Owner:        ownerMap[livestreamModel.UserID],
+			Title:        livestreamModel.Title,
+			Tags:         tags,
+			Description:  livestreamModel.Description,
+			PlaylistUrl:  livestreamModel.PlaylistUrl,
+			ThumbnailUrl: livestreamModel.ThumbnailUrl,
+			StartAt:      livestreamModel.StartAt,
+			EndAt:        livestreamModel.EndAt,
+			Status:       livestreamModel.Status,
 		}
 		livestreams[i] = livestream
+		LivestreamByIDCache[livestreamModel.ID] = livestream
 	}
+	LivestreamByIDCacheMutex.Unlock()
+
 	return livestreams, nil
 }
@@ -0,0 +1,196 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 配信の状態は upcoming → live → ended の順にしか進まない
+const (
+	livestreamStatusUpcoming = "upcoming"
+	livestreamStatusLive     = "live"
+	livestreamStatusEnded    = "ended"
+
+	livestreamLifecycleTickPeriod = 5 * time.Second
+)
+
+// start_at/end_atから本来の状態を求める
+func livestreamStatusAt(startAt int64, endAt int64, now int64) string {
+	switch {
+	case now >= endAt:
+		return livestreamStatusEnded
+	case now >= startAt:
+		return livestreamStatusLive
+	default:
+		return livestreamStatusUpcoming
+	}
+}
+
+// 配信を予定より早く始めるAPI
+// POST /api/livestream/:livestream_id/start
+func startLivestreamHandler(c echo.Context) error {
+	return transitLivestreamStatus(c, livestreamStatusLive, livestreamStatusUpcoming)
+}
+
+// 配信を予定より早く終えるAPI
+// POST /api/livestream/:livestream_id/end
+func endLivestreamHandler(c echo.Context) error {
+	return transitLivestreamStatus(c, livestreamStatusEnded, livestreamStatusUpcoming, livestreamStatusLive)
+}
+
+func transitLivestreamStatus(c echo.Context, to string, from ...string) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	livestreamModel, err := getOwnLivestreamForUpdate(ctx, tx, LivestreamID(livestreamID), userID)
+	if err != nil {
+		return err
+	}
+
+	allowed := false
+	for _, status := range from {
+		if livestreamModel.Status == status {
+			allowed = true
+			break
+		}
+	}
+	if !allowed {
+		return echo.NewHTTPError(http.StatusBadRequest, "can't change livestream status from "+livestreamModel.Status+" to "+to)
+	}
+
+	if _, err := tx.ExecContext(ctx, "UPDATE livestreams SET status = ? WHERE id = ?", to, livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update livestream status: "+err.Error())
+	}
+	livestreamModel.Status = to
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// コミット前に消すと、並行するリクエストが古い状態をキャッシュに戻してしまう
+	// 消した後はコミット済みの内容から組み立て直してキャッシュに載せる
+	invalidateLivestreamCaches(livestreamModel.ID)
+	livestream, err := refillLivestreamCache(ctx, livestreamModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestream: "+err.Error())
+	}
+
+	if to == livestreamStatusLive {
+		enqueueNotification(NotificationJob{
+			Type:         notificationTypeFollowingLive,
+			LivestreamID: livestreamModel.ID,
+		})
+	}
+
+	return c.JSON(http.StatusOK, livestream)
+}
+
+func refillLivestreamCache(ctx context.Context, livestreamModel LivestreamModel) (Livestream, error) {
+	tx, err := dbConn.BeginTxx(ctx, &sql.TxOptions{ReadOnly: true})
+	if err != nil {
+		return Livestream{}, err
+	}
+	defer tx.Rollback()
+
+	livestream, err := fillLivestreamResponse(ctx, tx, livestreamModel)
+	if err != nil {
+		return Livestream{}, err
+	}
+	return livestream, tx.Commit()
+}
+
+// start_at/end_atを過ぎた配信の状態を定期的に進める
+func runLivestreamLifecycleTicker() {
+	ticker := time.NewTicker(livestreamLifecycleTickPeriod)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		if err := advanceLivestreamStatuses(context.Background(), now.Unix()); err != nil {
+			log.Printf("failed to advance livestream statuses: %+v", err)
+		}
+	}
+}
+
+// 初期データはstatusが既定値のままなので、start_at/end_atから一括で合わせる
+func syncLivestreamStatuses(ctx context.Context, now int64) error {
+	_, err := dbConn.ExecContext(ctx, `
+	UPDATE livestreams SET status = CASE
+		WHEN end_at <= ? THEN 'ended'
+		WHEN start_at <= ? THEN 'live'
+		ELSE 'upcoming'
+	END
+	`, now, now)
+	return err
+}
+
+func advanceLivestreamStatuses(ctx context.Context, now int64) error {
+	for _, transition := range []struct {
+		to    string
+		query string
+	}{
+		{livestreamStatusEnded, "SELECT id FROM livestreams WHERE status IN ('upcoming', 'live') AND end_at <= ?"},
+		{livestreamStatusLive, "SELECT id FROM livestreams WHERE status = 'upcoming' AND start_at <= ?"},
+	} {
+		var livestreamIDs []LivestreamID
+		if err := dbConn.SelectContext(ctx, &livestreamIDs, transition.query, now); err != nil && !errors.Is(err, sql.ErrNoRows) {
+			return err
+		}
+		if len(livestreamIDs) == 0 {
+			continue
+		}
+
+		// 手動で先に進められた配信を巻き戻さないよう、遷移元の状態も条件に入れる
+		// 1件ずつ更新し、実際に状態を進めた場合だけ通知する (複数プロセスや手動の遷移と重なっても1回になる)
+		for _, id := range livestreamIDs {
+			rs, err := dbConn.ExecContext(ctx, "UPDATE livestreams SET status = ? WHERE id = ? AND status <> ? AND status <> 'ended'", transition.to, id, transition.to)
+			if err != nil {
+				return err
+			}
+			affected, err := rs.RowsAffected()
+			if err != nil {
+				return err
+			}
+			if affected == 0 {
+				continue
+			}
+
+			invalidateLivestreamCaches(id)
+			if transition.to == livestreamStatusLive {
+				enqueueNotification(NotificationJob{
+					Type:         notificationTypeFollowingLive,
+					LivestreamID: id,
+				})
+			}
+		}
+	}
+
+	return nil
+}
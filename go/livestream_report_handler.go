@@ -0,0 +1,264 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// 利用規約に違反している配信の報告。同じユーザは同じ配信を1回しか報告できない
+// 配信ごとの報告数はlivestream_report_countsに数えておき、運営の確認キューに多い順に並べる
+const (
+	livestreamReportReasonSpam       = "spam"
+	livestreamReportReasonHarassment = "harassment"
+	livestreamReportReasonViolence   = "violence"
+	livestreamReportReasonSexual     = "sexual"
+	livestreamReportReasonCopyright  = "copyright"
+	livestreamReportReasonOther      = "other"
+
+	defaultLivestreamReportQueueLimit = 20
+	maxLivestreamReportQueueLimit     = 100
+)
+
+var livestreamReportReasons = []string{
+	livestreamReportReasonSpam,
+	livestreamReportReasonHarassment,
+	livestreamReportReasonViolence,
+	livestreamReportReasonSexual,
+	livestreamReportReasonCopyright,
+	livestreamReportReasonOther,
+}
+
+type LivestreamReportModel struct {
+	ID           int64        `db:"id"`
+	UserID       UserID       `db:"user_id"`
+	LivestreamID LivestreamID `db:"livestream_id"`
+	Reason       string       `db:"reason"`
+	Detail       string       `db:"detail"`
+	CreatedAt    int64        `db:"created_at"`
+}
+
+type LivestreamReport struct {
+	ID           int64        `json:"id"`
+	LivestreamID LivestreamID `json:"livestream_id"`
+	Reason       string       `json:"reason"`
+	Detail       string       `json:"detail"`
+	CreatedAt    int64        `json:"created_at"`
+}
+
+type PostLivestreamReportRequest struct {
+	Reason string `json:"reason" validate:"required"`
+	Detail string `json:"detail" validate:"max=1000"`
+}
+
+type LivestreamReportQueueEntry struct {
+	Livestream     Livestream `json:"livestream"`
+	ReportCount    int64      `json:"report_count"`
+	LastReportedAt int64      `json:"last_reported_at"`
+	// 理由ごとの報告数
+	Reasons map[string]int64 `json:"reasons"`
+}
+
+type livestreamReportCountModel struct {
+	LivestreamID   LivestreamID `db:"livestream_id"`
+	ReportCount    int64        `db:"report_count"`
+	LastReportedAt int64        `db:"last_reported_at"`
+}
+
+// 配信の報告API
+// POST /api/livestream/:livestream_id/report
+func postLivestreamReportHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	req := PostLivestreamReportRequest{}
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+	if !slices.Contains(livestreamReportReasons, req.Reason) {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "unknown report reason: "+req.Reason)
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var ownerID UserID
+	if err := tx.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if ownerID == userID {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeOwnLivestream, "can't report own livestream")
+	}
+
+	reportModel := LivestreamReportModel{
+		UserID:       userID,
+		LivestreamID: LivestreamID(livestreamID),
+		Reason:       req.Reason,
+		Detail:       req.Detail,
+		CreatedAt:    time.Now().Unix(),
+	}
+	rs, err := tx.NamedExecContext(ctx, "INSERT IGNORE INTO livestream_reports (user_id, livestream_id, reason, detail, created_at) VALUES (:user_id, :livestream_id, :reason, :detail, :created_at)", &reportModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert livestream report: "+err.Error())
+	}
+	if affected, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	} else if affected == 0 {
+		return newCodedHTTPError(http.StatusConflict, errorCodeAlreadyReported, "the livestream is already reported")
+	}
+	reportID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted livestream report id: "+err.Error())
+	}
+	reportModel.ID = reportID
+
+	if _, err := tx.ExecContext(ctx, "INSERT INTO livestream_report_counts (livestream_id, report_count, last_reported_at) VALUES (?, 1, ?) ON DUPLICATE KEY UPDATE report_count = report_count + 1, last_reported_at = VALUES(last_reported_at)", livestreamID, reportModel.CreatedAt); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream reports: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, LivestreamReport{
+		ID:           reportModel.ID,
+		LivestreamID: reportModel.LivestreamID,
+		Reason:       reportModel.Reason,
+		Detail:       reportModel.Detail,
+		CreatedAt:    reportModel.CreatedAt,
+	})
+}
+
+// 報告された配信の確認キュー (運営向け)。報告数の多い順
+// GET /api/admin/reports
+func getLivestreamReportQueueHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	limit := defaultLivestreamReportQueueLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l <= 0 || l > maxLivestreamReportQueueLimit {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "limit query parameter must be between 1 and 100")
+		}
+		limit = l
+	}
+	offset := 0
+	if c.QueryParam("offset") != "" {
+		o, err := strconv.Atoi(c.QueryParam("offset"))
+		if err != nil || o < 0 {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "offset query parameter must be non-negative integer")
+		}
+		offset = o
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 次のページがあるかを知るために1件多く取る
+	var countModels []livestreamReportCountModel
+	if err := tx.SelectContext(ctx, &countModels, "SELECT * FROM livestream_report_counts ORDER BY report_count DESC, last_reported_at DESC, livestream_id DESC LIMIT ? OFFSET ?", limit+1, offset); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream report counts: "+err.Error())
+	}
+	page := pageInfo{total: -1, cursorParam: "offset"}
+	if len(countModels) > limit {
+		countModels = countModels[:limit]
+		page.nextCursor = strconv.Itoa(offset + limit)
+	}
+
+	entries := make([]LivestreamReportQueueEntry, 0, len(countModels))
+	if len(countModels) > 0 {
+		livestreamIDs := make([]LivestreamID, len(countModels))
+		for i, countModel := range countModels {
+			livestreamIDs[i] = countModel.LivestreamID
+		}
+
+		query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+		}
+		var livestreamModels []*LivestreamModel
+		if err := tx.SelectContext(ctx, &livestreamModels, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		livestreams, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+		}
+		livestreamByID := make(map[LivestreamID]Livestream, len(livestreams))
+		for _, livestream := range livestreams {
+			livestreamByID[livestream.ID] = livestream
+		}
+
+		query, args, err = sqlx.In("SELECT livestream_id, reason, COUNT(*) AS cnt FROM livestream_reports WHERE livestream_id IN (?) GROUP BY livestream_id, reason", livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+		}
+		var reasonCounts []struct {
+			LivestreamID LivestreamID `db:"livestream_id"`
+			Reason       string       `db:"reason"`
+			Count        int64        `db:"cnt"`
+		}
+		if err := tx.SelectContext(ctx, &reasonCounts, query, args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream report reasons: "+err.Error())
+		}
+		reasonsByID := make(map[LivestreamID]map[string]int64, len(countModels))
+		for _, reasonCount := range reasonCounts {
+			if reasonsByID[reasonCount.LivestreamID] == nil {
+				reasonsByID[reasonCount.LivestreamID] = make(map[string]int64)
+			}
+			reasonsByID[reasonCount.LivestreamID][reasonCount.Reason] = reasonCount.Count
+		}
+
+		for _, countModel := range countModels {
+			livestream, ok := livestreamByID[countModel.LivestreamID]
+			if !ok {
+				// 報告後に削除された配信
+				continue
+			}
+			entries = append(entries, LivestreamReportQueueEntry{
+				Livestream:     livestream,
+				ReportCount:    countModel.ReportCount,
+				LastReportedAt: countModel.LastReportedAt,
+				Reasons:        reasonsByID[countModel.LivestreamID],
+			})
+		}
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	setPageHeaders(c, page)
+	return c.JSON(http.StatusOK, entries)
+}
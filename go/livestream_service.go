@@ -0,0 +1,108 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"strings"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// 配信の予約。リクエストやセッションには触れず、返すエラーはハンドラでserviceHTTPErrorに通す
+type LivestreamService struct {
+	db    *sqlx.DB
+	clock Clock
+}
+
+// 予約枠を1つずつ減らして配信を作成し、タグの索引に載せる
+func (s *LivestreamService) Reserve(ctx context.Context, userID UserID, req ReserveLivestreamRequest) (Livestream, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return Livestream{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// 2023/11/25 10:00からの１年間の期間内であるかチェック
+	var (
+		termStartAt    = time.Date(2023, 11, 25, 1, 0, 0, 0, time.UTC)
+		termEndAt      = time.Date(2024, 11, 25, 1, 0, 0, 0, time.UTC)
+		reserveStartAt = time.Unix(req.StartAt, 0)
+		reserveEndAt   = time.Unix(req.EndAt, 0)
+	)
+	if (reserveStartAt.Equal(termEndAt) || reserveStartAt.After(termEndAt)) || (reserveEndAt.Equal(termStartAt) || reserveEndAt.Before(termStartAt)) {
+		return Livestream{}, newServiceError(serviceErrorInvalid, "", "bad reservation time range")
+	}
+
+	// 予約枠を1つの条件付きUPDATEで減らし、残数のない枠が含まれていれば更新件数が足りなくなるのでロールバックする
+	var slotCount int64
+	if err := tx.GetContext(ctx, &slotCount, "SELECT COUNT(*) FROM reservation_slots FORCE INDEX("+SLOTS_RANGE_INDEX+") WHERE start_at >= ? AND end_at <= ?", req.StartAt, req.EndAt); err != nil {
+		return Livestream{}, fmt.Errorf("failed to count reservation_slots: %w", err)
+	}
+
+	result, err := tx.ExecContext(ctx, "UPDATE reservation_slots SET slot = slot - 1 WHERE start_at >= ? AND end_at <= ? AND slot > 0", req.StartAt, req.EndAt)
+	if err != nil {
+		return Livestream{}, fmt.Errorf("failed to update reservation_slot: %w", err)
+	}
+	updated, err := result.RowsAffected()
+	if err != nil {
+		return Livestream{}, fmt.Errorf("failed to get affected rows: %w", err)
+	}
+	if updated != slotCount {
+		return Livestream{}, newServiceError(serviceErrorInvalid, errorCodeSlotUnavailable, fmt.Sprintf("予約期間 %d ~ %dに対して、予約区間 %d ~ %dが予約できません", termStartAt.Unix(), termEndAt.Unix(), req.StartAt, req.EndAt))
+	}
+
+	var (
+		livestreamModel = &LivestreamModel{
+			UserID:       userID,
+			Title:        req.Title,
+			Description:  req.Description,
+			PlaylistUrl:  req.PlaylistUrl,
+			ThumbnailUrl: req.ThumbnailUrl,
+			StartAt:      req.StartAt,
+			EndAt:        req.EndAt,
+			Status:       livestreamStatusAt(req.StartAt, req.EndAt, s.clock.Now().Unix()),
+		}
+	)
+
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO livestreams (user_id, title, description, playlist_url, thumbnail_url, start_at, end_at, status) VALUES(:user_id, :title, :description, :playlist_url, :thumbnail_url, :start_at, :end_at, :status)", livestreamModel)
+	if err != nil {
+		return Livestream{}, fmt.Errorf("failed to insert livestream: %w", err)
+	}
+
+	livestreamID, err := rs.LastInsertId()
+	if err != nil {
+		return Livestream{}, fmt.Errorf("failed to get last inserted livestream id: %w", err)
+	}
+	livestreamModel.ID = LivestreamID(livestreamID)
+
+	if len(req.Tags) > 0 {
+		values := make([]string, 0, len(req.Tags))
+		for _, tagID := range req.Tags {
+			values = append(values, fmt.Sprintf("(%d, %d)", livestreamID, tagID))
+		}
+		query := fmt.Sprintf("INSERT INTO livestream_tags (livestream_id, tag_id) VALUES %s", strings.Join(values, ","))
+		if _, err := tx.ExecContext(ctx, query); err != nil {
+			return Livestream{}, fmt.Errorf("failed to insert livestream tags: %w", err)
+		}
+	}
+
+	livestream, err := fillLivestreamResponse(ctx, tx, *livestreamModel)
+	if err != nil {
+		return Livestream{}, fmt.Errorf("failed to fill livestream: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Livestream{}, fmt.Errorf("failed to commit: %w", err)
+	}
+
+	expireReservationSlotsCache()
+
+	tagNames := make([]string, len(livestream.Tags))
+	for i, tag := range livestream.Tags {
+		tagNames[i] = tag.Name
+	}
+	addLivestreamToTagIndex(livestream.ID, tagNames)
+
+	return livestream, nil
+}
@@ -0,0 +1,63 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strconv"
+
+	"github.com/labstack/echo/v4"
+)
+
+// メディアサーバのポート (main()で設定する)
+var (
+	mediaRTMPPort = defaultMediaRTMPPort
+	mediaHLSPort  = defaultMediaHLSPort
+)
+
+type LivestreamURLsResponse struct {
+	// ストリームキーは含まない。OBSなどには別にキーを設定する
+	IngestURL   string `json:"ingest_url"`
+	PlaybackURL string `json:"playback_url"`
+}
+
+// PowerDNSに登録している配信者のサブドメインから組み立てる
+func livestreamURLs(ownerName string, livestreamID LivestreamID) LivestreamURLsResponse {
+	host := ownerName + "." + userSubdomainZone
+	return LivestreamURLsResponse{
+		IngestURL:   fmt.Sprintf("rtmp://%s/live", net.JoinHostPort(host, strconv.Itoa(mediaRTMPPort))),
+		PlaybackURL: fmt.Sprintf("http://%s/hls/%d/index.m3u8", net.JoinHostPort(host, strconv.Itoa(mediaHLSPort)), livestreamID),
+	}
+}
+
+// 配信の取り込み (RTMP)・再生 (HLS) URLの取得API
+// GET /api/livestream/:livestream_id/urls
+func getLivestreamURLsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	var ownerID UserID
+	if err := dbConn.GetContext(ctx, &ownerID, "SELECT user_id FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	ownerName, err := userRepository.GetNameByID(ctx, dbConn, ownerID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream owner: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, livestreamURLs(ownerName, LivestreamID(livestreamID)))
+}
@@ -4,47 +4,65 @@ package main
 // sqlx的な参考: https://jmoiron.github.io/sqlx/
 
 import (
+	"context"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"net/http"
 	"os"
-	"os/exec"
+	"os/signal"
 	"strconv"
 	"sync"
+	"syscall"
+	"time"
 
 	"github.com/go-sql-driver/mysql"
 	"github.com/jmoiron/sqlx"
 	"github.com/kaz/pprotein/integration/echov4"
 	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
 
 	"github.com/gorilla/sessions"
 	"github.com/labstack/echo-contrib/session"
 	echolog "github.com/labstack/gommon/log"
+	"golang.org/x/net/http2"
 )
 
 const (
-	listenPort                     = 8080
-	powerDNSSubdomainAddressEnvKey = "ISUCON13_POWERDNS_SUBDOMAIN_ADDRESS"
+	// コメント・リアクションのポーリングを1コネクションに多重化する
+	h2cMaxConcurrentStreams = 250
+	h2cIdleTimeout          = 120 * time.Second
+
+	// SIGTERMを受けてから処理中のリクエストを待つ時間
+	shutdownTimeout = 10 * time.Second
 )
 
 var (
-	powerDNSSubdomainAddress     string
 	dbConn                       *sqlx.DB
-	secret                       = []byte("isucon13_session_cookiestore_defaultsecret")
 	IconHashByUsernameCache      = make(map[string]string)
 	IconHashByUsernameCacheMutex = sync.RWMutex{}
-	IconHashByUserIDCache        = make(map[int64]string)
+	IconHashByUserIDCache        = make(map[UserID]string)
 	IconHashByUserIDCacheMutex   = sync.RWMutex{}
-	UserByIDCache                = make(map[int64]User)
+	UserByIDCache                = make(map[UserID]User)
 	UserByIDCacheMutex           = sync.RWMutex{}
-	LivestreamByIDCache          = make(map[int64]Livestream)
+	ThemeByUserIDCache           = make(map[UserID]ThemeModel)
+	ThemeByUserIDCacheMutex      = sync.RWMutex{}
+	UserIDByNameCache            = make(map[string]UserID)
+	UserIDByNameCacheMutex       = sync.RWMutex{}
+	LivestreamByIDCache          = make(map[LivestreamID]Livestream)
 	LivestreamByIDCacheMutex     = sync.RWMutex{}
-	LivecommentByIDCache         = make(map[int64]Livecomment)
+	LivecommentByIDCache         = make(map[LivecommentID]Livecomment)
 	LivecommentByIDCacheMutex    = sync.RWMutex{}
+	// ライブコメントごとのスパム報告数
+	ReportCountByLivecommentIDCache      = make(map[LivecommentID]int64)
+	ReportCountByLivecommentIDCacheMutex = sync.RWMutex{}
+	// ライブ配信ごとの絵文字別リアクション数
+	ReactionCountsByLivestreamIDCache      = make(map[LivestreamID]map[string]int64)
+	ReactionCountsByLivestreamIDCacheMutex = sync.RWMutex{}
 )
 
-func deleteLivestreamByIDCacheByOwnerID(ownerID int64) error {
+func deleteLivestreamByIDCacheByOwnerID(ownerID UserID) error {
 	LivestreamByIDCacheMutex.Lock()
 	defer LivestreamByIDCacheMutex.Unlock()
 
@@ -57,12 +75,13 @@ func deleteLivestreamByIDCacheByOwnerID(ownerID int64) error {
 	return nil
 }
 
-func deleteLivecommentByIDCacheByOwnerID(ownerID int64) error {
+func deleteLivecommentByIDCacheByOwnerID(ownerID UserID) error {
 	LivecommentByIDCacheMutex.Lock()
 	defer LivecommentByIDCacheMutex.Unlock()
 
 	for id, lc := range LivecommentByIDCache {
-		if lc.Livestream.Owner.ID == ownerID {
+		// 配信者としてだけでなくコメント投稿者としても埋め込まれている
+		if lc.Livestream.Owner.ID == ownerID || lc.User.ID == ownerID {
 			delete(LivecommentByIDCache, id)
 		}
 	}
@@ -72,69 +91,57 @@ func deleteLivecommentByIDCacheByOwnerID(ownerID int64) error {
 
 func init() {
 	log.SetFlags(log.Ldate | log.Ltime | log.Lshortfile)
-	if secretKey, ok := os.LookupEnv("ISUCON13_SESSION_SECRETKEY"); ok {
-		secret = []byte(secretKey)
-	}
+
+	registerCacheReset(func() {
+		IconHashByUsernameCacheMutex.Lock()
+		IconHashByUsernameCache = make(map[string]string)
+		IconHashByUsernameCacheMutex.Unlock()
+		IconHashByUserIDCacheMutex.Lock()
+		IconHashByUserIDCache = make(map[UserID]string)
+		IconHashByUserIDCacheMutex.Unlock()
+		UserByIDCacheMutex.Lock()
+		UserByIDCache = make(map[UserID]User)
+		UserByIDCacheMutex.Unlock()
+		ThemeByUserIDCacheMutex.Lock()
+		ThemeByUserIDCache = make(map[UserID]ThemeModel)
+		ThemeByUserIDCacheMutex.Unlock()
+		UserIDByNameCacheMutex.Lock()
+		UserIDByNameCache = make(map[string]UserID)
+		UserIDByNameCacheMutex.Unlock()
+		LivestreamByIDCacheMutex.Lock()
+		LivestreamByIDCache = make(map[LivestreamID]Livestream)
+		LivestreamByIDCacheMutex.Unlock()
+		LivecommentByIDCacheMutex.Lock()
+		LivecommentByIDCache = make(map[LivecommentID]Livecomment)
+		LivecommentByIDCacheMutex.Unlock()
+		ReportCountByLivecommentIDCacheMutex.Lock()
+		ReportCountByLivecommentIDCache = make(map[LivecommentID]int64)
+		ReportCountByLivecommentIDCacheMutex.Unlock()
+		ReactionCountsByLivestreamIDCacheMutex.Lock()
+		ReactionCountsByLivestreamIDCache = make(map[LivestreamID]map[string]int64)
+		ReactionCountsByLivestreamIDCacheMutex.Unlock()
+	})
 }
 
 type InitializeResponse struct {
 	Language string `json:"language"`
 }
 
-func connectDB(logger echo.Logger) (*sqlx.DB, error) {
-	const (
-		networkTypeEnvKey = "ISUCON13_MYSQL_DIALCONFIG_NET"
-		addrEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_ADDRESS"
-		portEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_PORT"
-		userEnvKey        = "ISUCON13_MYSQL_DIALCONFIG_USER"
-		passwordEnvKey    = "ISUCON13_MYSQL_DIALCONFIG_PASSWORD"
-		dbNameEnvKey      = "ISUCON13_MYSQL_DIALCONFIG_DATABASE"
-		parseTimeEnvKey   = "ISUCON13_MYSQL_DIALCONFIG_PARSETIME"
+func connectDB(conf *mysql.Config, maxOpenConns int, debugExplain bool) (*sqlx.DB, error) {
+	var (
+		db  *sqlx.DB
+		err error
 	)
-
-	conf := mysql.NewConfig()
-
-	// 環境変数がセットされていなかった場合でも一旦動かせるように、デフォルト値を入れておく
-	// この挙動を変更して、エラーを出すようにしてもいいかもしれない
-	conf.Net = "tcp"
-	conf.Addr = net.JoinHostPort("127.0.0.1", "3306")
-	conf.User = "isucon"
-	conf.Passwd = "isucon"
-	conf.DBName = "isupipe"
-	conf.ParseTime = true
-
-	if v, ok := os.LookupEnv(networkTypeEnvKey); ok {
-		conf.Net = v
-	}
-	if addr, ok := os.LookupEnv(addrEnvKey); ok {
-		if port, ok2 := os.LookupEnv(portEnvKey); ok2 {
-			conf.Addr = net.JoinHostPort(addr, port)
-		} else {
-			conf.Addr = net.JoinHostPort(addr, "3306")
-		}
-	}
-	if v, ok := os.LookupEnv(userEnvKey); ok {
-		conf.User = v
-	}
-	if v, ok := os.LookupEnv(passwordEnvKey); ok {
-		conf.Passwd = v
+	if debugExplain {
+		db, err = connectSlowQueryLoggingDB(conf)
+	} else {
+		db, err = sqlx.Open("mysql", conf.FormatDSN())
 	}
-	if v, ok := os.LookupEnv(dbNameEnvKey); ok {
-		conf.DBName = v
-	}
-	if v, ok := os.LookupEnv(parseTimeEnvKey); ok {
-		parseTime, err := strconv.ParseBool(v)
-		if err != nil {
-			return nil, fmt.Errorf("failed to parse environment variable '%s' as bool: %+v", parseTimeEnvKey, err)
-		}
-		conf.ParseTime = parseTime
-	}
-
-	db, err := sqlx.Open("mysql", conf.FormatDSN())
 	if err != nil {
 		return nil, err
 	}
-	db.SetMaxOpenConns(10)
+	db.SetMaxOpenConns(maxOpenConns)
+	db.SetMaxIdleConns(maxOpenConns)
 
 	if err := db.Ping(); err != nil {
 		return nil, err
@@ -143,28 +150,87 @@ func connectDB(logger echo.Logger) (*sqlx.DB, error) {
 	return db, nil
 }
 
+// 最初のリクエストで接続を張らずに済むよう、プールの上限まで接続しておく
+func warmUpDB(ctx context.Context, db *sqlx.DB, conns int) error {
+	var (
+		acquired sync.WaitGroup
+		done     sync.WaitGroup
+		mu       sync.Mutex
+		firstErr error
+	)
+	// 全部を同時に握らないと同じ接続が使い回される
+	release := make(chan struct{})
+	for i := 0; i < conns; i++ {
+		acquired.Add(1)
+		done.Add(1)
+		go func() {
+			defer done.Done()
+			conn, err := db.Conn(ctx)
+			if err == nil {
+				err = conn.PingContext(ctx)
+			}
+			acquired.Done()
+			if err != nil {
+				mu.Lock()
+				if firstErr == nil {
+					firstErr = err
+				}
+				mu.Unlock()
+			}
+			<-release
+			if conn != nil {
+				conn.Close()
+			}
+		}()
+	}
+	acquired.Wait()
+	close(release)
+	done.Wait()
+
+	return firstErr
+}
+
 func initializeHandler(c echo.Context) error {
-	// キャッシュをクリア
-	IconHashByUsernameCacheMutex.Lock()
-	IconHashByUsernameCache = make(map[string]string)
-	IconHashByUsernameCacheMutex.Unlock()
-	IconHashByUserIDCacheMutex.Lock()
-	IconHashByUserIDCache = make(map[int64]string)
-	IconHashByUserIDCacheMutex.Unlock()
-	UserByIDCacheMutex.Lock()
-	UserByIDCache = make(map[int64]User)
-	UserByIDCacheMutex.Unlock()
-	LivestreamByIDCacheMutex.Lock()
-	LivestreamByIDCache = make(map[int64]Livestream)
-	LivestreamByIDCacheMutex.Unlock()
-	LivecommentByIDCacheMutex.Lock()
-	LivecommentByIDCache = make(map[int64]Livecomment)
-	LivecommentByIDCacheMutex.Unlock()
+	// 読み込み直すまでreadyzを失敗させる
+	cachesReady.Store(false)
 
-	if out, err := exec.Command("../sql/init.sh").CombinedOutput(); err != nil {
-		c.Logger().Warnf("init.sh failed with err=%s", string(out))
+	// 各ファイルで登録されたキャッシュをクリア
+	resetCaches()
+
+	ctx := c.Request().Context()
+	if err := resetDatabase(ctx); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to initialize: "+err.Error())
 	}
+	// 初期データから作るキャッシュと集計は互いに独立している
+	if err := runParallel(ctx, initParallelism, []func(ctx context.Context) error{
+		func(ctx context.Context) error {
+			if err := loadLivestreamTagIndex(ctx); err != nil {
+				return fmt.Errorf("failed to load livestream tag index: %w", err)
+			}
+			return nil
+		},
+		func(ctx context.Context) error {
+			if err := loadTagMaster(ctx); err != nil {
+				return fmt.Errorf("failed to load tags: %w", err)
+			}
+			return nil
+		},
+		func(ctx context.Context) error {
+			if err := rebuildTipAggregates(ctx); err != nil {
+				return fmt.Errorf("failed to rebuild tip aggregates: %w", err)
+			}
+			return nil
+		},
+		func(ctx context.Context) error {
+			if err := syncLivestreamStatuses(ctx, time.Now().Unix()); err != nil {
+				return fmt.Errorf("failed to sync livestream statuses: %w", err)
+			}
+			return nil
+		},
+	}); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	cachesReady.Store(true)
 
 	go func() {
 		if _, err := http.Get("https://pprotein.sor4chi.com/api/group/collect"); err != nil {
@@ -178,110 +244,461 @@ func initializeHandler(c echo.Context) error {
 	})
 }
 
-func main() {
-	e := echo.New()
-	e.Debug = false
-	e.Logger.SetLevel(echolog.ERROR)
-	cookieStore := sessions.NewCookieStore(secret)
-	cookieStore.Options.Domain = "*.u.isucon.local"
-	e.Use(session.Middleware(cookieStore))
-
-	echov4.EnableDebugHandler(e)
-
+// ハンドラをルーティングに登録する
+func registerRoutes(e *echo.Echo, app *App) {
 	// 初期化
 	e.POST("/api/initialize", initializeHandler)
 
+	// ヘルスチェック
+	e.GET("/healthz", healthzHandler)
+	e.GET("/readyz", app.readyzHandler)
+
+	// APIドキュメント
+	e.GET("/api/openapi.json", getOpenAPIHandler)
+
+	// 機能フラグの確認
+	e.GET("/api/debug/flags", getFeatureFlagsHandler)
+	// PowerDNSのサーキットブレーカーの状態
+	e.GET("/api/debug/powerdns", app.getPowerDNSStateHandler)
+
 	// top
 	e.GET("/api/tag", getTagHandler)
-	e.GET("/api/user/:username/theme", getStreamerThemeHandler)
+	// タグ作成
+	e.POST("/api/tag", postTagHandler)
+	// タグごとの配信数と直近のアクティビティ
+	e.GET("/api/tag/stats", getTagStatsHandler)
+	e.GET("/api/user/:username/theme", app.getStreamerThemeHandler)
 
 	// livestream
 	// reserve livestream
-	e.POST("/api/livestream/reservation", reserveLivestreamHandler)
+	e.POST("/api/livestream/reservation", app.reserveLivestreamHandler, idempotencyMiddleware)
 	// list livestream
 	e.GET("/api/livestream/search", searchLivestreamsHandler)
+	// 直近の勢いがある配信
+	e.GET("/api/livestream/trending", getTrendingLivestreamsHandler)
+	// フォロー中の配信者と勢いのある配信のフィード
+	e.GET("/api/feed", getFeedHandler)
+	// 予約枠の空き状況
+	e.GET("/api/livestream/availability", getReservationAvailabilityHandler)
 	e.GET("/api/livestream", getMyLivestreamsHandler)
 	e.GET("/api/user/:username/livestream", getUserLivestreamsHandler)
 	// get livestream
 	e.GET("/api/livestream/:livestream_id", getLivestreamHandler)
+	e.PATCH("/api/livestream/:livestream_id", updateLivestreamHandler)
+	// 配信状態を手動で進める
+	e.POST("/api/livestream/:livestream_id/start", startLivestreamHandler)
+	e.POST("/api/livestream/:livestream_id/end", endLivestreamHandler)
+	e.DELETE("/api/livestream/:livestream_id", cancelLivestreamHandler)
 	// get polling livecomment timeline
 	e.GET("/api/livestream/:livestream_id/livecomment", getLivecommentsHandler)
 	// ライブコメント投稿
-	e.POST("/api/livestream/:livestream_id/livecomment", postLivecommentHandler)
-	e.POST("/api/livestream/:livestream_id/reaction", postReactionHandler)
+	e.POST("/api/livestream/:livestream_id/livecomment", app.postLivecommentHandler)
+	// ライブコメントのSSEストリーム
+	e.GET("/api/livestream/:livestream_id/livecomment/stream", streamLivecommentsHandler)
+	// ライブコメント検索
+	e.GET("/api/livestream/:livestream_id/livecomment/search", searchLivecommentsHandler)
+	// ライブコメント・リアクション・視聴者数のWebSocket
+	e.GET("/api/livestream/:livestream_id/ws", livestreamWebSocketHandler)
+	e.POST("/api/livestream/:livestream_id/reaction", app.postReactionHandler)
 	e.GET("/api/livestream/:livestream_id/reaction", getReactionsHandler)
+	e.DELETE("/api/livestream/:livestream_id/reaction/:reaction_id", deleteReactionHandler)
+	// 絵文字ごとのリアクション数
+	e.GET("/api/livestream/:livestream_id/reaction/counts", getReactionCountsHandler)
+	// リアクションをSSEで受け取る (オーバーレイ向け)
+	e.GET("/api/livestream/:livestream_id/reaction/stream", streamReactionsHandler)
 
 	// (配信者向け)ライブコメントの報告一覧取得API
 	e.GET("/api/livestream/:livestream_id/report", getLivecommentReportsHandler)
 	e.GET("/api/livestream/:livestream_id/ngwords", getNgwords)
 	// ライブコメント報告
-	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", reportLivecommentHandler)
+	e.POST("/api/livestream/:livestream_id/livecomment/:livecomment_id/report", app.reportLivecommentHandler)
+	// ライブコメントごとの報告一覧と報告数
+	e.GET("/api/livestream/:livestream_id/livecomment/:livecomment_id/reports", getLivecommentReportsByLivecommentHandler)
 	// 配信者によるモデレーション (NGワード登録)
 	e.POST("/api/livestream/:livestream_id/moderate", moderateHandler)
+	// NGワードの一括登録
+	e.POST("/api/livestream/:livestream_id/moderate/bulk", moderateBulkHandler)
+	// 配信者によるライブコメントの一括削除
+	e.DELETE("/api/livestream/:livestream_id/livecomments", deleteLivecommentsHandler)
+	// モデレーション操作の監査ログ (削除されたライブコメントの履歴を含む)
+	e.GET("/api/livestream/:livestream_id/moderation/log", getModerationLogHandler)
 
 	// livestream_viewersにINSERTするため必要
 	// ユーザ視聴開始 (viewer)
 	e.POST("/api/livestream/:livestream_id/enter", enterLivestreamHandler)
 	// ユーザ視聴終了 (viewer)
 	e.DELETE("/api/livestream/:livestream_id/exit", exitLivestreamHandler)
+	// 視聴中のクライアントが定期的に送るハートビート
+	e.POST("/api/livestream/:livestream_id/heartbeat", heartbeatLivestreamHandler)
+	// 共同配信者 (NGワード登録やコメント削除ができる)
+	e.POST("/api/livestream/:livestream_id/collaborators", postCollaboratorHandler)
+	e.GET("/api/livestream/:livestream_id/collaborators", getCollaboratorsHandler)
+	// 終了した配信の録画
+	e.POST("/api/livestream/:livestream_id/archive", postArchiveHandler)
+	e.GET("/api/livestream/:livestream_id/archive", getArchivesHandler)
+	// 配信の取り込み用ストリームキーの発行・再発行 (配信者のみ)
+	e.POST("/api/livestream/:livestream_id/streamkey", postStreamKeyHandler)
+	// 配信の報告
+	e.POST("/api/livestream/:livestream_id/report", postLivestreamReportHandler)
+	// チャットの設定 (スローモードなど)
+	e.GET("/api/livestream/:livestream_id/chat_settings", getChatSettingsHandler)
+	e.PATCH("/api/livestream/:livestream_id/chat_settings", patchChatSettingsHandler)
+	// 配信の取り込み・再生URL
+	e.GET("/api/livestream/:livestream_id/urls", getLivestreamURLsHandler)
+
+	// 運営・メディアサーバ向けのAPIはトークンを設定したときだけ有効にする
+	if internalAPIToken != "" {
+		// 機能フラグの切り替え (運営向け)
+		e.PUT("/api/debug/flags/:name", putFeatureFlagHandler, internalAPIMiddleware)
+		e.DELETE("/api/debug/flags/:name", deleteFeatureFlagHandler, internalAPIMiddleware)
+		// 報告された配信の確認キュー (運営向け)
+		e.GET("/api/admin/reports", getLivestreamReportQueueHandler, internalAPIMiddleware)
+		// モデレーションの監査ログ (運営向け)
+		e.GET("/api/admin/livestream/:livestream_id/moderation/log", getAdminModerationLogHandler, internalAPIMiddleware)
+		// メディアサーバからのストリームキーの確認
+		e.GET("/api/internal/streamkey/validate", validateStreamKeyHandler, internalAPIMiddleware)
+		// メディアサーバからの配信状態 (ビットレートなど) の報告
+		e.POST("/api/internal/livestream/:livestream_id/health", postStreamHealthHandler, internalAPIMiddleware)
+	}
 
 	// user
-	e.POST("/api/register", registerHandler)
-	e.POST("/api/login", loginHandler)
-	e.GET("/api/user/me", getMeHandler)
+	e.POST("/api/register", app.registerHandler, idempotencyMiddleware)
+	e.POST("/api/login", app.loginHandler)
+	e.GET("/api/user/me", app.getMeHandler)
+	// 複数ユーザの一括取得
+	e.GET("/api/users", app.getUsersHandler)
+	// ユーザ名変更
+	e.PATCH("/api/user/me/name", app.updateUsernameHandler)
+	// パスワード変更
+	e.PATCH("/api/user/me/password", app.changePasswordHandler)
+	// テーマ変更
+	e.PATCH("/api/user/me/theme", app.patchThemeHandler)
+	// フォロー
+	e.GET("/api/user/me/following", getFollowingHandler)
+	// アイコン履歴
+	e.GET("/api/user/me/icons", app.getIconHistoryHandler)
+	e.POST("/api/user/me/icons/:icon_id/activate", app.activateIconHandler)
+	e.POST("/api/user/:username/follow", followHandler)
+	e.DELETE("/api/user/:username/follow", unfollowHandler)
+	// ブロック
+	e.POST("/api/user/:username/block", blockUserHandler)
+	e.DELETE("/api/user/:username/block", unblockUserHandler)
+	// 通知
+	e.GET("/api/user/me/notifications", getNotificationsHandler)
+	e.POST("/api/user/me/notifications/read", readAllNotificationsHandler)
+	e.POST("/api/user/me/notifications/:notification_id/read", readNotificationHandler)
+	// 配信者の外部通知先 (モデレーション・高額チップ・報告数のしきい値超え)
+	e.GET("/api/user/me/webhooks", getWebhooksHandler)
+	e.POST("/api/user/me/webhooks", postWebhookHandler)
+	e.DELETE("/api/user/me/webhooks/:webhook_id", deleteWebhookHandler)
+	// 自分の配信の収益
+	e.GET("/api/user/me/earnings", getEarningsHandler)
 	// フロントエンドで、配信予約のコラボレーターを指定する際に必要
-	e.GET("/api/user/:username", getUserHandler)
-	e.GET("/api/user/:username/statistics", getUserStatisticsHandler)
-	e.GET("/api/user/:username/icon", getIconHandler)
-	e.POST("/api/icon", postIconHandler)
+	e.GET("/api/user/:username", app.getUserHandler)
+	e.GET("/api/user/:username/statistics", getUserStatisticsHandler, userStatisticsInFlight.middleware())
+	e.GET("/api/user/:username/summary", app.getUserSummaryHandler)
+	// 取得はIf-None-Matchで返せない場合だけハンドラの中でiconInFlightを取る
+	e.GET("/api/user/:username/icon", app.getIconHandler)
+	e.POST("/api/icon", app.postIconHandler, iconUploadInFlight.middleware())
+	// ユーザの配信の録画
+	e.GET("/api/user/:username/archive", getUserArchivesHandler)
+	// 配信者ごとのカスタムエモート
+	e.GET("/api/user/:username/emote", getEmotesHandler)
+	e.GET("/api/user/:username/emote/:emote_name", getEmoteImageHandler)
+	e.POST("/api/emote", postEmoteHandler)
 
 	// stats
 	// ライブ配信統計情報
-	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler)
+	e.GET("/api/livestream/:livestream_id/statistics", getLivestreamStatisticsHandler, livestreamStatisticsInFlight.middleware())
+
+	// 配信ページ用にユーザ・配信・ライブコメント・統計をまとめて取るGraphQL
+	e.POST("/api/graphql", postGraphQLHandler)
 
 	// 課金情報
 	e.GET("/api/payment", GetPaymentResult)
+	// 自分の配信に送られたチップの履歴
+	e.GET("/api/payment/history", getPaymentHistoryHandler)
+}
 
-	e.HTTPErrorHandler = errorResponseHandler
+func main() {
+	doc, err := buildOpenAPIDocument()
+	if err != nil {
+		log.Fatalf("failed to build OpenAPI document: %v", err)
+	}
+	openAPIDocument = doc
+	// ビルド時に go run . openapi > openapi.json で書き出せるようにする
+	if len(os.Args) > 1 && os.Args[1] == "openapi" {
+		os.Stdout.Write(openAPIDocument)
+		return
+	}
+
+	e := echo.New()
+	e.Debug = false
+	// 設定を読むまでのログ
+	e.Logger.SetLevel(echolog.ERROR)
+
+	// 設定の読み込み
+	cfg, err := loadConfig()
+	if err != nil {
+		e.Logger.Errorf("failed to load config: %v", err)
+		os.Exit(1)
+	}
+	applyRuntimeTuning(cfg)
+
+	cookieStore := sessions.NewCookieStore(cfg.SessionSecret)
+	cookieStore.Options.Domain = cfg.SessionCookieDomain
+	e.Use(middleware.RequestID())
+	e.Use(accessLogMiddleware)
+	e.Use(session.Middleware(cookieStore))
+	e.Use(newGzipMiddleware(cfg))
+	if cfg.StaticDir != "" {
+		e.Use(newStaticMiddleware(cfg.StaticDir))
+	}
+	if cfg.JSONSerializer == jsonSerializerGoccy {
+		jsonSerializer = goccyJSONSerializer{}
+	}
+	e.JSONSerializer = jsonSerializer
+	e.Validator = requestValidator{}
+	// 遅いクライアントにgoroutineを握られ続けないようにする
+	e.Server.ReadTimeout = cfg.ServerReadTimeout
+	e.Server.ReadHeaderTimeout = cfg.ServerReadHeaderTimeout
+	e.Server.WriteTimeout = cfg.ServerWriteTimeout
+	e.Server.IdleTimeout = cfg.ServerIdleTimeout
 
 	// DB接続
-	conn, err := connectDB(e.Logger)
+	conn, err := connectDB(cfg.MySQL, cfg.MySQLMaxOpenConns, cfg.DebugExplain)
 	if err != nil {
 		e.Logger.Errorf("failed to connect db: %v", err)
 		os.Exit(1)
 	}
 	defer conn.Close()
 	dbConn = conn
+	if cfg.DebugExplain {
+		go runSlowQueryExplainer(conn)
+	}
+	if err := warmUpDB(context.Background(), conn, cfg.MySQLMaxOpenConns); err != nil {
+		e.Logger.Errorf("failed to warm up db connections: %v", err)
+		os.Exit(1)
+	}
 
-	subdomainAddr, ok := os.LookupEnv(powerDNSSubdomainAddressEnvKey)
-	if !ok {
-		e.Logger.Errorf("environ %s must be provided", powerDNSSubdomainAddressEnvKey)
+	initConn, err := connectInitDB(cfg.MySQL, cfg.InitParallelism)
+	if err != nil {
+		e.Logger.Errorf("failed to connect db for initialization: %v", err)
 		os.Exit(1)
 	}
-	powerDNSSubdomainAddress = subdomainAddr
+	defer initConn.Close()
+	initDBConn = initConn
+	initParallelism = cfg.InitParallelism
+	internalAPIToken = cfg.InternalAPIToken
+	mediaRTMPPort = cfg.MediaRTMPPort
+	mediaHLSPort = cfg.MediaHLSPort
+
+	echov4.EnableDebugHandler(e)
+
+	initInFlightLimiters(cfg.IconInFlightLimit, cfg.StatsInFlightLimit)
+
+	powerDNS := newPowerDNSClient(cfg.PowerDNSAPIEndpoint, cfg.PowerDNSAPIKey, cfg.PowerDNSSubdomainAddress)
+	app := newApp(conn, powerDNS, systemClock{}, uuidGenerator{}, sha256Hasher{})
+	// Appに移していない処理もAppと同じリポジトリを使う
+	userRepository, iconRepository = app.users, app.icons
+	registerRoutes(e, app)
+	e.HTTPErrorHandler = errorResponseHandler
+
+	checkOpenAPICoverage(e)
+
+	whitelist, err := loadReactionEmojiWhitelist(cfg.ReactionEmojiWhitelistPath)
+	if err != nil {
+		e.Logger.Errorf("failed to load reaction emoji whitelist: %v", err)
+		os.Exit(1)
+	}
+	reactionEmojiWhitelist = whitelist
+
+	tiers, err := loadTipTiers(cfg.TipTiersPath)
+	if err != nil {
+		e.Logger.Errorf("failed to load tip tiers: %v", err)
+		os.Exit(1)
+	}
+	tipTiers = tiers
+
+	applyTunables(e, cfg.Tunables)
+	go runConfigReloader(e, cfg.EnvFilePath)
+
+	if err := loadLivestreamTagIndex(context.Background()); err != nil {
+		e.Logger.Errorf("failed to load livestream tag index: %v", err)
+		os.Exit(1)
+	}
+	if err := loadTagMaster(context.Background()); err != nil {
+		e.Logger.Errorf("failed to load tags: %v", err)
+		os.Exit(1)
+	}
+
+	livestreamEventHub.Observe(recordLivestreamActivity)
+
+	cachesReady.Store(true)
+
+	// 計測用データの生成 (go run . gen-fixtures -users 1000 ...)
+	if len(os.Args) > 1 && os.Args[1] == "gen-fixtures" {
+		if err := runGenFixtures(context.Background(), app, os.Args[2:]); err != nil {
+			e.Logger.Errorf("failed to generate fixtures: %v", err)
+			os.Exit(1)
+		}
+		return
+	}
+
+	go runRetroactiveModerationWorker()
+	go runNotificationWorker()
+	go runModerationLogWorker()
+	go runWebhookDispatcher()
+	go runViewerPresenceSweeper()
+	go runRateLimiterSweeper()
+	go runLivestreamLifecycleTicker()
+	go runTagMasterSyncer()
+	go runTipAggregateFlusher()
 
 	// HTTPサーバ起動
-	listenAddr := net.JoinHostPort("", strconv.Itoa(listenPort))
-	if err := e.Start(listenAddr); err != nil {
+	if cfg.SocketPath != "" {
+		listener, err := listenUnixSocket(cfg.SocketPath)
+		if err != nil {
+			e.Logger.Errorf("failed to listen on unix socket: %v", err)
+			os.Exit(1)
+		}
+		e.Listener = listener
+	}
+	listenAddr := net.JoinHostPort("", strconv.Itoa(cfg.ListenPort))
+	if e.Listener == nil {
+		// READY=1を送る前に待ち受けを始めておく
+		listener, err := net.Listen("tcp", listenAddr)
+		if err != nil {
+			e.Logger.Errorf("failed to listen on %s: %v", listenAddr, err)
+			os.Exit(1)
+		}
+		e.Listener = listener
+	}
+
+	go func() {
+		sig := make(chan os.Signal, 1)
+		signal.Notify(sig, syscall.SIGTERM, syscall.SIGINT)
+		<-sig
+		if err := sdNotify(sdNotifyStopping); err != nil {
+			log.Printf("failed to notify systemd of stopping: %v", err)
+		}
+		ctx, cancel := context.WithTimeout(context.Background(), shutdownTimeout)
+		defer cancel()
+		if err := e.Shutdown(ctx); err != nil {
+			log.Printf("failed to shutdown HTTP server: %v", err)
+		}
+	}()
+
+	// 設定の検証、DB接続、キャッシュの読み込みが済んだ
+	if err := sdNotify(sdNotifyReady); err != nil {
+		log.Printf("failed to notify systemd of readiness: %v", err)
+	}
+
+	if cfg.H2CEnabled {
+		// h2cでもHTTP/1.1のリクエストはそのまま受け付けられる
+		err = e.StartH2CServer(listenAddr, &http2.Server{
+			MaxConcurrentStreams: h2cMaxConcurrentStreams,
+			IdleTimeout:          h2cIdleTimeout,
+		})
+	} else {
+		err = e.Start(listenAddr)
+	}
+	if err != nil && !errors.Is(err, http.ErrServerClosed) {
 		e.Logger.Errorf("failed to start HTTP server: %v", err)
 		os.Exit(1)
 	}
 }
 
+// エラーレスポンスの共通の形
 type ErrorResponse struct {
-	Error string `json:"error"`
+	Code    ErrorCode `json:"code"`
+	Message string    `json:"message"`
+	// ログと突き合わせるためのID (X-Request-Idと同じ)
+	RequestID string `json:"request_id"`
+	// リクエストの検査で弾いた場合に違反したフィールド
+	Fields []FieldError `json:"fields,omitempty"`
+	// 再試行できるまでの秒数
+	RetryAfter int64 `json:"retry_after,omitempty"`
 }
 
+// 500系ではDBのエラーなど内部の詳細をクライアントに返さず、ログにだけ出す
+const internalErrorMessage = "internal server error"
+
 func errorResponseHandler(err error, c echo.Context) {
-	c.Logger().Errorf("error at %s: %+v", c.Path(), err)
-	if he, ok := err.(*echo.HTTPError); ok {
-		if e := c.JSON(he.Code, &ErrorResponse{Error: err.Error()}); e != nil {
-			c.Logger().Errorf("%+v", e)
-		}
+	requestID := c.Response().Header().Get(echo.HeaderXRequestID)
+	c.Logger().Errorf("error at %s (request_id=%s): %+v", c.Path(), requestID, err)
+	if c.Response().Committed {
 		return
 	}
 
-	if e := c.JSON(http.StatusInternalServerError, &ErrorResponse{Error: err.Error()}); e != nil {
-		c.Logger().Errorf("%+v", e)
+	status, message := http.StatusInternalServerError, internalErrorMessage
+	var he *echo.HTTPError
+	if errors.As(err, &he) {
+		status = he.Code
+		if status < http.StatusInternalServerError {
+			message = fmt.Sprint(he.Message)
+		}
+	}
+
+	res := &ErrorResponse{
+		Code:      errorCodeOf(err),
+		Message:   message,
+		RequestID: requestID,
+	}
+	var coded *codedHTTPError
+	if errors.As(err, &coded) {
+		res.Fields = coded.fields
+		if coded.retryAfter > 0 {
+			// 秒未満は切り上げる
+			res.RetryAfter = int64((coded.retryAfter + time.Second - 1) / time.Second)
+			c.Response().Header().Set(echo.HeaderRetryAfter, strconv.FormatInt(res.RetryAfter, 10))
+		}
+	}
+
+	if c.Request().Method == http.MethodHead {
+		err = c.NoContent(status)
+	} else {
+		err = c.JSON(status, res)
+	}
+	if err != nil {
+		c.Logger().Errorf("%+v", err)
+	}
+}
+
+// nginxから繋げるようにunixソケットで待ち受ける
+func listenUnixSocket(path string) (net.Listener, error) {
+	// 前回の起動時のソケットが残っているとlistenできない
+	if fi, err := os.Lstat(path); err == nil {
+		if fi.Mode()&os.ModeSocket == 0 {
+			return nil, fmt.Errorf("%s exists and is not a socket", path)
+		}
+		if err := os.Remove(path); err != nil {
+			return nil, fmt.Errorf("failed to remove stale socket: %w", err)
+		}
+	} else if !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	listener, err := net.Listen("unix", path)
+	if err != nil {
+		return nil, err
+	}
+	// nginxのworkerは別ユーザで動くため
+	if err := os.Chmod(path, 0o666); err != nil {
+		listener.Close()
+		return nil, fmt.Errorf("failed to chmod socket: %w", err)
+	}
+
+	return listener, nil
+}
+
+// SSEやWebSocketなど長時間繋ぎっぱなしにするリクエストでサーバのタイムアウトを解除する
+func clearConnDeadlines(c echo.Context) {
+	rc := http.NewResponseController(c.Response())
+	if err := rc.SetReadDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		c.Logger().Warnf("failed to clear read deadline: %v", err)
+	}
+	if err := rc.SetWriteDeadline(time.Time{}); err != nil && !errors.Is(err, http.ErrNotSupported) {
+		c.Logger().Warnf("failed to clear write deadline: %v", err)
 	}
 }
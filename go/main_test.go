@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"sync"
+	"sync/atomic"
+	"testing"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// DBを使うテストは環境変数 (ISUCON13_MYSQL_DIALCONFIG_*) のMySQLに接続する。つながらなければスキップする
+// スキーマは sql/initdb.d のものが入っている前提
+func newTestDB(t *testing.T) *sqlx.DB {
+	t.Helper()
+	conf, err := loadMySQLConfig()
+	if err != nil {
+		t.Fatalf("failed to load mysql config: %v", err)
+	}
+	db, err := connectDB(conf, 4, false)
+	if err != nil {
+		t.Skipf("mysql is not available: %v", err)
+	}
+	t.Cleanup(func() { db.Close() })
+	// まだグローバルのdbConnを使う処理がある
+	dbConn = db
+	return db
+}
+
+// DBとPowerDNSの偽物につないだApp。Appに移していない処理も同じリポジトリを使うようにする
+func newTestApp(t *testing.T) (*App, *fakePowerDNS) {
+	t.Helper()
+	db := newTestDB(t)
+	powerDNS, fake := newTestPowerDNS(t)
+	app := newApp(db, powerDNS, systemClock{}, uuidGenerator{}, sha256Hasher{})
+	userRepository, iconRepository = app.users, app.icons
+	return app, fake
+}
+
+var testNameSeq atomic.Int64
+
+// テスト同士や前回の実行と衝突しないユーザ名
+func newTestUsername(prefix string) string {
+	return fmt.Sprintf("%s%d-%d", prefix, testNameSeq.Add(1), testRunID)
+}
+
+var testRunID = time.Now().UnixNano()
+
+type powerDNSCall struct {
+	Name       string
+	Changetype string
+}
+
+// PowerDNSのAPIの代わりに、受け取ったPATCHを記録して返す
+type fakePowerDNS struct {
+	mu     sync.Mutex
+	calls  []powerDNSCall
+	status int
+}
+
+func newTestPowerDNS(t *testing.T) (*PowerDNSClient, *fakePowerDNS) {
+	t.Helper()
+	fake := &fakePowerDNS{status: http.StatusNoContent}
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		var body struct {
+			RRSets []struct {
+				Name       string `json:"name"`
+				Changetype string `json:"changetype"`
+			} `json:"rrsets"`
+		}
+		if err := json.NewDecoder(r.Body).Decode(&body); err != nil {
+			w.WriteHeader(http.StatusBadRequest)
+			return
+		}
+		fake.mu.Lock()
+		defer fake.mu.Unlock()
+		for _, rr := range body.RRSets {
+			fake.calls = append(fake.calls, powerDNSCall{Name: rr.Name, Changetype: rr.Changetype})
+		}
+		w.WriteHeader(fake.status)
+	}))
+	t.Cleanup(srv.Close)
+	return newPowerDNSClient(srv.URL, "test", "127.0.0.1"), fake
+}
+
+// 記録を取り出して空にする
+func (f *fakePowerDNS) takeCalls() []powerDNSCall {
+	f.mu.Lock()
+	defer f.mu.Unlock()
+	calls := f.calls
+	f.calls = nil
+	return calls
+}
+
+func (f *fakePowerDNS) setStatus(status int) {
+	f.mu.Lock()
+	f.status = status
+	f.mu.Unlock()
+}
+
+func recordName(name string) string {
+	return name + "." + userSubdomainZone + "."
+}
+
+func registerTestUser(t *testing.T, s *UserService, prefix string) User {
+	t.Helper()
+	user, err := s.Register(context.Background(), PostUserRequest{
+		Name:        newTestUsername(prefix),
+		DisplayName: "test",
+		Password:    "Passw0rd!test",
+	})
+	if err != nil {
+		t.Fatalf("failed to register user: %v", err)
+	}
+	return user
+}
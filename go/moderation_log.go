@@ -0,0 +1,308 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// モデレーション操作の監査ログ。ワーカーがまとめてINSERTする
+// 監査のため捨てずに残す。キューが詰まったら書き込みが追いつくまで呼び出し側を待たせる
+const (
+	moderationActionNGWordAdded        = "ng_word_added"
+	moderationActionLivecommentDeleted = "livecomment_deleted"
+	moderationActionUserMuted          = "user_muted"
+
+	moderationLogQueueSize       = 1024
+	defaultModerationLogLimit    = 100
+	maxModerationLogLimit        = 1000
+	moderationLogInsertBatchSize = 500
+	moderationLogInsertAttempts  = 3
+	moderationLogRetryBaseDelay  = 100 * time.Millisecond
+)
+
+type ModerationLogModel struct {
+	ID           int64        `db:"id"`
+	LivestreamID LivestreamID `db:"livestream_id"`
+	// NGワードによる自動削除ではNULL
+	ActorID             sql.NullInt64  `db:"actor_id"`
+	Action              string         `db:"action"`
+	TargetUserID        sql.NullInt64  `db:"target_user_id"`
+	TargetLivecommentID sql.NullInt64  `db:"target_livecomment_id"`
+	NGWord              sql.NullString `db:"ng_word"`
+	CreatedAt           int64          `db:"created_at"`
+}
+
+type ModerationLogEntry struct {
+	ID     int64  `json:"id"`
+	Action string `json:"action"`
+	// NGワードによる自動削除ではnull
+	ActorID             *UserID        `json:"actor_id"`
+	TargetUserID        *UserID        `json:"target_user_id,omitempty"`
+	TargetLivecommentID *LivecommentID `json:"target_livecomment_id,omitempty"`
+	// livecomment_deletedでは削除されたライブコメント
+	Livecomment *Livecomment `json:"livecomment,omitempty"`
+	// livecomment_deletedでは削除のきっかけになったNGワード (手動の削除では省略)
+	NGWord    *string `json:"ng_word,omitempty"`
+	CreatedAt int64   `json:"created_at"`
+}
+
+func fillModerationLogResponse(model ModerationLogModel) ModerationLogEntry {
+	entry := ModerationLogEntry{
+		ID:        model.ID,
+		Action:    model.Action,
+		CreatedAt: model.CreatedAt,
+	}
+	if model.ActorID.Valid {
+		actorID := UserID(model.ActorID.Int64)
+		entry.ActorID = &actorID
+	}
+	if model.TargetUserID.Valid {
+		targetUserID := UserID(model.TargetUserID.Int64)
+		entry.TargetUserID = &targetUserID
+	}
+	if model.TargetLivecommentID.Valid {
+		targetLivecommentID := LivecommentID(model.TargetLivecommentID.Int64)
+		entry.TargetLivecommentID = &targetLivecommentID
+	}
+	if model.NGWord.Valid {
+		entry.NGWord = &model.NGWord.String
+	}
+	return entry
+}
+
+var moderationLogQueue = make(chan []ModerationLogModel, moderationLogQueueSize)
+
+// actorIDが0ならNGワードによる自動の操作として記録する
+func newModerationLog(livestreamID LivestreamID, actorID UserID, action string) ModerationLogModel {
+	return ModerationLogModel{
+		LivestreamID: livestreamID,
+		ActorID:      sql.NullInt64{Int64: int64(actorID), Valid: actorID != 0},
+		Action:       action,
+		CreatedAt:    time.Now().Unix(),
+	}
+}
+
+// キューが詰まっている場合は空くまで待つ
+func enqueueModerationLogs(logs ...ModerationLogModel) {
+	if len(logs) == 0 {
+		return
+	}
+	select {
+	case moderationLogQueue <- logs:
+	default:
+		log.Printf("moderation log queue is full, waiting to enqueue %d %s logs for livestream %d", len(logs), logs[0].Action, logs[0].LivestreamID)
+		moderationLogQueue <- logs
+	}
+}
+
+func init() {
+	registerCacheReset(drainModerationLogQueue)
+}
+
+// initialize時に未処理のログを捨てる
+func drainModerationLogQueue() {
+	for {
+		select {
+		case <-moderationLogQueue:
+		default:
+			return
+		}
+	}
+}
+
+// 溜まっているログはバッチの大きさまでまとめて1回で書き込む
+func runModerationLogWorker() {
+	for logs := range moderationLogQueue {
+		batch := logs
+	collect:
+		for len(batch) < moderationLogInsertBatchSize {
+			select {
+			case more := <-moderationLogQueue:
+				batch = append(batch, more...)
+			default:
+				break collect
+			}
+		}
+
+		var err error
+		for attempt := 1; attempt <= moderationLogInsertAttempts; attempt++ {
+			if err = insertModerationLogs(context.Background(), batch); err == nil {
+				break
+			}
+			time.Sleep(moderationLogRetryBaseDelay << (attempt - 1))
+		}
+		if err != nil {
+			log.Printf("failed to insert %d moderation logs after %d attempts: %+v", len(batch), moderationLogInsertAttempts, err)
+		}
+	}
+}
+
+func insertModerationLogs(ctx context.Context, logs []ModerationLogModel) error {
+	for start := 0; start < len(logs); start += moderationLogInsertBatchSize {
+		end := min(start+moderationLogInsertBatchSize, len(logs))
+		if _, err := dbConn.NamedExecContext(ctx, "INSERT INTO moderation_log (livestream_id, actor_id, action, target_user_id, target_livecomment_id, ng_word, created_at) VALUES (:livestream_id, :actor_id, :action, :target_user_id, :target_livecomment_id, :ng_word, :created_at)", logs[start:end]); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// モデレーション操作の監査ログ (配信者・共同配信者向け)。新しい順
+// GET /api/livestream/:livestream_id/moderation/log
+func getModerationLogHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "livestream not found")
+		} else {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+		}
+	}
+
+	if ok, err := canModerateLivestream(ctx, tx, livestreamModel, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get collaborators: "+err.Error())
+	} else if !ok {
+		return newCodedHTTPError(http.StatusForbidden, errorCodeNotLivestreamOwner, "can't get other streamer's moderation log")
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return respondModerationLog(c, LivestreamID(livestreamID))
+}
+
+// モデレーション操作の監査ログ (運営向け)
+// GET /api/admin/livestream/:livestream_id/moderation/log
+func getAdminModerationLogHandler(c echo.Context) error {
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	// 削除された配信のログも見られるよう、配信の存在は確かめない
+	return respondModerationLog(c, LivestreamID(livestreamID))
+}
+
+func respondModerationLog(c echo.Context, livestreamID LivestreamID) error {
+	ctx := c.Request().Context()
+
+	limit := defaultModerationLogLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l <= 0 || l > maxModerationLogLimit {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "limit query parameter must be between 1 and 1000")
+		}
+		limit = l
+	}
+	offset := 0
+	if c.QueryParam("offset") != "" {
+		o, err := strconv.Atoi(c.QueryParam("offset"))
+		if err != nil || o < 0 {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "offset query parameter must be non-negative integer")
+		}
+		offset = o
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 次のページがあるかを知るために1件多く取る
+	var logModels []ModerationLogModel
+	if err := tx.SelectContext(ctx, &logModels, "SELECT * FROM moderation_log WHERE livestream_id = ? ORDER BY id DESC LIMIT ? OFFSET ?", livestreamID, limit+1, offset); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get moderation log: "+err.Error())
+	}
+	page := pageInfo{total: -1, cursorParam: "offset"}
+	if len(logModels) > limit {
+		logModels = logModels[:limit]
+		page.nextCursor = strconv.Itoa(offset + limit)
+	}
+
+	livecommentByID, err := getModeratedLivecomments(ctx, tx, logModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get moderated livecomments: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	entries := make([]ModerationLogEntry, len(logModels))
+	for i, logModel := range logModels {
+		entries[i] = fillModerationLogResponse(logModel)
+		if logModel.Action == moderationActionLivecommentDeleted {
+			if livecomment, ok := livecommentByID[LivecommentID(logModel.TargetLivecommentID.Int64)]; ok {
+				entries[i].Livecomment = &livecomment
+			}
+		}
+	}
+
+	setPageHeaders(c, page)
+	return c.JSON(http.StatusOK, entries)
+}
+
+// livecomment_deletedのログが指すライブコメントを、削除済みのものも含めて引く
+func getModeratedLivecomments(ctx context.Context, tx *sqlx.Tx, logModels []ModerationLogModel) (map[LivecommentID]Livecomment, error) {
+	var livecommentIDs []int64
+	for _, logModel := range logModels {
+		if logModel.Action == moderationActionLivecommentDeleted && logModel.TargetLivecommentID.Valid {
+			livecommentIDs = append(livecommentIDs, logModel.TargetLivecommentID.Int64)
+		}
+	}
+	if len(livecommentIDs) == 0 {
+		return map[LivecommentID]Livecomment{}, nil
+	}
+
+	query, args, err := sqlx.In("SELECT * FROM livecomments WHERE id IN (?)", livecommentIDs)
+	if err != nil {
+		return nil, err
+	}
+	var livecommentModels []*LivecommentModel
+	if err := tx.SelectContext(ctx, &livecommentModels, tx.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	livecomments, err := fillLivecommentResponseBulk(ctx, tx, livecommentModels)
+	if err != nil {
+		return nil, err
+	}
+
+	livecommentByID := make(map[LivecommentID]Livecomment, len(livecomments))
+	for _, livecomment := range livecomments {
+		livecommentByID[livecomment.ID] = livecomment
+	}
+	return livecommentByID, nil
+}
@@ -0,0 +1,202 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"log"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+)
+
+const (
+	retroactiveModerationQueueSize = 1024
+	// キューの空きを待つ時間の上限。待っても空かなければNGワードを登録せずに503を返す
+	retroactiveModerationReserveTimeout = 3 * time.Second
+	// 1回のDELETEでまとめて消す件数
+	retroactiveModerationBatchSize = 500
+)
+
+// NGワード追加時に過去のライブコメントを遡って削除するジョブ
+type RetroactiveModerationJob struct {
+	LivestreamID LivestreamID
+	// 追加されたNGワードだけから作ったマッチャー
+	Matcher *NGWordMatcher
+}
+
+var (
+	retroactiveModerationQueue = make(chan RetroactiveModerationJob, retroactiveModerationQueueSize)
+	// キューの空きの予約。予約した数だけキューに空きがあるので、予約後の送信は詰まらない
+	retroactiveModerationSlots = make(chan struct{}, retroactiveModerationQueueSize)
+)
+
+var errRetroactiveModerationQueueFull = errors.New("retroactive moderation queue is full")
+
+// ジョブを落とさないよう、NGワードをコミットする前にキューの空きを確保しておく
+type retroactiveModerationReservation struct {
+	used bool
+}
+
+// 空きが無ければtimeoutまで待ち、それでも無ければerrRetroactiveModerationQueueFullを返す
+func reserveRetroactiveModeration(ctx context.Context) (*retroactiveModerationReservation, error) {
+	timer := time.NewTimer(retroactiveModerationReserveTimeout)
+	defer timer.Stop()
+
+	select {
+	case retroactiveModerationSlots <- struct{}{}:
+		return &retroactiveModerationReservation{}, nil
+	case <-timer.C:
+		return nil, errRetroactiveModerationQueueFull
+	case <-ctx.Done():
+		return nil, ctx.Err()
+	}
+}
+
+func (r *retroactiveModerationReservation) enqueue(job RetroactiveModerationJob) {
+	r.used = true
+	retroactiveModerationQueue <- job
+}
+
+// enqueueしなかった場合に空きを返す。deferで呼ぶ
+func (r *retroactiveModerationReservation) release() {
+	if !r.used {
+		<-retroactiveModerationSlots
+	}
+}
+
+func init() {
+	registerCacheReset(drainRetroactiveModerationQueue)
+}
+
+// initialize時に未処理のジョブを捨てる
+func drainRetroactiveModerationQueue() {
+	for {
+		select {
+		case <-retroactiveModerationQueue:
+			<-retroactiveModerationSlots
+		default:
+			return
+		}
+	}
+}
+
+func runRetroactiveModerationWorker() {
+	for job := range retroactiveModerationQueue {
+		<-retroactiveModerationSlots
+		if err := processRetroactiveModeration(context.Background(), job); err != nil {
+			log.Printf("failed to process retroactive moderation for livestream %d: %+v", job.LivestreamID, err)
+		}
+	}
+}
+
+func processRetroactiveModeration(ctx context.Context, job RetroactiveModerationJob) error {
+	var livecomments []*LivecommentModel
+	if err := dbConn.SelectContext(ctx, &livecomments, "SELECT id, user_id, comment FROM livecomments WHERE livestream_id = ? AND deleted_at IS NULL", job.LivestreamID); err != nil {
+		return err
+	}
+
+	// 監査ログに残すため、きっかけになったNGワードごとにまとめる
+	deletedLivecommentIDsByNGWord := make(map[string][]LivecommentID)
+	authorIDByLivecommentID := make(map[LivecommentID]UserID)
+	for _, livecomment := range livecomments {
+		if word, ok := job.Matcher.Match(livecomment.Comment); ok {
+			deletedLivecommentIDsByNGWord[word] = append(deletedLivecommentIDsByNGWord[word], livecomment.ID)
+			authorIDByLivecommentID[livecomment.ID] = livecomment.UserID
+		}
+	}
+
+	var streamerID UserID
+	if err := dbConn.GetContext(ctx, &streamerID, "SELECT user_id FROM livestreams WHERE id = ?", job.LivestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			// 処理待ちの間に配信が取り消された
+			return nil
+		}
+		return err
+	}
+
+	for word, deletedLivecommentsIDs := range deletedLivecommentIDsByNGWord {
+		for start := 0; start < len(deletedLivecommentsIDs); start += retroactiveModerationBatchSize {
+			end := min(start+retroactiveModerationBatchSize, len(deletedLivecommentsIDs))
+			batch, err := deleteLivecommentsByNGWord(ctx, streamerID, word, deletedLivecommentsIDs[start:end])
+			if err != nil {
+				return err
+			}
+			if len(batch) == 0 {
+				continue
+			}
+
+			LivecommentByIDCacheMutex.Lock()
+			for _, id := range batch {
+				delete(LivecommentByIDCache, id)
+			}
+			LivecommentByIDCacheMutex.Unlock()
+
+			livestreamEventHub.Publish(job.LivestreamID, LivestreamEvent{
+				Type: livestreamEventLivecommentDeleted,
+				Data: LivecommentDeletedEvent{LivecommentIDs: batch},
+			})
+			enqueueNotification(NotificationJob{
+				Type:           notificationTypeLivecommentModerated,
+				LivestreamID:   job.LivestreamID,
+				LivecommentIDs: batch,
+			})
+			enqueueWebhookEvent(WebhookEvent{
+				Type:         webhookEventLivecommentModerated,
+				LivestreamID: job.LivestreamID,
+				Data:         LivecommentModeratedWebhookData{LivecommentIDs: batch},
+			})
+
+			// NGワードによる自動削除なので操作したユーザは無し
+			moderationLogs := make([]ModerationLogModel, len(batch))
+			for i, id := range batch {
+				moderationLogs[i] = newModerationLog(job.LivestreamID, 0, moderationActionLivecommentDeleted)
+				moderationLogs[i].TargetUserID = sql.NullInt64{Int64: int64(authorIDByLivecommentID[id]), Valid: true}
+				moderationLogs[i].TargetLivecommentID = sql.NullInt64{Int64: int64(id), Valid: true}
+				moderationLogs[i].NGWord = sql.NullString{String: word, Valid: true}
+			}
+			enqueueModerationLogs(moderationLogs...)
+		}
+	}
+
+	return nil
+}
+
+// チップの合計と合わせて削除済みにし、実際に削除したIDを返す
+func deleteLivecommentsByNGWord(ctx context.Context, streamerID UserID, word string, livecommentIDs []LivecommentID) ([]LivecommentID, error) {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer tx.Rollback()
+
+	// 走査後に配信者が手で消したものは除く
+	query, args, err := sqlx.In("SELECT id FROM livecomments WHERE id IN (?) AND deleted_at IS NULL FOR UPDATE", livecommentIDs)
+	if err != nil {
+		return nil, err
+	}
+	var deletedIDs []LivecommentID
+	if err := tx.SelectContext(ctx, &deletedIDs, tx.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	if len(deletedIDs) == 0 {
+		return nil, nil
+	}
+
+	if err := subtractLivecommentTips(ctx, tx, streamerID, deletedIDs); err != nil {
+		return nil, err
+	}
+
+	query, args, err = sqlx.In("UPDATE livecomments SET deleted_at = ?, deleted_ng_word = ? WHERE id IN (?)", time.Now().Unix(), word, deletedIDs)
+	if err != nil {
+		return nil, err
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return nil, err
+	}
+	return deletedIDs, nil
+}
@@ -0,0 +1,307 @@
+package main
+
+import (
+	"encoding/binary"
+	"encoding/json"
+	"fmt"
+	"math"
+	"net/http/httptest"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// テスト用の最小限のデコーダ。整数はint64、マップはmap[string]anyにする
+type msgpackDecoder struct {
+	buf []byte
+}
+
+func (d *msgpackDecoder) next(n int) ([]byte, error) {
+	if len(d.buf) < n {
+		return nil, fmt.Errorf("unexpected end of data")
+	}
+	b := d.buf[:n]
+	d.buf = d.buf[n:]
+	return b, nil
+}
+
+func (d *msgpackDecoder) length(n int) (int, error) {
+	b, err := d.next(n)
+	if err != nil {
+		return 0, err
+	}
+	switch n {
+	case 1:
+		return int(b[0]), nil
+	case 2:
+		return int(binary.BigEndian.Uint16(b)), nil
+	default:
+		return int(binary.BigEndian.Uint32(b)), nil
+	}
+}
+
+func (d *msgpackDecoder) decode() (any, error) {
+	head, err := d.next(1)
+	if err != nil {
+		return nil, err
+	}
+	c := head[0]
+	switch {
+	case c <= 0x7f:
+		return int64(c), nil
+	case c >= 0xe0:
+		return int64(int8(c)), nil
+	case c&0xe0 == 0xa0:
+		return d.str(int(c & 0x1f))
+	case c&0xf0 == 0x90:
+		return d.array(int(c & 0x0f))
+	case c&0xf0 == 0x80:
+		return d.mapOf(int(c & 0x0f))
+	}
+
+	sizes := map[byte]int{0xcc: 1, 0xcd: 2, 0xce: 4, 0xcf: 8, 0xd0: 1, 0xd1: 2, 0xd2: 4, 0xd3: 8, 0xca: 4, 0xcb: 8}
+	if size, ok := sizes[c]; ok {
+		b, err := d.next(size)
+		if err != nil {
+			return nil, err
+		}
+		switch c {
+		case 0xcc:
+			return int64(b[0]), nil
+		case 0xcd:
+			return int64(binary.BigEndian.Uint16(b)), nil
+		case 0xce:
+			return int64(binary.BigEndian.Uint32(b)), nil
+		case 0xcf:
+			return int64(binary.BigEndian.Uint64(b)), nil
+		case 0xd0:
+			return int64(int8(b[0])), nil
+		case 0xd1:
+			return int64(int16(binary.BigEndian.Uint16(b))), nil
+		case 0xd2:
+			return int64(int32(binary.BigEndian.Uint32(b))), nil
+		case 0xd3:
+			return int64(binary.BigEndian.Uint64(b)), nil
+		case 0xca:
+			return float64(math.Float32frombits(binary.BigEndian.Uint32(b))), nil
+		default:
+			return math.Float64frombits(binary.BigEndian.Uint64(b)), nil
+		}
+	}
+
+	var n int
+	switch c {
+	case 0xc0:
+		return nil, nil
+	case 0xc2:
+		return false, nil
+	case 0xc3:
+		return true, nil
+	case 0xd9, 0xc4:
+		n, err = d.length(1)
+	case 0xda, 0xc5, 0xdc, 0xde:
+		n, err = d.length(2)
+	case 0xdb, 0xc6, 0xdd, 0xdf:
+		n, err = d.length(4)
+	default:
+		return nil, fmt.Errorf("unknown type byte %#x", c)
+	}
+	if err != nil {
+		return nil, err
+	}
+	switch c {
+	case 0xd9, 0xda, 0xdb:
+		return d.str(n)
+	case 0xc4, 0xc5, 0xc6:
+		b, err := d.next(n)
+		return append([]byte{}, b...), err
+	case 0xdc, 0xdd:
+		return d.array(n)
+	default:
+		return d.mapOf(n)
+	}
+}
+
+func (d *msgpackDecoder) str(n int) (any, error) {
+	b, err := d.next(n)
+	return string(b), err
+}
+
+func (d *msgpackDecoder) array(n int) (any, error) {
+	a := make([]any, n)
+	for i := range a {
+		v, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		a[i] = v
+	}
+	return a, nil
+}
+
+func (d *msgpackDecoder) mapOf(n int) (any, error) {
+	m := make(map[string]any, n)
+	for i := 0; i < n; i++ {
+		k, err := d.decode()
+		if err != nil {
+			return nil, err
+		}
+		key, ok := k.(string)
+		if !ok {
+			return nil, fmt.Errorf("map key %v is not a string", k)
+		}
+		if m[key], err = d.decode(); err != nil {
+			return nil, err
+		}
+	}
+	return m, nil
+}
+
+func unmarshalMsgpack(t *testing.T, b []byte) any {
+	t.Helper()
+	d := &msgpackDecoder{buf: b}
+	v, err := d.decode()
+	if err != nil {
+		t.Fatalf("failed to decode msgpack: %v", err)
+	}
+	if len(d.buf) != 0 {
+		t.Fatalf("%d trailing bytes", len(d.buf))
+	}
+	return v
+}
+
+// JSONで読み直した値と比べられるよう、数値をfloat64にそろえる
+func normalizeMsgpackValue(v any) any {
+	switch v := v.(type) {
+	case int64:
+		return float64(v)
+	case []any:
+		for i := range v {
+			v[i] = normalizeMsgpackValue(v[i])
+		}
+	case map[string]any:
+		for k := range v {
+			v[k] = normalizeMsgpackValue(v[k])
+		}
+	}
+	return v
+}
+
+// encoding/jsonと同じキー・値になる
+func TestMarshalMsgpackMatchesJSON(t *testing.T) {
+	type embedded struct {
+		Embedded string `json:"embedded"`
+	}
+	type withEmbedded struct {
+		*embedded
+		Name string `json:"name"`
+	}
+
+	tests := map[string]any{
+		"livecomment": Livecomment{
+			ID:         1,
+			User:       User{ID: 2, Name: "alice", Theme: Theme{ID: 3, DarkMode: true}},
+			Livestream: Livestream{ID: 4, Title: "配信", Tags: []Tag{{ID: 5, Name: "tag"}}},
+			Comment:    "こんにちは",
+			Tip:        1000,
+			CreatedAt:  1700000000,
+		},
+		"omitempty":       User{ID: 1, Name: "bob"},
+		"nil slice":       struct{ A []int64 }{},
+		"empty slice":     []Livecomment{},
+		"int map keys":    map[int64]string{-1: "a", 10: "b", 2: "c"},
+		"nil embedded":    withEmbedded{Name: "x"},
+		"embedded":        withEmbedded{embedded: &embedded{Embedded: "y"}, Name: "x"},
+		"long array":      make([]bool, 70000),
+		"floats":          []float64{0.5, -1.25, math.MaxFloat64},
+		"nil pointer":     (*User)(nil),
+		"string sizes":    []string{"", strings.Repeat("a", 31), strings.Repeat("b", 32), strings.Repeat("c", 256), strings.Repeat("d", 65536)},
+		"integer borders": []int64{0, 127, 128, 255, 256, 65535, 65536, math.MaxUint32, math.MaxUint32 + 1, -1, -32, -33, -128, -129, -32768, -32769, math.MinInt32, math.MinInt32 - 1, math.MinInt64 + 1},
+	}
+	for name, v := range tests {
+		t.Run(name, func(t *testing.T) {
+			b, err := marshalMsgpack(v)
+			if err != nil {
+				t.Fatalf("marshalMsgpack: %v", err)
+			}
+			got := normalizeMsgpackValue(unmarshalMsgpack(t, b))
+
+			j, err := json.Marshal(v)
+			if err != nil {
+				t.Fatalf("json.Marshal: %v", err)
+			}
+			var want any
+			if err := json.Unmarshal(j, &want); err != nil {
+				t.Fatalf("json.Unmarshal: %v", err)
+			}
+
+			if !reflect.DeepEqual(got, want) {
+				t.Errorf("msgpack = %v\nwant      %v", got, want)
+			}
+		})
+	}
+}
+
+// float64に丸めると区別できない値は整数のまま比べる
+func TestMarshalMsgpackIntegers(t *testing.T) {
+	for _, n := range []int64{math.MaxInt64, math.MinInt64, math.MaxInt32 + 1} {
+		b, err := marshalMsgpack(n)
+		if err != nil {
+			t.Fatalf("marshalMsgpack(%d): %v", n, err)
+		}
+		if got := unmarshalMsgpack(t, b); got != n {
+			t.Errorf("round trip of %d = %v", n, got)
+		}
+	}
+	b, err := marshalMsgpack(uint64(math.MaxUint64))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if b[0] != 0xcf || binary.BigEndian.Uint64(b[1:]) != math.MaxUint64 {
+		t.Errorf("MaxUint64 = %x", b)
+	}
+}
+
+func TestMarshalMsgpackBytes(t *testing.T) {
+	for _, n := range []int{0, 255, 256, 65536} {
+		in := make([]byte, n)
+		for i := range in {
+			in[i] = byte(i)
+		}
+		b, err := marshalMsgpack(in)
+		if err != nil {
+			t.Fatalf("marshalMsgpack: %v", err)
+		}
+		if got, ok := unmarshalMsgpack(t, b).([]byte); !ok || !reflect.DeepEqual(got, in) {
+			t.Errorf("round trip of %d bytes failed", n)
+		}
+	}
+}
+
+func TestMarshalMsgpackUnsupported(t *testing.T) {
+	if _, err := marshalMsgpack(make(chan int)); err == nil {
+		t.Error("chan was encoded")
+	}
+	if _, err := marshalMsgpack(map[bool]int{true: 1}); err == nil {
+		t.Error("bool map key was encoded")
+	}
+}
+
+func TestAcceptsMsgpack(t *testing.T) {
+	for accept, want := range map[string]bool{
+		"":                      false,
+		"application/json":      false,
+		"application/msgpack":   true,
+		"application/x-msgpack": true,
+		"application/json, application/msgpack;q=0.9": true,
+		"application/msgpack;q=0":                     false,
+	} {
+		req := httptest.NewRequest("GET", "/", nil)
+		if accept != "" {
+			req.Header.Set("Accept", accept)
+		}
+		if got := acceptsMsgpack(req); got != want {
+			t.Errorf("acceptsMsgpack(%q) = %v, want %v", accept, got, want)
+		}
+	}
+}
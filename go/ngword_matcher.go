@@ -0,0 +1,155 @@
+package main
+
+import (
+	"context"
+	"sync"
+
+	"github.com/jmoiron/sqlx"
+)
+
+var (
+	NGWordMatcherByLivestreamIDCache      = make(map[LivestreamID]*NGWordMatcher)
+	NGWordMatcherByLivestreamIDCacheMutex = sync.RWMutex{}
+)
+
+func init() {
+	registerCacheReset(func() {
+		NGWordMatcherByLivestreamIDCacheMutex.Lock()
+		NGWordMatcherByLivestreamIDCache = make(map[LivestreamID]*NGWordMatcher)
+		NGWordMatcherByLivestreamIDCacheMutex.Unlock()
+	})
+}
+
+// NGワードをまとめて1パスで判定するためのAho-Corasickオートマトン
+// 文字列はバイト単位で扱う (UTF-8同士の部分一致はバイト列の部分一致と等価)
+type NGWordMatcher struct {
+	words []string
+	nodes []ngWordMatcherNode
+}
+
+type ngWordMatcherNode struct {
+	next map[byte]int
+	fail int
+	// このノードで終わるNGワードのindex。失敗リンク先で終わるものも含めて1つだけ持てば十分
+	output int
+}
+
+func NewNGWordMatcher(words []string) *NGWordMatcher {
+	m := &NGWordMatcher{
+		words: words,
+		nodes: []ngWordMatcherNode{{next: map[byte]int{}, output: -1}},
+	}
+
+	// trieを構築
+	for i, word := range words {
+		cur := 0
+		for j := 0; j < len(word); j++ {
+			nxt, ok := m.nodes[cur].next[word[j]]
+			if !ok {
+				m.nodes = append(m.nodes, ngWordMatcherNode{next: map[byte]int{}, output: -1})
+				nxt = len(m.nodes) - 1
+				m.nodes[cur].next[word[j]] = nxt
+			}
+			cur = nxt
+		}
+		if m.nodes[cur].output < 0 {
+			m.nodes[cur].output = i
+		}
+	}
+
+	// BFSで失敗リンクを張る
+	queue := make([]int, 0, len(m.nodes))
+	for _, child := range m.nodes[0].next {
+		m.nodes[child].fail = 0
+		queue = append(queue, child)
+	}
+	for len(queue) > 0 {
+		cur := queue[0]
+		queue = queue[1:]
+		for b, child := range m.nodes[cur].next {
+			f := m.nodes[cur].fail
+			for {
+				if nxt, ok := m.nodes[f].next[b]; ok {
+					m.nodes[child].fail = nxt
+					break
+				}
+				if f == 0 {
+					m.nodes[child].fail = 0
+					break
+				}
+				f = m.nodes[f].fail
+			}
+			if m.nodes[child].output < 0 {
+				m.nodes[child].output = m.nodes[m.nodes[child].fail].output
+			}
+			queue = append(queue, child)
+		}
+	}
+
+	return m
+}
+
+// textに含まれるNGワードを1つ返す
+func (m *NGWordMatcher) Match(text string) (string, bool) {
+	if m == nil || len(m.words) == 0 {
+		return "", false
+	}
+	// 空文字のNGワードはstrings.Containsと同様に全てにマッチさせる
+	if out := m.nodes[0].output; out >= 0 {
+		return m.words[out], true
+	}
+
+	cur := 0
+	for i := 0; i < len(text); i++ {
+		for {
+			if nxt, ok := m.nodes[cur].next[text[i]]; ok {
+				cur = nxt
+				break
+			}
+			if cur == 0 {
+				break
+			}
+			cur = m.nodes[cur].fail
+		}
+		if out := m.nodes[cur].output; out >= 0 {
+			return m.words[out], true
+		}
+	}
+
+	return "", false
+}
+
+func getNGWordMatcher(ctx context.Context, tx *sqlx.Tx, livestreamModel LivestreamModel) (*NGWordMatcher, error) {
+	if matcher, ok := getCachedNGWordMatcher(livestreamModel.ID); ok {
+		return matcher, nil
+	}
+
+	matcher, err := loadNGWordMatcher(ctx, tx, livestreamModel.UserID, livestreamModel.ID)
+	if err != nil {
+		return nil, err
+	}
+	setNGWordMatcherCache(livestreamModel.ID, matcher)
+
+	return matcher, nil
+}
+
+func loadNGWordMatcher(ctx context.Context, tx *sqlx.Tx, userID UserID, livestreamID LivestreamID) (*NGWordMatcher, error) {
+	var words []string
+	if err := tx.SelectContext(ctx, &words, "SELECT word FROM ng_words WHERE user_id = ? AND livestream_id = ?", userID, livestreamID); err != nil {
+		return nil, err
+	}
+	return NewNGWordMatcher(words), nil
+}
+
+func getCachedNGWordMatcher(livestreamID LivestreamID) (*NGWordMatcher, bool) {
+	NGWordMatcherByLivestreamIDCacheMutex.RLock()
+	defer NGWordMatcherByLivestreamIDCacheMutex.RUnlock()
+	matcher, ok := NGWordMatcherByLivestreamIDCache[livestreamID]
+	return matcher, ok
+}
+
+func setNGWordMatcherCache(livestreamID LivestreamID, matcher *NGWordMatcher) {
+	NGWordMatcherByLivestreamIDCacheMutex.Lock()
+	NGWordMatcherByLivestreamIDCache[livestreamID] = matcher
+	NGWordMatcherByLivestreamIDCacheMutex.Unlock()
+}
@@ -0,0 +1,77 @@
+package main
+
+import (
+	"strings"
+	"testing"
+)
+
+// 1つずつstrings.Containsで調べた結果と同じになる
+func TestNGWordMatcherMatchesContains(t *testing.T) {
+	tests := map[string]struct {
+		words []string
+		texts []string
+	}{
+		"overlapping": {
+			words: []string{"he", "she", "his", "hers"},
+			texts: []string{"ushers", "ahishers", "shx", "hx", "h", ""},
+		},
+		// 長いワードの途中で失敗しても、失敗リンク先で終わる短いワードを拾う
+		"suffix": {
+			words: []string{"abcd", "bc", "cde"},
+			texts: []string{"abce", "abx", "xcdx", "xcde", "abd"},
+		},
+		"prefix": {
+			words: []string{"spam", "spammer"},
+			texts: []string{"spa", "spammer", "sp am"},
+		},
+		"empty word": {
+			words: []string{"foo", ""},
+			texts: []string{"", "bar", "foo"},
+		},
+		"no words": {
+			words: []string{},
+			texts: []string{"", "anything"},
+		},
+		"duplicate": {
+			words: []string{"ng", "ng"},
+			texts: []string{"ng", "n g"},
+		},
+		"multibyte": {
+			words: []string{"バカ", "アホ", "死ね", "😡"},
+			texts: []string{"ばか", "お前はバカだ", "アホウドリ", "死ぬ", "怒ってる😡", "🙂", "バ カ"},
+		},
+		// 先頭バイトが同じ別の文字に途中までマッチしても誤検知しない
+		"multibyte shared prefix": {
+			words: []string{"あい", "いう"},
+			texts: []string{"あぃう", "ああいう", "いい"},
+		},
+	}
+	for name, tt := range tests {
+		t.Run(name, func(t *testing.T) {
+			m := NewNGWordMatcher(tt.words)
+			for _, text := range tt.texts {
+				want := false
+				for _, word := range tt.words {
+					if strings.Contains(text, word) {
+						want = true
+					}
+				}
+
+				word, got := m.Match(text)
+				if got != want {
+					t.Errorf("Match(%q) = %v, want %v", text, got, want)
+				}
+				if got && !strings.Contains(text, word) {
+					t.Errorf("Match(%q) returned %q, which is not in the text", text, word)
+				}
+			}
+		})
+	}
+}
+
+func TestNGWordMatcherNil(t *testing.T) {
+	var m *NGWordMatcher
+	if _, ok := m.Match("text"); ok {
+		t.Error("nil matcher matched")
+	}
+}
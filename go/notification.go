@@ -0,0 +1,255 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"log"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	notificationTypeTip                  = "tip"
+	notificationTypeLivecommentModerated = "livecomment_moderated"
+	notificationTypeFollowingLive        = "following_live"
+
+	notificationQueueSize     = 1024
+	defaultNotificationsLimit = 50
+)
+
+type NotificationModel struct {
+	ID            int64         `db:"id"`
+	UserID        UserID        `db:"user_id"`
+	Type          string        `db:"type"`
+	LivestreamID  LivestreamID  `db:"livestream_id"`
+	LivecommentID sql.NullInt64 `db:"livecomment_id"`
+	// tipの場合はチップ額
+	Amount    int64         `db:"amount"`
+	ReadAt    sql.NullInt64 `db:"read_at"`
+	CreatedAt int64         `db:"created_at"`
+}
+
+type Notification struct {
+	ID            int64         `json:"id"`
+	Type          string        `json:"type"`
+	LivestreamID  LivestreamID  `json:"livestream_id"`
+	LivecommentID LivecommentID `json:"livecomment_id,omitempty"`
+	Amount        int64         `json:"amount,omitempty"`
+	Read          bool          `json:"read"`
+	CreatedAt     int64         `json:"created_at"`
+}
+
+// 通知の元になったイベント。宛先の解決とINSERTはワーカーで行う
+type NotificationJob struct {
+	Type         string
+	LivestreamID LivestreamID
+	// tip: チップ付きコメント1件, livecomment_moderated: 削除されたコメント
+	LivecommentIDs []LivecommentID
+	Amount         int64
+}
+
+var notificationQueue = make(chan NotificationJob, notificationQueueSize)
+
+// リクエストを待たせないよう、キューが詰まっている場合は通知を諦める
+func enqueueNotification(job NotificationJob) {
+	select {
+	case notificationQueue <- job:
+	default:
+		log.Printf("notification queue is full, dropped %s notification for livestream %d", job.Type, job.LivestreamID)
+	}
+}
+
+func init() {
+	registerCacheReset(drainNotificationQueue)
+}
+
+// initialize時に未処理のジョブを捨てる
+func drainNotificationQueue() {
+	for {
+		select {
+		case <-notificationQueue:
+		default:
+			return
+		}
+	}
+}
+
+func runNotificationWorker() {
+	for job := range notificationQueue {
+		if err := processNotification(context.Background(), job); err != nil {
+			log.Printf("failed to process %s notification for livestream %d: %+v", job.Type, job.LivestreamID, err)
+		}
+	}
+}
+
+func processNotification(ctx context.Context, job NotificationJob) error {
+	now := time.Now().Unix()
+
+	switch job.Type {
+	case notificationTypeTip:
+		// 配信者宛て
+		for _, livecommentID := range job.LivecommentIDs {
+			if _, err := dbConn.ExecContext(ctx,
+				"INSERT INTO notifications (user_id, type, livestream_id, livecomment_id, amount, created_at) SELECT user_id, ?, id, ?, ?, ? FROM livestreams WHERE id = ?",
+				job.Type, livecommentID, job.Amount, now, job.LivestreamID,
+			); err != nil {
+				return err
+			}
+		}
+	case notificationTypeLivecommentModerated:
+		// 削除されたコメントの投稿者宛て
+		if len(job.LivecommentIDs) == 0 {
+			return nil
+		}
+		query, args, err := sqlx.In(
+			"INSERT INTO notifications (user_id, type, livestream_id, livecomment_id, amount, created_at) SELECT user_id, ?, livestream_id, id, 0, ? FROM livecomments WHERE id IN (?)",
+			job.Type, now, job.LivecommentIDs,
+		)
+		if err != nil {
+			return err
+		}
+		if _, err := dbConn.ExecContext(ctx, dbConn.Rebind(query), args...); err != nil {
+			return err
+		}
+	case notificationTypeFollowingLive:
+		// 配信者のフォロワー宛て
+		if _, err := dbConn.ExecContext(ctx,
+			"INSERT INTO notifications (user_id, type, livestream_id, amount, created_at) SELECT f.follower_id, ?, l.id, 0, ? FROM livestreams l INNER JOIN follows f ON f.streamer_id = l.user_id WHERE l.id = ?",
+			job.Type, now, job.LivestreamID,
+		); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// 自分宛ての通知一覧API (新しい順)
+// GET /api/user/me/notifications
+func getNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	limit := defaultNotificationsLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l <= 0 {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "limit query parameter must be positive integer")
+		}
+		limit = l
+	}
+
+	query := "SELECT * FROM notifications WHERE user_id = ?"
+	args := []interface{}{userID}
+	if c.QueryParam("unread") == "true" {
+		query += " AND read_at IS NULL"
+	}
+	if c.QueryParam("before_id") != "" {
+		beforeID, err := strconv.ParseInt(c.QueryParam("before_id"), 10, 64)
+		if err != nil {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "before_id query parameter must be integer")
+		}
+		query += " AND id < ?"
+		args = append(args, beforeID)
+	}
+	// 続きがあるか判定するため1件多く取る
+	query += " ORDER BY id DESC LIMIT ?"
+	args = append(args, limit+1)
+
+	var notificationModels []*NotificationModel
+	if err := dbConn.SelectContext(ctx, &notificationModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notifications: "+err.Error())
+	}
+	page := pageInfo{total: -1, cursorParam: "before_id"}
+	if len(notificationModels) > limit {
+		notificationModels = notificationModels[:limit]
+		page.nextCursor = strconv.FormatInt(notificationModels[limit-1].ID, 10)
+	}
+
+	notifications := make([]Notification, len(notificationModels))
+	for i, notificationModel := range notificationModels {
+		notifications[i] = Notification{
+			ID:            notificationModel.ID,
+			Type:          notificationModel.Type,
+			LivestreamID:  notificationModel.LivestreamID,
+			LivecommentID: LivecommentID(notificationModel.LivecommentID.Int64),
+			Amount:        notificationModel.Amount,
+			Read:          notificationModel.ReadAt.Valid,
+			CreatedAt:     notificationModel.CreatedAt,
+		}
+	}
+
+	setPageHeaders(c, page)
+	return c.JSON(http.StatusOK, notifications)
+}
+
+// 通知の既読化API
+// POST /api/user/me/notifications/:notification_id/read
+func readNotificationHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	notificationID, err := strconv.Atoi(c.Param("notification_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "notification_id in path must be integer")
+	}
+
+	var exists bool
+	if err := dbConn.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM notifications WHERE id = ? AND user_id = ?)", notificationID, userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get notification: "+err.Error())
+	}
+	if !exists {
+		return echo.NewHTTPError(http.StatusNotFound, "notification not found")
+	}
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE notifications SET read_at = ? WHERE id = ? AND read_at IS NULL", time.Now().Unix(), notificationID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update notification: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+// 全通知の既読化API
+// POST /api/user/me/notifications/read
+func readAllNotificationsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	if _, err := dbConn.ExecContext(ctx, "UPDATE notifications SET read_at = ? WHERE user_id = ? AND read_at IS NULL", time.Now().Unix(), userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to update notifications: "+err.Error())
+	}
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,334 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"reflect"
+	"sort"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// ルートごとのAPIドキュメント。ルートを追加したらここにも足す
+// キーは "メソッド パス" (パスはechoのルート定義と同じ表記)
+type apiOperation struct {
+	Summary string
+	Tag     string
+	// ログインセッションが必要か
+	Auth  bool
+	Query []string
+	// JSONのリクエストボディの型 (nilならボディなし)
+	Request any
+	Status  int
+	// JSONのレスポンスボディの型 (nilならボディなし)
+	Response any
+	// JSON以外を返す場合のContent-Type
+	ContentType string
+}
+
+var apiOperations = map[string]apiOperation{
+	"POST /api/initialize":  {Summary: "ベンチマーク前の初期化", Tag: "system", Status: http.StatusOK, Response: InitializeResponse{}},
+	"GET /healthz":          {Summary: "死活監視", Tag: "system", Status: http.StatusOK, ContentType: echo.MIMETextPlain},
+	"GET /readyz":           {Summary: "DB・PowerDNS・キャッシュの準備状況", Tag: "system", Status: http.StatusOK, Response: ReadinessResponse{}},
+	"GET /api/openapi.json": {Summary: "このドキュメント", Tag: "system", Status: http.StatusOK, ContentType: echo.MIMEApplicationJSON},
+
+	"GET /api/debug/flags":          {Summary: "機能フラグの一覧", Tag: "system", Status: http.StatusOK, Response: []FeatureFlagState{}},
+	"PUT /api/debug/flags/:name":    {Summary: "機能フラグの上書き", Tag: "system", Request: PutFeatureFlagRequest{}, Status: http.StatusOK, Response: FeatureFlagState{}},
+	"DELETE /api/debug/flags/:name": {Summary: "機能フラグの上書きを解除", Tag: "system", Status: http.StatusOK, Response: FeatureFlagState{}},
+	"GET /api/debug/powerdns":       {Summary: "PowerDNSのサーキットブレーカーの状態", Tag: "system", Status: http.StatusOK, Response: CircuitBreakerState{}},
+
+	"GET /api/tag":                  {Summary: "タグ一覧", Tag: "tag", Status: http.StatusOK, Response: TagsResponse{}},
+	"GET /api/tag/stats":            {Summary: "タグごとの配信数と直近のアクティビティ (アクティビティ降順)", Tag: "tag", Status: http.StatusOK, Response: TagStatsResponse{}},
+	"POST /api/tag":                 {Summary: "タグ作成 (既にあれば既存のタグを返す)", Tag: "tag", Auth: true, Request: PostTagRequest{}, Status: http.StatusCreated, Response: Tag{}},
+	"GET /api/user/:username/theme": {Summary: "配信者のテーマ", Tag: "user", Auth: true, Status: http.StatusOK, Response: Theme{}},
+
+	"POST /api/livestream/reservation":          {Summary: "配信予約", Tag: "livestream", Auth: true, Request: ReserveLivestreamRequest{}, Status: http.StatusCreated, Response: Livestream{}},
+	"GET /api/livestream/search":                {Summary: "配信検索", Tag: "livestream", Auth: true, Query: []string{"q", "tag", "match", "status", "sort", "limit", "offset", "fields"}, Status: http.StatusOK, Response: []Livestream{}},
+	"GET /api/livestream/trending":              {Summary: "直近の勢いがある配信", Tag: "livestream", Auth: true, Query: []string{"limit"}, Status: http.StatusOK, Response: []TrendingLivestream{}},
+	"GET /api/feed":                             {Summary: "フォロー中の配信者と勢いのある配信のフィード", Tag: "livestream", Auth: true, Query: []string{"cursor", "limit"}, Status: http.StatusOK, Response: FeedResponse{}},
+	"GET /api/livestream/availability":          {Summary: "予約枠の空き状況", Tag: "livestream", Auth: true, Query: []string{"from", "until"}, Status: http.StatusOK, Response: []ReservationSlotModel{}},
+	"GET /api/livestream":                       {Summary: "自分の配信一覧", Tag: "livestream", Auth: true, Query: []string{"fields"}, Status: http.StatusOK, Response: []Livestream{}},
+	"GET /api/user/:username/livestream":        {Summary: "ユーザの配信一覧", Tag: "livestream", Auth: true, Query: []string{"fields"}, Status: http.StatusOK, Response: []Livestream{}},
+	"GET /api/livestream/:livestream_id":        {Summary: "配信取得", Tag: "livestream", Auth: true, Status: http.StatusOK, Response: Livestream{}},
+	"PATCH /api/livestream/:livestream_id":      {Summary: "配信情報の更新", Tag: "livestream", Auth: true, Request: UpdateLivestreamRequest{}, Status: http.StatusOK, Response: Livestream{}},
+	"POST /api/livestream/:livestream_id/start": {Summary: "配信開始", Tag: "livestream", Auth: true, Status: http.StatusOK, Response: Livestream{}},
+	"POST /api/livestream/:livestream_id/end":   {Summary: "配信終了", Tag: "livestream", Auth: true, Status: http.StatusOK, Response: Livestream{}},
+	"DELETE /api/livestream/:livestream_id":     {Summary: "配信予約の取り消し", Tag: "livestream", Auth: true, Status: http.StatusNoContent},
+
+	"GET /api/livestream/:livestream_id/livecomment":              {Summary: "ライブコメント一覧", Tag: "livecomment", Auth: true, Query: []string{"limit", "before_id", "after_id"}, Status: http.StatusOK, Response: []Livecomment{}},
+	"POST /api/livestream/:livestream_id/livecomment":             {Summary: "ライブコメント投稿", Tag: "livecomment", Auth: true, Request: PostLivecommentRequest{}, Status: http.StatusCreated, Response: Livecomment{}},
+	"GET /api/livestream/:livestream_id/livecomment/stream":       {Summary: "ライブコメントのSSEストリーム", Tag: "livecomment", Auth: true, Status: http.StatusOK, ContentType: "text/event-stream"},
+	"GET /api/livestream/:livestream_id/livecomment/search":       {Summary: "ライブコメント検索", Tag: "livecomment", Auth: true, Query: []string{"q", "min_tip", "max_tip", "limit"}, Status: http.StatusOK, Response: []Livecomment{}},
+	"GET /api/livestream/:livestream_id/ws":                       {Summary: "ライブコメント・リアクション・視聴者数のWebSocket", Tag: "livestream", Auth: true, Status: http.StatusSwitchingProtocols},
+	"POST /api/livestream/:livestream_id/reaction":                {Summary: "リアクション投稿", Tag: "reaction", Auth: true, Request: PostReactionRequest{}, Status: http.StatusCreated, Response: Reaction{}},
+	"GET /api/livestream/:livestream_id/reaction":                 {Summary: "リアクション一覧", Tag: "reaction", Auth: true, Query: []string{"limit", "cursor"}, Status: http.StatusOK, Response: []Reaction{}},
+	"DELETE /api/livestream/:livestream_id/reaction/:reaction_id": {Summary: "リアクション削除", Tag: "reaction", Auth: true, Status: http.StatusOK, Response: Reaction{}},
+	"GET /api/livestream/:livestream_id/reaction/counts":          {Summary: "絵文字ごとのリアクション数", Tag: "reaction", Auth: true, Status: http.StatusOK, Response: map[string]int64{}},
+	"GET /api/livestream/:livestream_id/reaction/stream":          {Summary: "リアクションのSSEストリーム", Tag: "reaction", Auth: true, Status: http.StatusOK, ContentType: "text/event-stream"},
+
+	"GET /api/livestream/:livestream_id/report":                              {Summary: "(配信者向け) ライブコメントの報告一覧", Tag: "moderation", Auth: true, Status: http.StatusOK, Response: []LivecommentReport{}},
+	"GET /api/livestream/:livestream_id/ngwords":                             {Summary: "NGワード一覧", Tag: "moderation", Auth: true, Status: http.StatusOK, Response: []NGWord{}},
+	"POST /api/livestream/:livestream_id/livecomment/:livecomment_id/report": {Summary: "ライブコメント報告", Tag: "moderation", Auth: true, Status: http.StatusCreated, Response: LivecommentReport{}},
+	"GET /api/livestream/:livestream_id/livecomment/:livecomment_id/reports": {Summary: "ライブコメントごとの報告一覧と報告数", Tag: "moderation", Auth: true, Status: http.StatusOK, Response: LivecommentReportsResponse{}},
+	"POST /api/livestream/:livestream_id/moderate":                           {Summary: "NGワード登録", Tag: "moderation", Auth: true, Request: ModerateRequest{}, Status: http.StatusCreated, Response: map[string]int64{}},
+	"POST /api/livestream/:livestream_id/moderate/bulk":                      {Summary: "NGワードの一括登録", Tag: "moderation", Auth: true, Request: ModerateBulkRequest{}, Status: http.StatusCreated, Response: map[string][]int64{}},
+	"DELETE /api/livestream/:livestream_id/livecomments":                     {Summary: "ライブコメントの一括削除", Tag: "moderation", Auth: true, Request: DeleteLivecommentsRequest{}, Status: http.StatusOK, Response: DeleteLivecommentsResponse{}},
+	"GET /api/livestream/:livestream_id/moderation/log":                      {Summary: "モデレーション操作の監査ログ", Tag: "moderation", Auth: true, Query: []string{"limit", "offset"}, Status: http.StatusOK, Response: []ModerationLogEntry{}},
+	"GET /api/admin/livestream/:livestream_id/moderation/log":                {Summary: "モデレーション操作の監査ログ (運営用)", Tag: "system", Query: []string{"limit", "offset"}, Status: http.StatusOK, Response: []ModerationLogEntry{}},
+
+	"POST /api/livestream/:livestream_id/enter":           {Summary: "視聴開始", Tag: "livestream", Auth: true, Status: http.StatusOK},
+	"DELETE /api/livestream/:livestream_id/exit":          {Summary: "視聴終了", Tag: "livestream", Auth: true, Status: http.StatusOK},
+	"POST /api/livestream/:livestream_id/heartbeat":       {Summary: "視聴継続の通知", Tag: "livestream", Auth: true, Status: http.StatusOK},
+	"POST /api/livestream/:livestream_id/collaborators":   {Summary: "共同配信者の追加", Tag: "livestream", Auth: true, Request: PostCollaboratorRequest{}, Status: http.StatusCreated, Response: []User{}},
+	"GET /api/livestream/:livestream_id/collaborators":    {Summary: "共同配信者一覧", Tag: "livestream", Auth: true, Query: []string{"fields"}, Status: http.StatusOK, Response: []User{}},
+	"POST /api/livestream/:livestream_id/archive":         {Summary: "録画の登録", Tag: "livestream", Auth: true, Request: PostArchiveRequest{}, Status: http.StatusCreated, Response: Archive{}},
+	"GET /api/livestream/:livestream_id/archive":          {Summary: "配信の録画一覧", Tag: "livestream", Auth: true, Status: http.StatusOK, Response: []Archive{}},
+	"POST /api/livestream/:livestream_id/streamkey":       {Summary: "ストリームキーの発行・再発行", Tag: "livestream", Auth: true, Status: http.StatusCreated, Response: StreamKeyResponse{}},
+	"POST /api/livestream/:livestream_id/report":          {Summary: "配信の報告", Tag: "livestream", Auth: true, Request: PostLivestreamReportRequest{}, Status: http.StatusCreated, Response: LivestreamReport{}},
+	"GET /api/admin/reports":                              {Summary: "報告された配信の確認キュー (運営用)", Tag: "system", Query: []string{"limit", "offset"}, Status: http.StatusOK, Response: []LivestreamReportQueueEntry{}},
+	"GET /api/livestream/:livestream_id/chat_settings":    {Summary: "チャットの設定", Tag: "livestream", Auth: true, Status: http.StatusOK, Response: ChatSettings{}},
+	"PATCH /api/livestream/:livestream_id/chat_settings":  {Summary: "チャットの設定の変更", Tag: "livestream", Auth: true, Request: PatchChatSettingsRequest{}, Status: http.StatusOK, Response: ChatSettings{}},
+	"GET /api/livestream/:livestream_id/urls":             {Summary: "配信の取り込み・再生URL", Tag: "livestream", Auth: true, Status: http.StatusOK, Response: LivestreamURLsResponse{}},
+	"POST /api/internal/livestream/:livestream_id/health": {Summary: "配信状態の報告 (メディアサーバ用)", Tag: "system", Request: PostStreamHealthRequest{}, Status: http.StatusNoContent},
+	"GET /api/internal/streamkey/validate":                {Summary: "ストリームキーの確認 (メディアサーバ用)", Tag: "system", Query: []string{"key"}, Status: http.StatusOK, Response: ValidateStreamKeyResponse{}},
+	"GET /api/livestream/:livestream_id/statistics":       {Summary: "配信の統計情報", Tag: "stats", Auth: true, Status: http.StatusOK, Response: LivestreamStatistics{}},
+	"POST /api/graphql":                                   {Summary: "ユーザ・配信・ライブコメント・統計をまとめて取るGraphQL (クエリのみ)", Tag: "stats", Auth: true, Request: GraphQLRequest{}, Status: http.StatusOK, Response: GraphQLResponse{}},
+
+	"POST /api/register":                                    {Summary: "ユーザ登録", Tag: "user", Request: PostUserRequest{}, Status: http.StatusCreated, Response: User{}},
+	"POST /api/login":                                       {Summary: "ログイン", Tag: "user", Request: LoginRequest{}, Status: http.StatusOK},
+	"GET /api/user/me":                                      {Summary: "自分のユーザ情報", Tag: "user", Auth: true, Status: http.StatusOK, Response: MeResponse{}},
+	"PATCH /api/user/me/name":                               {Summary: "ユーザ名変更", Tag: "user", Auth: true, Request: UpdateUsernameRequest{}, Status: http.StatusOK, Response: User{}},
+	"PATCH /api/user/me/password":                           {Summary: "パスワード変更", Tag: "user", Auth: true, Request: ChangePasswordRequest{}, Status: http.StatusNoContent},
+	"PATCH /api/user/me/theme":                              {Summary: "テーマ変更 (省略した項目は変えない)", Tag: "user", Auth: true, Request: PatchThemeRequest{}, Status: http.StatusOK, Response: Theme{}},
+	"GET /api/user/me/following":                            {Summary: "フォロー中の配信者一覧", Tag: "user", Auth: true, Query: []string{"fields"}, Status: http.StatusOK, Response: []User{}},
+	"GET /api/user/me/icons":                                {Summary: "アイコン履歴", Tag: "user", Auth: true, Status: http.StatusOK, Response: []IconHistoryEntry{}},
+	"POST /api/user/me/icons/:icon_id/activate":             {Summary: "過去のアイコンに戻す", Tag: "user", Auth: true, Status: http.StatusOK, Response: PostIconResponse{}},
+	"POST /api/user/:username/follow":                       {Summary: "フォロー", Tag: "user", Auth: true, Status: http.StatusOK, Response: User{}},
+	"DELETE /api/user/:username/follow":                     {Summary: "フォロー解除", Tag: "user", Auth: true, Status: http.StatusOK, Response: User{}},
+	"POST /api/user/:username/block":                        {Summary: "ブロック", Tag: "user", Auth: true, Status: http.StatusNoContent},
+	"DELETE /api/user/:username/block":                      {Summary: "ブロック解除", Tag: "user", Auth: true, Status: http.StatusNoContent},
+	"GET /api/user/me/notifications":                        {Summary: "自分宛ての通知一覧", Tag: "user", Auth: true, Query: []string{"unread", "limit", "before_id"}, Status: http.StatusOK, Response: []Notification{}},
+	"POST /api/user/me/notifications/read":                  {Summary: "全通知の既読化", Tag: "user", Auth: true, Status: http.StatusNoContent},
+	"POST /api/user/me/notifications/:notification_id/read": {Summary: "通知の既読化", Tag: "user", Auth: true, Status: http.StatusNoContent},
+	"GET /api/user/me/webhooks":                             {Summary: "自分のwebhook一覧", Tag: "user", Auth: true, Status: http.StatusOK, Response: []Webhook{}},
+	"POST /api/user/me/webhooks":                            {Summary: "webhook登録 (署名用のsecretはこのときだけ返す)", Tag: "user", Auth: true, Request: PostWebhookRequest{}, Status: http.StatusCreated, Response: PostWebhookResponse{}},
+	"DELETE /api/user/me/webhooks/:webhook_id":              {Summary: "webhook削除", Tag: "user", Auth: true, Status: http.StatusNoContent},
+	"GET /api/user/me/earnings":                             {Summary: "自分の配信の収益", Tag: "payment", Auth: true, Query: []string{"from", "until"}, Status: http.StatusOK, Response: EarningsResponse{}},
+	"GET /api/users":                                        {Summary: "ユーザの一括取得 (namesかidsのどちらか、最大100件)", Tag: "user", Auth: true, Query: []string{"names", "ids", "fields"}, Status: http.StatusOK, Response: []User{}},
+	"GET /api/user/:username":                               {Summary: "ユーザ取得", Tag: "user", Auth: true, Status: http.StatusOK, Response: User{}},
+	"GET /api/user/:username/statistics":                    {Summary: "ユーザの統計情報", Tag: "stats", Auth: true, Status: http.StatusOK, Response: UserStatistics{}},
+	"GET /api/user/:username/summary":                       {Summary: "ユーザの概要 (フォロワー数・配信数・チップ合計・順位)", Tag: "stats", Status: http.StatusOK, Response: UserSummary{}},
+	"GET /api/user/:username/icon":                          {Summary: "アイコン画像", Tag: "user", Auth: true, Status: http.StatusOK, ContentType: "image/jpeg"},
+	"POST /api/icon":                                        {Summary: "アイコン登録", Tag: "user", Auth: true, Request: PostIconRequest{}, Status: http.StatusCreated, Response: PostIconResponse{}},
+	"GET /api/user/:username/archive":                       {Summary: "ユーザの録画一覧", Tag: "livestream", Auth: true, Status: http.StatusOK, Response: []Archive{}},
+	"GET /api/user/:username/emote":                         {Summary: "配信者のエモート一覧", Tag: "emote", Auth: true, Status: http.StatusOK, Response: []Emote{}},
+	"GET /api/user/:username/emote/:emote_name":             {Summary: "エモート画像", Tag: "emote", Auth: true, Status: http.StatusOK, ContentType: "image/png"},
+	"POST /api/emote":                                       {Summary: "エモート登録", Tag: "emote", Auth: true, Request: PostEmoteRequest{}, Status: http.StatusCreated, Response: Emote{}},
+
+	"GET /api/payment":         {Summary: "チップの総額", Tag: "payment", Status: http.StatusOK, Response: PaymentResult{}},
+	"GET /api/payment/history": {Summary: "自分の配信に送られたチップの履歴", Tag: "payment", Auth: true, Query: []string{"cursor", "limit"}, Status: http.StatusOK, Response: PaymentHistoryResponse{}},
+}
+
+// 起動時に一度だけ組み立てる
+var openAPIDocument []byte
+
+// apiOperationsとGoの構造体のjsonタグからOpenAPI 3のドキュメントを組み立てる
+func buildOpenAPIDocument() ([]byte, error) {
+	g := &openAPISchemaGenerator{schemas: map[string]any{}}
+
+	paths := map[string]map[string]any{}
+	for key, op := range apiOperations {
+		method, path, _ := strings.Cut(key, " ")
+
+		var params []any
+		segments := strings.Split(path, "/")
+		for i, segment := range segments {
+			if !strings.HasPrefix(segment, ":") {
+				continue
+			}
+			name := segment[1:]
+			segments[i] = "{" + name + "}"
+			schema := map[string]any{"type": "string"}
+			if strings.HasSuffix(name, "_id") {
+				schema = map[string]any{"type": "integer", "format": "int64"}
+			}
+			params = append(params, map[string]any{"name": name, "in": "path", "required": true, "schema": schema})
+		}
+		for _, name := range op.Query {
+			params = append(params, map[string]any{"name": name, "in": "query", "schema": map[string]any{"type": "string"}})
+		}
+
+		operation := map[string]any{
+			"summary": op.Summary,
+			"tags":    []string{op.Tag},
+		}
+		if len(params) > 0 {
+			operation["parameters"] = params
+		}
+		if op.Auth {
+			operation["security"] = []any{map[string]any{"session": []string{}}}
+		}
+		if op.Request != nil {
+			operation["requestBody"] = map[string]any{
+				"required": true,
+				"content": map[string]any{
+					echo.MIMEApplicationJSON: map[string]any{"schema": g.schemaOf(reflect.TypeOf(op.Request))},
+				},
+			}
+		}
+		response := map[string]any{"description": http.StatusText(op.Status)}
+		switch {
+		case op.Response != nil:
+			response["content"] = map[string]any{
+				echo.MIMEApplicationJSON: map[string]any{"schema": g.schemaOf(reflect.TypeOf(op.Response))},
+			}
+		case op.ContentType != "":
+			response["content"] = map[string]any{op.ContentType: map[string]any{}}
+		}
+		operation["responses"] = map[string]any{
+			strconv.Itoa(op.Status): response,
+			"default": map[string]any{
+				"description": "エラー",
+				"content": map[string]any{
+					echo.MIMEApplicationJSON: map[string]any{"schema": g.schemaOf(reflect.TypeOf(ErrorResponse{}))},
+				},
+			},
+		}
+
+		openAPIPath := strings.Join(segments, "/")
+		if paths[openAPIPath] == nil {
+			paths[openAPIPath] = map[string]any{}
+		}
+		paths[openAPIPath][strings.ToLower(method)] = operation
+	}
+
+	doc := map[string]any{
+		"openapi": "3.0.3",
+		"info": map[string]any{
+			"title":   "ISUPIPE API",
+			"version": "1.0.0",
+		},
+		"paths": paths,
+		"components": map[string]any{
+			"schemas": g.schemas,
+			"securitySchemes": map[string]any{
+				"session": map[string]any{"type": "apiKey", "in": "cookie", "name": defaultSessionIDKey},
+			},
+		},
+	}
+
+	// encoding/jsonはmapのキーをソートするので出力は毎回同じになる
+	return json.MarshalIndent(doc, "", "  ")
+}
+
+type openAPISchemaGenerator struct {
+	// 名前付きの構造体はcomponents/schemasに置いて$refで参照する
+	schemas map[string]any
+}
+
+func (g *openAPISchemaGenerator) schemaOf(t reflect.Type) map[string]any {
+	switch t.Kind() {
+	case reflect.Pointer:
+		schema := g.schemaOf(t.Elem())
+		if _, ok := schema["$ref"]; ok {
+			return map[string]any{"allOf": []any{schema}, "nullable": true}
+		}
+		schema["nullable"] = true
+		return schema
+	case reflect.Bool:
+		return map[string]any{"type": "boolean"}
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32:
+		return map[string]any{"type": "integer", "format": "int32"}
+	case reflect.Int64, reflect.Uint64:
+		return map[string]any{"type": "integer", "format": "int64"}
+	case reflect.Float32, reflect.Float64:
+		return map[string]any{"type": "number"}
+	case reflect.String:
+		return map[string]any{"type": "string"}
+	case reflect.Slice, reflect.Array:
+		if t.Elem().Kind() == reflect.Uint8 {
+			// []byteはbase64の文字列になる
+			return map[string]any{"type": "string", "format": "byte"}
+		}
+		return map[string]any{"type": "array", "items": g.schemaOf(t.Elem())}
+	case reflect.Map:
+		return map[string]any{"type": "object", "additionalProperties": g.schemaOf(t.Elem())}
+	case reflect.Struct:
+		if t.Name() == "" {
+			return g.structSchema(t)
+		}
+		if _, ok := g.schemas[t.Name()]; !ok {
+			// 自己参照する型で無限に再帰しないよう先に登録する
+			g.schemas[t.Name()] = map[string]any{}
+			g.schemas[t.Name()] = g.structSchema(t)
+		}
+		return map[string]any{"$ref": "#/components/schemas/" + t.Name()}
+	default:
+		// interface{}など
+		return map[string]any{}
+	}
+}
+
+func (g *openAPISchemaGenerator) structSchema(t reflect.Type) map[string]any {
+	properties := map[string]any{}
+	var required []string
+	g.collectProperties(t, properties, &required)
+	sort.Strings(required)
+
+	schema := map[string]any{"type": "object", "properties": properties}
+	if len(required) > 0 {
+		schema["required"] = required
+	}
+	return schema
+}
+
+// encoding/jsonと同じく、タグの無い埋め込み構造体のフィールドは親に展開する
+func (g *openAPISchemaGenerator) collectProperties(t reflect.Type, properties map[string]any, required *[]string) {
+	for i := 0; i < t.NumField(); i++ {
+		f := t.Field(i)
+		tag := f.Tag.Get("json")
+		if tag == "-" {
+			continue
+		}
+		name, opts, _ := strings.Cut(tag, ",")
+		if f.Anonymous && name == "" && f.Type.Kind() == reflect.Struct {
+			g.collectProperties(f.Type, properties, required)
+			continue
+		}
+		if !f.IsExported() {
+			continue
+		}
+		if name == "" {
+			name = f.Name
+		}
+		properties[name] = g.schemaOf(f.Type)
+		if !strings.Contains(opts, "omitempty") {
+			*required = append(*required, name)
+		}
+	}
+}
+
+// /api/openapi.json
+func getOpenAPIHandler(c echo.Context) error {
+	return c.JSONBlob(http.StatusOK, openAPIDocument)
+}
+
+// ドキュメントの書き漏れを起動時に知らせる
+func checkOpenAPICoverage(e *echo.Echo) {
+	var missing []string
+	for _, route := range e.Routes() {
+		if !strings.HasPrefix(route.Path, "/api/") && route.Path != "/healthz" && route.Path != "/readyz" {
+			continue
+		}
+		if _, ok := apiOperations[route.Method+" "+route.Path]; !ok {
+			missing = append(missing, route.Method+" "+route.Path)
+		}
+	}
+	if len(missing) > 0 {
+		sort.Strings(missing)
+		log.Printf("routes missing from apiOperations: %s", strings.Join(missing, ", "))
+	}
+}
@@ -0,0 +1,62 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/url"
+	"strconv"
+	"strings"
+
+	"github.com/labstack/echo/v4"
+)
+
+// 一覧APIの続きの有無をヘッダで返す。レスポンスの本体は今まで通り (配列のままのものは配列のまま) にする
+//
+//	X-Total-Count: 条件に合う全件数 (追加のクエリ無しで分かる場合のみ)
+//	X-Next-Cursor: 次のページを取るときにcursorParamへ渡す値 (続きが無ければ付けない)
+//	Link: <次のページのURL>; rel="next" (RFC 5988)
+type pageInfo struct {
+	// 全件数が分からない場合は負
+	total int64
+	// 次のページを指定するクエリパラメータ名 (before_id, offsetなど)
+	cursorParam string
+	nextCursor  string
+}
+
+func setPageHeaders(c echo.Context, page pageInfo) {
+	header := c.Response().Header()
+	if page.total >= 0 {
+		header.Set("X-Total-Count", strconv.FormatInt(page.total, 10))
+	}
+	if page.nextCursor == "" {
+		return
+	}
+	header.Set("X-Next-Cursor", page.nextCursor)
+
+	// 他の検索条件はそのままにカーソルだけを差し替える
+	query := c.Request().URL.Query()
+	query.Set(page.cursorParam, page.nextCursor)
+	next := url.URL{Path: c.Request().URL.Path, RawQuery: query.Encode()}
+	header.Add("Link", "<"+next.String()+`>; rel="next"`)
+}
+
+// created_atの降順 (同時刻はidの降順) に並ぶ一覧のカーソル。最後に返した要素の "created_at_id"
+func formatCreatedAtIDCursor(createdAt int64, id int64) string {
+	return fmt.Sprintf("%d_%d", createdAt, id)
+}
+
+func parseCreatedAtIDCursor(cursor string) (int64, int64, error) {
+	createdAtStr, idStr, ok := strings.Cut(cursor, "_")
+	if !ok {
+		return 0, 0, errors.New("cursor must be created_at_id")
+	}
+	createdAt, err := strconv.ParseInt(createdAtStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	id, err := strconv.ParseInt(idStr, 10, 64)
+	if err != nil {
+		return 0, 0, err
+	}
+	return createdAt, id, nil
+}
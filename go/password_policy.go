@@ -0,0 +1,56 @@
+package main
+
+import (
+	"fmt"
+	"unicode"
+	"unicode/utf8"
+)
+
+// 登録時とパスワード変更時に検査する。ベンチマークの初期データは弱いパスワードなのでデフォルトは緩くしておく
+type PasswordPolicy struct {
+	MinLength int
+	// 小文字・大文字・数字・記号のうち何種類以上を含むか
+	MinCharClasses int
+}
+
+const (
+	defaultPasswordMinLength      = 1
+	defaultPasswordMinCharClasses = 0
+	// 小文字・大文字・数字・記号
+	passwordCharClasses = 4
+)
+
+func countPasswordCharClasses(password string) int {
+	var lower, upper, digit, symbol bool
+	for _, r := range password {
+		switch {
+		case unicode.IsLower(r):
+			lower = true
+		case unicode.IsUpper(r):
+			upper = true
+		case unicode.IsDigit(r):
+			digit = true
+		default:
+			symbol = true
+		}
+	}
+	n := 0
+	for _, ok := range []bool{lower, upper, digit, symbol} {
+		if ok {
+			n++
+		}
+	}
+	return n
+}
+
+// fieldはエラーに載せるjsonのキー名
+func checkPasswordPolicy(field string, password string) (FieldError, bool) {
+	policy := currentTunables().PasswordPolicy
+	if utf8.RuneCountInString(password) < policy.MinLength {
+		return FieldError{Field: field, Reason: fmt.Sprintf("must have at least %d characters", policy.MinLength)}, false
+	}
+	if countPasswordCharClasses(password) < policy.MinCharClasses {
+		return FieldError{Field: field, Reason: fmt.Sprintf("must contain at least %d of lowercase letters, uppercase letters, digits and symbols", policy.MinCharClasses)}, false
+	}
+	return FieldError{}, true
+}
@@ -1,34 +1,362 @@
 package main
 
 import (
+	"context"
 	"net/http"
+	"strconv"
+	"time"
 
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 )
 
+const (
+	defaultPaymentHistoryLimit = 50
+
+	// 収益を日別に集計する際の区切り (JST)
+	earningsDayOffsetSeconds = 9 * 60 * 60
+)
+
 type PaymentResult struct {
 	TotalTip int64 `json:"total_tip"`
+	// total_tipを単位に合わせて表示する文字列
+	TotalTipDisplay string      `json:"total_tip_display"`
+	TipCurrency     TipCurrency `json:"tip_currency"`
 }
 
 func GetPaymentResult(c echo.Context) error {
 	ctx := c.Request().Context()
 
+	// 全体の合計は配信者ごとの行から求める (1行に集めると投稿のたびに同じ行のロックを取り合う)
+	var totalTip int64
+	if err := dbConn.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(total_tip), 0) FROM tip_aggregates"); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get total tip: "+err.Error())
+	}
+	totalTip += unflushedTipAggregateTotal()
+
+	return c.JSON(http.StatusOK, &PaymentResult{
+		TotalTip:        totalTip,
+		TotalTipDisplay: formatTip(totalTip),
+		TipCurrency:     currentTunables().TipCurrency,
+	})
+}
+
+// 配信者ごとのチップ合計に加算する (減らす場合は負の値を渡す)
+// livecommentsの更新と同じトランザクションで呼ぶこと
+func addTipAggregate(ctx context.Context, tx *sqlx.Tx, streamerID UserID, tip int64) error {
+	if tip == 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO tip_aggregates (user_id, total_tip) VALUES (?, ?) ON DUPLICATE KEY UPDATE total_tip = total_tip + VALUES(total_tip)",
+		streamerID, tip,
+	)
+	return err
+}
+
+// チップ付きのライブコメントを履歴と合計に反映する
+func recordTip(ctx context.Context, tx *sqlx.Tx, streamerID UserID, livecommentModel LivecommentModel) error {
+	if err := recordTipEvent(ctx, tx, streamerID, livecommentModel); err != nil {
+		return err
+	}
+	return addTipAggregate(ctx, tx, streamerID, livecommentModel.Tip)
+}
+
+// 履歴だけを書き込む。合計はコミット後にbufferTipAggregateで足すこと
+func recordTipEvent(ctx context.Context, tx *sqlx.Tx, streamerID UserID, livecommentModel LivecommentModel) error {
+	if livecommentModel.Tip == 0 {
+		return nil
+	}
+	_, err := tx.ExecContext(ctx,
+		"INSERT INTO tip_events (streamer_id, livestream_id, livecomment_id, tipper_id, tip, created_at) VALUES (?, ?, ?, ?, ?, ?)",
+		streamerID, livecommentModel.LivestreamID, livecommentModel.ID, livecommentModel.UserID, livecommentModel.Tip, livecommentModel.CreatedAt,
+	)
+	return err
+}
+
+// 削除するライブコメントのチップを履歴と合計から取り除く
+// 二重に引かないよう、呼び出し側で対象行をロックした上で未削除のものだけを渡すこと
+func subtractLivecommentTips(ctx context.Context, tx *sqlx.Tx, streamerID UserID, livecommentIDs []LivecommentID) error {
+	if len(livecommentIDs) == 0 {
+		return nil
+	}
+	query, args, err := sqlx.In("SELECT IFNULL(SUM(tip), 0) FROM livecomments WHERE id IN (?)", livecommentIDs)
+	if err != nil {
+		return err
+	}
+	var tips int64
+	if err := tx.GetContext(ctx, &tips, tx.Rebind(query), args...); err != nil {
+		return err
+	}
+	query, args, err = sqlx.In("DELETE FROM tip_events WHERE livecomment_id IN (?)", livecommentIDs)
+	if err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, tx.Rebind(query), args...); err != nil {
+		return err
+	}
+	return addTipAggregate(ctx, tx, streamerID, -tips)
+}
+
+// initialize時にチップの履歴と合計を初期データから作り直す
+func rebuildTipAggregates(ctx context.Context) error {
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tip_aggregates"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, "DELETE FROM tip_events"); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+	INSERT INTO tip_events (streamer_id, livestream_id, livecomment_id, tipper_id, tip, created_at)
+	SELECT l.user_id, lc.livestream_id, lc.id, lc.user_id, lc.tip, lc.created_at FROM livecomments lc INNER JOIN livestreams l ON l.id = lc.livestream_id
+	WHERE lc.deleted_at IS NULL AND lc.tip > 0
+	ORDER BY lc.id
+	`); err != nil {
+		return err
+	}
+	if _, err := tx.ExecContext(ctx, `
+	INSERT INTO tip_aggregates (user_id, total_tip)
+	SELECT l.user_id, SUM(lc.tip) FROM livecomments lc INNER JOIN livestreams l ON l.id = lc.livestream_id
+	WHERE lc.deleted_at IS NULL
+	GROUP BY l.user_id
+	`); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+type TipEventModel struct {
+	ID            int64         `db:"id"`
+	StreamerID    UserID        `db:"streamer_id"`
+	LivestreamID  LivestreamID  `db:"livestream_id"`
+	LivecommentID LivecommentID `db:"livecomment_id"`
+	TipperID      UserID        `db:"tipper_id"`
+	Tip           int64         `db:"tip"`
+	CreatedAt     int64         `db:"created_at"`
+}
+
+type TipEvent struct {
+	ID         int64      `json:"id"`
+	Tipper     User       `json:"tipper"`
+	Livestream Livestream `json:"livestream"`
+	Amount     int64      `json:"amount"`
+	CreatedAt  int64      `json:"created_at"`
+}
+
+type PaymentHistoryResponse struct {
+	Items []TipEvent `json:"items"`
+	// 続きが無い場合は空
+	NextCursor string `json:"next_cursor"`
+}
+
+// 自分の配信に送られたチップの履歴API (新しい順)
+// GET /api/payment/history?cursor=&limit=
+func getPaymentHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	limit := defaultPaymentHistoryLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l <= 0 {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "limit query parameter must be positive integer")
+		}
+		limit = l
+	}
+
+	// カーソルは最後に返した履歴の "created_at_id"
+	query := "SELECT * FROM tip_events WHERE streamer_id = ?"
+	args := []interface{}{userID}
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		createdAt, id, err := parseCreatedAtIDCursor(cursor)
+		if err != nil {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid cursor")
+		}
+		query += " AND (created_at < ? OR (created_at = ? AND id < ?))"
+		args = append(args, createdAt, createdAt, id)
+	}
+	// 続きがあるか判定するため1件多く取る
+	query += " ORDER BY created_at DESC, id DESC LIMIT ?"
+	args = append(args, limit+1)
+
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	var totalTip int64
-	if err := tx.GetContext(ctx, &totalTip, "SELECT IFNULL(SUM(tip), 0) FROM livecomments"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total tip: "+err.Error())
+	var tipEventModels []*TipEventModel
+	if err := tx.SelectContext(ctx, &tipEventModels, query, args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get tip events: "+err.Error())
+	}
+
+	res := PaymentHistoryResponse{Items: []TipEvent{}}
+	if len(tipEventModels) > limit {
+		tipEventModels = tipEventModels[:limit]
+		last := tipEventModels[limit-1]
+		res.NextCursor = formatCreatedAtIDCursor(last.CreatedAt, last.ID)
+	}
+
+	if len(tipEventModels) > 0 {
+		tipperIDs := make([]UserID, 0, len(tipEventModels))
+		livestreamIDs := make([]LivestreamID, 0, len(tipEventModels))
+		for _, tipEventModel := range tipEventModels {
+			tipperIDs = append(tipperIDs, tipEventModel.TipperID)
+			livestreamIDs = append(livestreamIDs, tipEventModel.LivestreamID)
+		}
+
+		userModels, err := userRepository.ListByIDs(ctx, tx, tipperIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+		}
+		users, err := userRepository.FillBulk(ctx, tx, userModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
+		}
+		userMap := make(map[UserID]User, len(users))
+		for _, user := range users {
+			userMap[user.ID] = user
+		}
+
+		query, args, err = sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+		}
+		var livestreamModels []*LivestreamModel
+		if err := tx.SelectContext(ctx, &livestreamModels, tx.Rebind(query), args...); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		}
+		livestreams, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
+		if err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+		}
+		livestreamMap := make(map[LivestreamID]Livestream, len(livestreams))
+		for _, livestream := range livestreams {
+			livestreamMap[livestream.ID] = livestream
+		}
+
+		res.Items = make([]TipEvent, len(tipEventModels))
+		for i, tipEventModel := range tipEventModels {
+			res.Items[i] = TipEvent{
+				ID:         tipEventModel.ID,
+				Tipper:     userMap[tipEventModel.TipperID],
+				Livestream: livestreamMap[tipEventModel.LivestreamID],
+				Amount:     tipEventModel.Tip,
+				CreatedAt:  tipEventModel.CreatedAt,
+			}
+		}
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, &PaymentResult{
-		TotalTip: totalTip,
-	})
+	setPageHeaders(c, pageInfo{total: -1, cursorParam: "cursor", nextCursor: res.NextCursor})
+	return c.JSON(http.StatusOK, res)
+}
+
+type DailyEarning struct {
+	// JSTの日付 (YYYY-MM-DD)
+	Date     string `json:"date"`
+	TotalTip int64  `json:"total_tip"`
+}
+
+type LivestreamEarning struct {
+	LivestreamID LivestreamID `json:"livestream_id"`
+	TotalTip     int64        `json:"total_tip"`
+}
+
+type EarningsResponse struct {
+	TotalTip    int64               `json:"total_tip"`
+	Daily       []DailyEarning      `json:"daily"`
+	Livestreams []LivestreamEarning `json:"livestreams"`
+}
+
+// 自分の配信のチップ収益を日別・配信別に集計するAPI
+// GET /api/user/me/earnings?from=&until= (unix秒, fromを含みuntilを含まない)
+func getEarningsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	query := "FROM tip_events WHERE streamer_id = ?"
+	args := []interface{}{userID}
+	if c.QueryParam("from") != "" {
+		from, err := strconv.ParseInt(c.QueryParam("from"), 10, 64)
+		if err != nil {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "from query parameter must be integer")
+		}
+		query += " AND created_at >= ?"
+		args = append(args, from)
+	}
+	if c.QueryParam("until") != "" {
+		until, err := strconv.ParseInt(c.QueryParam("until"), 10, 64)
+		if err != nil {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "until query parameter must be integer")
+		}
+		query += " AND created_at < ?"
+		args = append(args, until)
+	}
+
+	var daily []struct {
+		Day      int64 `db:"day"`
+		TotalTip int64 `db:"total_tip"`
+	}
+	dailyArgs := append([]interface{}{earningsDayOffsetSeconds}, args...)
+	if err := dbConn.SelectContext(ctx, &daily, "SELECT FLOOR((created_at + ?) / 86400) AS day, SUM(tip) AS total_tip "+query+" GROUP BY day ORDER BY day", dailyArgs...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get daily earnings: "+err.Error())
+	}
+
+	res := EarningsResponse{
+		Daily:       make([]DailyEarning, len(daily)),
+		Livestreams: []LivestreamEarning{},
+	}
+	for i, d := range daily {
+		res.Daily[i] = DailyEarning{
+			Date:     time.Unix(d.Day*86400, 0).UTC().Format("2006-01-02"),
+			TotalTip: d.TotalTip,
+		}
+		res.TotalTip += d.TotalTip
+	}
+
+	var livestreams []struct {
+		LivestreamID LivestreamID `db:"livestream_id"`
+		TotalTip     int64        `db:"total_tip"`
+	}
+	if err := dbConn.SelectContext(ctx, &livestreams, "SELECT livestream_id, SUM(tip) AS total_tip "+query+" GROUP BY livestream_id ORDER BY livestream_id", args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream earnings: "+err.Error())
+	}
+	for _, l := range livestreams {
+		res.Livestreams = append(res.Livestreams, LivestreamEarning{
+			LivestreamID: l.LivestreamID,
+			TotalTip:     l.TotalTip,
+		})
+	}
+
+	return c.JSON(http.StatusOK, res)
 }
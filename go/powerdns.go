@@ -0,0 +1,186 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"strings"
+	"sync"
+	"time"
+)
+
+const (
+	// 続けてこの回数失敗したらPowerDNSへのリクエストを止める
+	powerDNSBreakerFailureThreshold = 5
+	// 止めてから様子見のリクエストを1つだけ通すまでの時間
+	powerDNSBreakerCooldown = 5 * time.Second
+	// 落ちている間に1リクエストを長く待たせない
+	powerDNSRequestTimeout = 3 * time.Second
+)
+
+// ユーザごとのサブドメイン (<username>.u.isucon.local) のゾーン
+const userSubdomainZone = "u.isucon.local"
+
+// ブレーカーが開いている間はリクエストせずにこのエラーを返す
+var errPowerDNSUnavailable = errors.New("powerdns is unavailable")
+
+const (
+	circuitClosed   = "closed"
+	circuitOpen     = "open"
+	circuitHalfOpen = "half_open"
+)
+
+// PowerDNSが落ちている間、ユーザ登録がタイムアウトまで待たされ続けないようにする
+// 失敗が続いたら開いてすぐに失敗させ、クールダウン後に1リクエストだけ通して復旧を確かめる
+type circuitBreaker struct {
+	mu                  sync.Mutex
+	state               string
+	consecutiveFailures int
+	openedAt            time.Time
+	// 開いている間に弾いた数 (デバッグ用)
+	rejected int64
+}
+
+type CircuitBreakerState struct {
+	State               string `json:"state"`
+	ConsecutiveFailures int    `json:"consecutive_failures"`
+	// 開いていない場合は0
+	OpenedAt int64 `json:"opened_at"`
+	Rejected int64 `json:"rejected"`
+}
+
+func (b *circuitBreaker) allow(now time.Time) bool {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	switch b.state {
+	case circuitOpen:
+		if now.Sub(b.openedAt) < powerDNSBreakerCooldown {
+			b.rejected++
+			return false
+		}
+		b.state = circuitHalfOpen
+		return true
+	case circuitHalfOpen:
+		// 様子見のリクエストの結果が出るまでは通さない
+		b.rejected++
+		return false
+	default:
+		return true
+	}
+}
+
+func (b *circuitBreaker) record(now time.Time, failed bool) {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	if !failed {
+		b.state = circuitClosed
+		b.consecutiveFailures = 0
+		return
+	}
+	b.consecutiveFailures++
+	if b.state == circuitHalfOpen || b.consecutiveFailures >= powerDNSBreakerFailureThreshold {
+		b.state = circuitOpen
+		b.openedAt = now
+	}
+}
+
+func (b *circuitBreaker) snapshot() CircuitBreakerState {
+	b.mu.Lock()
+	defer b.mu.Unlock()
+	state := CircuitBreakerState{
+		State:               b.state,
+		ConsecutiveFailures: b.consecutiveFailures,
+		Rejected:            b.rejected,
+	}
+	if state.State == "" {
+		state.State = circuitClosed
+	}
+	if b.state == circuitOpen || b.state == circuitHalfOpen {
+		state.OpenedAt = b.openedAt.Unix()
+	}
+	return state
+}
+
+// ユーザのサブドメインを管理するPowerDNSのAPIクライアント
+type PowerDNSClient struct {
+	endpoint string
+	apiKey   string
+	// サブドメインのAレコードに登録するアドレス
+	subdomainAddress string
+	httpClient       *http.Client
+	breaker          circuitBreaker
+}
+
+func newPowerDNSClient(endpoint string, apiKey string, subdomainAddress string) *PowerDNSClient {
+	return &PowerDNSClient{
+		endpoint:         endpoint,
+		apiKey:           apiKey,
+		subdomainAddress: subdomainAddress,
+		httpClient:       &http.Client{Timeout: powerDNSRequestTimeout},
+	}
+}
+
+// ユーザのサブドメインのAレコードを作成 (changetype=REPLACE) または削除 (changetype=DELETE) する
+// ブレーカーが開いていればerrPowerDNSUnavailableを返す
+func (p *PowerDNSClient) PatchRecord(name string, changetype string) error {
+	if !p.breaker.allow(time.Now()) {
+		return errPowerDNSUnavailable
+	}
+	err := p.patchRecord(name, changetype)
+	// 4xxはリクエストの問題なので、PowerDNSが落ちているとはみなさない
+	var statusErr *powerDNSStatusError
+	failed := err != nil && !(errors.As(err, &statusErr) && statusErr.statusCode < 500)
+	p.breaker.record(time.Now(), failed)
+	return err
+}
+
+type powerDNSStatusError struct {
+	statusCode int
+}
+
+func (e *powerDNSStatusError) Error() string {
+	return fmt.Sprintf("status code is not 204: %d", e.statusCode)
+}
+
+func (p *PowerDNSClient) patchRecord(name string, changetype string) error {
+	endpoint := p.endpoint + "/zones/" + userSubdomainZone + "."
+	body := fmt.Sprintf(`{"rrsets": [{"name": "%s.%s.", "type": "A", "ttl": 3600, "changetype": "%s", "records": [{"content": "%s", "disabled": false}]}]}`, name, userSubdomainZone, changetype, p.subdomainAddress)
+	req, err := http.NewRequest(http.MethodPatch, endpoint, strings.NewReader(body))
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", p.apiKey)
+	req.Header.Set("Content-Type", "application/json")
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusNoContent {
+		return &powerDNSStatusError{statusCode: resp.StatusCode}
+	}
+	return nil
+}
+
+// readyz用。APIが応答するかだけを見る
+func (p *PowerDNSClient) Ping(ctx context.Context) error {
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, p.endpoint, nil)
+	if err != nil {
+		return err
+	}
+	req.Header.Set("X-API-Key", p.apiKey)
+	resp, err := p.httpClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("status code is not 200: %d", resp.StatusCode)
+	}
+	return nil
+}
+
+func (p *PowerDNSClient) BreakerState() CircuitBreakerState {
+	return p.breaker.snapshot()
+}
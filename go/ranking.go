@@ -0,0 +1,201 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// ランキングは全配信・全ユーザを集計するので重い。短い間だけスナップショットを使い回す
+const defaultRankingSnapshotTTL = 1 * time.Second
+
+// ある時点のライブ配信ランキング (スコア = リアクション数 + チップ合計 + 同時視聴者数)
+type LivestreamRankingSnapshot struct {
+	// スコア昇順 (同点はID昇順)
+	Ranking LivestreamRanking
+	// スナップショット作成後の配信はここに無いのでスコア0として扱う
+	ScoreByLivestreamID map[LivestreamID]int64
+	CreatedAt           time.Time
+}
+
+var (
+	livestreamRankingSnapshot      *LivestreamRankingSnapshot
+	livestreamRankingSnapshotMutex = sync.Mutex{}
+)
+
+func getLivestreamRankingSnapshot(ctx context.Context) (*LivestreamRankingSnapshot, error) {
+	livestreamRankingSnapshotMutex.Lock()
+	defer livestreamRankingSnapshotMutex.Unlock()
+
+	if livestreamRankingSnapshot != nil && time.Since(livestreamRankingSnapshot.CreatedAt) < currentTunables().RankingSnapshotTTL {
+		return livestreamRankingSnapshot, nil
+	}
+
+	var stats []struct {
+		LivestreamID LivestreamID `db:"livestream_id"`
+		Reactions    int64        `db:"reactions"`
+		Tips         int64        `db:"tips"`
+	}
+	if err := dbConn.SelectContext(ctx, &stats, `
+	SELECT l.id AS livestream_id, IFNULL(r.reactions, 0) AS reactions, IFNULL(t.tips, 0) AS tips
+	FROM livestreams l
+	LEFT JOIN (SELECT livestream_id, COUNT(*) AS reactions FROM reactions GROUP BY livestream_id) r ON r.livestream_id = l.id
+	LEFT JOIN (SELECT livestream_id, SUM(tip) AS tips FROM livecomments WHERE deleted_at IS NULL GROUP BY livestream_id) t ON t.livestream_id = l.id
+	`); err != nil {
+		return nil, err
+	}
+
+	snapshot := &LivestreamRankingSnapshot{
+		Ranking:             make(LivestreamRanking, 0, len(stats)),
+		ScoreByLivestreamID: make(map[LivestreamID]int64, len(stats)),
+		CreatedAt:           time.Now(),
+	}
+	concurrentViewers := getConcurrentViewersCounts()
+	for _, stat := range stats {
+		score := stat.Reactions + stat.Tips + concurrentViewers[stat.LivestreamID]
+		snapshot.Ranking = append(snapshot.Ranking, LivestreamRankingEntry{
+			LivestreamID: stat.LivestreamID,
+			Score:        score,
+		})
+		snapshot.ScoreByLivestreamID[stat.LivestreamID] = score
+	}
+	sort.Sort(snapshot.Ranking)
+
+	livestreamRankingSnapshot = snapshot
+	return snapshot, nil
+}
+
+func init() {
+	registerCacheReset(expireLivestreamRankingSnapshot)
+	registerCacheReset(resetUserRankingSnapshot)
+}
+
+func expireLivestreamRankingSnapshot() {
+	livestreamRankingSnapshotMutex.Lock()
+	livestreamRankingSnapshot = nil
+	livestreamRankingSnapshotMutex.Unlock()
+}
+
+// ユーザごとの集計値
+type UserSummaryStats struct {
+	UserID          UserID
+	Username        string
+	FollowersCount  int64
+	TotalLivestream int64
+	TotalReactions  int64
+	TotalTip        int64
+	// 1始まり
+	Rank int64
+}
+
+// ある時点のユーザランキング (スコア = リアクション数 + チップ合計)
+type UserRankingSnapshot struct {
+	StatsByUsername map[string]*UserSummaryStats
+	CreatedAt       time.Time
+	// 集計を始めた時点のuserRankingGeneration
+	generation uint64
+}
+
+func (s *UserRankingSnapshot) stale() bool {
+	return s.generation != userRankingGeneration.Load() || time.Since(s.CreatedAt) >= currentTunables().RankingSnapshotTTL
+}
+
+var (
+	userRankingSnapshot atomic.Pointer[UserRankingSnapshot]
+	// 改名や初期化で集計し直しが必要になるたびに進める
+	userRankingGeneration atomic.Uint64
+	userRankingRebuilding atomic.Bool
+	userRankingFlight     flightGroup
+)
+
+// 古くなったら集計し直しをバックグラウンドで1つだけ走らせ、終わるまでは前のスナップショットを返す
+// スナップショットが無い場合 (起動直後や初期化後) だけ集計を待つ
+func getUserRankingSnapshot(ctx context.Context) (*UserRankingSnapshot, error) {
+	snapshot := userRankingSnapshot.Load()
+	if snapshot == nil {
+		v, err := userRankingFlight.Do("", func() (interface{}, error) {
+			return rebuildUserRankingSnapshot(ctx)
+		})
+		if err != nil {
+			return nil, err
+		}
+		return v.(*UserRankingSnapshot), nil
+	}
+
+	if snapshot.stale() && userRankingRebuilding.CompareAndSwap(false, true) {
+		go func() {
+			defer userRankingRebuilding.Store(false)
+			if _, err := rebuildUserRankingSnapshot(context.Background()); err != nil {
+				log.Printf("failed to rebuild user ranking snapshot: %+v", err)
+			}
+		}()
+	}
+	return snapshot, nil
+}
+
+func rebuildUserRankingSnapshot(ctx context.Context) (*UserRankingSnapshot, error) {
+	generation := userRankingGeneration.Load()
+
+	var stats []*struct {
+		UserID          UserID `db:"id"`
+		Username        string `db:"name"`
+		FollowersCount  int64  `db:"followers_count"`
+		TotalLivestream int64  `db:"livestreams"`
+		TotalReactions  int64  `db:"reactions"`
+		TotalTip        int64  `db:"tips"`
+	}
+	if err := dbConn.SelectContext(ctx, &stats, `
+	SELECT u.id, u.name, u.followers_count, IFNULL(l.livestreams, 0) AS livestreams, IFNULL(r.reactions, 0) AS reactions, IFNULL(t.tips, 0) AS tips
+	FROM users u
+	LEFT JOIN (SELECT user_id, COUNT(*) AS livestreams FROM livestreams GROUP BY user_id) l ON l.user_id = u.id
+	LEFT JOIN (SELECT l.user_id, COUNT(*) AS reactions FROM reactions r INNER JOIN livestreams l ON l.id = r.livestream_id GROUP BY l.user_id) r ON r.user_id = u.id
+	LEFT JOIN (SELECT l.user_id, SUM(lc.tip) AS tips FROM livecomments lc INNER JOIN livestreams l ON l.id = lc.livestream_id WHERE lc.deleted_at IS NULL GROUP BY l.user_id) t ON t.user_id = u.id
+	`); err != nil {
+		return nil, err
+	}
+
+	ranking := make(UserRanking, 0, len(stats))
+	snapshot := &UserRankingSnapshot{
+		StatsByUsername: make(map[string]*UserSummaryStats, len(stats)),
+		CreatedAt:       time.Now(),
+		generation:      generation,
+	}
+	for _, stat := range stats {
+		ranking = append(ranking, UserRankingEntry{
+			Username: stat.Username,
+			Score:    stat.TotalReactions + stat.TotalTip,
+		})
+		snapshot.StatsByUsername[stat.Username] = &UserSummaryStats{
+			UserID:          stat.UserID,
+			Username:        stat.Username,
+			FollowersCount:  stat.FollowersCount,
+			TotalLivestream: stat.TotalLivestream,
+			TotalReactions:  stat.TotalReactions,
+			TotalTip:        stat.TotalTip,
+		}
+	}
+	// 統計APIと同じく、スコア昇順に並べて末尾から順位を付ける
+	sort.Sort(ranking)
+	for i, entry := range ranking {
+		snapshot.StatsByUsername[entry.Username].Rank = int64(len(ranking) - i)
+	}
+
+	// 集計中に改名や初期化があった場合は、古い内容を載せないよう呼び出し元に返すだけにする
+	if userRankingGeneration.Load() == generation {
+		userRankingSnapshot.Store(snapshot)
+	}
+	return snapshot, nil
+}
+
+// 前のスナップショットは作り直すまで返し続ける
+func expireUserRankingSnapshot() {
+	userRankingGeneration.Add(1)
+}
+
+func resetUserRankingSnapshot() {
+	userRankingGeneration.Add(1)
+	userRankingSnapshot.Store(nil)
+}
@@ -1,24 +1,61 @@
 package main
 
 import (
+	"bufio"
 	"context"
-	"encoding/json"
+	"database/sql"
+	"errors"
 	"fmt"
 	"net/http"
+	"os"
 	"strconv"
+	"strings"
+	"sync"
 	"time"
 
 	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
+	"golang.org/x/time/rate"
 )
 
+const (
+	defaultReactionEmojiWhitelistPath = "../sql/emoji_whitelist.txt"
+
+	// ユーザ・配信ごとのリアクション投稿レート (1秒あたりの回数とバースト)
+	defaultReactionRateLimit = 5
+	defaultReactionRateBurst = 10
+
+	rateLimiterSweepPeriod = 1 * time.Minute
+)
+
+// 起動時に読み込むリアクションとして使える絵文字名
+var reactionEmojiWhitelist map[string]struct{}
+
+var (
+	ReactionLimiterByKeyCache      = make(map[reactionLimiterKey]*rate.Limiter)
+	ReactionLimiterByKeyCacheMutex = sync.Mutex{}
+)
+
+func init() {
+	registerCacheReset(func() {
+		ReactionLimiterByKeyCacheMutex.Lock()
+		ReactionLimiterByKeyCache = make(map[reactionLimiterKey]*rate.Limiter)
+		ReactionLimiterByKeyCacheMutex.Unlock()
+	})
+}
+
+type reactionLimiterKey struct {
+	UserID       UserID
+	LivestreamID LivestreamID
+}
+
 type ReactionModel struct {
-	ID           int64  `db:"id"`
-	EmojiName    string `db:"emoji_name"`
-	UserID       int64  `db:"user_id"`
-	LivestreamID int64  `db:"livestream_id"`
-	CreatedAt    int64  `db:"created_at"`
+	ID           int64        `db:"id"`
+	EmojiName    string       `db:"emoji_name"`
+	UserID       UserID       `db:"user_id"`
+	LivestreamID LivestreamID `db:"livestream_id"`
+	CreatedAt    int64        `db:"created_at"`
 }
 
 type Reaction struct {
@@ -41,9 +78,14 @@ func getReactionsHandler(c echo.Context) error {
 		return err
 	}
 
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
 	}
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
@@ -52,19 +94,43 @@ func getReactionsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	query := "SELECT * FROM reactions WHERE livestream_id = ? ORDER BY created_at DESC"
+	// カーソルは最後に返したリアクションの "created_at_id"
+	// ブロックしているユーザのものはLIMITより前にSQLで除く
+	query := "SELECT * FROM reactions WHERE livestream_id = ?" + notBlockedCondition
+	args := []interface{}{livestreamID, userID}
+	if cursor := c.QueryParam("cursor"); cursor != "" {
+		createdAt, id, err := parseCreatedAtIDCursor(cursor)
+		if err != nil {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "invalid cursor")
+		}
+		query += " AND (created_at < ? OR (created_at = ? AND id < ?))"
+		args = append(args, createdAt, createdAt, id)
+	}
+	query += " ORDER BY created_at DESC, id DESC"
+	limit := 0
 	if c.QueryParam("limit") != "" {
-		limit, err := strconv.Atoi(c.QueryParam("limit"))
+		limit, err = strconv.Atoi(c.QueryParam("limit"))
 		if err != nil {
-			return echo.NewHTTPError(http.StatusBadRequest, "limit query parameter must be integer")
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "limit query parameter must be integer")
+		}
+		if limit > 0 {
+			// 続きがあるか判定するため1件多く取る
+			query += fmt.Sprintf(" LIMIT %d", limit+1)
+		} else {
+			query += fmt.Sprintf(" LIMIT %d", limit)
 		}
-		query += fmt.Sprintf(" LIMIT %d", limit)
 	}
 
 	reactionModels := []*ReactionModel{}
-	if err := tx.SelectContext(ctx, &reactionModels, query, livestreamID); err != nil {
+	if err := tx.SelectContext(ctx, &reactionModels, query, args...); err != nil {
 		return echo.NewHTTPError(http.StatusNotFound, "failed to get reactions")
 	}
+	page := pageInfo{total: -1, cursorParam: "cursor"}
+	if limit > 0 && len(reactionModels) > limit {
+		reactionModels = reactionModels[:limit]
+		last := reactionModels[limit-1]
+		page.nextCursor = formatCreatedAtIDCursor(last.CreatedAt, last.ID)
+	}
 
 	reactions, err := fillReactionResponseBulk(ctx, tx, reactionModels)
 	if err != nil {
@@ -75,73 +141,164 @@ func getReactionsHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, reactions)
+	setPageHeaders(c, page)
+	return respondNegotiated(c, http.StatusOK, reactions)
 }
 
-func postReactionHandler(c echo.Context) error {
+// 絵文字ごとのリアクション数を返すAPI
+// GET /api/livestream/:livestream_id/reaction/counts
+func getReactionCountsHandler(c echo.Context) error {
 	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
 	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	counts, err := getReactionCounts(ctx, tx, LivestreamID(livestreamID))
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction counts: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
+	return c.JSON(http.StatusOK, counts)
+}
+
+// リアクションのSSEストリーム
+// GET /api/livestream/:livestream_id/reaction/stream
+func streamReactionsHandler(c echo.Context) error {
 	if err := verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	return serveLivestreamEventStream(c, LivestreamID(livestreamID), livestreamEventReaction, livestreamEventReactionDeleted)
+}
+
+func (app *App) postReactionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	if err := app.verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
 
-	var req *PostReactionRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	var req PostReactionRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidJSON, "failed to decode the request body as json")
+	}
+	if !allowReaction(userID, LivestreamID(livestreamID)) {
+		return newCodedHTTPError(http.StatusTooManyRequests, errorCodeReactionRateLimited, "too many reactions")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	reaction, added, err := app.reactionService.Toggle(ctx, userID, LivestreamID(livestreamID), req.EmojiName)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+		return serviceHTTPError(err)
 	}
-	defer tx.Rollback()
+	if !added {
+		return c.JSON(http.StatusOK, reaction)
+	}
+	return c.JSON(http.StatusCreated, reaction)
+}
+
+// 自分のリアクションを取り消すAPI
+// DELETE /api/livestream/:livestream_id/reaction/:reaction_id
+func deleteReactionHandler(c echo.Context) error {
+	ctx := c.Request().Context()
 
-	reactionModel := ReactionModel{
-		UserID:       int64(userID),
-		LivestreamID: int64(livestreamID),
-		EmojiName:    req.EmojiName,
-		CreatedAt:    time.Now().Unix(),
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
 	}
 
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert reaction: "+err.Error())
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+	reactionID, err := strconv.Atoi(c.Param("reaction_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "reaction_id in path must be integer")
 	}
 
-	reactionID, err := result.LastInsertId()
+	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted reaction id: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var reactionModel ReactionModel
+	if err := tx.GetContext(ctx, &reactionModel, "SELECT * FROM reactions WHERE id = ? AND livestream_id = ? FOR UPDATE", reactionID, livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "reaction not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get reaction: "+err.Error())
+	}
+	if reactionModel.UserID != userID {
+		return echo.NewHTTPError(http.StatusForbidden, "can't delete other user's reaction")
 	}
-	reactionModel.ID = reactionID
 
 	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill reaction: "+err.Error())
 	}
 
+	if _, err := tx.ExecContext(ctx, "DELETE FROM reactions WHERE id = ?", reactionModel.ID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete reaction: "+err.Error())
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusCreated, reaction)
+	// ランキングやユーザ統計はreactionsをその場で数えているので、ここではキャッシュだけ直せばよい
+	adjustReactionCount(reaction.Livestream.ID, reaction.EmojiName, -1)
+	livestreamEventHub.Publish(reaction.Livestream.ID, LivestreamEvent{
+		Type: livestreamEventReactionDeleted,
+		Data: reaction,
+	})
+
+	return c.JSON(http.StatusOK, reaction)
 }
 
 func fillReactionResponse(ctx context.Context, tx *sqlx.Tx, reactionModel ReactionModel) (Reaction, error) {
-	userModel := UserModel{}
-	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", reactionModel.UserID); err != nil {
+	userModel, err := userRepository.GetByID(ctx, tx, reactionModel.UserID)
+	if err != nil {
 		return Reaction{}, err
 	}
-	user, err := fillUserResponse(ctx, tx, userModel)
+	user, err := userRepository.Fill(ctx, tx, userModel)
 	if err != nil {
 		return Reaction{}, err
 	}
@@ -172,35 +329,39 @@ func fillReactionResponseBulk(ctx context.Context, tx *sqlx.Tx, reactionModels [
 		return []Reaction{}, nil
 	}
 
-	userIDs := make([]int64, len(reactionModels))
-	livestreamIDs := make([]int64, len(reactionModels))
-	for i, reactionModel := range reactionModels {
-		userIDs[i] = reactionModel.UserID
-		livestreamIDs[i] = reactionModel.LivestreamID
+	// 1配信のリアクション一覧では同じユーザ・配信が何度も出てくるので重複を除く
+	userIDSet := make(map[UserID]struct{}, len(reactionModels))
+	livestreamIDSet := make(map[LivestreamID]struct{}, 1)
+	for _, reactionModel := range reactionModels {
+		userIDSet[reactionModel.UserID] = struct{}{}
+		livestreamIDSet[reactionModel.LivestreamID] = struct{}{}
+	}
+	userIDs := make([]UserID, 0, len(userIDSet))
+	for id := range userIDSet {
+		userIDs = append(userIDs, id)
+	}
+	livestreamIDs := make([]LivestreamID, 0, len(livestreamIDSet))
+	for id := range livestreamIDSet {
+		livestreamIDs = append(livestreamIDs, id)
 	}
 
-	userModels := []*UserModel{}
-	query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", userIDs)
+	userModels, err := userRepository.ListByIDs(ctx, tx, userIDs)
 	if err != nil {
 		return nil, err
 	}
-	query = tx.Rebind(query)
-	if err := tx.SelectContext(ctx, &userModels, query, args...); err != nil {
-		return nil, err
-	}
 
-	users, err := fillUserResponseBulk(ctx, tx, userModels)
+	users, err := userRepository.FillBulk(ctx, tx, userModels)
 	if err != nil {
 		return nil, err
 	}
 
-	userIDToUser := map[int64]User{}
+	userIDToUser := map[UserID]User{}
 	for _, user := range users {
 		userIDToUser[user.ID] = user
 	}
 
 	livestreamModels := []*LivestreamModel{}
-	query, args, err = sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+	query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
 	if err != nil {
 		return nil, err
 	}
@@ -214,7 +375,7 @@ func fillReactionResponseBulk(ctx context.Context, tx *sqlx.Tx, reactionModels [
 		return nil, err
 	}
 
-	livestreamIDToLivestream := map[int64]Livestream{}
+	livestreamIDToLivestream := map[LivestreamID]Livestream{}
 	for _, livestream := range livestreams {
 		livestreamIDToLivestream[livestream.ID] = livestream
 	}
@@ -232,3 +393,120 @@ func fillReactionResponseBulk(ctx context.Context, tx *sqlx.Tx, reactionModels [
 
 	return reactions, nil
 }
+
+// キャッシュのコピーを返す
+func getReactionCounts(ctx context.Context, tx *sqlx.Tx, livestreamID LivestreamID) (map[string]int64, error) {
+	ReactionCountsByLivestreamIDCacheMutex.RLock()
+	cached, ok := ReactionCountsByLivestreamIDCache[livestreamID]
+	if ok {
+		counts := make(map[string]int64, len(cached))
+		for emojiName, count := range cached {
+			counts[emojiName] = count
+		}
+		ReactionCountsByLivestreamIDCacheMutex.RUnlock()
+		return counts, nil
+	}
+	ReactionCountsByLivestreamIDCacheMutex.RUnlock()
+
+	var rows []struct {
+		EmojiName string `db:"emoji_name"`
+		Count     int64  `db:"cnt"`
+	}
+	if err := tx.SelectContext(ctx, &rows, "SELECT emoji_name, COUNT(*) AS cnt FROM reactions WHERE livestream_id = ? GROUP BY emoji_name", livestreamID); err != nil {
+		return nil, err
+	}
+
+	counts := make(map[string]int64, len(rows))
+	loaded := make(map[string]int64, len(rows))
+	for _, row := range rows {
+		counts[row.EmojiName] = row.Count
+		loaded[row.EmojiName] = row.Count
+	}
+
+	ReactionCountsByLivestreamIDCacheMutex.Lock()
+	// 数えている間に他のリクエストでキャッシュが作られていればそちらを優先する
+	if _, ok := ReactionCountsByLivestreamIDCache[livestreamID]; !ok {
+		ReactionCountsByLivestreamIDCache[livestreamID] = loaded
+	}
+	ReactionCountsByLivestreamIDCacheMutex.Unlock()
+
+	return counts, nil
+}
+
+func adjustReactionCount(livestreamID LivestreamID, emojiName string, delta int64) {
+	ReactionCountsByLivestreamIDCacheMutex.Lock()
+	defer ReactionCountsByLivestreamIDCacheMutex.Unlock()
+
+	// キャッシュに無い場合は次回参照時にDBから数え直すので何もしない
+	counts, ok := ReactionCountsByLivestreamIDCache[livestreamID]
+	if !ok {
+		return
+	}
+	counts[emojiName] += delta
+	if counts[emojiName] <= 0 {
+		delete(counts, emojiName)
+	}
+}
+
+// トークンバケットでユーザ・配信ごとのリアクション投稿を制限する
+func allowReaction(userID UserID, livestreamID LivestreamID) bool {
+	key := reactionLimiterKey{UserID: userID, LivestreamID: livestreamID}
+
+	ReactionLimiterByKeyCacheMutex.Lock()
+	limiter, ok := ReactionLimiterByKeyCache[key]
+	if !ok {
+		tunables := currentTunables()
+		limiter = rate.NewLimiter(tunables.ReactionRateLimit, tunables.ReactionRateBurst)
+		ReactionLimiterByKeyCache[key] = limiter
+	}
+	ReactionLimiterByKeyCacheMutex.Unlock()
+
+	return limiter.Allow()
+}
+
+// バケットが満タンに戻ったリミッタは作り直しても同じなので捨てる
+func sweepIdleReactionLimiters(now time.Time) {
+	ReactionLimiterByKeyCacheMutex.Lock()
+	defer ReactionLimiterByKeyCacheMutex.Unlock()
+
+	for key, limiter := range ReactionLimiterByKeyCache {
+		if limiter.TokensAt(now) >= float64(limiter.Burst()) {
+			delete(ReactionLimiterByKeyCache, key)
+		}
+	}
+}
+
+// 投稿の制限に使うユーザ・配信ごとの状態が溜まり続けないよう、定期的に不要なものを捨てる
+func runRateLimiterSweeper() {
+	ticker := time.NewTicker(rateLimiterSweepPeriod)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		sweepIdleReactionLimiters(now)
+		sweepExpiredLivecommentSlots(now)
+	}
+}
+
+// 1行に1つ絵文字名を書いたファイルを読み込む
+func loadReactionEmojiWhitelist(path string) (map[string]struct{}, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	whitelist := make(map[string]struct{})
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		name := strings.TrimSpace(scanner.Text())
+		if name == "" {
+			continue
+		}
+		whitelist[name] = struct{}{}
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+
+	return whitelist, nil
+}
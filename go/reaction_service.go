@@ -0,0 +1,93 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// リアクションの付け外し。リクエストやセッションには触れず、返すエラーはハンドラでserviceHTTPErrorに通す
+type ReactionService struct {
+	db    *sqlx.DB
+	clock Clock
+}
+
+// 同じリアクションが無ければ付け、あれば取り消す。付けた場合はaddedがtrueになる
+func (s *ReactionService) Toggle(ctx context.Context, userID UserID, livestreamID LivestreamID, emojiName string) (Reaction, bool, error) {
+	if _, ok := reactionEmojiWhitelist[emojiName]; !ok {
+		return Reaction{}, false, newServiceError(serviceErrorInvalid, errorCodeEmojiNotAllowed, "emoji_name is not allowed")
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return Reaction{}, false, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	// 同じリアクションが既にあれば取り消す (トグル)
+	var existingReactionModel ReactionModel
+	err = tx.GetContext(ctx, &existingReactionModel, "SELECT * FROM reactions WHERE user_id = ? AND livestream_id = ? AND emoji_name = ? FOR UPDATE", userID, livestreamID, emojiName)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return Reaction{}, false, fmt.Errorf("failed to get reaction: %w", err)
+	}
+	if err == nil {
+		reaction, err := fillReactionResponse(ctx, tx, existingReactionModel)
+		if err != nil {
+			return Reaction{}, false, fmt.Errorf("failed to fill reaction: %w", err)
+		}
+
+		if _, err := tx.ExecContext(ctx, "DELETE FROM reactions WHERE id = ?", existingReactionModel.ID); err != nil {
+			return Reaction{}, false, fmt.Errorf("failed to delete reaction: %w", err)
+		}
+
+		if err := tx.Commit(); err != nil {
+			return Reaction{}, false, fmt.Errorf("failed to commit: %w", err)
+		}
+
+		adjustReactionCount(reaction.Livestream.ID, reaction.EmojiName, -1)
+		livestreamEventHub.Publish(reaction.Livestream.ID, LivestreamEvent{
+			Type: livestreamEventReactionDeleted,
+			Data: reaction,
+		})
+
+		return reaction, false, nil
+	}
+
+	reactionModel := ReactionModel{
+		UserID:       userID,
+		LivestreamID: livestreamID,
+		EmojiName:    emojiName,
+		CreatedAt:    s.clock.Now().Unix(),
+	}
+
+	result, err := tx.NamedExecContext(ctx, "INSERT INTO reactions (user_id, livestream_id, emoji_name, created_at) VALUES (:user_id, :livestream_id, :emoji_name, :created_at)", reactionModel)
+	if err != nil {
+		return Reaction{}, false, fmt.Errorf("failed to insert reaction: %w", err)
+	}
+
+	reactionID, err := result.LastInsertId()
+	if err != nil {
+		return Reaction{}, false, fmt.Errorf("failed to get last inserted reaction id: %w", err)
+	}
+	reactionModel.ID = reactionID
+
+	reaction, err := fillReactionResponse(ctx, tx, reactionModel)
+	if err != nil {
+		return Reaction{}, false, fmt.Errorf("failed to fill reaction: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Reaction{}, false, fmt.Errorf("failed to commit: %w", err)
+	}
+
+	adjustReactionCount(reaction.Livestream.ID, reaction.EmojiName, 1)
+	livestreamEventHub.Publish(reaction.Livestream.ID, LivestreamEvent{
+		Type: livestreamEventReaction,
+		Data: reaction,
+	})
+
+	return reaction, true, nil
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"math"
+	"os"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
+)
+
+const (
+	cgroupV2CPUMaxPath    = "/sys/fs/cgroup/cpu.max"
+	cgroupV1CPUQuotaPath  = "/sys/fs/cgroup/cpu/cpu.cfs_quota_us"
+	cgroupV1CPUPeriodPath = "/sys/fs/cgroup/cpu/cpu.cfs_period_us"
+
+	// 0ならcgroupのCPUクォータから決める
+	autoGoMaxProcs       = 0
+	gcPercentOff         = -1
+	memoryLimitUnlimited = math.MaxInt64
+)
+
+// ホストごとのsystemdの設定に頼らず、起動時にGOMAXPROCS・GOGC・GOMEMLIMITを揃える
+func applyRuntimeTuning(cfg *Config) {
+	procs, source := cfg.GoMaxProcs, "env"
+	if procs == autoGoMaxProcs {
+		procs, source = cgroupCPULimit()
+	}
+	runtime.GOMAXPROCS(procs)
+	debug.SetGCPercent(cfg.GoGC)
+	debug.SetMemoryLimit(cfg.GoMemLimit)
+
+	gogc := strconv.Itoa(cfg.GoGC)
+	if cfg.GoGC == gcPercentOff {
+		gogc = "off"
+	}
+	memLimit := strconv.FormatInt(cfg.GoMemLimit, 10)
+	if cfg.GoMemLimit == memoryLimitUnlimited {
+		memLimit = "unlimited"
+	}
+	log.Printf("runtime tuning: GOMAXPROCS=%d (%s) GOGC=%s GOMEMLIMIT=%s", procs, source, gogc, memLimit)
+}
+
+// cgroupのCPUクォータから使えるCPU数を求める (automaxprocsと同じく切り捨て、最低1)
+// クォータが無ければruntime.NumCPU()
+func cgroupCPULimit() (int, string) {
+	if b, err := os.ReadFile(cgroupV2CPUMaxPath); err == nil {
+		// "max 100000" または "200000 100000"
+		fields := strings.Fields(string(b))
+		if len(fields) == 2 && fields[0] != "max" {
+			if procs, ok := cpuQuotaToProcs(fields[0], fields[1]); ok {
+				return procs, "cgroup v2"
+			}
+		}
+		return runtime.NumCPU(), "NumCPU"
+	}
+
+	quota, err := os.ReadFile(cgroupV1CPUQuotaPath)
+	if err != nil {
+		return runtime.NumCPU(), "NumCPU"
+	}
+	period, err := os.ReadFile(cgroupV1CPUPeriodPath)
+	if err != nil {
+		return runtime.NumCPU(), "NumCPU"
+	}
+	if procs, ok := cpuQuotaToProcs(strings.TrimSpace(string(quota)), strings.TrimSpace(string(period))); ok {
+		return procs, "cgroup v1"
+	}
+	return runtime.NumCPU(), "NumCPU"
+}
+
+func cpuQuotaToProcs(quota, period string) (int, bool) {
+	q, err := strconv.ParseInt(quota, 10, 64)
+	if err != nil || q <= 0 {
+		return 0, false
+	}
+	p, err := strconv.ParseInt(period, 10, 64)
+	if err != nil || p <= 0 {
+		return 0, false
+	}
+	procs := int(q / p)
+	if procs < 1 {
+		procs = 1
+	}
+	return min(procs, runtime.NumCPU()), true
+}
+
+// "off" またはGOGCと同じ整数
+func parseGCPercent(v string) (int, error) {
+	if v == "off" {
+		return gcPercentOff, nil
+	}
+	percent, err := strconv.Atoi(v)
+	if err != nil {
+		return 0, err
+	}
+	if percent < 0 {
+		return 0, fmt.Errorf("must be \"off\" or non-negative")
+	}
+	return percent, nil
+}
+
+// バイト数。KiB/MiB/GiBの接尾辞を付けられる
+func parseMemoryLimit(v string) (int64, error) {
+	if v == "off" {
+		return memoryLimitUnlimited, nil
+	}
+	unit := int64(1)
+	for suffix, bytes := range map[string]int64{"KiB": 1 << 10, "MiB": 1 << 20, "GiB": 1 << 30} {
+		if strings.HasSuffix(v, suffix) {
+			v, unit = strings.TrimSuffix(v, suffix), bytes
+			break
+		}
+	}
+	n, err := strconv.ParseInt(v, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	if n <= 0 {
+		return 0, fmt.Errorf("must be positive")
+	}
+	if n > memoryLimitUnlimited/unit {
+		return memoryLimitUnlimited, nil
+	}
+	return n * unit, nil
+}
+
+// 環境変数GOGCで起動していればその値を引き継ぐ
+func currentGCPercent() int {
+	percent := debug.SetGCPercent(100)
+	debug.SetGCPercent(percent)
+	return percent
+}
+
+// 環境変数GOMEMLIMITで起動していればその値を引き継ぐ
+func currentMemoryLimit() int64 {
+	// 負の値を渡すと変更せずに現在値を返す
+	return debug.SetMemoryLimit(-1)
+}
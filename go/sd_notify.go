@@ -0,0 +1,33 @@
+package main
+
+import (
+	"net"
+	"os"
+)
+
+const (
+	sdNotifyReady    = "READY=1"
+	sdNotifyStopping = "STOPPING=1"
+)
+
+// systemdのType=notifyで起動されていればNOTIFY_SOCKETに状態を送る
+// それ以外 (手元での実行など) では何もしない
+func sdNotify(state string) error {
+	socketPath, ok := os.LookupEnv("NOTIFY_SOCKET")
+	if !ok || socketPath == "" {
+		return nil
+	}
+	// 抽象名前空間のソケット
+	if socketPath[0] == '@' {
+		socketPath = "\x00" + socketPath[1:]
+	}
+
+	conn, err := net.DialUnix("unixgram", nil, &net.UnixAddr{Name: socketPath, Net: "unixgram"})
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+
+	_, err = conn.Write([]byte(state))
+	return err
+}
@@ -0,0 +1,83 @@
+package main
+
+import (
+	"errors"
+	"net/http"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// サービスが返す、クライアントに伝えてよいエラー。サービスの層はHTTPを知らないので種類とcodeだけを決め、
+// ステータスコードへの対応はハンドラがserviceHTTPErrorで行う。serviceErrorでないエラーはDBなどの内部エラーとして扱う
+type serviceErrorKind int
+
+const (
+	serviceErrorInvalid serviceErrorKind = iota + 1
+	serviceErrorUnauthorized
+	serviceErrorForbidden
+	serviceErrorNotFound
+	serviceErrorConflict
+	serviceErrorTooManyRequests
+	serviceErrorUnavailable
+)
+
+var serviceErrorStatuses = map[serviceErrorKind]int{
+	serviceErrorInvalid:         http.StatusBadRequest,
+	serviceErrorUnauthorized:    http.StatusUnauthorized,
+	serviceErrorForbidden:       http.StatusForbidden,
+	serviceErrorNotFound:        http.StatusNotFound,
+	serviceErrorConflict:        http.StatusConflict,
+	serviceErrorTooManyRequests: http.StatusTooManyRequests,
+	serviceErrorUnavailable:     http.StatusServiceUnavailable,
+}
+
+type serviceError struct {
+	kind serviceErrorKind
+	// 空ならステータスコードから決める
+	code    ErrorCode
+	message string
+	// validation_failedの場合に違反したフィールド
+	fields []FieldError
+	// 再試行できるまでの時間 (0なら返さない)
+	retryAfter time.Duration
+	// 原因 (errors.Isで調べられるように持っておく)
+	err error
+}
+
+func (e *serviceError) Error() string {
+	return e.message
+}
+
+func (e *serviceError) Unwrap() error {
+	return e.err
+}
+
+func newServiceError(kind serviceErrorKind, code ErrorCode, message string) error {
+	return &serviceError{kind: kind, code: code, message: message}
+}
+
+// 待てば成功するエラー
+func newRetryAfterServiceError(kind serviceErrorKind, code ErrorCode, message string, retryAfter time.Duration) error {
+	return &serviceError{kind: kind, code: code, message: message, retryAfter: retryAfter}
+}
+
+func newServiceValidationError(errs validationErrors) error {
+	return &serviceError{kind: serviceErrorInvalid, code: errorCodeValidationFailed, message: "invalid request: " + errs.Error(), fields: errs}
+}
+
+// サービスのエラーをハンドラから返すエラーに直す
+func serviceHTTPError(err error) error {
+	var se *serviceError
+	if !errors.As(err, &se) {
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
+	}
+	status, ok := serviceErrorStatuses[se.kind]
+	if !ok {
+		status = http.StatusInternalServerError
+	}
+	if se.code == "" {
+		return echo.NewHTTPError(status, se.message)
+	}
+	return &codedHTTPError{HTTPError: echo.NewHTTPError(status, se.message), code: se.code, fields: se.fields, retryAfter: se.retryAfter}
+}
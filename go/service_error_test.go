@@ -0,0 +1,100 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"testing"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+func TestServiceHTTPError(t *testing.T) {
+	tests := []struct {
+		name           string
+		err            error
+		wantStatus     int
+		wantCode       ErrorCode
+		wantRetryAfter time.Duration
+	}{
+		{
+			name:       "coded",
+			err:        newServiceError(serviceErrorNotFound, errorCodeLivestreamNotFound, "livestream not found"),
+			wantStatus: http.StatusNotFound,
+			wantCode:   errorCodeLivestreamNotFound,
+		},
+		{
+			name:       "code from status",
+			err:        newServiceError(serviceErrorInvalid, "", "name is not changed"),
+			wantStatus: http.StatusBadRequest,
+			wantCode:   errorCodeBadRequest,
+		},
+		{
+			name:           "retry after",
+			err:            newRetryAfterServiceError(serviceErrorTooManyRequests, errorCodeSlowMode, "slow mode", 3*time.Second),
+			wantStatus:     http.StatusTooManyRequests,
+			wantCode:       errorCodeSlowMode,
+			wantRetryAfter: 3 * time.Second,
+		},
+		{
+			name:       "wrapped",
+			err:        fmt.Errorf("context: %w", newServiceError(serviceErrorConflict, errorCodeUsernameTaken, "taken")),
+			wantStatus: http.StatusConflict,
+			wantCode:   errorCodeUsernameTaken,
+		},
+		{
+			name:       "internal",
+			err:        errors.New("failed to begin transaction: bad connection"),
+			wantStatus: http.StatusInternalServerError,
+			wantCode:   errorCodeInternal,
+		},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			err := serviceHTTPError(tt.err)
+			var he *echo.HTTPError
+			if !errors.As(err, &he) {
+				t.Fatalf("%v is not an echo.HTTPError", err)
+			}
+			if he.Code != tt.wantStatus {
+				t.Errorf("status = %d, want %d", he.Code, tt.wantStatus)
+			}
+			if code := errorCodeOf(err); code != tt.wantCode {
+				t.Errorf("code = %q, want %q", code, tt.wantCode)
+			}
+			var coded *codedHTTPError
+			if errors.As(err, &coded) && coded.retryAfter != tt.wantRetryAfter {
+				t.Errorf("retry after = %v, want %v", coded.retryAfter, tt.wantRetryAfter)
+			}
+		})
+	}
+}
+
+func TestServiceValidationError(t *testing.T) {
+	err := serviceHTTPError(newServiceValidationError(validationErrors{{Field: "name", Reason: "required"}}))
+	var coded *codedHTTPError
+	if !errors.As(err, &coded) {
+		t.Fatalf("%v is not a codedHTTPError", err)
+	}
+	if coded.Code != http.StatusBadRequest || coded.code != errorCodeValidationFailed {
+		t.Errorf("got %d %q, want 400 validation_failed", coded.Code, coded.code)
+	}
+	if len(coded.fields) != 1 || coded.fields[0].Field != "name" {
+		t.Errorf("fields = %v", coded.fields)
+	}
+}
+
+func TestPowerDNSServiceError(t *testing.T) {
+	err := powerDNSServiceError(errPowerDNSUnavailable)
+	if !errors.Is(err, errPowerDNSUnavailable) {
+		t.Error("cause is lost")
+	}
+	var he *echo.HTTPError
+	if errors.As(serviceHTTPError(err), &he); he == nil || he.Code != http.StatusServiceUnavailable {
+		t.Errorf("unavailable powerdns is not 503: %v", he)
+	}
+	if errors.As(serviceHTTPError(powerDNSServiceError(&powerDNSStatusError{statusCode: 422})), &he); he.Code != http.StatusInternalServerError {
+		t.Errorf("powerdns status error is %d, want 500", he.Code)
+	}
+}
@@ -0,0 +1,228 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"database/sql/driver"
+	"fmt"
+	"log"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+)
+
+// ISU_DEBUG_EXPLAIN=1 の場合、アプリのDB接続で遅かったクエリをログに出し、非同期でEXPLAINした結果も出す
+// 「遅かった」と「インデックスが無かった」を、手元で再現せずに結び付けるためのもの
+// 無効ならドライバを包まないので、通常の動作には影響しない
+const (
+	slowQueryThreshold = 100 * time.Millisecond
+	// EXPLAINが詰まっている間の遅いクエリは捨てる
+	slowQueryExplainQueueSize = 64
+	// 同じクエリを何度もEXPLAINしない
+	slowQueryExplainInterval = 1 * time.Minute
+	explainTimeout           = 5 * time.Second
+)
+
+type slowQuery struct {
+	query    string
+	args     []driver.NamedValue
+	duration time.Duration
+}
+
+var (
+	slowQueryExplainQueue = make(chan slowQuery, slowQueryExplainQueueSize)
+
+	explainedSlowQueries      = map[string]time.Time{}
+	explainedSlowQueriesMutex = sync.Mutex{}
+)
+
+// 遅いクエリを計測するコネクタでDBに繋ぐ
+func connectSlowQueryLoggingDB(conf *mysql.Config) (*sqlx.DB, error) {
+	connector, err := mysql.NewConnector(conf)
+	if err != nil {
+		return nil, err
+	}
+	return sqlx.NewDb(sql.OpenDB(slowQueryConnector{connector}), "mysql"), nil
+}
+
+func recordQueryDuration(query string, args []driver.NamedValue, start time.Time) {
+	duration := time.Since(start)
+	if duration < slowQueryThreshold {
+		return
+	}
+	log.Printf("slow query (%s): %s", duration, query)
+
+	explainedSlowQueriesMutex.Lock()
+	if last, ok := explainedSlowQueries[query]; ok && time.Since(last) < slowQueryExplainInterval {
+		explainedSlowQueriesMutex.Unlock()
+		return
+	}
+	explainedSlowQueries[query] = time.Now()
+	explainedSlowQueriesMutex.Unlock()
+
+	select {
+	case slowQueryExplainQueue <- slowQuery{query: query, args: args, duration: duration}:
+	default:
+	}
+}
+
+// EXPLAINできる文か
+func explainable(query string) bool {
+	fields := strings.Fields(query)
+	if len(fields) == 0 {
+		return false
+	}
+	switch strings.ToUpper(fields[0]) {
+	case "SELECT", "INSERT", "UPDATE", "DELETE", "REPLACE":
+		return true
+	}
+	return false
+}
+
+func runSlowQueryExplainer(db *sqlx.DB) {
+	for q := range slowQueryExplainQueue {
+		if !explainable(q.query) {
+			continue
+		}
+		args := make([]any, len(q.args))
+		for i, arg := range q.args {
+			args[i] = arg.Value
+		}
+
+		ctx, cancel := context.WithTimeout(context.Background(), explainTimeout)
+		var plan []map[string]interface{}
+		rows, err := db.QueryxContext(ctx, "EXPLAIN "+q.query, args...)
+		if err == nil {
+			for rows.Next() {
+				row := map[string]interface{}{}
+				if err = rows.MapScan(row); err != nil {
+					break
+				}
+				plan = append(plan, row)
+			}
+			if err == nil {
+				err = rows.Err()
+			}
+			rows.Close()
+		}
+		cancel()
+		if err != nil {
+			log.Printf("failed to explain slow query (%s): %s: %v", q.duration, q.query, err)
+			continue
+		}
+
+		var b strings.Builder
+		for _, row := range plan {
+			b.WriteString("\n\t")
+			for _, key := range []string{"table", "type", "possible_keys", "key", "rows", "filtered", "Extra"} {
+				b.WriteString(key + "=" + explainValue(row[key]) + " ")
+			}
+		}
+		log.Printf("explain slow query (%s): %s%s", q.duration, q.query, b.String())
+	}
+}
+
+func explainValue(v interface{}) string {
+	switch v := v.(type) {
+	case nil:
+		return "NULL"
+	case []byte:
+		return string(v)
+	default:
+		return fmt.Sprint(v)
+	}
+}
+
+type slowQueryConnector struct {
+	driver.Connector
+}
+
+func (c slowQueryConnector) Connect(ctx context.Context) (driver.Conn, error) {
+	conn, err := c.Connector.Connect(ctx)
+	if err != nil {
+		return nil, err
+	}
+	return &slowQueryConn{conn}, nil
+}
+
+// mysqlのコネクションが実装しているインターフェースはそのまま委譲する
+type slowQueryConn struct {
+	driver.Conn
+}
+
+func (c *slowQueryConn) PrepareContext(ctx context.Context, query string) (driver.Stmt, error) {
+	stmt, err := c.Conn.(driver.ConnPrepareContext).PrepareContext(ctx, query)
+	if err != nil {
+		return nil, err
+	}
+	return &slowQueryStmt{Stmt: stmt, query: query}, nil
+}
+
+func (c *slowQueryConn) BeginTx(ctx context.Context, opts driver.TxOptions) (driver.Tx, error) {
+	return c.Conn.(driver.ConnBeginTx).BeginTx(ctx, opts)
+}
+
+// interpolateParamsが無効な場合、引数付きのクエリはErrSkipでPrepareContext経由になる
+func (c *slowQueryConn) QueryContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := c.Conn.(driver.QueryerContext).QueryContext(ctx, query, args)
+	if err == nil {
+		recordQueryDuration(query, args, start)
+	}
+	return rows, err
+}
+
+func (c *slowQueryConn) ExecContext(ctx context.Context, query string, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	result, err := c.Conn.(driver.ExecerContext).ExecContext(ctx, query, args)
+	if err == nil {
+		recordQueryDuration(query, args, start)
+	}
+	return result, err
+}
+
+func (c *slowQueryConn) Ping(ctx context.Context) error {
+	return c.Conn.(driver.Pinger).Ping(ctx)
+}
+
+func (c *slowQueryConn) ResetSession(ctx context.Context) error {
+	return c.Conn.(driver.SessionResetter).ResetSession(ctx)
+}
+
+func (c *slowQueryConn) IsValid() bool {
+	return c.Conn.(driver.Validator).IsValid()
+}
+
+func (c *slowQueryConn) CheckNamedValue(nv *driver.NamedValue) error {
+	return c.Conn.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
+
+type slowQueryStmt struct {
+	driver.Stmt
+	query string
+}
+
+func (s *slowQueryStmt) QueryContext(ctx context.Context, args []driver.NamedValue) (driver.Rows, error) {
+	start := time.Now()
+	rows, err := s.Stmt.(driver.StmtQueryContext).QueryContext(ctx, args)
+	if err == nil {
+		recordQueryDuration(s.query, args, start)
+	}
+	return rows, err
+}
+
+func (s *slowQueryStmt) ExecContext(ctx context.Context, args []driver.NamedValue) (driver.Result, error) {
+	start := time.Now()
+	result, err := s.Stmt.(driver.StmtExecContext).ExecContext(ctx, args)
+	if err == nil {
+		recordQueryDuration(s.query, args, start)
+	}
+	return result, err
+}
+
+func (s *slowQueryStmt) CheckNamedValue(nv *driver.NamedValue) error {
+	return s.Stmt.(driver.NamedValueChecker).CheckNamedValue(nv)
+}
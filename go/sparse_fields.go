@@ -0,0 +1,133 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"net/http"
+	"reflect"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+// ユーザ・配信の一覧APIは ?fields=id,name,icon_hash で要素に残すキーを選べる
+// 指定できるのは要素の最上位のキー (jsonタグの名前) のみで、ownerの中身などは選べない
+// 指定しなければ今まで通り全て返す。MessagePackでも同じように効く
+
+// ?fields=で選ばれたフィールド。nilなら全て返す
+type fieldSelection struct {
+	fields []msgpackField
+}
+
+// ?fields=を要素の型と突き合わせる。知らない名前は組み立てる前に弾けるよう、DBに触る前に呼ぶ
+func parseFieldSelection(c echo.Context, elem interface{}) (*fieldSelection, error) {
+	names := splitQueryList(c.QueryParam("fields"))
+	if len(names) == 0 {
+		return nil, nil
+	}
+	fields, err := selectStructFields(reflect.TypeOf(elem), names)
+	if err != nil {
+		return nil, newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, err.Error())
+	}
+	return &fieldSelection{fields: fields}, nil
+}
+
+func (s *fieldSelection) has(name string) bool {
+	if s == nil {
+		return true
+	}
+	for _, f := range s.fields {
+		if f.name == name {
+			return true
+		}
+	}
+	return false
+}
+
+// 選ばれたフィールドが配信の行だけで埋まるなら、配信者やタグを引かずに組み立てる
+func fillLivestreamsSelected(ctx context.Context, tx *sqlx.Tx, livestreamModels []*LivestreamModel, sel *fieldSelection) ([]Livestream, error) {
+	if sel.has("owner") || sel.has("tags") {
+		return fillLivestreamResponseBulk(ctx, tx, livestreamModels)
+	}
+	livestreams := make([]Livestream, len(livestreamModels))
+	for i, livestreamModel := range livestreamModels {
+		livestreams[i] = Livestream{
+			ID:           livestreamModel.ID,
+			Title:        livestreamModel.Title,
+			Description:  livestreamModel.Description,
+			PlaylistUrl:  livestreamModel.PlaylistUrl,
+			ThumbnailUrl: livestreamModel.ThumbnailUrl,
+			StartAt:      livestreamModel.StartAt,
+			EndAt:        livestreamModel.EndAt,
+			Status:       livestreamModel.Status,
+		}
+	}
+	return livestreams, nil
+}
+
+// 選ばれたフィールドがユーザの行だけで埋まるなら、テーマやアイコンを引かずに組み立てる
+func fillUsersSelected(ctx context.Context, q sqlx.ExtContext, users UserRepository, userModels []*UserModel, sel *fieldSelection) ([]User, error) {
+	if sel.has("theme") || sel.has("icon_hash") {
+		return users.FillBulk(ctx, q, userModels)
+	}
+	filled := make([]User, len(userModels))
+	for i, userModel := range userModels {
+		filled[i] = User{
+			ID:             userModel.ID,
+			Name:           userModel.Name,
+			DisplayName:    userModel.DisplayName,
+			Description:    userModel.Description,
+			FollowersCount: userModel.FollowersCount,
+		}
+	}
+	return filled, nil
+}
+
+// 一覧をselで選ばれたフィールドだけに絞ってから、Acceptに合わせて返す
+func respondFieldSelected(c echo.Context, code int, list interface{}, sel *fieldSelection) error {
+	if sel == nil {
+		return respondNegotiated(c, code, list)
+	}
+
+	v := reflect.ValueOf(list)
+	if v.Kind() != reflect.Slice {
+		return echo.NewHTTPError(http.StatusInternalServerError, "fields can only be selected from a list")
+	}
+	projected := make([]map[string]interface{}, v.Len())
+	for i := 0; i < v.Len(); i++ {
+		elem := v.Index(i)
+		if elem.Kind() == reflect.Pointer {
+			if elem.IsNil() {
+				continue
+			}
+			elem = elem.Elem()
+		}
+		m := make(map[string]interface{}, len(sel.fields))
+		for _, f := range sel.fields {
+			// 明示的に指定されたキーはomitemptyでも出す
+			if fv, ok := fieldByIndex(elem, f.index); ok {
+				m[f.name] = fv.Interface()
+			}
+		}
+		projected[i] = m
+	}
+
+	return respondNegotiated(c, code, projected)
+}
+
+// jsonタグの名前からフィールドを引く。知らない名前が含まれていればエラーにする
+func selectStructFields(t reflect.Type, names []string) ([]msgpackField, error) {
+	byName := make(map[string]msgpackField)
+	for _, f := range msgpackStructFields(t) {
+		byName[f.name] = f
+	}
+	selected := make([]msgpackField, 0, len(names))
+	for _, name := range names {
+		f, ok := byName[name]
+		if !ok {
+			return nil, fmt.Errorf("unknown field %q", name)
+		}
+		selected = append(selected, f)
+	}
+	return selected, nil
+}
@@ -0,0 +1,57 @@
+package main
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+
+	"github.com/labstack/echo/v4"
+)
+
+func newFieldsContext(fields string) (echo.Context, *httptest.ResponseRecorder) {
+	req := httptest.NewRequest(http.MethodGet, "/?fields="+fields, nil)
+	rec := httptest.NewRecorder()
+	return echo.New().NewContext(req, rec), rec
+}
+
+func TestParseFieldSelectionRejectsUnknownField(t *testing.T) {
+	c, _ := newFieldsContext("id,password")
+	_, err := parseFieldSelection(c, User{})
+	var coded *codedHTTPError
+	if !errors.As(err, &coded) || coded.code != errorCodeInvalidParameter {
+		t.Errorf("err = %v, want invalid_parameter", err)
+	}
+
+	c, _ = newFieldsContext("")
+	if sel, err := parseFieldSelection(c, User{}); err != nil || sel != nil || !sel.has("theme") {
+		t.Errorf("no fields: sel = %v, err = %v", sel, err)
+	}
+}
+
+// 配信者やタグを選ばなければDBに触らずに組み立てる (txがnilでも動く)
+func TestFillLivestreamsSelectedSkipsOwnerAndTags(t *testing.T) {
+	c, rec := newFieldsContext("id,title,status")
+	sel, err := parseFieldSelection(c, Livestream{})
+	if err != nil {
+		t.Fatal(err)
+	}
+	models := []*LivestreamModel{{ID: 1, UserID: 2, Title: "a", Status: livestreamStatusLive}}
+	livestreams, err := fillLivestreamsSelected(context.Background(), nil, models, sel)
+	if err != nil {
+		t.Fatalf("fillLivestreamsSelected: %v", err)
+	}
+	if err := respondFieldSelected(c, http.StatusOK, livestreams, sel); err != nil {
+		t.Fatal(err)
+	}
+
+	var got []map[string]any
+	if err := json.Unmarshal(rec.Body.Bytes(), &got); err != nil {
+		t.Fatal(err)
+	}
+	if len(got) != 1 || len(got[0]) != 3 || got[0]["title"] != "a" || got[0]["status"] != livestreamStatusLive {
+		t.Errorf("got %v", got)
+	}
+}
@@ -0,0 +1,43 @@
+package main
+
+import (
+	"strings"
+
+	"github.com/labstack/echo/v4"
+	"github.com/labstack/echo/v4/middleware"
+)
+
+// ビルド時にファイル名にハッシュが付くアセット
+const staticAssetsPathPrefix = "/assets/"
+
+// nginx無しで動かすとき用に、フロントエンドを配信する
+// 存在しないパスはSPAのルーティングのためindex.htmlを返す (nginxのtry_files $uri /index.html と同じ)
+func newStaticMiddleware(root string) echo.MiddlewareFunc {
+	static := middleware.StaticWithConfig(middleware.StaticConfig{
+		Skipper: isAPIRequest,
+		Root:    root,
+		Index:   "index.html",
+		HTML5:   true,
+	})
+
+	return func(next echo.HandlerFunc) echo.HandlerFunc {
+		h := static(next)
+		return func(c echo.Context) error {
+			if !isAPIRequest(c) {
+				if strings.HasPrefix(c.Request().URL.Path, staticAssetsPathPrefix) {
+					c.Response().Header().Set("Cache-Control", "public, max-age=31536000, immutable")
+				} else {
+					// index.htmlは毎回取り直させて新しいアセットを参照させる
+					c.Response().Header().Set("Cache-Control", "no-cache")
+				}
+			}
+			return h(c)
+		}
+	}
+}
+
+// APIのエラー (404など) をindex.htmlで置き換えないようにする
+func isAPIRequest(c echo.Context) bool {
+	p := c.Request().URL.Path
+	return strings.HasPrefix(p, "/api/") || p == "/healthz" || p == "/readyz"
+}
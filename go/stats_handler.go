@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
 	"net/http"
@@ -12,15 +13,22 @@ import (
 )
 
 type LivestreamStatistics struct {
-	Rank           int64 `json:"rank"`
-	ViewersCount   int64 `json:"viewers_count"`
-	TotalReactions int64 `json:"total_reactions"`
-	TotalReports   int64 `json:"total_reports"`
-	MaxTip         int64 `json:"max_tip"`
+	Rank         int64 `json:"rank"`
+	ViewersCount int64 `json:"viewers_count"`
+	// ハートビートで生存確認できている同時視聴者数
+	ConcurrentViewersCount int64 `json:"concurrent_viewers_count"`
+	TotalReactions         int64 `json:"total_reactions"`
+	TotalReports           int64 `json:"total_reports"`
+	MaxTip                 int64 `json:"max_tip"`
+	// max_tipを単位に合わせて表示する文字列
+	MaxTipDisplay string      `json:"max_tip_display"`
+	TipCurrency   TipCurrency `json:"tip_currency"`
+	// メディアサーバから最後に報告された配信の状態 (報告が無ければ含めない)
+	Health *StreamHealthSample `json:"health,omitempty"`
 }
 
 type LivestreamRankingEntry struct {
-	LivestreamID int64
+	LivestreamID LivestreamID
 	Score        int64
 }
 type LivestreamRanking []LivestreamRankingEntry
@@ -42,8 +50,20 @@ type UserStatistics struct {
 	TotalLivecomments int64  `json:"total_livecomments"`
 	TotalTip          int64  `json:"total_tip"`
 	FavoriteEmoji     string `json:"favorite_emoji"`
+	// 配信に付いたリアクションの多い絵文字 (上位5件、favorite_emojiと同じ順)
+	TopEmojis []EmojiCount `json:"top_emojis"`
+	// total_tipを単位に合わせて表示する文字列
+	TotalTipDisplay string      `json:"total_tip_display"`
+	TipCurrency     TipCurrency `json:"tip_currency"`
 }
 
+type EmojiCount struct {
+	EmojiName string `json:"emoji_name" db:"emoji_name"`
+	Count     int64  `json:"count" db:"count"`
+}
+
+const topEmojisLimit = 5
+
 type UserRankingEntry struct {
 	Username string
 	Score    int64
@@ -69,8 +89,6 @@ func getUserStatisticsHandler(c echo.Context) error {
 	}
 
 	username := c.Param("username")
-	// ユーザごとに、紐づく配信について、累計リアクション数、累計ライブコメント数、累計売上金額を算出
-	// また、現在の合計視聴者数もだす
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -78,23 +96,35 @@ func getUserStatisticsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
-	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+	stats, err := getUserStatistics(ctx, tx, username)
+	if err != nil {
+		return err
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
+
+// ユーザごとに、紐づく配信について、累計リアクション数、累計ライブコメント数、累計売上金額を算出
+// また、現在の合計視聴者数もだす
+// エラーはecho.NewHTTPErrorで返すので、ハンドラからはそのまま返してよい
+func getUserStatistics(ctx context.Context, tx *sqlx.Tx, username string) (UserStatistics, error) {
+	user, err := userRepository.GetByName(ctx, tx, username)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusBadRequest, "not found user that has the given username")
+			return UserStatistics{}, newCodedHTTPError(http.StatusBadRequest, errorCodeUserNotFound, "not found user that has the given username")
 		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+			return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 		}
 	}
 
 	// ランク算出
 	var users []*UserModel
 	if err := tx.SelectContext(ctx, &users, "SELECT * FROM users"); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
 	}
 
 	var ranking UserRanking
-	var userIDs []int64
+	var userIDs []UserID
 	for _, user := range users {
 		userIDs = append(userIDs, user.ID)
 	}
@@ -104,12 +134,12 @@ func getUserStatisticsHandler(c echo.Context) error {
 		FROM users u
 		LEFT JOIN livestreams l ON l.user_id = u.id
 		LEFT JOIN reactions r ON r.livestream_id = l.id
-		LEFT JOIN livecomments l2 ON l2.livestream_id = l.id
+		LEFT JOIN livecomments l2 ON l2.livestream_id = l.id AND l2.deleted_at IS NULL
 		WHERE u.id IN (?)
 		GROUP BY u.id, u.name
 	`, userIDs)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
 	}
 
 	query = tx.Rebind(query)
@@ -120,7 +150,7 @@ func getUserStatisticsHandler(c echo.Context) error {
 		Tips      int64  `db:"tips"`
 	}
 	if err := tx.SelectContext(ctx, &results, query, args...); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user stats: "+err.Error())
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user stats: "+err.Error())
 	}
 
 	for _, result := range results {
@@ -149,7 +179,7 @@ func getUserStatisticsHandler(c echo.Context) error {
     WHERE u.name = ?
 	`
 	if err := tx.GetContext(ctx, &totalReactions, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
 	}
 
 	// ライブコメント数、チップ合計
@@ -157,25 +187,25 @@ func getUserStatisticsHandler(c echo.Context) error {
 	var totalTip int64
 	var livestreams []*LivestreamModel
 	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams WHERE user_id = ?", user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
 	var livecomments []struct {
 		Tip int64 `db:"tip"`
 	}
-	query = `SELECT IFNULL(SUM(tip), 0) AS tip FROM livecomments WHERE livestream_id IN (?)`
-	var livestreamIDs []int64
+	query = `SELECT IFNULL(SUM(tip), 0) AS tip FROM livecomments WHERE livestream_id IN (?) AND deleted_at IS NULL`
+	var livestreamIDs []LivestreamID
 	for _, livestream := range livestreams {
 		livestreamIDs = append(livestreamIDs, livestream.ID)
 	}
 	query, args, err = sqlx.In(query, livestreamIDs)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
 	}
 
 	query = tx.Rebind(query)
 	if err := tx.SelectContext(ctx, &livecomments, query, args...); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livecomments: "+err.Error())
 	}
 
 	for _, livecomment := range livecomments {
@@ -190,23 +220,27 @@ func getUserStatisticsHandler(c echo.Context) error {
 	WHERE l.user_id = ?
 	`
 	if err := tx.GetContext(ctx, &viewersCount, query, user.ID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
 	}
 
-	// お気に入り絵文字
-	var favoriteEmoji string
+	// お気に入り絵文字と上位の絵文字 (1回のGROUP BYで、favorite_emojiは先頭)
+	topEmojis := []EmojiCount{}
 	query = `
-	SELECT r.emoji_name
+	SELECT r.emoji_name, COUNT(*) AS count
 	FROM users u
 	INNER JOIN livestreams l ON l.user_id = u.id
 	INNER JOIN reactions r ON r.livestream_id = l.id
 	WHERE u.name = ?
 	GROUP BY emoji_name
 	ORDER BY COUNT(*) DESC, emoji_name DESC
-	LIMIT 1
+	LIMIT ?
 	`
-	if err := tx.GetContext(ctx, &favoriteEmoji, query, username); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
+	if err := tx.SelectContext(ctx, &topEmojis, query, username, topEmojisLimit); err != nil {
+		return UserStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to find favorite emoji: "+err.Error())
+	}
+	var favoriteEmoji string
+	if len(topEmojis) > 0 {
+		favoriteEmoji = topEmojis[0].EmojiName
 	}
 
 	stats := UserStatistics{
@@ -216,8 +250,11 @@ func getUserStatisticsHandler(c echo.Context) error {
 		TotalLivecomments: totalLivecomments,
 		TotalTip:          totalTip,
 		FavoriteEmoji:     favoriteEmoji,
+		TopEmojis:         topEmojis,
+		TotalTipDisplay:   formatTip(totalTip),
+		TipCurrency:       currentTunables().TipCurrency,
 	}
-	return c.JSON(http.StatusOK, stats)
+	return stats, nil
 }
 
 func getLivestreamStatisticsHandler(c echo.Context) error {
@@ -229,9 +266,9 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 
 	id, err := strconv.Atoi(c.Param("livestream_id"))
 	if err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "livestream_id in path must be integer")
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
 	}
-	livestreamID := int64(id)
+	livestreamID := LivestreamID(id)
 
 	tx, err := dbConn.BeginTxx(ctx, nil)
 	if err != nil {
@@ -239,35 +276,49 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	}
 	defer tx.Rollback()
 
+	stats, err := getLivestreamStatistics(ctx, tx, livestreamID)
+	if err != nil {
+		return err
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusOK, stats)
+}
+
+// エラーはecho.NewHTTPErrorで返す
+func getLivestreamStatistics(ctx context.Context, tx *sqlx.Tx, livestreamID LivestreamID) (LivestreamStatistics, error) {
 	var livestream LivestreamModel
 	if err := tx.GetContext(ctx, &livestream, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusBadRequest, "cannot get stats of not found livestream")
+			return LivestreamStatistics{}, newCodedHTTPError(http.StatusBadRequest, errorCodeLivestreamNotFound, "cannot get stats of not found livestream")
 		} else {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+			return LivestreamStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
 		}
 	}
 
 	var livestreams []*LivestreamModel
 	if err := tx.SelectContext(ctx, &livestreams, "SELECT * FROM livestreams"); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+		return LivestreamStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
 	}
 
 	// ランク算出
 	type LivestreamStats struct {
-		LivestreamID int64 `db:"livestream_id"`
-		Reactions    int64 `db:"reactions"`
-		Tips         int64 `db:"tips"`
+		LivestreamID LivestreamID `db:"livestream_id"`
+		Reactions    int64        `db:"reactions"`
+		Tips         int64        `db:"tips"`
 	}
 	var stats []LivestreamStats
 	if err := tx.SelectContext(ctx, &stats, `
 	SELECT l.id AS livestream_id, COUNT(r.id) AS reactions, IFNULL(SUM(l2.tip), 0) AS tips
 	FROM livestreams l
 	LEFT JOIN reactions r ON l.id = r.livestream_id
-	LEFT JOIN livecomments l2 ON l.id = l2.livestream_id
+	LEFT JOIN livecomments l2 ON l.id = l2.livestream_id AND l2.deleted_at IS NULL
 	GROUP BY l.id
 	`); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get stats: "+err.Error())
+		return LivestreamStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to get stats: "+err.Error())
 	}
 
 	var ranking LivestreamRanking
@@ -292,36 +343,36 @@ func getLivestreamStatisticsHandler(c echo.Context) error {
 	// 視聴者数算出
 	var viewersCount int64
 	if err := tx.GetContext(ctx, &viewersCount, `SELECT COUNT(*) FROM livestreams l INNER JOIN livestream_viewers_history h ON h.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
+		return LivestreamStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to count livestream viewers: "+err.Error())
 	}
 
 	// 最大チップ額
 	var maxTip int64
-	if err := tx.GetContext(ctx, &maxTip, `SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to find maximum tip livecomment: "+err.Error())
+	if err := tx.GetContext(ctx, &maxTip, `SELECT IFNULL(MAX(tip), 0) FROM livestreams l INNER JOIN livecomments l2 ON l2.livestream_id = l.id WHERE l.id = ? AND l2.deleted_at IS NULL`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return LivestreamStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to find maximum tip livecomment: "+err.Error())
 	}
 
 	// リアクション数
 	var totalReactions int64
 	if err := tx.GetContext(ctx, &totalReactions, "SELECT COUNT(*) FROM livestreams l INNER JOIN reactions r ON r.livestream_id = l.id WHERE l.id = ?", livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
+		return LivestreamStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to count total reactions: "+err.Error())
 	}
 
 	// スパム報告数
 	var totalReports int64
 	if err := tx.GetContext(ctx, &totalReports, `SELECT COUNT(*) FROM livestreams l INNER JOIN livecomment_reports r ON r.livestream_id = l.id WHERE l.id = ?`, livestreamID); err != nil && !errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count total spam reports: "+err.Error())
-	}
-
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
-
-	return c.JSON(http.StatusOK, LivestreamStatistics{
-		Rank:           rank,
-		ViewersCount:   viewersCount,
-		MaxTip:         maxTip,
-		TotalReactions: totalReactions,
-		TotalReports:   totalReports,
-	})
+		return LivestreamStatistics{}, echo.NewHTTPError(http.StatusInternalServerError, "failed to count total spam reports: "+err.Error())
+	}
+
+	return LivestreamStatistics{
+		Rank:                   rank,
+		ViewersCount:           viewersCount,
+		ConcurrentViewersCount: getConcurrentViewersCount(livestreamID),
+		MaxTip:                 maxTip,
+		MaxTipDisplay:          formatTip(maxTip),
+		TipCurrency:            currentTunables().TipCurrency,
+		TotalReactions:         totalReactions,
+		TotalReports:           totalReports,
+		Health:                 latestStreamHealth(livestreamID),
+	}, nil
 }
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// メディアサーバから報告される配信の状態。直近の分だけをメモリに持つ
+const streamHealthSamplesPerLivestream = 60
+
+type StreamHealthSample struct {
+	BitrateKbps   int64 `json:"bitrate_kbps"`
+	DroppedFrames int64 `json:"dropped_frames"`
+	// メディアサーバに繋がっている再生クライアントの数 (ハートビートの同時視聴者数とは別)
+	ViewerConnections int64 `json:"viewer_connections"`
+	ReportedAt        int64 `json:"reported_at"`
+}
+
+type PostStreamHealthRequest struct {
+	BitrateKbps       int64 `json:"bitrate_kbps" validate:"min=0"`
+	DroppedFrames     int64 `json:"dropped_frames" validate:"min=0"`
+	ViewerConnections int64 `json:"viewer_connections" validate:"min=0"`
+}
+
+// 古いものから上書きするリングバッファ
+type streamHealthRing struct {
+	samples [streamHealthSamplesPerLivestream]StreamHealthSample
+	next    int
+	count   int
+}
+
+func (r *streamHealthRing) push(sample StreamHealthSample) {
+	r.samples[r.next] = sample
+	r.next = (r.next + 1) % len(r.samples)
+	if r.count < len(r.samples) {
+		r.count++
+	}
+}
+
+func (r *streamHealthRing) latest() (StreamHealthSample, bool) {
+	if r.count == 0 {
+		return StreamHealthSample{}, false
+	}
+	return r.samples[(r.next+len(r.samples)-1)%len(r.samples)], true
+}
+
+var (
+	StreamHealthByLivestreamIDCache      = make(map[LivestreamID]*streamHealthRing)
+	StreamHealthByLivestreamIDCacheMutex = sync.Mutex{}
+)
+
+func init() {
+	registerCacheReset(func() {
+		StreamHealthByLivestreamIDCacheMutex.Lock()
+		StreamHealthByLivestreamIDCache = make(map[LivestreamID]*streamHealthRing)
+		StreamHealthByLivestreamIDCacheMutex.Unlock()
+	})
+}
+
+func recordStreamHealth(livestreamID LivestreamID, sample StreamHealthSample) {
+	StreamHealthByLivestreamIDCacheMutex.Lock()
+	defer StreamHealthByLivestreamIDCacheMutex.Unlock()
+	ring, ok := StreamHealthByLivestreamIDCache[livestreamID]
+	if !ok {
+		ring = &streamHealthRing{}
+		StreamHealthByLivestreamIDCache[livestreamID] = ring
+	}
+	ring.push(sample)
+}
+
+// 報告が無ければnil
+func latestStreamHealth(livestreamID LivestreamID) *StreamHealthSample {
+	StreamHealthByLivestreamIDCacheMutex.Lock()
+	defer StreamHealthByLivestreamIDCacheMutex.Unlock()
+	ring, ok := StreamHealthByLivestreamIDCache[livestreamID]
+	if !ok {
+		return nil
+	}
+	sample, ok := ring.latest()
+	if !ok {
+		return nil
+	}
+	return &sample
+}
+
+// メディアサーバからの配信状態の報告API
+// POST /api/internal/livestream/:livestream_id/health
+func postStreamHealthHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	req := PostStreamHealthRequest{}
+	if err := bindRequest(c, &req); err != nil {
+		return err
+	}
+
+	// 存在しない配信の分をメモリに溜めない
+	var exists int
+	if err := dbConn.GetContext(ctx, &exists, "SELECT 1 FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+
+	recordStreamHealth(LivestreamID(livestreamID), StreamHealthSample{
+		BitrateKbps:       req.BitrateKbps,
+		DroppedFrames:     req.DroppedFrames,
+		ViewerConnections: req.ViewerConnections,
+		ReportedAt:        time.Now().Unix(),
+	})
+
+	return c.NoContent(http.StatusNoContent)
+}
@@ -0,0 +1,141 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"crypto/subtle"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+// ストリームキーは発行時にだけ返し、DBにはSHA-256のハッシュだけを保存する
+// 発行し直すと前のキーは使えなくなる
+const streamKeyPrefix = "live_"
+
+// /api/internal/*の認証に使うトークン (main()で設定する)
+var internalAPIToken string
+
+type StreamKeyResponse struct {
+	LivestreamID LivestreamID `json:"livestream_id"`
+	StreamKey    string       `json:"stream_key"`
+	CreatedAt    int64        `json:"created_at"`
+}
+
+type ValidateStreamKeyResponse struct {
+	LivestreamID LivestreamID `json:"livestream_id"`
+	UserID       UserID       `json:"user_id"`
+}
+
+func hashStreamKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// ストリームキーの発行・再発行API (配信者のみ)
+// POST /api/livestream/:livestream_id/streamkey
+func postStreamKeyHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	secret := make([]byte, 24)
+	if _, err := rand.Read(secret); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate stream key: "+err.Error())
+	}
+	streamKey := streamKeyPrefix + hex.EncodeToString(secret)
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	var livestreamModel LivestreamModel
+	if err := tx.GetContext(ctx, &livestreamModel, "SELECT * FROM livestreams WHERE id = ?", livestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "livestream not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.UserID != userID {
+		return newCodedHTTPError(http.StatusForbidden, errorCodeNotLivestreamOwner, "can't issue a stream key for other streamer's livestream")
+	}
+
+	now := time.Now().Unix()
+	if _, err := tx.ExecContext(ctx, "INSERT INTO livestream_stream_keys (livestream_id, key_hash, created_at) VALUES (?, ?, ?) ON DUPLICATE KEY UPDATE key_hash = VALUES(key_hash), created_at = VALUES(created_at)", livestreamID, hashStreamKey(streamKey), now); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save stream key: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	return c.JSON(http.StatusCreated, StreamKeyResponse{
+		LivestreamID: LivestreamID(livestreamID),
+		StreamKey:    streamKey,
+		CreatedAt:    now,
+	})
+}
+
+// メディアサーバがRTMPのpublishを許可してよいか確かめるAPI
+// 2xxなら許可、403なら拒否する
+// GET /api/internal/streamkey/validate?key=
+func validateStreamKeyHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	key := c.QueryParam("key")
+	if !strings.HasPrefix(key, streamKeyPrefix) {
+		return newCodedHTTPError(http.StatusForbidden, errorCodeInvalidStreamKey, "invalid stream key")
+	}
+
+	var livestreamModel LivestreamModel
+	err := dbConn.GetContext(ctx, &livestreamModel, "SELECT l.* FROM livestream_stream_keys k INNER JOIN livestreams l ON l.id = k.livestream_id WHERE k.key_hash = ?", hashStreamKey(key))
+	if errors.Is(err, sql.ErrNoRows) {
+		return newCodedHTTPError(http.StatusForbidden, errorCodeInvalidStreamKey, "invalid stream key")
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if livestreamModel.Status == livestreamStatusEnded {
+		return newCodedHTTPError(http.StatusForbidden, errorCodeInvalidStreamKey, "livestream has already ended")
+	}
+
+	return c.JSON(http.StatusOK, ValidateStreamKeyResponse{
+		LivestreamID: livestreamModel.ID,
+		UserID:       livestreamModel.UserID,
+	})
+}
+
+// /api/internal/*と/api/admin/*はブラウザからではなく運営やメディアサーバから呼ぶ
+// nginxがすべてのリクエストをlocalhostから転送するので、送信元ではなくAuthorization: Bearerのトークンだけで判断する
+// トークンが設定されていなければルート自体を登録しない (registerRoutes)
+func internalAPIMiddleware(next echo.HandlerFunc) echo.HandlerFunc {
+	return func(c echo.Context) error {
+		token, ok := strings.CutPrefix(c.Request().Header.Get(echo.HeaderAuthorization), "Bearer ")
+		if internalAPIToken == "" || !ok || subtle.ConstantTimeCompare([]byte(token), []byte(internalAPIToken)) != 1 {
+			return newCodedHTTPError(http.StatusUnauthorized, errorCodeUnauthorized, "invalid internal api token")
+		}
+		return next(c)
+	}
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"context"
+	"slices"
+	"sync"
+)
+
+// タグ名 → ライブ配信IDのインデックス
+// タグ検索でtags → livestream_tags → livestreams と辿らずに済むよう、起動時とinitialize時に全件読み込み、予約時に追記する
+var (
+	LivestreamIDsByTagNameCache      = make(map[string][]LivestreamID)
+	LivestreamIDsByTagNameCacheMutex = sync.RWMutex{}
+)
+
+func loadLivestreamTagIndex(ctx context.Context) error {
+	var rows []struct {
+		TagName      string       `db:"name"`
+		LivestreamID LivestreamID `db:"livestream_id"`
+	}
+	if err := dbConn.SelectContext(ctx, &rows, "SELECT t.name, lt.livestream_id FROM livestream_tags lt INNER JOIN tags t ON t.id = lt.tag_id"); err != nil {
+		return err
+	}
+
+	index := make(map[string][]LivestreamID)
+	for _, row := range rows {
+		index[row.TagName] = append(index[row.TagName], row.LivestreamID)
+	}
+
+	LivestreamIDsByTagNameCacheMutex.Lock()
+	LivestreamIDsByTagNameCache = index
+	LivestreamIDsByTagNameCacheMutex.Unlock()
+
+	return nil
+}
+
+func addLivestreamToTagIndex(livestreamID LivestreamID, tagNames []string) {
+	LivestreamIDsByTagNameCacheMutex.Lock()
+	defer LivestreamIDsByTagNameCacheMutex.Unlock()
+
+	for _, name := range tagNames {
+		ids := LivestreamIDsByTagNameCache[name]
+		// 読み出し側と配列を共有しないようにコピーしてから追記する
+		LivestreamIDsByTagNameCache[name] = append(ids[:len(ids):len(ids)], livestreamID)
+	}
+}
+
+func removeLivestreamFromTagIndex(livestreamID LivestreamID) {
+	LivestreamIDsByTagNameCacheMutex.Lock()
+	defer LivestreamIDsByTagNameCacheMutex.Unlock()
+
+	for name, ids := range LivestreamIDsByTagNameCache {
+		if !slices.Contains(ids, livestreamID) {
+			continue
+		}
+		// 読み出し側と配列を共有しないように新しいスライスを作る
+		remaining := make([]LivestreamID, 0, len(ids)-1)
+		for _, id := range ids {
+			if id != livestreamID {
+				remaining = append(remaining, id)
+			}
+		}
+		if len(remaining) == 0 {
+			delete(LivestreamIDsByTagNameCache, name)
+		} else {
+			LivestreamIDsByTagNameCache[name] = remaining
+		}
+	}
+}
+
+// いずれか (matchAll=falseの場合) または全て (matchAll=trueの場合) のタグを持つ配信のIDをID降順で返す
+func findLivestreamIDsByTagNames(tagNames []string, matchAll bool) []LivestreamID {
+	LivestreamIDsByTagNameCacheMutex.RLock()
+	hits := make(map[LivestreamID]int)
+	for _, name := range tagNames {
+		// 同じタグが重複して付いていても1回と数える
+		seen := make(map[LivestreamID]struct{})
+		for _, id := range LivestreamIDsByTagNameCache[name] {
+			if _, ok := seen[id]; ok {
+				continue
+			}
+			seen[id] = struct{}{}
+			hits[id]++
+		}
+	}
+	LivestreamIDsByTagNameCacheMutex.RUnlock()
+
+	ids := make([]LivestreamID, 0, len(hits))
+	for id, n := range hits {
+		if matchAll && n < len(tagNames) {
+			continue
+		}
+		ids = append(ids, id)
+	}
+	slices.SortFunc(ids, func(a, b LivestreamID) int {
+		switch {
+		case a > b:
+			return -1
+		case a < b:
+			return 1
+		}
+		return 0
+	})
+
+	return ids
+}
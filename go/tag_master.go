@@ -0,0 +1,154 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"log"
+	"net/http"
+	"slices"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/labstack/echo/v4"
+)
+
+// 他のインスタンスで追加されたタグを取り込む間隔
+const tagMasterSyncPeriod = 1 * time.Second
+
+// タグマスタ。正規化したタグ名で重複を判定する
+var (
+	TagByNormalizedNameCache      = make(map[string]Tag)
+	TagByNormalizedNameCacheMutex = sync.RWMutex{}
+)
+
+type PostTagRequest struct {
+	Name string `json:"name"`
+}
+
+// 前後の空白を除き、大文字小文字を区別しない
+func normalizeTagName(name string) string {
+	return strings.ToLower(strings.TrimSpace(name))
+}
+
+func loadTagMaster(ctx context.Context) error {
+	var tagModels []*TagModel
+	if err := dbConn.SelectContext(ctx, &tagModels, "SELECT * FROM tags"); err != nil {
+		return err
+	}
+
+	master := make(map[string]Tag, len(tagModels))
+	for _, tagModel := range tagModels {
+		key := normalizeTagName(tagModel.Name)
+		// 初期データに正規化後同じになるタグがあれば、先に登録されたものを使う
+		if existing, ok := master[key]; ok && existing.ID < tagModel.ID {
+			continue
+		}
+		master[key] = Tag{ID: tagModel.ID, Name: tagModel.Name}
+	}
+
+	TagByNormalizedNameCacheMutex.Lock()
+	TagByNormalizedNameCache = master
+	TagByNormalizedNameCacheMutex.Unlock()
+
+	return nil
+}
+
+func getTagByNormalizedName(name string) (Tag, bool) {
+	TagByNormalizedNameCacheMutex.RLock()
+	defer TagByNormalizedNameCacheMutex.RUnlock()
+
+	tag, ok := TagByNormalizedNameCache[name]
+	return tag, ok
+}
+
+// ID昇順のタグ一覧
+func getAllTags() []*Tag {
+	TagByNormalizedNameCacheMutex.RLock()
+	tags := make([]*Tag, 0, len(TagByNormalizedNameCache))
+	for _, tag := range TagByNormalizedNameCache {
+		tags = append(tags, &Tag{ID: tag.ID, Name: tag.Name})
+	}
+	TagByNormalizedNameCacheMutex.RUnlock()
+
+	slices.SortFunc(tags, func(a, b *Tag) int {
+		switch {
+		case a.ID < b.ID:
+			return -1
+		case a.ID > b.ID:
+			return 1
+		}
+		return 0
+	})
+	return tags
+}
+
+// タグ作成API
+// POST /api/tag
+func postTagHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	var req *PostTagRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidJSON, "failed to decode the request body as json")
+	}
+
+	name := normalizeTagName(req.Name)
+	if name == "" {
+		return echo.NewHTTPError(http.StatusBadRequest, "name must not be empty")
+	}
+	if len(name) > 255 {
+		return echo.NewHTTPError(http.StatusBadRequest, "name is too long")
+	}
+
+	if tag, ok := getTagByNormalizedName(name); ok {
+		return c.JSON(http.StatusOK, tag)
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "INSERT INTO tags (name) VALUES (?)", name)
+	if err != nil {
+		var mysqlErr *mysql.MySQLError
+		if !errors.As(err, &mysqlErr) || mysqlErr.Number != 1062 {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert tag: "+err.Error())
+		}
+		// 他のインスタンスが先に同じタグを作った
+		if err := loadTagMaster(ctx); err != nil {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to load tags: "+err.Error())
+		}
+		tag, ok := getTagByNormalizedName(name)
+		if !ok {
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to find duplicated tag")
+		}
+		return c.JSON(http.StatusOK, tag)
+	}
+	tagID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted tag id: "+err.Error())
+	}
+
+	tag := Tag{ID: tagID, Name: name}
+	TagByNormalizedNameCacheMutex.Lock()
+	TagByNormalizedNameCache[name] = tag
+	TagByNormalizedNameCacheMutex.Unlock()
+
+	return c.JSON(http.StatusCreated, tag)
+}
+
+// インスタンス間の通知経路は無いので、DBを定期的に読み直して他のインスタンスで追加されたタグを反映する
+func runTagMasterSyncer() {
+	ticker := time.NewTicker(tagMasterSyncPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := loadTagMaster(context.Background()); err != nil {
+			log.Printf("failed to sync tag master: %+v", err)
+		}
+	}
+}
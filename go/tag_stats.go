@@ -0,0 +1,116 @@
+package main
+
+import (
+	"net/http"
+	"slices"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo/v4"
+)
+
+// タグごとの配信数と直近のアクティビティ (カテゴリ一覧ページ用)
+// タグインデックスとトレンドのバケットから数えるのでDBは見ない。ランキングと同じ間隔でスナップショットを使い回す
+type TagStat struct {
+	Tag
+	LivestreamCount int64 `json:"livestream_count"`
+	// 直近TrendingWindow内にアクティビティがあった配信の数
+	ActiveLivestreamCount int64 `json:"active_livestream_count"`
+	// 直近TrendingWindow内のリアクション数+コメント数の合計
+	RecentActivity int64 `json:"recent_activity"`
+}
+
+type TagStatsResponse struct {
+	Tags []TagStat `json:"tags"`
+}
+
+type tagStatsSnapshot struct {
+	// アクティビティ降順
+	Stats     []TagStat
+	CreatedAt time.Time
+}
+
+var (
+	currentTagStatsSnapshot      *tagStatsSnapshot
+	currentTagStatsSnapshotMutex = sync.Mutex{}
+)
+
+func init() {
+	registerCacheReset(func() {
+		currentTagStatsSnapshotMutex.Lock()
+		currentTagStatsSnapshot = nil
+		currentTagStatsSnapshotMutex.Unlock()
+	})
+}
+
+func getTagStatsSnapshot(now time.Time) *tagStatsSnapshot {
+	currentTagStatsSnapshotMutex.Lock()
+	defer currentTagStatsSnapshotMutex.Unlock()
+
+	if currentTagStatsSnapshot != nil && now.Sub(currentTagStatsSnapshot.CreatedAt) < currentTunables().RankingSnapshotTTL {
+		return currentTagStatsSnapshot
+	}
+
+	// インデックスはタグ名そのままなので、タグマスタと同じく正規化した名前でまとめる
+	livestreamIDsByNormalizedName := make(map[string]map[LivestreamID]struct{})
+	LivestreamIDsByTagNameCacheMutex.RLock()
+	for name, ids := range LivestreamIDsByTagNameCache {
+		key := normalizeTagName(name)
+		set, ok := livestreamIDsByNormalizedName[key]
+		if !ok {
+			set = make(map[LivestreamID]struct{}, len(ids))
+			livestreamIDsByNormalizedName[key] = set
+		}
+		for _, id := range ids {
+			set[id] = struct{}{}
+		}
+	}
+	LivestreamIDsByTagNameCacheMutex.RUnlock()
+
+	activityCounts := getRecentActivityCounts(now)
+
+	tags := getAllTags()
+	stats := make([]TagStat, 0, len(tags))
+	for _, tag := range tags {
+		stat := TagStat{Tag: *tag}
+		for id := range livestreamIDsByNormalizedName[normalizeTagName(tag.Name)] {
+			stat.LivestreamCount++
+			if activity := activityCounts[id]; activity > 0 {
+				stat.ActiveLivestreamCount++
+				stat.RecentActivity += activity
+			}
+		}
+		stats = append(stats, stat)
+	}
+	// アクティビティ降順、同じなら配信数降順、それも同じならID昇順
+	slices.SortStableFunc(stats, func(a, b TagStat) int {
+		switch {
+		case a.RecentActivity != b.RecentActivity:
+			if a.RecentActivity > b.RecentActivity {
+				return -1
+			}
+			return 1
+		case a.LivestreamCount != b.LivestreamCount:
+			if a.LivestreamCount > b.LivestreamCount {
+				return -1
+			}
+			return 1
+		}
+		return 0
+	})
+
+	currentTagStatsSnapshot = &tagStatsSnapshot{
+		Stats:     stats,
+		CreatedAt: now,
+	}
+	return currentTagStatsSnapshot
+}
+
+// タグごとの人気の統計API
+// GET /api/tag/stats
+func getTagStatsHandler(c echo.Context) error {
+	snapshot := getTagStatsSnapshot(time.Now())
+	return c.JSON(http.StatusOK, &TagStatsResponse{
+		Tags: snapshot.Stats,
+	})
+}
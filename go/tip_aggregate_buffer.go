@@ -0,0 +1,121 @@
+package main
+
+import (
+	"context"
+	"log"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// write_behind_statsが有効な間、チップ合計への加算をメモリに溜めてまとめて書き込む
+// 投げ銭が集中したときにtip_aggregatesの人気配信者の行のロック待ちでコメント投稿が詰まらないようにする
+const tipAggregateFlushPeriod = 500 * time.Millisecond
+
+var (
+	// まだ書き込んでいない加算 (user_id -> チップ)
+	pendingTipAggregates = map[UserID]int64{}
+	// 書き込み中の加算。書き込み終わるまでは読み出し側で足す
+	flushingTipAggregates     = map[UserID]int64{}
+	pendingTipAggregatesMutex = sync.Mutex{}
+	tipAggregateFlushMutex    = sync.Mutex{}
+)
+
+func init() {
+	registerCacheReset(func() {
+		// 書き込み中のものが終わってから捨てる (initialize時は初期データから作り直す)
+		tipAggregateFlushMutex.Lock()
+		defer tipAggregateFlushMutex.Unlock()
+		pendingTipAggregatesMutex.Lock()
+		defer pendingTipAggregatesMutex.Unlock()
+		pendingTipAggregates = map[UserID]int64{}
+	})
+}
+
+// コミットした後に呼ぶこと
+func bufferTipAggregate(streamerID UserID, tip int64) {
+	if tip == 0 {
+		return
+	}
+	pendingTipAggregatesMutex.Lock()
+	defer pendingTipAggregatesMutex.Unlock()
+	pendingTipAggregates[streamerID] += tip
+}
+
+// DBにまだ反映されていない分
+func unflushedTipAggregate(userID UserID) int64 {
+	pendingTipAggregatesMutex.Lock()
+	defer pendingTipAggregatesMutex.Unlock()
+	return pendingTipAggregates[userID] + flushingTipAggregates[userID]
+}
+
+// 全配信者のDBにまだ反映されていない分
+func unflushedTipAggregateTotal() int64 {
+	pendingTipAggregatesMutex.Lock()
+	defer pendingTipAggregatesMutex.Unlock()
+	var total int64
+	for _, tip := range pendingTipAggregates {
+		total += tip
+	}
+	for _, tip := range flushingTipAggregates {
+		total += tip
+	}
+	return total
+}
+
+func flushTipAggregates(ctx context.Context) error {
+	tipAggregateFlushMutex.Lock()
+	defer tipAggregateFlushMutex.Unlock()
+
+	pendingTipAggregatesMutex.Lock()
+	flushing := pendingTipAggregates
+	pendingTipAggregates = map[UserID]int64{}
+	flushingTipAggregates = flushing
+	pendingTipAggregatesMutex.Unlock()
+
+	if len(flushing) == 0 {
+		return nil
+	}
+
+	// 1文で書き込む。デッドロックしないよう行ロックはuser_idの順に取る
+	userIDs := make([]UserID, 0, len(flushing))
+	for userID := range flushing {
+		userIDs = append(userIDs, userID)
+	}
+	sort.Slice(userIDs, func(i, j int) bool { return userIDs[i] < userIDs[j] })
+	placeholders := make([]string, 0, len(userIDs))
+	args := make([]any, 0, len(userIDs)*2)
+	for _, userID := range userIDs {
+		placeholders = append(placeholders, "(?, ?)")
+		args = append(args, userID, flushing[userID])
+	}
+	_, err := dbConn.ExecContext(ctx,
+		"INSERT INTO tip_aggregates (user_id, total_tip) VALUES "+strings.Join(placeholders, ", ")+" ON DUPLICATE KEY UPDATE total_tip = total_tip + VALUES(total_tip)",
+		args...,
+	)
+
+	pendingTipAggregatesMutex.Lock()
+	if err != nil {
+		// 次回まとめて書き込む
+		for userID, tip := range flushing {
+			pendingTipAggregates[userID] += tip
+		}
+	}
+	flushingTipAggregates = map[UserID]int64{}
+	pendingTipAggregatesMutex.Unlock()
+
+	return err
+}
+
+// フラグを無効にした後も溜まっている分は書き込み続ける
+func runTipAggregateFlusher() {
+	ticker := time.NewTicker(tipAggregateFlushPeriod)
+	defer ticker.Stop()
+
+	for range ticker.C {
+		if err := flushTipAggregates(context.Background()); err != nil {
+			log.Printf("failed to flush tip aggregates: %+v", err)
+		}
+	}
+}
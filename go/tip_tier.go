@@ -0,0 +1,97 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"sort"
+	"strconv"
+)
+
+const defaultTipTiersPath = "../sql/tip_tiers.json"
+
+// チップ額の区分。クライアントはnameで表示を切り替える
+type TipTier struct {
+	Name string `json:"name"`
+	Min  int64  `json:"min"`
+	// 0なら上限なし
+	Max int64 `json:"max"`
+}
+
+// チップの単位。DBやAPIのチップ額は整数のままで、表示するときだけDisplayMultiplierを掛ける
+type TipCurrency struct {
+	Name              string  `json:"name"`
+	DisplayMultiplier float64 `json:"display_multiplier"`
+	// 1回のチップの上限。0なら区分の範囲内であれば制限しない
+	MaxSingleTip int64 `json:"max_single_tip"`
+}
+
+var defaultTipCurrency = TipCurrency{
+	Name:              "ISU",
+	DisplayMultiplier: 1,
+}
+
+// 起動時に読み込むチップの区分 (min昇順)
+var tipTiers []TipTier
+
+func loadTipTiers(path string) ([]TipTier, error) {
+	b, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	var tiers []TipTier
+	if err := json.Unmarshal(b, &tiers); err != nil {
+		return nil, err
+	}
+
+	sort.Slice(tiers, func(i, j int) bool { return tiers[i].Min < tiers[j].Min })
+	for i, tier := range tiers {
+		if tier.Name == "" {
+			return nil, fmt.Errorf("tip tier %d has no name", i)
+		}
+		if tier.Min <= 0 {
+			return nil, fmt.Errorf("tip tier %s: min must be positive", tier.Name)
+		}
+		if tier.Max != 0 && tier.Max < tier.Min {
+			return nil, fmt.Errorf("tip tier %s: max must not be less than min", tier.Name)
+		}
+		if i > 0 {
+			prev := tiers[i-1]
+			if prev.Max == 0 || prev.Max >= tier.Min {
+				return nil, fmt.Errorf("tip tiers %s and %s overlap", prev.Name, tier.Name)
+			}
+		}
+	}
+
+	return tiers, nil
+}
+
+// チップ額に対応する区分名を返す。チップ無し (0) は空文字
+// どの区分にも入らない額はfalse
+func resolveTipTier(tip int64) (string, bool) {
+	if tip == 0 {
+		return "", true
+	}
+	for _, tier := range tipTiers {
+		if tip >= tier.Min && (tier.Max == 0 || tip <= tier.Max) {
+			return tier.Name, true
+		}
+	}
+	return "", false
+}
+
+// 区分と1回の上限の両方を満たすか
+func tipAllowed(tip int64) bool {
+	if _, ok := resolveTipTier(tip); !ok {
+		return false
+	}
+	maxTip := currentTunables().TipCurrency.MaxSingleTip
+	return maxTip == 0 || tip <= maxTip
+}
+
+// 表示用の文字列 (例: "1500 ISU")
+func formatTip(tip int64) string {
+	currency := currentTunables().TipCurrency
+	return strconv.FormatFloat(float64(tip)*currency.DisplayMultiplier, 'f', -1, 64) + " " + currency.Name
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"net/http"
+	"sort"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/jmoiron/sqlx"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultTrendingWindow    = 10 * time.Minute
+	trendingBucketSize       = 1 * time.Minute
+	defaultTrendingListLimit = 20
+)
+
+// ライブ配信ごとの、分単位のアクティビティ数 (バケットの開始時刻(unix秒) → 件数)
+// イベントハブに流れるコメント・リアクションのイベントから数えるのでDBは見ない
+var (
+	ActivityBucketsByLivestreamIDCache      = make(map[LivestreamID]map[int64]int64)
+	ActivityBucketsByLivestreamIDCacheMutex = sync.Mutex{}
+)
+
+func init() {
+	registerCacheReset(func() {
+		ActivityBucketsByLivestreamIDCacheMutex.Lock()
+		ActivityBucketsByLivestreamIDCache = make(map[LivestreamID]map[int64]int64)
+		ActivityBucketsByLivestreamIDCacheMutex.Unlock()
+	})
+}
+
+type TrendingLivestream struct {
+	Livestream Livestream `json:"livestream"`
+	// 直近TrendingWindow内のリアクション数+コメント数
+	Activity int64 `json:"activity"`
+}
+
+func recordLivestreamActivity(livestreamID LivestreamID, event LivestreamEvent) {
+	if event.Type != livestreamEventLivecomment && event.Type != livestreamEventReaction {
+		return
+	}
+
+	bucket := time.Now().Truncate(trendingBucketSize).Unix()
+
+	ActivityBucketsByLivestreamIDCacheMutex.Lock()
+	defer ActivityBucketsByLivestreamIDCacheMutex.Unlock()
+
+	buckets, ok := ActivityBucketsByLivestreamIDCache[livestreamID]
+	if !ok {
+		buckets = make(map[int64]int64)
+		ActivityBucketsByLivestreamIDCache[livestreamID] = buckets
+	}
+	buckets[bucket]++
+}
+
+// 窓から外れたバケットを捨てつつ、配信ごとの直近のアクティビティ数を返す
+func getRecentActivityCounts(now time.Time) map[LivestreamID]int64 {
+	oldest := now.Add(-currentTunables().TrendingWindow).Truncate(trendingBucketSize).Unix()
+
+	ActivityBucketsByLivestreamIDCacheMutex.Lock()
+	defer ActivityBucketsByLivestreamIDCacheMutex.Unlock()
+
+	counts := make(map[LivestreamID]int64, len(ActivityBucketsByLivestreamIDCache))
+	for livestreamID, buckets := range ActivityBucketsByLivestreamIDCache {
+		var total int64
+		for bucket, n := range buckets {
+			if bucket < oldest {
+				delete(buckets, bucket)
+				continue
+			}
+			total += n
+		}
+		if len(buckets) == 0 {
+			delete(ActivityBucketsByLivestreamIDCache, livestreamID)
+			continue
+		}
+		counts[livestreamID] = total
+	}
+
+	return counts
+}
+
+// 直近の勢いがある配信一覧API
+// GET /api/livestream/trending
+func getTrendingLivestreamsHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	limit := defaultTrendingListLimit
+	if c.QueryParam("limit") != "" {
+		l, err := strconv.Atoi(c.QueryParam("limit"))
+		if err != nil || l <= 0 {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "limit query parameter must be positive integer")
+		}
+		limit = l
+	}
+
+	counts := getRecentActivityCounts(time.Now())
+	livestreamIDs := make([]LivestreamID, 0, len(counts))
+	for livestreamID := range counts {
+		livestreamIDs = append(livestreamIDs, livestreamID)
+	}
+	// アクティビティ降順、同数なら新しい配信を先にする
+	sort.Slice(livestreamIDs, func(i, j int) bool {
+		if counts[livestreamIDs[i]] != counts[livestreamIDs[j]] {
+			return counts[livestreamIDs[i]] > counts[livestreamIDs[j]]
+		}
+		return livestreamIDs[i] > livestreamIDs[j]
+	})
+	if len(livestreamIDs) > limit {
+		livestreamIDs = livestreamIDs[:limit]
+	}
+
+	if len(livestreamIDs) == 0 {
+		return c.JSON(http.StatusOK, []TrendingLivestream{})
+	}
+
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	query, args, err := sqlx.In("SELECT * FROM livestreams WHERE id IN (?)", livestreamIDs)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to build query: "+err.Error())
+	}
+	var livestreamModels []*LivestreamModel
+	if err := tx.SelectContext(ctx, &livestreamModels, tx.Rebind(query), args...); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestreams: "+err.Error())
+	}
+	livestreams, err := fillLivestreamResponseBulk(ctx, tx, livestreamModels)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill livestreams: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	livestreamMap := make(map[LivestreamID]Livestream, len(livestreams))
+	for _, livestream := range livestreams {
+		livestreamMap[livestream.ID] = livestream
+	}
+	trending := make([]TrendingLivestream, 0, len(livestreamIDs))
+	for _, livestreamID := range livestreamIDs {
+		// 集計後に削除された配信は除く
+		livestream, ok := livestreamMap[livestreamID]
+		if !ok {
+			continue
+		}
+		trending = append(trending, TrendingLivestream{
+			Livestream: livestream,
+			Activity:   counts[livestreamID],
+		})
+	}
+
+	return c.JSON(http.StatusOK, trending)
+}
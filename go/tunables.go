@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"log"
+	"os"
+	"os/signal"
+	"strings"
+	"sync/atomic"
+	"syscall"
+
+	"github.com/labstack/echo/v4"
+	echolog "github.com/labstack/gommon/log"
+	"golang.org/x/time/rate"
+)
+
+var tunables atomic.Pointer[Tunables]
+
+func init() {
+	// 設定を読み込む前 (initなど) に参照されてもデフォルト値を返す
+	tunables.Store(&Tunables{
+		LogLevel:                 echolog.ERROR,
+		ReactionRateLimit:        defaultReactionRateLimit,
+		ReactionRateBurst:        defaultReactionRateBurst,
+		ViewerHeartbeatTTL:       defaultViewerHeartbeatTTL,
+		TrendingWindow:           defaultTrendingWindow,
+		RankingSnapshotTTL:       defaultRankingSnapshotTTL,
+		ReservationSlotsCacheTTL: defaultReservationSlotsCacheTTL,
+		TipCurrency:              defaultTipCurrency,
+		NGWordMuteThreshold:      defaultNGWordMuteThreshold,
+		NGWordMuteDuration:       defaultNGWordMuteDuration,
+		PasswordPolicy: PasswordPolicy{
+			MinLength:      defaultPasswordMinLength,
+			MinCharClasses: defaultPasswordMinCharClasses,
+		},
+	})
+}
+
+// 1つのリクエスト内では同じ値を使えるよう、まとめて取得する
+func currentTunables() *Tunables {
+	return tunables.Load()
+}
+
+func applyTunables(e *echo.Echo, t Tunables) {
+	old := tunables.Swap(&t)
+	e.Logger.SetLevel(t.LogLevel)
+
+	// 作成済みのリミッタには新しいレートが反映されないので作り直させる
+	if old.ReactionRateLimit != t.ReactionRateLimit || old.ReactionRateBurst != t.ReactionRateBurst {
+		ReactionLimiterByKeyCacheMutex.Lock()
+		ReactionLimiterByKeyCache = make(map[reactionLimiterKey]*rate.Limiter)
+		ReactionLimiterByKeyCacheMutex.Unlock()
+	}
+}
+
+// SIGHUPでenvファイルを読み直し、再起動せずに変えられる設定だけを反映する
+// 起動後にプロセスの環境変数は外から変えられないので、systemdのEnvironmentFileと同じファイルを読む
+// ファイルから消えたキーは環境変数からも消し、デフォルト値に戻す
+// 読み直した設定が不正なら何も変えない
+func runConfigReloader(e *echo.Echo, envFilePath string) {
+	// 起動時の環境変数はsystemdが同じファイルから設定している
+	fileValues, err := readEnvFile(envFilePath)
+	if err != nil && !errors.Is(err, os.ErrNotExist) {
+		log.Printf("failed to read %s: %v", envFilePath, err)
+	}
+
+	sig := make(chan os.Signal, 1)
+	signal.Notify(sig, syscall.SIGHUP)
+	for range sig {
+		values, err := readEnvFile(envFilePath)
+		if err != nil {
+			log.Printf("failed to read %s: %v", envFilePath, err)
+			continue
+		}
+		restore := applyEnvFile(fileValues, values)
+		cfg, err := loadConfig()
+		if err != nil {
+			restore()
+			log.Printf("failed to reload config: %v", err)
+			continue
+		}
+		fileValues = values
+		applyTunables(e, cfg.Tunables)
+		log.Printf("reloaded config: %+v", cfg.Tunables)
+	}
+}
+
+// 前回のファイルの内容からの差分を環境変数に反映し、元に戻す関数を返す
+func applyEnvFile(prev map[string]string, next map[string]string) func() {
+	saved := make(map[string]*string, len(prev)+len(next))
+	save := func(key string) {
+		if _, ok := saved[key]; ok {
+			return
+		}
+		if v, ok := os.LookupEnv(key); ok {
+			saved[key] = &v
+		} else {
+			saved[key] = nil
+		}
+	}
+
+	for key := range prev {
+		if _, ok := next[key]; !ok {
+			save(key)
+			os.Unsetenv(key)
+		}
+	}
+	for key, value := range next {
+		save(key)
+		os.Setenv(key, value)
+	}
+
+	return func() {
+		for key, v := range saved {
+			if v == nil {
+				os.Unsetenv(key)
+			} else {
+				os.Setenv(key, *v)
+			}
+		}
+	}
+}
+
+// KEY=VALUE (export付きも可) の行を読む
+func readEnvFile(path string) (map[string]string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+
+	values := make(map[string]string)
+	scanner := bufio.NewScanner(f)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		line = strings.TrimPrefix(line, "export ")
+		key, value, ok := strings.Cut(line, "=")
+		if !ok {
+			continue
+		}
+		values[strings.TrimSpace(key)] = strings.Trim(strings.TrimSpace(value), `"'`)
+	}
+	if err := scanner.Err(); err != nil {
+		return nil, err
+	}
+	return values, nil
+}
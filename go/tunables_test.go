@@ -0,0 +1,48 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestApplyEnvFileUnsetsRemovedKeys(t *testing.T) {
+	// t.Setenvで終了時に元に戻す
+	t.Setenv("ISUTEST_KEPT", "1")
+	t.Setenv("ISUTEST_REMOVED", "2")
+	t.Setenv("ISUTEST_ADDED", "")
+	os.Unsetenv("ISUTEST_ADDED")
+
+	path := filepath.Join(t.TempDir(), "env.sh")
+	if err := os.WriteFile(path, []byte("# comment\nexport ISUTEST_KEPT=\"10\"\nISUTEST_ADDED=3\n"), 0o644); err != nil {
+		t.Fatal(err)
+	}
+	next, err := readEnvFile(path)
+	if err != nil {
+		t.Fatalf("readEnvFile: %v", err)
+	}
+
+	prev := map[string]string{"ISUTEST_KEPT": "1", "ISUTEST_REMOVED": "2"}
+	restore := applyEnvFile(prev, next)
+	if v := os.Getenv("ISUTEST_KEPT"); v != "10" {
+		t.Errorf("ISUTEST_KEPT = %q, want 10", v)
+	}
+	if v := os.Getenv("ISUTEST_ADDED"); v != "3" {
+		t.Errorf("ISUTEST_ADDED = %q, want 3", v)
+	}
+	if _, ok := os.LookupEnv("ISUTEST_REMOVED"); ok {
+		t.Error("removed key is still set")
+	}
+
+	// 設定が不正だった場合は元に戻す
+	restore()
+	if v := os.Getenv("ISUTEST_KEPT"); v != "1" {
+		t.Errorf("restored ISUTEST_KEPT = %q, want 1", v)
+	}
+	if v := os.Getenv("ISUTEST_REMOVED"); v != "2" {
+		t.Errorf("restored ISUTEST_REMOVED = %q, want 2", v)
+	}
+	if _, ok := os.LookupEnv("ISUTEST_ADDED"); ok {
+		t.Error("added key is still set after restore")
+	}
+}
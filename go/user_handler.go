@@ -2,19 +2,15 @@ package main
 
 import (
 	"context"
-	"crypto/sha256"
 	"database/sql"
-	"encoding/json"
 	"errors"
-	"fmt"
+	"log"
 	"net/http"
-	"os"
+	"strconv"
 	"strings"
 	"time"
 
-	"github.com/google/uuid"
 	"github.com/gorilla/sessions"
-	"github.com/jmoiron/sqlx"
 	"github.com/labstack/echo-contrib/session"
 	"github.com/labstack/echo/v4"
 	"golang.org/x/crypto/bcrypt"
@@ -28,42 +24,95 @@ const (
 	bcryptDefaultCost        = bcrypt.MinCost
 )
 
+// ユーザごとに残すアイコンの数 (有効なものを含む)
+const maxIconHistoryPerUser = 5
+
+// GET /api/usersで一度に引けるユーザ数
+const maxUsersPerLookup = 100
+
+// GET /api/user/:username の組み立てをまとめる
+var userProfileFlight flightGroup
+
 var fallbackImage = "../img/NoImage.jpg"
 
 type UserModel struct {
-	ID             int64  `db:"id"`
+	ID             UserID `db:"id"`
 	Name           string `db:"name"`
 	DisplayName    string `db:"display_name"`
 	Description    string `db:"description"`
 	HashedPassword string `db:"password"`
+	FollowersCount int64  `db:"followers_count"`
 }
 
 type User struct {
-	ID          int64  `json:"id"`
+	ID          UserID `json:"id"`
 	Name        string `json:"name"`
 	DisplayName string `json:"display_name,omitempty"`
 	Description string `json:"description,omitempty"`
 	Theme       Theme  `json:"theme,omitempty"`
 	IconHash    string `json:"icon_hash,omitempty"`
+	// フォロワー数
+	FollowersCount int64 `json:"followers_count"`
+}
+
+// 自分のユーザ情報。他のユーザには見せない項目を足す
+type MeResponse struct {
+	User
+	// 一度もログインしていなければ含めない
+	LastLoginAt *int64 `json:"last_login_at,omitempty"`
+}
+
+type ChangePasswordRequest struct {
+	CurrentPassword string `json:"current_password" validate:"required"`
+	// 強度はパスワードポリシーで検査する
+	NewPassword string `json:"new_password" validate:"required,max=72"`
+}
+
+type UpdateUsernameRequest struct {
+	// 文字種はvalidateUsernameで検査する
+	Name string `json:"name" validate:"required,max=63"`
+}
+
+type UserSummary struct {
+	Username        string `json:"username"`
+	FollowersCount  int64  `json:"followers_count"`
+	TotalLivestream int64  `json:"total_livestreams"`
+	TotalTip        int64  `json:"total_tip"`
+	Rank            int64  `json:"rank"`
 }
 
 type Theme struct {
 	ID       int64 `json:"id"`
 	DarkMode bool  `json:"dark_mode"`
+	// #rrggbb。空ならフロントエンドのデフォルト
+	AccentColor string `json:"accent_color"`
+	// small, medium, large
+	FontSize string `json:"font_size"`
 }
 
 type ThemeModel struct {
-	ID       int64 `db:"id"`
-	UserID   int64 `db:"user_id"`
-	DarkMode bool  `db:"dark_mode"`
+	ID          int64  `db:"id"`
+	UserID      UserID `db:"user_id"`
+	DarkMode    bool   `db:"dark_mode"`
+	AccentColor string `db:"accent_color"`
+	FontSize    string `db:"font_size"`
+}
+
+// 省略した項目は変えない
+type PatchThemeRequest struct {
+	DarkMode    *bool   `json:"dark_mode"`
+	AccentColor *string `json:"accent_color"`
+	FontSize    *string `json:"font_size"`
 }
 
 type PostUserRequest struct {
-	Name        string `json:"name"`
-	DisplayName string `json:"display_name"`
-	Description string `json:"description"`
+	// <name>.u.isucon.localのDNSラベルになるので63文字まで。文字種はvalidateUsernameで検査する
+	Name        string `json:"name" validate:"required,max=63"`
+	DisplayName string `json:"display_name" validate:"max=255"`
+	Description string `json:"description" validate:"max=1000"`
 	// Password is non-hashed password.
-	Password string               `json:"password"`
+	// bcryptは72バイトより長いパスワードを扱えない
+	Password string               `json:"password" validate:"required,max=72"`
 	Theme    PostUserRequestTheme `json:"theme"`
 }
 
@@ -72,9 +121,9 @@ type PostUserRequestTheme struct {
 }
 
 type LoginRequest struct {
-	Username string `json:"username"`
+	Username string `json:"username" validate:"required"`
 	// Password is non-hashed password.
-	Password string `json:"password"`
+	Password string `json:"password" validate:"required"`
 }
 
 type PostIconRequest struct {
@@ -85,7 +134,13 @@ type PostIconResponse struct {
 	ID int64 `json:"id"`
 }
 
-func getIconHandler(c echo.Context) error {
+type IconHistoryEntry struct {
+	ID       int64  `json:"id"`
+	IconHash string `json:"icon_hash"`
+	Active   bool   `json:"active"`
+}
+
+func (app *App) getIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
 	username := c.Param("username")
@@ -94,30 +149,33 @@ func getIconHandler(c echo.Context) error {
 
 	if ifNoneMatch != "" {
 		trimmedIfNoneMatch := ifNoneMatch[1 : len(ifNoneMatch)-1]
-		IconHashByUsernameCacheMutex.RLock()
-		if hash, ok := IconHashByUsernameCache[username]; ok && hash == trimmedIfNoneMatch {
-			IconHashByUsernameCacheMutex.RUnlock()
+		if hash, ok := app.icons.CachedHashByUsername(username); ok && hash == trimmedIfNoneMatch {
 			return c.NoContent(http.StatusNotModified)
 		}
-		IconHashByUsernameCacheMutex.RUnlock()
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	// 304で返せるリクエストには枠を使わせず、DBを引く場合だけ数える
+	if !iconInFlight.tryAcquire() {
+		return inFlightBusyError(c)
+	}
+	defer iconInFlight.release()
+
+	tx, err := app.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	var user UserModel
-	if err := tx.GetContext(ctx, &user, "SELECT * FROM users WHERE name = ?", username); err != nil {
+	user, err := app.users.GetByName(ctx, tx, username)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
+			return newCodedHTTPError(http.StatusNotFound, errorCodeUserNotFound, "not found user that has the given username")
 		}
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	var image []byte
-	if err := tx.GetContext(ctx, &image, "SELECT image FROM icons WHERE user_id = ?", user.ID); err != nil {
+	image, err := app.icons.GetActiveImage(ctx, tx, user.ID)
+	if err != nil {
 		if errors.Is(err, sql.ErrNoRows) {
 			return c.File(fallbackImage)
 		} else {
@@ -125,21 +183,15 @@ func getIconHandler(c echo.Context) error {
 		}
 	}
 
-	hash := fmt.Sprintf("%x", sha256.Sum256(image))
-	IconHashByUsernameCacheMutex.Lock()
-	IconHashByUsernameCache[username] = hash
-	IconHashByUsernameCacheMutex.Unlock()
-	IconHashByUserIDCacheMutex.Lock()
-	IconHashByUserIDCache[user.ID] = hash
-	IconHashByUserIDCacheMutex.Unlock()
+	app.icons.SetActiveHash(user.ID, username, app.icons.Hash(image))
 
 	return c.Blob(http.StatusOK, "image/jpeg", image)
 }
 
-func postIconHandler(c echo.Context) error {
+func (app *App) postIconHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	if err := app.verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
@@ -147,52 +199,132 @@ func postIconHandler(c echo.Context) error {
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
 
 	var req *PostIconRequest
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	if err := decodeJSONBody(c, &req); err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidJSON, "failed to decode the request body as json")
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := app.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	if _, err := tx.ExecContext(ctx, "DELETE FROM icons WHERE user_id = ?", userID); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete old user icon: "+err.Error())
-	}
-
-	rs, err := tx.ExecContext(ctx, "INSERT INTO icons (user_id, image) VALUES (?, ?)", userID, req.Image)
+	username, err := app.users.GetNameByID(ctx, tx, userID)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert new user icon: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	iconID, err := rs.LastInsertId()
+	iconID, err := app.icons.Upsert(ctx, tx, userID, req.Image)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted icon id: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	UserByIDCacheMutex.Lock()
-	delete(UserByIDCache, userID)
-	UserByIDCacheMutex.Unlock()
-	deleteLivestreamByIDCacheByOwnerID(userID)
-	deleteLivecommentByIDCacheByOwnerID(userID)
+	app.icons.SetActiveHash(userID, username, app.icons.Hash(req.Image))
+	invalidateUserCaches(userID)
 
 	return c.JSON(http.StatusCreated, &PostIconResponse{
 		ID: iconID,
 	})
 }
 
-func getMeHandler(c echo.Context) error {
+// 自分のアイコン履歴API (新しい順)
+// GET /api/user/me/icons
+func (app *App) getIconHistoryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := app.verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	icons, err := app.icons.ListByUserID(ctx, app.db, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icons: "+err.Error())
+	}
+
+	history := make([]IconHistoryEntry, len(icons))
+	for i, icon := range icons {
+		history[i] = IconHistoryEntry{
+			ID:       icon.ID,
+			IconHash: app.icons.Hash(icon.Image),
+			Active:   icon.IsActive,
+		}
+	}
+
+	return c.JSON(http.StatusOK, history)
+}
+
+// 過去のアイコンに戻すAPI
+// POST /api/user/me/icons/:icon_id/activate
+func (app *App) activateIconHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := app.verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	iconID, err := strconv.Atoi(c.Param("icon_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "icon_id in path must be integer")
+	}
+
+	tx, err := app.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	username, err := app.users.GetNameByID(ctx, tx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+
+	image, err := app.icons.GetImage(ctx, tx, userID, int64(iconID))
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return echo.NewHTTPError(http.StatusNotFound, "icon not found")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user icon: "+err.Error())
+	}
+
+	if err := app.icons.Activate(ctx, tx, userID, int64(iconID)); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to activate user icon: "+err.Error())
+	}
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	app.icons.SetActiveHash(userID, username, app.icons.Hash(image))
+	invalidateUserCaches(userID)
+
+	return c.JSON(http.StatusOK, &PostIconResponse{
+		ID: int64(iconID),
+	})
+}
+
+func (app *App) getMeHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 
-	if err := verifyUserSession(c); err != nil {
+	if err := app.verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
@@ -200,172 +332,173 @@ func getMeHandler(c echo.Context) error {
 	// error already checked
 	sess, _ := session.Get(defaultSessionIDKey, c)
 	// existence already checked
-	userID := sess.Values[defaultUserIDKey].(int64)
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	tx, err := app.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	userModel := UserModel{}
-	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE id = ?", userID)
+	userModel, err := app.users.GetByID(ctx, tx, userID)
 	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusNotFound, "not found user that has the userid in session")
+		return newCodedHTTPError(http.StatusNotFound, errorCodeUserNotFound, "not found user that has the userid in session")
 	}
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
 	}
 
-	user, err := fillUserResponse(ctx, tx, userModel)
+	user, err := app.users.Fill(ctx, tx, userModel)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
 	}
 
+	res := MeResponse{User: user}
+	lastLoginAt, err := app.users.GetLastLoginAt(ctx, tx, userID)
+	if err != nil && !errors.Is(err, sql.ErrNoRows) {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last login: "+err.Error())
+	}
+	if err == nil {
+		res.LastLoginAt = &lastLoginAt
+	}
+
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, user)
+	return c.JSON(http.StatusOK, res)
 }
 
 // ユーザ登録API
 // POST /api/register
-func registerHandler(c echo.Context) error {
+func (app *App) registerHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
 	req := PostUserRequest{}
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
-	}
-
-	if req.Name == "pipe" {
-		return echo.NewHTTPError(http.StatusBadRequest, "the username 'pipe' is reserved")
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 
-	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptDefaultCost)
+	user, err := app.userService.Register(ctx, req)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate hashed password: "+err.Error())
+		return serviceHTTPError(err)
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	return c.JSON(http.StatusCreated, user)
+}
+
+// ユーザ名変更API
+// PATCH /api/user/me/name
+func (app *App) updateUsernameHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	if err := app.verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
 	}
-	defer tx.Rollback()
 
-	userModel := UserModel{
-		Name:           req.Name,
-		DisplayName:    req.DisplayName,
-		Description:    req.Description,
-		HashedPassword: string(hashedPassword),
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	var req UpdateUsernameRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 
-	result, err := tx.NamedExecContext(ctx, "INSERT INTO users (name, display_name, description, password) VALUES(:name, :display_name, :description, :password)", userModel)
+	user, err := app.userService.UpdateName(ctx, userID, req.Name)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user: "+err.Error())
+		return serviceHTTPError(err)
 	}
 
-	userID, err := result.LastInsertId()
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted user id: "+err.Error())
+	// セッションに保持しているユーザ名も差し替える
+	sess.Values[defaultUsernameKey] = req.Name
+	if err := sess.Save(c.Request(), c.Response()); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
 	}
 
-	userModel.ID = userID
+	return c.JSON(http.StatusOK, user)
+}
 
-	themeModel := ThemeModel{
-		UserID:   userID,
-		DarkMode: req.Theme.DarkMode,
-	}
-	if _, err := tx.NamedExecContext(ctx, "INSERT INTO themes (user_id, dark_mode) VALUES(:user_id, :dark_mode)", themeModel); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert user theme: "+err.Error())
-	}
+// パスワード変更API
+// PATCH /api/user/me/password
+func (app *App) changePasswordHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
 
-	// post request to powerdns
-	{
-		endpoint := "http://192.168.0.4:8081/api/v1/servers/localhost/zones/u.isucon.local."
-		body := fmt.Sprintf(`{"rrsets": [{"name": "%s.u.isucon.local.", "type": "A", "ttl": 3600, "changetype": "REPLACE", "records": [{"content": "%s", "disabled": false}]}]}`, req.Name, powerDNSSubdomainAddress)
-		req, err := http.NewRequest(http.MethodPatch, endpoint, strings.NewReader(body))
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to create request to powerdns: "+err.Error())
-		}
-		req.Header.Set("X-API-Key", "isudns")
-		req.Header.Set("Content-Type", "application/json")
-		client := &http.Client{}
-		resp, err := client.Do(req)
-		if err != nil {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to request to powerdns: "+err.Error())
-		}
-		defer resp.Body.Close()
-		if resp.StatusCode != http.StatusNoContent {
-			return echo.NewHTTPError(http.StatusInternalServerError, "failed to request to powerdns: status code is not 204")
-		}
+	if err := app.verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
 	}
-	// if out, err := exec.Command("pdnsutil", "add-record", "u.isucon.dev", req.Name, "A", "3600", powerDNSSubdomainAddress).CombinedOutput(); err != nil {
-	// 	return echo.NewHTTPError(http.StatusInternalServerError, string(out)+": "+err.Error())
-	// }
 
-	user, err := fillUserResponse(ctx, tx, userModel)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
-	}
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	var req ChangePasswordRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
 
-	UserByIDCacheMutex.Lock()
-	delete(UserByIDCache, userID)
-	UserByIDCacheMutex.Unlock()
-	deleteLivestreamByIDCacheByOwnerID(userID)
-	deleteLivecommentByIDCacheByOwnerID(userID)
+	if err := app.userService.ChangePassword(ctx, userID, req.CurrentPassword, req.NewPassword); err != nil {
+		return serviceHTTPError(err)
+	}
 
-	return c.JSON(http.StatusCreated, user)
+	return c.NoContent(http.StatusNoContent)
 }
 
-// ユーザログインAPI
-// POST /api/login
-func loginHandler(c echo.Context) error {
+// テーマ変更API
+// PATCH /api/user/me/theme
+func (app *App) patchThemeHandler(c echo.Context) error {
 	ctx := c.Request().Context()
 	defer c.Request().Body.Close()
 
-	req := LoginRequest{}
-	if err := json.NewDecoder(c.Request().Body).Decode(&req); err != nil {
-		return echo.NewHTTPError(http.StatusBadRequest, "failed to decode the request body as json")
+	if err := app.verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
 	}
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
-	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
-	}
-	defer tx.Rollback()
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
 
-	userModel := UserModel{}
-	// usernameはUNIQUEなので、whereで一意に特定できる
-	err = tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", req.Username)
-	if errors.Is(err, sql.ErrNoRows) {
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+	var req PatchThemeRequest
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
+
+	theme, err := app.userService.UpdateTheme(ctx, userID, req)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		return serviceHTTPError(err)
 	}
 
-	if err := tx.Commit(); err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
-	}
+	return c.JSON(http.StatusOK, theme)
+}
 
-	err = bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(req.Password))
-	if err == bcrypt.ErrMismatchedHashAndPassword {
-		return echo.NewHTTPError(http.StatusUnauthorized, "invalid username or password")
+// ユーザログインAPI
+// POST /api/login
+func (app *App) loginHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	defer c.Request().Body.Close()
+
+	req := LoginRequest{}
+	if err := bindRequest(c, &req); err != nil {
+		return err
 	}
+
+	userModel, err := app.userService.Authenticate(ctx, req.Username, req.Password)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to compare hash and password: "+err.Error())
+		return serviceHTTPError(err)
 	}
 
-	sessionEndAt := time.Now().Add(1 * time.Hour)
+	sessionEndAt := app.clock.Now().Add(1 * time.Hour)
 
-	sessionID := uuid.NewString()
+	sessionID := app.ids.NewString()
 
 	sess, err := session.Get(defaultSessionIDKey, c)
 	if err != nil {
@@ -378,7 +511,7 @@ func loginHandler(c echo.Context) error {
 		Path:   "/",
 	}
 	sess.Values[defaultSessionIDKey] = sessionID
-	sess.Values[defaultUserIDKey] = userModel.ID
+	sess.Values[defaultUserIDKey] = int64(userModel.ID)
 	sess.Values[defaultUsernameKey] = userModel.Name
 	sess.Values[defaultSessionExpiresKey] = sessionEndAt.Unix()
 
@@ -386,47 +519,187 @@ func loginHandler(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to save session: "+err.Error())
 	}
 
+	// ログインのレスポンスを待たせない
+	loggedInAt := app.clock.Now().Unix()
+	go func() {
+		if err := app.users.RecordLogin(context.Background(), app.db, userModel.ID, loggedInAt); err != nil {
+			log.Printf("failed to record last login of user %d: %v", userModel.ID, err)
+		}
+	}()
+
 	return c.NoContent(http.StatusOK)
 }
 
 // ユーザ詳細API
 // GET /api/user/:username
-func getUserHandler(c echo.Context) error {
+func (app *App) getUserHandler(c echo.Context) error {
 	ctx := c.Request().Context()
-	if err := verifyUserSession(c); err != nil {
+	if err := app.verifyUserSession(c); err != nil {
 		// echo.NewHTTPErrorが返っているのでそのまま出力
 		return err
 	}
 
 	username := c.Param("username")
 
-	tx, err := dbConn.BeginTxx(ctx, nil)
+	// 同じ配信者のプロフィールにアクセスが集中しても、組み立てるのは1回で済ませる
+	// 最初のリクエストが切断されても待っている側は続けられるようにする
+	flightCtx := context.WithoutCancel(ctx)
+	v, err := userProfileFlight.Do("name:"+username, func() (interface{}, error) {
+		return app.users.GetIDByName(flightCtx, app.db, username)
+	})
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newCodedHTTPError(http.StatusNotFound, errorCodeUserNotFound, "not found user that has the given username")
+		}
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	}
+	userID := v.(UserID)
+
+	// ユーザ情報を読む前にバージョンを取る。更新後に来たリクエストは別のキーになる
+	etag := userETag(userID)
+	if notModified(c, etag) {
+		return c.NoContent(http.StatusNotModified)
+	}
+
+	v, err = userProfileFlight.Do("profile:"+etag, func() (interface{}, error) {
+		userModel, err := app.users.GetByID(flightCtx, app.db, userID)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return nil, newCodedHTTPError(http.StatusNotFound, errorCodeUserNotFound, "not found user that has the given username")
+			}
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+		user, err := app.users.Fill(flightCtx, app.db, userModel)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		}
+		body, err := marshalJSON(user)
+		if err != nil {
+			return nil, echo.NewHTTPError(http.StatusInternalServerError, "failed to encode user: "+err.Error())
+		}
+		return body, nil
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.JSONBlob(http.StatusOK, v.([]byte))
+}
+
+// コメント一覧などで複数のユーザをまとめて取得する。見つからないユーザは結果に含めない
+// GET /api/users?names=a,b,c または ?ids=1,2,3
+func (app *App) getUsersHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := app.verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	names := splitQueryList(c.QueryParam("names"))
+	rawIDs := splitQueryList(c.QueryParam("ids"))
+	if (len(names) == 0) == (len(rawIDs) == 0) {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "exactly one of names or ids is required")
+	}
+	if len(names) > maxUsersPerLookup || len(rawIDs) > maxUsersPerLookup {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "too many users are requested")
+	}
+	ids := make([]UserID, 0, len(rawIDs))
+	for _, rawID := range rawIDs {
+		id, err := strconv.ParseInt(rawID, 10, 64)
+		if err != nil {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "ids must be integers")
+		}
+		ids = append(ids, UserID(id))
+	}
+
+	sel, err := parseFieldSelection(c, User{})
+	if err != nil {
+		return err
+	}
+
+	tx, err := app.db.BeginTxx(ctx, nil)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
 	}
 	defer tx.Rollback()
 
-	userModel := UserModel{}
-	if err := tx.GetContext(ctx, &userModel, "SELECT * FROM users WHERE name = ?", username); err != nil {
-		if errors.Is(err, sql.ErrNoRows) {
-			return echo.NewHTTPError(http.StatusNotFound, "not found user that has the given username")
-		}
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+	var userModels []*UserModel
+	if len(names) > 0 {
+		userModels, err = app.users.ListByNames(ctx, tx, names)
+	} else {
+		userModels, err = app.users.ListByIDs(ctx, tx, ids)
+	}
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get users: "+err.Error())
 	}
 
-	user, err := fillUserResponse(ctx, tx, userModel)
+	filled, err := fillUsersSelected(ctx, tx, app.users, userModels, sel)
 	if err != nil {
-		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill user: "+err.Error())
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to fill users: "+err.Error())
 	}
 
 	if err := tx.Commit(); err != nil {
 		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
 	}
 
-	return c.JSON(http.StatusOK, user)
+	// リクエストされた順に並べる
+	users := make([]User, 0, len(filled))
+	if len(names) > 0 {
+		byName := make(map[string]User, len(filled))
+		for _, user := range filled {
+			byName[user.Name] = user
+		}
+		for _, name := range names {
+			if user, ok := byName[name]; ok {
+				users = append(users, user)
+			}
+		}
+	} else {
+		byID := make(map[UserID]User, len(filled))
+		for _, user := range filled {
+			byID[user.ID] = user
+		}
+		for _, id := range ids {
+			if user, ok := byID[id]; ok {
+				users = append(users, user)
+			}
+		}
+	}
+
+	return respondFieldSelected(c, http.StatusOK, users, sel)
+}
+
+// カンマ区切りのクエリパラメータを空要素と重複を除いて分割する
+func splitQueryList(s string) []string {
+	if s == "" {
+		return nil
+	}
+	items := []string{}
+	seen := make(map[string]struct{})
+	for _, item := range strings.Split(s, ",") {
+		item = strings.TrimSpace(item)
+		if item == "" {
+			continue
+		}
+		if _, ok := seen[item]; ok {
+			continue
+		}
+		seen[item] = struct{}{}
+		items = append(items, item)
+	}
+	return items
 }
 
 func verifyUserSession(c echo.Context) error {
+	return verifyUserSessionAt(c, time.Now())
+}
+
+// Appに移したハンドラはAppの時計で有効期限を判定する
+func (app *App) verifyUserSession(c echo.Context) error {
+	return verifyUserSessionAt(c, app.clock.Now())
+}
+
+func verifyUserSessionAt(c echo.Context, now time.Time) error {
 	sess, err := session.Get(defaultSessionIDKey, c)
 	if err != nil {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get session")
@@ -442,193 +715,57 @@ func verifyUserSession(c echo.Context) error {
 		return echo.NewHTTPError(http.StatusUnauthorized, "failed to get USERID value from session")
 	}
 
-	now := time.Now()
 	if now.Unix() > sessionExpires.(int64) {
-		return echo.NewHTTPError(http.StatusUnauthorized, "session has expired")
+		return newCodedHTTPError(http.StatusUnauthorized, errorCodeSessionExpired, "session has expired")
 	}
 
 	return nil
 }
 
-func fillUserResponse(ctx context.Context, tx *sqlx.Tx, userModel UserModel) (User, error) {
-	UserByIDCacheMutex.RLock()
-	if user, ok := UserByIDCache[userModel.ID]; ok {
-		UserByIDCacheMutex.RUnlock()
-		return user, nil
-	}
-	UserByIDCacheMutex.RUnlock()
+// プロフィールページ向けの集計値。ログイン不要で毎回呼ばれる想定なのでランキングのスナップショットから返す
+// GET /api/user/:username/summary
+func (app *App) getUserSummaryHandler(c echo.Context) error {
+	ctx := c.Request().Context()
 
-	themeModel := ThemeModel{}
-	if err := tx.GetContext(ctx, &themeModel, "SELECT * FROM themes WHERE user_id = ?", userModel.ID); err != nil {
-		return User{}, err
-	}
+	username := c.Param("username")
 
-	IconHashByUserIDCacheMutex.RLock()
-	hashStr, ok := IconHashByUserIDCache[userModel.ID]
-	IconHashByUserIDCacheMutex.RUnlock()
+	snapshot, err := getUserRankingSnapshot(ctx)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user ranking: "+err.Error())
+	}
 
-	var image []byte
-	isFallbackImage := false
+	stats, ok := snapshot.StatsByUsername[username]
 	if !ok {
-		if err := tx.GetContext(ctx, &image, "SELECT image FROM icons WHERE user_id = ?", userModel.ID); err != nil {
-			if !errors.Is(err, sql.ErrNoRows) {
-				return User{}, err
-			}
-			image, err = os.ReadFile(fallbackImage)
-			if err != nil {
-				return User{}, err
+		// スナップショット作成後に登録されたユーザは集計値0で最下位として扱う
+		userID, err := app.users.GetIDByName(ctx, app.db, username)
+		if err != nil {
+			if errors.Is(err, sql.ErrNoRows) {
+				return newCodedHTTPError(http.StatusNotFound, errorCodeUserNotFound, "user not found")
 			}
-			isFallbackImage = true
+			return echo.NewHTTPError(http.StatusInternalServerError, "failed to get user: "+err.Error())
+		}
+		stats = &UserSummaryStats{
+			UserID:   userID,
+			Username: username,
+			Rank:     int64(len(snapshot.StatsByUsername) + 1),
 		}
-		hashStr = fmt.Sprintf("%x", sha256.Sum256(image))
-	}
-
-	if !isFallbackImage {
-		IconHashByUserIDCacheMutex.Lock()
-		IconHashByUserIDCache[userModel.ID] = hashStr
-		IconHashByUserIDCacheMutex.Unlock()
 	}
 
-	user := User{
-		ID:          userModel.ID,
-		Name:        userModel.Name,
-		DisplayName: userModel.DisplayName,
-		Description: userModel.Description,
-		Theme: Theme{
-			ID:       themeModel.ID,
-			DarkMode: themeModel.DarkMode,
-		},
-		IconHash: hashStr,
-	}
+	return c.JSON(http.StatusOK, UserSummary{
+		Username:        stats.Username,
+		FollowersCount:  stats.FollowersCount,
+		TotalLivestream: stats.TotalLivestream,
+		TotalTip:        stats.TotalTip,
+		Rank:            stats.Rank,
+	})
+}
 
+// ユーザ情報を埋め込んだレスポンスのキャッシュをまとめて捨てる
+func invalidateUserCaches(userID UserID) {
+	bumpUserVersion(userID)
 	UserByIDCacheMutex.Lock()
-	UserByIDCache[userModel.ID] = user
+	delete(UserByIDCache, userID)
 	UserByIDCacheMutex.Unlock()
-
-	return user, nil
-}
-
-// N+1問題を解消するためにbulkで取得する
-func fillUserResponseBulk(ctx context.Context, tx *sqlx.Tx, userModels []*UserModel) ([]User, error) {
-	// if len(userModels) == 0 {
-	// 	return []User{}, nil
-	// }
-	// cachedUsers := make([]User, 0, len(userModels))
-	// uncachedUserModels := make([]*UserModel, 0, len(userModels))
-
-	// UserByIDCacheMutex.RLock()
-	// for _, userModel := range userModels {
-	// 	if user, ok := UserByIDCache[userModel.ID]; ok {
-	// 		cachedUsers = append(cachedUsers, user)
-	// 	} else {
-	// 		uncachedUserModels = append(uncachedUserModels, userModel)
-	// 	}
-	// }
-	// UserByIDCacheMutex.RUnlock()
-
-	// if len(uncachedUserModels) == 0 {
-	// 	return cachedUsers, nil
-	// }
-
-	// // user_idのリストを作成
-	// userIDs := make([]int64, len(uncachedUserModels))
-	// for i, userModel := range uncachedUserModels {
-	// 	userIDs[i] = userModel.ID
-	// }
-
-	// // themeを取得
-	// themeModels := make([]ThemeModel, 0, len(uncachedUserModels))
-	// query, args, err := sqlx.In("SELECT * FROM themes WHERE user_id IN (?)", userIDs)
-	// if err != nil {
-	// 	return nil, err
-	// }
-	// query = tx.Rebind(query)
-	// if err := tx.SelectContext(ctx, &themeModels, query, args...); err != nil {
-	// 	return nil, err
-	// }
-
-	// // キャッシュされていないuser_idのリストを作成
-	// uncachedUserIDs := make([]int64, 0, len(uncachedUserModels))
-	// iconHashStringMap := make(map[int64]string, len(uncachedUserModels))
-
-	// IconHashByUserIDCacheMutex.RLock()
-	// for _, userModel := range uncachedUserModels {
-	// 	hash, ok := IconHashByUserIDCache[userModel.ID]
-	// 	if !ok {
-	// 		uncachedUserIDs = append(uncachedUserIDs, userModel.ID)
-	// 	} else {
-	// 		iconHashStringMap[userModel.ID] = hash
-	// 	}
-	// }
-	// IconHashByUserIDCacheMutex.RUnlock()
-
-	// // キャッシュされていないアイコンを取得
-	// if len(uncachedUserIDs) > 0 {
-	// 	icons := make([]struct {
-	// 		UserID int64  `db:"user_id"`
-	// 		Image  []byte `db:"image"`
-	// 	}, 0, len(uncachedUserIDs))
-	// 	query, args, err = sqlx.In("SELECT user_id, image FROM icons WHERE user_id IN (?)", uncachedUserIDs)
-	// 	if err != nil {
-	// 		return nil, err
-	// 	}
-	// 	query = tx.Rebind(query)
-	// 	if err := tx.SelectContext(ctx, &icons, query, args...); err != nil {
-	// 		return nil, err
-	// 	}
-
-	// 	IconHashByUserIDCacheMutex.Lock()
-	// 	for _, icon := range icons {
-	// 		hash := fmt.Sprintf("%x", sha256.Sum256(icon.Image))
-	// 		iconHashStringMap[icon.UserID] = hash
-	// 		IconHashByUserIDCache[icon.UserID] = hash
-	// 	}
-	// 	IconHashByUserIDCacheMutex.Unlock()
-	// }
-
-	// users := []User{}
-	// for i, userModel := range uncachedUserModels {
-	// 	iconHash, ok := iconHashStringMap[userModel.ID]
-	// 	if !ok {
-	// 		icon, err := os.ReadFile(fallbackImage)
-	// 		if err != nil {
-	// 			return nil, err
-	// 		}
-	// 		iconHash = fmt.Sprintf("%x", sha256.Sum256(icon))
-	// 	}
-
-	// 	user := User{
-	// 		ID:          userModel.ID,
-	// 		Name:        userModel.Name,
-	// 		DisplayName: userModel.DisplayName,
-	// 		Description: userModel.Description,
-	// 		Theme: Theme{
-	// 			ID:       themeModels[i].ID,
-	// 			DarkMode: themeModels[i].DarkMode,
-	// 		},
-	// 		IconHash: iconHash,
-	// 	}
-	// 	users = append(users, user)
-	// }
-
-	// UserByIDCacheMutex.Lock()
-	// for i, user := range users {
-	// 	UserByIDCache[userModels[i].ID] = user
-	// }
-	// UserByIDCacheMutex.Unlock()
-
-	// users = append(cachedUsers, users...)
-
-	// return users, nil
-
-	users := make([]User, len(userModels))
-	for i, userModel := range userModels {
-		user, err := fillUserResponse(ctx, tx, *userModel)
-		if err != nil {
-			return nil, err
-		}
-		users[i] = user
-	}
-
-	return users, nil
+	deleteLivestreamByIDCacheByOwnerID(userID)
+	deleteLivecommentByIDCacheByOwnerID(userID)
 }
@@ -0,0 +1,519 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"sync/atomic"
+
+	"github.com/jmoiron/sqlx"
+)
+
+// users・themes・iconsテーブルのSQLとそのキャッシュをまとめる
+// 引数のsqlx.ExtContextにはトランザクションでもdbConnでも渡せる
+// 見つからない場合はsql.ErrNoRowsをそのまま返す
+type UserRepository struct {
+	icons IconRepository
+}
+
+// icon_hashの計算に使うHasherはmainから渡す (newIconRepository)
+type IconRepository struct {
+	hasher Hasher
+}
+
+func newIconRepository(hasher Hasher) IconRepository {
+	return IconRepository{hasher: hasher}
+}
+
+func newUserRepository(icons IconRepository) UserRepository {
+	return UserRepository{icons: icons}
+}
+
+var (
+	// Appに移していないハンドラやバックグラウンドの処理が使う。mainでAppと同じものを入れる
+	userRepository UserRepository
+	iconRepository IconRepository
+
+	// 名前やテーマを無効化するたびに進める。GetThemeByNameが読んでいる間に進んだら結果をキャッシュに載せない
+	userNameGeneration atomic.Uint64
+)
+
+type IconModel struct {
+	ID       int64  `db:"id"`
+	UserID   UserID `db:"user_id"`
+	Image    []byte `db:"image"`
+	IsActive bool   `db:"is_active"`
+}
+
+func (UserRepository) GetByID(ctx context.Context, q sqlx.ExtContext, id UserID) (UserModel, error) {
+	var userModel UserModel
+	err := sqlx.GetContext(ctx, q, &userModel, "SELECT * FROM users WHERE id = ?", id)
+	return userModel, err
+}
+
+// 同じトランザクション内で更新する前に行ロックを取る
+func (UserRepository) GetByIDForUpdate(ctx context.Context, q sqlx.ExtContext, id UserID) (UserModel, error) {
+	var userModel UserModel
+	err := sqlx.GetContext(ctx, q, &userModel, "SELECT * FROM users WHERE id = ? FOR UPDATE", id)
+	return userModel, err
+}
+
+// usernameはUNIQUEなので、whereで一意に特定できる
+func (UserRepository) GetByName(ctx context.Context, q sqlx.ExtContext, name string) (UserModel, error) {
+	var userModel UserModel
+	err := sqlx.GetContext(ctx, q, &userModel, "SELECT * FROM users WHERE name = ?", name)
+	return userModel, err
+}
+
+func (UserRepository) GetIDByName(ctx context.Context, q sqlx.ExtContext, name string) (UserID, error) {
+	var id UserID
+	err := sqlx.GetContext(ctx, q, &id, "SELECT id FROM users WHERE name = ?", name)
+	return id, err
+}
+
+func (UserRepository) GetNameByID(ctx context.Context, q sqlx.ExtContext, id UserID) (string, error) {
+	var name string
+	err := sqlx.GetContext(ctx, q, &name, "SELECT name FROM users WHERE id = ?", id)
+	return name, err
+}
+
+// N+1問題を解消するためにbulkで取得する。順序はidsと一致しない
+func (UserRepository) ListByIDs(ctx context.Context, q sqlx.ExtContext, ids []UserID) ([]*UserModel, error) {
+	userModels := []*UserModel{}
+	if len(ids) == 0 {
+		return userModels, nil
+	}
+	query, args, err := sqlx.In("SELECT * FROM users WHERE id IN (?)", ids)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqlx.SelectContext(ctx, q, &userModels, q.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	return userModels, nil
+}
+
+// ListByIDsのname版。順序はnamesと一致しない
+func (UserRepository) ListByNames(ctx context.Context, q sqlx.ExtContext, names []string) ([]*UserModel, error) {
+	userModels := []*UserModel{}
+	if len(names) == 0 {
+		return userModels, nil
+	}
+	query, args, err := sqlx.In("SELECT * FROM users WHERE name IN (?)", names)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqlx.SelectContext(ctx, q, &userModels, q.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	return userModels, nil
+}
+
+// ユーザとテーマを作成し、userModel.IDを埋める
+func (UserRepository) Create(ctx context.Context, e sqlx.ExtContext, userModel *UserModel, darkMode bool) error {
+	result, err := sqlx.NamedExecContext(ctx, e, "INSERT INTO users (name, display_name, description, password) VALUES(:name, :display_name, :description, :password)", userModel)
+	if err != nil {
+		return fmt.Errorf("failed to insert user: %w", err)
+	}
+	lastInsertID, err := result.LastInsertId()
+	if err != nil {
+		return fmt.Errorf("failed to get last inserted user id: %w", err)
+	}
+	userModel.ID = UserID(lastInsertID)
+
+	themeModel := ThemeModel{
+		UserID:   userModel.ID,
+		DarkMode: darkMode,
+	}
+	if _, err := sqlx.NamedExecContext(ctx, e, "INSERT INTO themes (user_id, dark_mode) VALUES(:user_id, :dark_mode)", themeModel); err != nil {
+		return fmt.Errorf("failed to insert user theme: %w", err)
+	}
+	return nil
+}
+
+// 古い時刻で上書きしない (非同期で書くので順番が前後しうる)
+func (UserRepository) RecordLogin(ctx context.Context, e sqlx.ExtContext, id UserID, loggedInAt int64) error {
+	_, err := e.ExecContext(ctx, "INSERT INTO user_logins (user_id, last_login_at) VALUES (?, ?) ON DUPLICATE KEY UPDATE last_login_at = GREATEST(last_login_at, VALUES(last_login_at))", id, loggedInAt)
+	return err
+}
+
+// 一度もログインしていなければsql.ErrNoRows
+func (UserRepository) GetLastLoginAt(ctx context.Context, q sqlx.ExtContext, id UserID) (int64, error) {
+	var lastLoginAt int64
+	err := sqlx.GetContext(ctx, q, &lastLoginAt, "SELECT last_login_at FROM user_logins WHERE user_id = ?", id)
+	return lastLoginAt, err
+}
+
+func (UserRepository) UpdatePassword(ctx context.Context, e sqlx.ExtContext, id UserID, hashedPassword string) error {
+	_, err := e.ExecContext(ctx, "UPDATE users SET password = ? WHERE id = ?", hashedPassword, id)
+	return err
+}
+
+// 重複した場合はMySQLのエラー (1062) をそのまま返す
+func (UserRepository) UpdateName(ctx context.Context, e sqlx.ExtContext, id UserID, name string) error {
+	_, err := e.ExecContext(ctx, "UPDATE users SET name = ? WHERE id = ?", name, id)
+	return err
+}
+
+// テーマはPATCH /api/user/me/themeでしか変わらないので、変更時に消すまでキャッシュする
+func (UserRepository) GetTheme(ctx context.Context, q sqlx.ExtContext, id UserID) (ThemeModel, error) {
+	ThemeByUserIDCacheMutex.RLock()
+	themeModel, ok := ThemeByUserIDCache[id]
+	ThemeByUserIDCacheMutex.RUnlock()
+	if ok {
+		return themeModel, nil
+	}
+
+	if err := sqlx.GetContext(ctx, q, &themeModel, "SELECT * FROM themes WHERE user_id = ?", id); err != nil {
+		return ThemeModel{}, err
+	}
+
+	ThemeByUserIDCacheMutex.Lock()
+	ThemeByUserIDCache[id] = themeModel
+	ThemeByUserIDCacheMutex.Unlock()
+	return themeModel, nil
+}
+
+// ユーザ名からテーマを引く。キャッシュに無い場合だけJOIN1回で取得してキャッシュに載せる
+func (UserRepository) GetThemeByName(ctx context.Context, q sqlx.ExtContext, name string) (ThemeModel, error) {
+	UserIDByNameCacheMutex.RLock()
+	userID, ok := UserIDByNameCache[name]
+	UserIDByNameCacheMutex.RUnlock()
+	if ok {
+		ThemeByUserIDCacheMutex.RLock()
+		themeModel, ok := ThemeByUserIDCache[userID]
+		ThemeByUserIDCacheMutex.RUnlock()
+		if ok {
+			return themeModel, nil
+		}
+	}
+
+	generation := userNameGeneration.Load()
+	var themeModel ThemeModel
+	if err := sqlx.GetContext(ctx, q, &themeModel, "SELECT t.* FROM users u INNER JOIN themes t ON t.user_id = u.id WHERE u.name = ?", name); err != nil {
+		return ThemeModel{}, err
+	}
+
+	// 読んでいる間にリネームがコミットされていると古い名前を書き戻してしまう
+	UserIDByNameCacheMutex.Lock()
+	if userNameGeneration.Load() == generation {
+		UserIDByNameCache[name] = themeModel.UserID
+	}
+	UserIDByNameCacheMutex.Unlock()
+	ThemeByUserIDCacheMutex.Lock()
+	if userNameGeneration.Load() == generation {
+		ThemeByUserIDCache[themeModel.UserID] = themeModel
+	}
+	ThemeByUserIDCacheMutex.Unlock()
+	return themeModel, nil
+}
+
+// ユーザ名の変更後に古い名前を引けないようにする
+func (UserRepository) InvalidateName(name string) {
+	UserIDByNameCacheMutex.Lock()
+	userNameGeneration.Add(1)
+	delete(UserIDByNameCache, name)
+	UserIDByNameCacheMutex.Unlock()
+}
+
+// 同じトランザクション内で更新する前に行ロックを取る。キャッシュは見ない
+func (UserRepository) GetThemeForUpdate(ctx context.Context, q sqlx.ExtContext, id UserID) (ThemeModel, error) {
+	var themeModel ThemeModel
+	err := sqlx.GetContext(ctx, q, &themeModel, "SELECT * FROM themes WHERE user_id = ? FOR UPDATE", id)
+	return themeModel, err
+}
+
+func (UserRepository) UpdateTheme(ctx context.Context, e sqlx.ExtContext, themeModel ThemeModel) error {
+	_, err := sqlx.NamedExecContext(ctx, e, "UPDATE themes SET dark_mode = :dark_mode, accent_color = :accent_color, font_size = :font_size WHERE user_id = :user_id", themeModel)
+	return err
+}
+
+func (UserRepository) InvalidateTheme(id UserID) {
+	ThemeByUserIDCacheMutex.Lock()
+	userNameGeneration.Add(1)
+	delete(ThemeByUserIDCache, id)
+	ThemeByUserIDCacheMutex.Unlock()
+}
+
+// レスポンス用のUserを組み立てる。結果はUserByIDCacheに載せる
+func (r UserRepository) Fill(ctx context.Context, q sqlx.ExtContext, userModel UserModel) (User, error) {
+	UserByIDCacheMutex.RLock()
+	if user, ok := UserByIDCache[userModel.ID]; ok {
+		UserByIDCacheMutex.RUnlock()
+		return user, nil
+	}
+	UserByIDCacheMutex.RUnlock()
+
+	themeModel, err := r.GetTheme(ctx, q, userModel.ID)
+	if err != nil {
+		return User{}, err
+	}
+
+	iconHash, err := r.icons.GetHash(ctx, q, userModel.ID)
+	if err != nil {
+		return User{}, err
+	}
+
+	user := newUser(userModel, themeModel, iconHash)
+
+	UserByIDCacheMutex.Lock()
+	UserByIDCache[userModel.ID] = user
+	UserByIDCacheMutex.Unlock()
+
+	return user, nil
+}
+
+// Fillのbulk版。themes・iconsはキャッシュに無いユーザの分だけまとめて取得する
+func (r UserRepository) FillBulk(ctx context.Context, q sqlx.ExtContext, userModels []*UserModel) ([]User, error) {
+	if len(userModels) == 0 {
+		return []User{}, nil
+	}
+
+	users := make([]User, len(userModels))
+	uncachedIndexes := make([]int, 0, len(userModels))
+
+	UserByIDCacheMutex.RLock()
+	for i, userModel := range userModels {
+		if user, ok := UserByIDCache[userModel.ID]; ok {
+			users[i] = user
+		} else {
+			uncachedIndexes = append(uncachedIndexes, i)
+		}
+	}
+	UserByIDCacheMutex.RUnlock()
+
+	if len(uncachedIndexes) == 0 {
+		return users, nil
+	}
+
+	uncachedUserIDSet := make(map[UserID]struct{}, len(uncachedIndexes))
+	for _, i := range uncachedIndexes {
+		uncachedUserIDSet[userModels[i].ID] = struct{}{}
+	}
+	uncachedUserIDs := make([]UserID, 0, len(uncachedUserIDSet))
+	for id := range uncachedUserIDSet {
+		uncachedUserIDs = append(uncachedUserIDs, id)
+	}
+
+	// themeを取得
+	themeModels := []*ThemeModel{}
+	query, args, err := sqlx.In("SELECT * FROM themes WHERE user_id IN (?)", uncachedUserIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqlx.SelectContext(ctx, q, &themeModels, q.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+	themeModelMap := make(map[UserID]*ThemeModel, len(themeModels))
+	for _, themeModel := range themeModels {
+		themeModelMap[themeModel.UserID] = themeModel
+	}
+
+	iconHashMap, err := r.icons.GetHashes(ctx, q, uncachedUserIDs)
+	if err != nil {
+		return nil, err
+	}
+
+	for _, i := range uncachedIndexes {
+		userModel := userModels[i]
+		themeModel, ok := themeModelMap[userModel.ID]
+		if !ok {
+			return nil, sql.ErrNoRows
+		}
+		users[i] = newUser(*userModel, *themeModel, iconHashMap[userModel.ID])
+	}
+
+	UserByIDCacheMutex.Lock()
+	for _, i := range uncachedIndexes {
+		UserByIDCache[userModels[i].ID] = users[i]
+	}
+	UserByIDCacheMutex.Unlock()
+
+	return users, nil
+}
+
+func newUser(userModel UserModel, themeModel ThemeModel, iconHash string) User {
+	return User{
+		ID:             userModel.ID,
+		Name:           userModel.Name,
+		DisplayName:    userModel.DisplayName,
+		Description:    userModel.Description,
+		Theme:          newTheme(themeModel),
+		IconHash:       iconHash,
+		FollowersCount: userModel.FollowersCount,
+	}
+}
+
+func newTheme(themeModel ThemeModel) Theme {
+	return Theme{
+		ID:          themeModel.ID,
+		DarkMode:    themeModel.DarkMode,
+		AccentColor: themeModel.AccentColor,
+		FontSize:    themeModel.FontSize,
+	}
+}
+
+func (IconRepository) GetActiveImage(ctx context.Context, q sqlx.ExtContext, userID UserID) ([]byte, error) {
+	var image []byte
+	err := sqlx.GetContext(ctx, q, &image, "SELECT image FROM icons WHERE user_id = ? AND is_active = TRUE", userID)
+	return image, err
+}
+
+// 他のユーザのアイコンは見つからない扱いにする
+func (IconRepository) GetImage(ctx context.Context, q sqlx.ExtContext, userID UserID, iconID int64) ([]byte, error) {
+	var image []byte
+	err := sqlx.GetContext(ctx, q, &image, "SELECT image FROM icons WHERE id = ? AND user_id = ?", iconID, userID)
+	return image, err
+}
+
+// 有効なものを含むアイコンの履歴 (新しい順)
+func (IconRepository) ListByUserID(ctx context.Context, q sqlx.ExtContext, userID UserID) ([]IconModel, error) {
+	var icons []IconModel
+	if err := sqlx.SelectContext(ctx, q, &icons, "SELECT * FROM icons WHERE user_id = ? ORDER BY id DESC", userID); err != nil {
+		return nil, err
+	}
+	return icons, nil
+}
+
+// 新しいアイコンを有効にして登録し、そのidを返す。古いアイコンは履歴として一定数だけ残す
+func (IconRepository) Upsert(ctx context.Context, e sqlx.ExtContext, userID UserID, image []byte) (int64, error) {
+	if _, err := e.ExecContext(ctx, "UPDATE icons SET is_active = FALSE WHERE user_id = ?", userID); err != nil {
+		return 0, fmt.Errorf("failed to deactivate old user icon: %w", err)
+	}
+
+	rs, err := e.ExecContext(ctx, "INSERT INTO icons (user_id, image, is_active) VALUES (?, ?, TRUE)", userID, image)
+	if err != nil {
+		return 0, fmt.Errorf("failed to insert new user icon: %w", err)
+	}
+	iconID, err := rs.LastInsertId()
+	if err != nil {
+		return 0, fmt.Errorf("failed to get last inserted icon id: %w", err)
+	}
+
+	if _, err := e.ExecContext(ctx, "DELETE FROM icons WHERE user_id = ? AND id NOT IN (SELECT id FROM (SELECT id FROM icons WHERE user_id = ? ORDER BY id DESC LIMIT ?) AS recent)", userID, userID, maxIconHistoryPerUser); err != nil {
+		return 0, fmt.Errorf("failed to delete old user icons: %w", err)
+	}
+	return iconID, nil
+}
+
+func (IconRepository) Activate(ctx context.Context, e sqlx.ExtContext, userID UserID, iconID int64) error {
+	_, err := e.ExecContext(ctx, "UPDATE icons SET is_active = (id = ?) WHERE user_id = ?", iconID, userID)
+	return err
+}
+
+// 有効なアイコンのハッシュ。アイコン未設定のユーザはフォールバック画像のハッシュを返す (キャッシュはしない)
+func (r IconRepository) GetHash(ctx context.Context, q sqlx.ExtContext, userID UserID) (string, error) {
+	IconHashByUserIDCacheMutex.RLock()
+	hash, ok := IconHashByUserIDCache[userID]
+	IconHashByUserIDCacheMutex.RUnlock()
+	if ok {
+		return hash, nil
+	}
+
+	image, err := r.GetActiveImage(ctx, q, userID)
+	if errors.Is(err, sql.ErrNoRows) {
+		return r.fallbackHash()
+	}
+	if err != nil {
+		return "", err
+	}
+
+	hash = r.hasher.Sum(image)
+	IconHashByUserIDCacheMutex.Lock()
+	IconHashByUserIDCache[userID] = hash
+	IconHashByUserIDCacheMutex.Unlock()
+	return hash, nil
+}
+
+// GetHashのbulk版。画像はハッシュがキャッシュされていないユーザの分だけ取得する
+func (r IconRepository) GetHashes(ctx context.Context, q sqlx.ExtContext, userIDs []UserID) (map[UserID]string, error) {
+	iconHashMap := make(map[UserID]string, len(userIDs))
+	noHashUserIDs := make([]UserID, 0, len(userIDs))
+	IconHashByUserIDCacheMutex.RLock()
+	for _, id := range userIDs {
+		if hash, ok := IconHashByUserIDCache[id]; ok {
+			iconHashMap[id] = hash
+		} else {
+			noHashUserIDs = append(noHashUserIDs, id)
+		}
+	}
+	IconHashByUserIDCacheMutex.RUnlock()
+
+	if len(noHashUserIDs) == 0 {
+		return iconHashMap, nil
+	}
+
+	icons := []struct {
+		UserID UserID `db:"user_id"`
+		Image  []byte `db:"image"`
+	}{}
+	query, args, err := sqlx.In("SELECT user_id, image FROM icons WHERE user_id IN (?) AND is_active = TRUE", noHashUserIDs)
+	if err != nil {
+		return nil, err
+	}
+	if err := sqlx.SelectContext(ctx, q, &icons, q.Rebind(query), args...); err != nil {
+		return nil, err
+	}
+
+	IconHashByUserIDCacheMutex.Lock()
+	for _, icon := range icons {
+		hash := r.hasher.Sum(icon.Image)
+		iconHashMap[icon.UserID] = hash
+		IconHashByUserIDCache[icon.UserID] = hash
+	}
+	IconHashByUserIDCacheMutex.Unlock()
+
+	for _, id := range noHashUserIDs {
+		if _, ok := iconHashMap[id]; ok {
+			continue
+		}
+		hash, err := r.fallbackHash()
+		if err != nil {
+			return nil, err
+		}
+		iconHashMap[id] = hash
+	}
+	return iconHashMap, nil
+}
+
+// If-None-Matchの確認用。DBは見ない
+func (IconRepository) CachedHashByUsername(username string) (string, bool) {
+	IconHashByUsernameCacheMutex.RLock()
+	defer IconHashByUsernameCacheMutex.RUnlock()
+	hash, ok := IconHashByUsernameCache[username]
+	return hash, ok
+}
+
+// 有効なアイコンが変わったらハッシュのキャッシュを差し替える
+func (IconRepository) SetActiveHash(userID UserID, username string, hash string) {
+	IconHashByUserIDCacheMutex.Lock()
+	IconHashByUserIDCache[userID] = hash
+	IconHashByUserIDCacheMutex.Unlock()
+	IconHashByUsernameCacheMutex.Lock()
+	IconHashByUsernameCache[username] = hash
+	IconHashByUsernameCacheMutex.Unlock()
+}
+
+// ユーザ名の変更に合わせてキャッシュのキーを付け替える
+func (IconRepository) RenameUsername(oldName string, newName string) {
+	IconHashByUsernameCacheMutex.Lock()
+	defer IconHashByUsernameCacheMutex.Unlock()
+	if hash, ok := IconHashByUsernameCache[oldName]; ok {
+		IconHashByUsernameCache[newName] = hash
+		delete(IconHashByUsernameCache, oldName)
+	}
+}
+
+func (r IconRepository) Hash(image []byte) string {
+	return r.hasher.Sum(image)
+}
+
+func (r IconRepository) fallbackHash() (string, error) {
+	image, err := os.ReadFile(fallbackImage)
+	if err != nil {
+		return "", err
+	}
+	return r.hasher.Sum(image), nil
+}
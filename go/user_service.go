@@ -0,0 +1,334 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"log"
+	"regexp"
+	"slices"
+	"strings"
+
+	"github.com/go-sql-driver/mysql"
+	"github.com/jmoiron/sqlx"
+	"golang.org/x/crypto/bcrypt"
+)
+
+var (
+	// DNSのラベルとして使える文字だけ (大文字は名前解決で区別されないので許さない)
+	usernamePattern = regexp.MustCompile(`^[a-z0-9]([a-z0-9-]*[a-z0-9])?$`)
+
+	themeAccentColorPattern = regexp.MustCompile(`^#[0-9a-fA-F]{6}$`)
+	themeFontSizes          = []string{"small", "medium", "large"}
+
+	// UpdateNameでPowerDNSのレコードを消してよいか判断するために区別する
+	errUsernameTaken      = newServiceError(serviceErrorConflict, errorCodeUsernameTaken, "the username is already taken")
+	errUsernameNotChanged = newServiceError(serviceErrorInvalid, "", "name is not changed")
+)
+
+// ユーザ登録・ログイン・ユーザ名・パスワード・テーマの変更。リクエストやセッションには触れず、返すエラーはハンドラでserviceHTTPErrorに通す
+type UserService struct {
+	db       *sqlx.DB
+	powerDNS *PowerDNSClient
+	users    UserRepository
+	icons    IconRepository
+}
+
+// ユーザを作成し、サブドメインのAレコードを登録する
+func (s *UserService) Register(ctx context.Context, req PostUserRequest) (User, error) {
+	var errs validationErrors
+	if fe, ok := validateUsername(req.Name); !ok {
+		errs = append(errs, fe)
+	}
+	if req.DisplayName != strings.TrimSpace(req.DisplayName) {
+		errs = append(errs, FieldError{Field: "display_name", Reason: "must not start or end with whitespace"})
+	}
+	if fe, ok := checkPasswordPolicy("password", req.Password); !ok {
+		errs = append(errs, fe)
+	}
+	if len(errs) > 0 {
+		return User{}, newServiceValidationError(errs)
+	}
+	if req.Name == "pipe" {
+		return User{}, newServiceError(serviceErrorInvalid, errorCodeUsernameReserved, "the username 'pipe' is reserved")
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(req.Password), bcryptDefaultCost)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to generate hashed password: %w", err)
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	userModel := UserModel{
+		Name:           req.Name,
+		DisplayName:    req.DisplayName,
+		Description:    req.Description,
+		HashedPassword: string(hashedPassword),
+	}
+	if err := s.users.Create(ctx, tx, &userModel, req.Theme.DarkMode); err != nil {
+		return User{}, err
+	}
+
+	// post request to powerdns
+	// 非同期の場合はコミットできてから登録する (登録直後の名前解決は失敗しうる)
+	asyncDNS := featureEnabled(featureAsyncDNS)
+	if !asyncDNS {
+		if err := s.powerDNS.PatchRecord(req.Name, "REPLACE"); err != nil {
+			return User{}, powerDNSServiceError(err)
+		}
+	}
+
+	user, err := s.users.Fill(ctx, tx, userModel)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to fill user: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return User{}, fmt.Errorf("failed to commit: %w", err)
+	}
+
+	invalidateUserCaches(userModel.ID)
+
+	if asyncDNS {
+		go func() {
+			if err := s.powerDNS.PatchRecord(req.Name, "REPLACE"); err != nil {
+				log.Printf("failed to register powerdns record of %s: %v", req.Name, err)
+			}
+		}()
+	}
+
+	return user, nil
+}
+
+// ユーザ名とパスワードを照合する。どちらが違っても同じエラーにする
+func (s *UserService) Authenticate(ctx context.Context, username string, password string) (UserModel, error) {
+	userModel, err := s.users.GetByName(ctx, s.db, username)
+	if errors.Is(err, sql.ErrNoRows) {
+		return UserModel{}, newServiceError(serviceErrorUnauthorized, errorCodeInvalidCredentials, "invalid username or password")
+	}
+	if err != nil {
+		return UserModel{}, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(password))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return UserModel{}, newServiceError(serviceErrorUnauthorized, errorCodeInvalidCredentials, "invalid username or password")
+	}
+	if err != nil {
+		return UserModel{}, fmt.Errorf("failed to compare hash and password: %w", err)
+	}
+
+	return userModel, nil
+}
+
+// 今のパスワードを確かめてから変更する。ログイン中のセッションはそのまま使える
+func (s *UserService) ChangePassword(ctx context.Context, userID UserID, currentPassword string, newPassword string) error {
+	if fe, ok := checkPasswordPolicy("new_password", newPassword); !ok {
+		return newServiceValidationError(validationErrors{fe})
+	}
+
+	hashedPassword, err := bcrypt.GenerateFromPassword([]byte(newPassword), bcryptDefaultCost)
+	if err != nil {
+		return fmt.Errorf("failed to generate hashed password: %w", err)
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	userModel, err := s.users.GetByIDForUpdate(ctx, tx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return newServiceError(serviceErrorNotFound, errorCodeUserNotFound, "not found user that has the userid in session")
+		}
+		return fmt.Errorf("failed to get user: %w", err)
+	}
+
+	// セッションは有効なので401ではなく403にする
+	err = bcrypt.CompareHashAndPassword([]byte(userModel.HashedPassword), []byte(currentPassword))
+	if err == bcrypt.ErrMismatchedHashAndPassword {
+		return newServiceError(serviceErrorForbidden, errorCodeInvalidCredentials, "current password is wrong")
+	}
+	if err != nil {
+		return fmt.Errorf("failed to compare hash and password: %w", err)
+	}
+
+	if err := s.users.UpdatePassword(ctx, tx, userID, string(hashedPassword)); err != nil {
+		return fmt.Errorf("failed to update password: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return fmt.Errorf("failed to commit: %w", err)
+	}
+	return nil
+}
+
+// ユーザ名を変更し、サブドメインのAレコードとキャッシュを付け替える
+func (s *UserService) UpdateName(ctx context.Context, userID UserID, name string) (User, error) {
+	if fe, ok := validateUsername(name); !ok {
+		return User{}, newServiceValidationError(validationErrors{fe})
+	}
+	if name == "pipe" {
+		return User{}, newServiceError(serviceErrorInvalid, errorCodeUsernameReserved, "the username 'pipe' is reserved")
+	}
+
+	// PowerDNSへのリクエスト中にusersの行ロックを持たないよう、レコードはトランザクションの外で先に作る
+	// 他のユーザが使っている名前のレコードを作ったり消したりしないよう、使われていないことを先に確かめる
+	currentName, err := s.users.GetNameByID(ctx, s.db, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return User{}, newServiceError(serviceErrorNotFound, errorCodeUserNotFound, "not found user that has the userid in session")
+		}
+		return User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+	if name == currentName {
+		return User{}, errUsernameNotChanged
+	}
+	if _, err := s.users.GetIDByName(ctx, s.db, name); err == nil {
+		return User{}, errUsernameTaken
+	} else if !errors.Is(err, sql.ErrNoRows) {
+		return User{}, fmt.Errorf("failed to get user: %w", err)
+	}
+
+	if err := s.powerDNS.PatchRecord(name, "REPLACE"); err != nil {
+		return User{}, powerDNSServiceError(err)
+	}
+
+	userModel, oldName, err := s.renameUser(ctx, userID, name)
+	if err != nil {
+		// 確認後に他のリクエストが同じ名前を取った場合、レコードはそちらのものなので消さない
+		if !errors.Is(err, errUsernameTaken) && !errors.Is(err, errUsernameNotChanged) {
+			if err := s.powerDNS.PatchRecord(name, "DELETE"); err != nil {
+				log.Printf("failed to delete powerdns record of %s: %v", name, err)
+			}
+		}
+		return User{}, err
+	}
+
+	// コミット前に消すと、並行するリクエストが古い名前のUserをキャッシュに戻してしまう
+	invalidateUserCaches(userID)
+	s.users.InvalidateName(oldName)
+	s.icons.RenameUsername(oldName, name)
+	expireUserRankingSnapshot()
+
+	// 古い名前は既に使えないので、レコードの削除に失敗してもリクエストは成功扱いにする
+	if err := s.powerDNS.PatchRecord(oldName, "DELETE"); err != nil {
+		log.Printf("failed to delete powerdns record of %s: %v", oldName, err)
+	}
+
+	user, err := s.users.Fill(ctx, s.db, userModel)
+	if err != nil {
+		return User{}, fmt.Errorf("failed to fill user: %w", err)
+	}
+	return user, nil
+}
+
+// 行ロックを取ってユーザ名を書き換え、コミットする。変更前の名前も返す
+func (s *UserService) renameUser(ctx context.Context, userID UserID, name string) (UserModel, string, error) {
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return UserModel{}, "", fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	userModel, err := s.users.GetByIDForUpdate(ctx, tx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return UserModel{}, "", newServiceError(serviceErrorNotFound, errorCodeUserNotFound, "not found user that has the userid in session")
+		}
+		return UserModel{}, "", fmt.Errorf("failed to get user: %w", err)
+	}
+	oldName := userModel.Name
+	if name == oldName {
+		return UserModel{}, "", errUsernameNotChanged
+	}
+
+	if err := s.users.UpdateName(ctx, tx, userID, name); err != nil {
+		var mysqlErr *mysql.MySQLError
+		if errors.As(err, &mysqlErr) && mysqlErr.Number == 1062 {
+			return UserModel{}, "", errUsernameTaken
+		}
+		return UserModel{}, "", fmt.Errorf("failed to update username: %w", err)
+	}
+	userModel.Name = name
+
+	if err := tx.Commit(); err != nil {
+		return UserModel{}, "", fmt.Errorf("failed to commit: %w", err)
+	}
+	return userModel, oldName, nil
+}
+
+// ユーザ名はPowerDNSのレコード名になるので、登録できない名前はDBにもDNSにも触る前に弾く
+// 長さはリクエストのvalidateタグで検査済み
+func validateUsername(name string) (FieldError, bool) {
+	if !usernamePattern.MatchString(name) {
+		return FieldError{Field: "name", Reason: "must consist of lowercase letters, digits and hyphens, and must not start or end with a hyphen"}, false
+	}
+	return FieldError{}, true
+}
+
+// テーマを変更し、テーマとテーマを埋め込んだUserのキャッシュを消す
+func (s *UserService) UpdateTheme(ctx context.Context, userID UserID, req PatchThemeRequest) (Theme, error) {
+	var errs validationErrors
+	if req.AccentColor != nil && *req.AccentColor != "" && !themeAccentColorPattern.MatchString(*req.AccentColor) {
+		errs = append(errs, FieldError{Field: "accent_color", Reason: "must be a color code like #1a2b3c"})
+	}
+	if req.FontSize != nil && !slices.Contains(themeFontSizes, *req.FontSize) {
+		errs = append(errs, FieldError{Field: "font_size", Reason: "must be one of " + strings.Join(themeFontSizes, ", ")})
+	}
+	if len(errs) > 0 {
+		return Theme{}, newServiceValidationError(errs)
+	}
+
+	tx, err := s.db.BeginTxx(ctx, nil)
+	if err != nil {
+		return Theme{}, fmt.Errorf("failed to begin transaction: %w", err)
+	}
+	defer tx.Rollback()
+
+	themeModel, err := s.users.GetThemeForUpdate(ctx, tx, userID)
+	if err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return Theme{}, newServiceError(serviceErrorNotFound, errorCodeUserNotFound, "not found user that has the userid in session")
+		}
+		return Theme{}, fmt.Errorf("failed to get user theme: %w", err)
+	}
+	if req.DarkMode != nil {
+		themeModel.DarkMode = *req.DarkMode
+	}
+	if req.AccentColor != nil {
+		themeModel.AccentColor = strings.ToLower(*req.AccentColor)
+	}
+	if req.FontSize != nil {
+		themeModel.FontSize = *req.FontSize
+	}
+
+	if err := s.users.UpdateTheme(ctx, tx, themeModel); err != nil {
+		return Theme{}, fmt.Errorf("failed to update user theme: %w", err)
+	}
+
+	if err := tx.Commit(); err != nil {
+		return Theme{}, fmt.Errorf("failed to commit: %w", err)
+	}
+
+	s.users.InvalidateTheme(userID)
+	invalidateUserCaches(userID)
+
+	return newTheme(themeModel), nil
+}
+
+// PowerDNSが落ちていてブレーカーが開いている場合は再試行できるエラーにする
+func powerDNSServiceError(err error) error {
+	if errors.Is(err, errPowerDNSUnavailable) {
+		return &serviceError{kind: serviceErrorUnavailable, code: errorCodeUnavailable, message: "failed to request to powerdns: " + err.Error(), err: err}
+	}
+	return fmt.Errorf("failed to request to powerdns: %w", err)
+}
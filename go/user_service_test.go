@@ -0,0 +1,145 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"slices"
+	"testing"
+)
+
+func TestUserServiceUpdateName(t *testing.T) {
+	app, fake := newTestApp(t)
+	db, s := app.db, app.userService
+	ctx := context.Background()
+
+	user := registerTestUser(t, s, "rename")
+	oldName := user.Name
+	// 古い名前でキャッシュに載せておく
+	if _, err := userRepository.GetThemeByName(ctx, db, oldName); err != nil {
+		t.Fatalf("failed to get theme: %v", err)
+	}
+	fake.takeCalls()
+
+	newName := newTestUsername("renamed")
+	renamed, err := s.UpdateName(ctx, user.ID, newName)
+	if err != nil {
+		t.Fatalf("UpdateName: %v", err)
+	}
+	if renamed.Name != newName {
+		t.Errorf("name = %q, want %q", renamed.Name, newName)
+	}
+
+	// 新しいレコードを作ってから古いレコードを消す
+	want := []powerDNSCall{
+		{Name: recordName(newName), Changetype: "REPLACE"},
+		{Name: recordName(oldName), Changetype: "DELETE"},
+	}
+	if calls := fake.takeCalls(); !slices.Equal(calls, want) {
+		t.Errorf("powerdns calls = %v, want %v", calls, want)
+	}
+
+	if _, err := userRepository.GetThemeByName(ctx, db, oldName); !errors.Is(err, sql.ErrNoRows) {
+		t.Errorf("old name is still resolvable: %v", err)
+	}
+	if theme, err := userRepository.GetThemeByName(ctx, db, newName); err != nil || theme.UserID != user.ID {
+		t.Errorf("GetThemeByName(new) = %v, %v", theme.UserID, err)
+	}
+	UserByIDCacheMutex.RLock()
+	cached, ok := UserByIDCache[user.ID]
+	UserByIDCacheMutex.RUnlock()
+	if ok && cached.Name != newName {
+		t.Errorf("cached name = %q, want %q", cached.Name, newName)
+	}
+}
+
+func TestUserServiceUpdateNameRejected(t *testing.T) {
+	app, fake := newTestApp(t)
+	s := app.userService
+	ctx := context.Background()
+
+	user := registerTestUser(t, s, "reject")
+	other := registerTestUser(t, s, "other")
+	fake.takeCalls()
+
+	if _, err := s.UpdateName(ctx, user.ID, other.Name); !errors.Is(err, errUsernameTaken) {
+		t.Errorf("taken name: err = %v, want errUsernameTaken", err)
+	}
+	if _, err := s.UpdateName(ctx, user.ID, user.Name); !errors.Is(err, errUsernameNotChanged) {
+		t.Errorf("same name: err = %v, want errUsernameNotChanged", err)
+	}
+	// 他のユーザのレコードを作り直したり消したりしない
+	if calls := fake.takeCalls(); len(calls) != 0 {
+		t.Errorf("powerdns calls = %v, want none", calls)
+	}
+}
+
+func TestUserServiceUpdateNamePowerDNSFailure(t *testing.T) {
+	app, fake := newTestApp(t)
+	db, s := app.db, app.userService
+	ctx := context.Background()
+
+	user := registerTestUser(t, s, "dnsfail")
+	fake.setStatus(http.StatusInternalServerError)
+
+	if _, err := s.UpdateName(ctx, user.ID, newTestUsername("dnsfail")); err == nil {
+		t.Fatal("UpdateName succeeded while powerdns is failing")
+	}
+	name, err := userRepository.GetNameByID(ctx, db, user.ID)
+	if err != nil {
+		t.Fatalf("failed to get name: %v", err)
+	}
+	if name != user.Name {
+		t.Errorf("name = %q, want unchanged %q", name, user.Name)
+	}
+}
+
+func TestValidateUsername(t *testing.T) {
+	for name, want := range map[string]bool{
+		"alice":     true,
+		"a-b-1":     true,
+		"0":         true,
+		"Alice":     false,
+		"-alice":    false,
+		"alice-":    false,
+		"al_ice":    false,
+		"al.ice":    false,
+		"":          false,
+		"ユーザ":       false,
+		"alice bob": false,
+	} {
+		if _, ok := validateUsername(name); ok != want {
+			t.Errorf("validateUsername(%q) = %v, want %v", name, ok, want)
+		}
+	}
+}
+
+// 名前の検査はDBにもPowerDNSにも触る前に行う
+func TestUserServiceRejectsBeforeTouchingDB(t *testing.T) {
+	s := &UserService{}
+	ctx := context.Background()
+
+	_, err := s.Register(ctx, PostUserRequest{Name: "Bad_Name", Password: "Passw0rd!test"})
+	var se *serviceError
+	if !errors.As(err, &se) || se.code != errorCodeValidationFailed {
+		t.Fatalf("Register: err = %v, want validation_failed", err)
+	}
+	if len(se.fields) == 0 || se.fields[0].Field != "name" {
+		t.Errorf("fields = %v, want name", se.fields)
+	}
+
+	if _, err := s.Register(ctx, PostUserRequest{Name: "pipe", Password: "Passw0rd!test"}); !errors.As(err, &se) || se.code != errorCodeUsernameReserved {
+		t.Errorf("Register(pipe): err = %v, want username_reserved", err)
+	}
+	if _, err := s.UpdateName(ctx, 1, "pipe"); !errors.As(err, &se) || se.code != errorCodeUsernameReserved {
+		t.Errorf("UpdateName(pipe): err = %v, want username_reserved", err)
+	}
+	if _, err := s.UpdateName(ctx, 1, "-bad"); !errors.As(err, &se) || se.code != errorCodeValidationFailed {
+		t.Errorf("UpdateName(-bad): err = %v, want validation_failed", err)
+	}
+	fontSize := "huge"
+	if _, err := s.UpdateTheme(ctx, 1, PatchThemeRequest{FontSize: &fontSize}); !errors.As(err, &se) || se.code != errorCodeValidationFailed {
+		t.Errorf("UpdateTheme: err = %v, want validation_failed", err)
+	}
+}
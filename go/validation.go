@@ -0,0 +1,214 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"reflect"
+	"strconv"
+	"strings"
+	"sync"
+	"unicode/utf8"
+
+	"github.com/labstack/echo/v4"
+)
+
+// リクエストボディの構造体にvalidateタグでルールを書き、bindRequestでデコードと同時に検査する
+//
+//	Name string `json:"name" validate:"required,max=255"`
+//
+// 使えるルール
+//   - required: ゼロ値 (空文字列・空スライスを含む) を許さない
+//   - min=N, max=N: 文字列は文字数、スライスは要素数、数値は値
+//   - gtfield=Field: 同じ構造体の別の数値フィールドより大きい
+//
+// ポインタのフィールドはnilなら省略されたものとして検査しない
+const validateTagName = "validate"
+
+// 400のレスポンスに載せる、ルールに違反したフィールド
+type FieldError struct {
+	// jsonのキー名
+	Field  string `json:"field"`
+	Reason string `json:"reason"`
+}
+
+type validationErrors []FieldError
+
+func (v validationErrors) Error() string {
+	reasons := make([]string, len(v))
+	for i, fe := range v {
+		reasons[i] = fe.Field + " " + fe.Reason
+	}
+	return strings.Join(reasons, ", ")
+}
+
+// echo.Validatorとしてe.Validatorに設定する
+type requestValidator struct{}
+
+func (requestValidator) Validate(i interface{}) error {
+	v := reflect.ValueOf(i)
+	for v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return nil
+		}
+		v = v.Elem()
+	}
+	if v.Kind() != reflect.Struct {
+		return nil
+	}
+
+	var errs validationErrors
+	for _, rule := range validationRulesOf(v.Type()) {
+		if reason, ok := rule.check(v); !ok {
+			errs = append(errs, FieldError{Field: rule.field, Reason: reason})
+		}
+	}
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
+
+// JSONのリクエストボディをデコードしてvalidateタグのルールを検査する。返すエラーはそのままハンドラから返してよい
+func bindRequest(c echo.Context, v interface{}) error {
+	if err := decodeJSONBody(c, v); err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidJSON, "failed to decode the request body as json")
+	}
+	if err := c.Validate(v); err != nil {
+		var errs validationErrors
+		if !errors.As(err, &errs) {
+			return newCodedHTTPError(http.StatusBadRequest, errorCodeValidationFailed, err.Error())
+		}
+		return newValidationError(errs)
+	}
+	return nil
+}
+
+// タグでは書けないルールをハンドラ側で検査した場合も、同じ形の400を返す
+func newValidationError(errs validationErrors) error {
+	return &codedHTTPError{
+		HTTPError: echo.NewHTTPError(http.StatusBadRequest, "invalid request: "+errs.Error()),
+		code:      errorCodeValidationFailed,
+		fields:    errs,
+	}
+}
+
+type validationRule struct {
+	field string
+	index int
+	kind  string
+	// min, maxの値
+	n int64
+	// gtfieldで比べるフィールド
+	otherIndex int
+	otherField string
+}
+
+func (r validationRule) check(parent reflect.Value) (string, bool) {
+	v := parent.Field(r.index)
+	if v.Kind() == reflect.Pointer {
+		if v.IsNil() {
+			return "", true
+		}
+		v = v.Elem()
+	}
+
+	switch r.kind {
+	case "required":
+		if v.IsZero() || (isLengthKind(v.Kind()) && lengthOf(v) == 0) {
+			return "is required", false
+		}
+	case "min":
+		if isLengthKind(v.Kind()) {
+			if lengthOf(v) < r.n {
+				return fmt.Sprintf("must have at least %d %s", r.n, lengthUnit(v.Kind())), false
+			}
+		} else if v.Int() < r.n {
+			return fmt.Sprintf("must be at least %d", r.n), false
+		}
+	case "max":
+		if isLengthKind(v.Kind()) {
+			if lengthOf(v) > r.n {
+				return fmt.Sprintf("must have at most %d %s", r.n, lengthUnit(v.Kind())), false
+			}
+		} else if v.Int() > r.n {
+			return fmt.Sprintf("must be at most %d", r.n), false
+		}
+	case "gtfield":
+		if v.Int() <= parent.Field(r.otherIndex).Int() {
+			return "must be greater than " + r.otherField, false
+		}
+	}
+	return "", true
+}
+
+func isLengthKind(kind reflect.Kind) bool {
+	return kind == reflect.String || kind == reflect.Slice || kind == reflect.Map
+}
+
+// 文字列はバイト数ではなく文字数で数える
+func lengthOf(v reflect.Value) int64 {
+	if v.Kind() == reflect.String {
+		return int64(utf8.RuneCountInString(v.String()))
+	}
+	return int64(v.Len())
+}
+
+func lengthUnit(kind reflect.Kind) string {
+	if kind == reflect.String {
+		return "characters"
+	}
+	return "items"
+}
+
+// 型ごとのルール。タグを読むのは1度だけにする
+var validationRulesCache sync.Map
+
+func validationRulesOf(t reflect.Type) []validationRule {
+	if cached, ok := validationRulesCache.Load(t); ok {
+		return cached.([]validationRule)
+	}
+
+	var rules []validationRule
+	for i := 0; i < t.NumField(); i++ {
+		sf := t.Field(i)
+		tag := sf.Tag.Get(validateTagName)
+		if tag == "" {
+			continue
+		}
+		field := jsonFieldName(sf)
+		for _, spec := range strings.Split(tag, ",") {
+			kind, arg, _ := strings.Cut(spec, "=")
+			rule := validationRule{field: field, index: i, kind: kind}
+			switch kind {
+			case "required":
+			case "min", "max":
+				n, err := strconv.ParseInt(arg, 10, 64)
+				if err != nil {
+					panic(fmt.Sprintf("invalid %s rule on %s.%s: %q", kind, t.Name(), sf.Name, spec))
+				}
+				rule.n = n
+			case "gtfield":
+				other, ok := t.FieldByName(arg)
+				if !ok || len(other.Index) != 1 {
+					panic(fmt.Sprintf("unknown field in gtfield rule on %s.%s: %q", t.Name(), sf.Name, arg))
+				}
+				rule.otherIndex = other.Index[0]
+				rule.otherField = jsonFieldName(other)
+			default:
+				panic(fmt.Sprintf("unknown validation rule on %s.%s: %q", t.Name(), sf.Name, spec))
+			}
+			rules = append(rules, rule)
+		}
+	}
+
+	validationRulesCache.Store(t, rules)
+	return rules
+}
+
+func jsonFieldName(sf reflect.StructField) string {
+	if name, _, _ := strings.Cut(sf.Tag.Get("json"), ","); name != "" && name != "-" {
+		return name
+	}
+	return sf.Name
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	defaultViewerHeartbeatTTL = 30 * time.Second
+	viewerPresenceSweepPeriod = 5 * time.Second
+)
+
+// ライブ配信ごとの視聴者の最終ハートビート時刻
+var (
+	ViewerLastSeenByLivestreamIDCache      = make(map[LivestreamID]map[UserID]time.Time)
+	ViewerLastSeenByLivestreamIDCacheMutex = sync.Mutex{}
+)
+
+func init() {
+	registerCacheReset(func() {
+		ViewerLastSeenByLivestreamIDCacheMutex.Lock()
+		ViewerLastSeenByLivestreamIDCache = make(map[LivestreamID]map[UserID]time.Time)
+		ViewerLastSeenByLivestreamIDCacheMutex.Unlock()
+	})
+}
+
+// 視聴継続の通知API
+// POST /api/livestream/:livestream_id/heartbeat
+func heartbeatLivestreamHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	// 存在しない配信のIDで視聴者の記録を増やさない
+	var exists bool
+	if err := dbConn.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM livestreams WHERE id = ?)", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if !exists {
+		return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "livestream not found")
+	}
+
+	if touchViewer(LivestreamID(livestreamID), userID) {
+		if err := publishViewersCount(ctx, LivestreamID(livestreamID)); err != nil {
+			c.Logger().Warnf("failed to publish viewers count: %+v", err)
+		}
+	}
+
+	return c.NoContent(http.StatusOK)
+}
+
+// 新しく視聴者が増えた場合はtrueを返す
+func touchViewer(livestreamID LivestreamID, userID UserID) bool {
+	ViewerLastSeenByLivestreamIDCacheMutex.Lock()
+	defer ViewerLastSeenByLivestreamIDCacheMutex.Unlock()
+
+	viewers, ok := ViewerLastSeenByLivestreamIDCache[livestreamID]
+	if !ok {
+		viewers = make(map[UserID]time.Time)
+		ViewerLastSeenByLivestreamIDCache[livestreamID] = viewers
+	}
+	_, existed := viewers[userID]
+	viewers[userID] = time.Now()
+
+	return !existed
+}
+
+func removeViewer(livestreamID LivestreamID, userID UserID) {
+	ViewerLastSeenByLivestreamIDCacheMutex.Lock()
+	defer ViewerLastSeenByLivestreamIDCacheMutex.Unlock()
+
+	viewers, ok := ViewerLastSeenByLivestreamIDCache[livestreamID]
+	if !ok {
+		return
+	}
+	delete(viewers, userID)
+	if len(viewers) == 0 {
+		delete(ViewerLastSeenByLivestreamIDCache, livestreamID)
+	}
+}
+
+func getConcurrentViewersCount(livestreamID LivestreamID) int64 {
+	ViewerLastSeenByLivestreamIDCacheMutex.Lock()
+	defer ViewerLastSeenByLivestreamIDCacheMutex.Unlock()
+
+	return int64(len(ViewerLastSeenByLivestreamIDCache[livestreamID]))
+}
+
+func getConcurrentViewersCounts() map[LivestreamID]int64 {
+	ViewerLastSeenByLivestreamIDCacheMutex.Lock()
+	defer ViewerLastSeenByLivestreamIDCacheMutex.Unlock()
+
+	counts := make(map[LivestreamID]int64, len(ViewerLastSeenByLivestreamIDCache))
+	for livestreamID, viewers := range ViewerLastSeenByLivestreamIDCache {
+		counts[livestreamID] = int64(len(viewers))
+	}
+	return counts
+}
+
+// 期限切れの視聴者を取り除き、視聴者数が変わった配信のIDを返す
+func sweepExpiredViewers(now time.Time) []LivestreamID {
+	// この時間ハートビートが途絶えた視聴者は離脱したものとみなす
+	ttl := currentTunables().ViewerHeartbeatTTL
+
+	ViewerLastSeenByLivestreamIDCacheMutex.Lock()
+	defer ViewerLastSeenByLivestreamIDCacheMutex.Unlock()
+
+	var changed []LivestreamID
+	for livestreamID, viewers := range ViewerLastSeenByLivestreamIDCache {
+		before := len(viewers)
+		for userID, lastSeen := range viewers {
+			if now.Sub(lastSeen) > ttl {
+				delete(viewers, userID)
+			}
+		}
+		if len(viewers) != before {
+			changed = append(changed, livestreamID)
+		}
+		if len(viewers) == 0 {
+			delete(ViewerLastSeenByLivestreamIDCache, livestreamID)
+		}
+	}
+
+	return changed
+}
+
+func runViewerPresenceSweeper() {
+	ticker := time.NewTicker(viewerPresenceSweepPeriod)
+	defer ticker.Stop()
+
+	for now := range ticker.C {
+		for _, livestreamID := range sweepExpiredViewers(now) {
+			if err := publishViewersCount(context.Background(), livestreamID); err != nil {
+				log.Printf("failed to publish viewers count: %+v", err)
+			}
+		}
+	}
+}
@@ -0,0 +1,539 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"log"
+	"net"
+	"net/http"
+	"net/netip"
+	"net/url"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"syscall"
+	"time"
+
+	"github.com/labstack/echo-contrib/session"
+	"github.com/labstack/echo/v4"
+)
+
+const (
+	webhookEventLivecommentModerated   = "livecomment_moderated"
+	webhookEventLargeTip               = "large_tip"
+	webhookEventReportThresholdCrossed = "report_threshold_crossed"
+
+	// redのティア以上のチップ
+	webhookLargeTipThreshold = 5000
+	// 1件のライブコメントへの報告がこの件数に達したら送る
+	webhookReportThreshold = 5
+
+	webhookQueueSize       = 1024
+	webhookDeliveryWorkers = 4
+	webhookMaxAttempts     = 4
+	webhookRetryBaseDelay  = time.Second
+	webhookRequestTimeout  = 5 * time.Second
+	// 1人の配信者が登録できるwebhookの数
+	webhookMaxPerUser = 10
+
+	webhookSignatureHeader = "X-Isupipe-Signature"
+	webhookTimestampHeader = "X-Isupipe-Timestamp"
+	webhookEventHeader     = "X-Isupipe-Event"
+)
+
+var webhookEventTypes = []string{
+	webhookEventLivecommentModerated,
+	webhookEventLargeTip,
+	webhookEventReportThresholdCrossed,
+}
+
+type WebhookModel struct {
+	ID         int64  `db:"id"`
+	UserID     UserID `db:"user_id"`
+	URL        string `db:"url"`
+	Secret     string `db:"secret"`
+	EventTypes string `db:"event_types"`
+	CreatedAt  int64  `db:"created_at"`
+}
+
+type Webhook struct {
+	ID         int64    `json:"id"`
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+	CreatedAt  int64    `json:"created_at"`
+}
+
+type PostWebhookRequest struct {
+	URL        string   `json:"url"`
+	EventTypes []string `json:"event_types"`
+}
+
+// 署名の検証に使うsecretは登録時にだけ返す
+type PostWebhookResponse struct {
+	Webhook
+	Secret string `json:"secret"`
+}
+
+// 送信するボディ
+type WebhookPayload struct {
+	Type         string       `json:"type"`
+	LivestreamID LivestreamID `json:"livestream_id"`
+	Data         any          `json:"data"`
+	CreatedAt    int64        `json:"created_at"`
+}
+
+type LivecommentModeratedWebhookData struct {
+	LivecommentIDs []LivecommentID `json:"livecomment_ids"`
+}
+
+type ReportThresholdCrossedWebhookData struct {
+	LivecommentID LivecommentID `json:"livecomment_id"`
+	ReportCount   int64         `json:"report_count"`
+}
+
+// 送信先の解決はワーカーで行う
+type WebhookEvent struct {
+	Type         string
+	LivestreamID LivestreamID
+	Data         any
+}
+
+type webhookDelivery struct {
+	WebhookID int64
+	URL       string
+	Secret    string
+	EventType string
+	Body      []byte
+	Attempt   int
+}
+
+// 配信者ごとの登録済みwebhook
+var (
+	WebhooksByUserIDCache      = make(map[UserID][]*WebhookModel)
+	WebhooksByUserIDCacheMutex = sync.RWMutex{}
+)
+
+var (
+	webhookEventQueue    = make(chan WebhookEvent, webhookQueueSize)
+	webhookDeliveryQueue = make(chan webhookDelivery, webhookQueueSize)
+	webhookHTTPClient    = newWebhookHTTPClient()
+)
+
+// 送信先にはユーザが指定したURLを使うので、内部のサーバ (PowerDNSやMySQL、/api/internal/*) に届かないようにする
+// 名前解決の結果が変わっても (DNS rebinding) 防げるよう、接続する直前のIPアドレスで判断する
+// リダイレクトは追わず、3xxは失敗として扱う
+func newWebhookHTTPClient() *http.Client {
+	dialer := &net.Dialer{
+		Timeout: webhookRequestTimeout,
+		Control: func(network, address string, _ syscall.RawConn) error {
+			host, _, err := net.SplitHostPort(address)
+			if err != nil {
+				return err
+			}
+			addr, err := netip.ParseAddr(host)
+			if err != nil {
+				return err
+			}
+			if !isPublicWebhookAddr(addr) {
+				return fmt.Errorf("webhook destination %s is not a public address", addr)
+			}
+			return nil
+		},
+	}
+	transport := http.DefaultTransport.(*http.Transport).Clone()
+	transport.Proxy = nil
+	transport.DialContext = dialer.DialContext
+	return &http.Client{
+		Timeout:   webhookRequestTimeout,
+		Transport: transport,
+		CheckRedirect: func(*http.Request, []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+// ループバック・プライベート・リンクローカルなど、インターネットから届かないアドレスには送らない
+func isPublicWebhookAddr(addr netip.Addr) bool {
+	addr = addr.Unmap()
+	if !addr.IsGlobalUnicast() || addr.IsPrivate() {
+		return false
+	}
+	for _, prefix := range webhookBlockedPrefixes {
+		if prefix.Contains(addr) {
+			return false
+		}
+	}
+	return true
+}
+
+// IsGlobalUnicastとIsPrivateで除けない予約済みの範囲
+var webhookBlockedPrefixes = []netip.Prefix{
+	netip.MustParsePrefix("0.0.0.0/8"),
+	netip.MustParsePrefix("100.64.0.0/10"),
+	netip.MustParsePrefix("192.0.0.0/24"),
+	netip.MustParsePrefix("198.18.0.0/15"),
+	netip.MustParsePrefix("240.0.0.0/4"),
+	netip.MustParsePrefix("64:ff9b::/96"),
+	netip.MustParsePrefix("2001:db8::/32"),
+}
+
+// 登録時に名前解決して、公開されたアドレスに向いているか確かめる
+// 送信時にもnewWebhookHTTPClientで確かめるので、ここは誤った登録を早めに断るためのもの
+func validateWebhookHost(ctx context.Context, host string) error {
+	if addr, err := netip.ParseAddr(host); err == nil {
+		if !isPublicWebhookAddr(addr) {
+			return fmt.Errorf("%s is not a public address", addr)
+		}
+		return nil
+	}
+	addrs, err := net.DefaultResolver.LookupNetIP(ctx, "ip", host)
+	if err != nil {
+		return fmt.Errorf("failed to resolve %s", host)
+	}
+	for _, addr := range addrs {
+		if !isPublicWebhookAddr(addr) {
+			return fmt.Errorf("%s resolves to a non-public address", host)
+		}
+	}
+	return nil
+}
+
+func init() {
+	registerCacheReset(func() {
+		WebhooksByUserIDCacheMutex.Lock()
+		WebhooksByUserIDCache = make(map[UserID][]*WebhookModel)
+		WebhooksByUserIDCacheMutex.Unlock()
+	})
+	// initialize時に未送信のイベントを捨てる
+	registerCacheReset(func() {
+		for {
+			select {
+			case <-webhookEventQueue:
+			case <-webhookDeliveryQueue:
+			default:
+				return
+			}
+		}
+	})
+}
+
+// リクエストを待たせないよう、キューが詰まっている場合は送信を諦める
+func enqueueWebhookEvent(event WebhookEvent) {
+	select {
+	case webhookEventQueue <- event:
+	default:
+		log.Printf("webhook queue is full, dropped %s event for livestream %d", event.Type, event.LivestreamID)
+	}
+}
+
+func enqueueWebhookDelivery(delivery webhookDelivery) {
+	select {
+	case webhookDeliveryQueue <- delivery:
+	default:
+		log.Printf("webhook delivery queue is full, dropped %s event for webhook %d", delivery.EventType, delivery.WebhookID)
+	}
+}
+
+func runWebhookDispatcher() {
+	for i := 0; i < webhookDeliveryWorkers; i++ {
+		go func() {
+			for delivery := range webhookDeliveryQueue {
+				deliverWebhook(delivery)
+			}
+		}()
+	}
+
+	for event := range webhookEventQueue {
+		if err := dispatchWebhookEvent(context.Background(), event); err != nil {
+			log.Printf("failed to dispatch %s webhook for livestream %d: %+v", event.Type, event.LivestreamID, err)
+		}
+	}
+}
+
+// 配信者のwebhookのうち、イベントを購読しているものに送る
+func dispatchWebhookEvent(ctx context.Context, event WebhookEvent) error {
+	var streamerID UserID
+	if err := dbConn.GetContext(ctx, &streamerID, "SELECT user_id FROM livestreams WHERE id = ?", event.LivestreamID); err != nil {
+		if errors.Is(err, sql.ErrNoRows) {
+			return nil
+		}
+		return err
+	}
+
+	webhooks, err := getWebhooks(ctx, streamerID)
+	if err != nil {
+		return err
+	}
+
+	var body []byte
+	for _, webhook := range webhooks {
+		if !slices.Contains(strings.Split(webhook.EventTypes, ","), event.Type) {
+			continue
+		}
+		if body == nil {
+			body, err = json.Marshal(WebhookPayload{
+				Type:         event.Type,
+				LivestreamID: event.LivestreamID,
+				Data:         event.Data,
+				CreatedAt:    time.Now().Unix(),
+			})
+			if err != nil {
+				return err
+			}
+		}
+		enqueueWebhookDelivery(webhookDelivery{
+			WebhookID: webhook.ID,
+			URL:       webhook.URL,
+			Secret:    webhook.Secret,
+			EventType: event.Type,
+			Body:      body,
+			Attempt:   1,
+		})
+	}
+	return nil
+}
+
+// 失敗したら間隔を倍にしながら再送する。待っている間ワーカーを塞がないようタイマーでキューに戻す
+func deliverWebhook(delivery webhookDelivery) {
+	err := postWebhook(delivery)
+	if err == nil {
+		return
+	}
+	if delivery.Attempt >= webhookMaxAttempts {
+		log.Printf("gave up delivering %s event to webhook %d after %d attempts: %+v", delivery.EventType, delivery.WebhookID, delivery.Attempt, err)
+		return
+	}
+
+	delay := webhookRetryBaseDelay << (delivery.Attempt - 1)
+	delivery.Attempt++
+	time.AfterFunc(delay, func() {
+		enqueueWebhookDelivery(delivery)
+	})
+}
+
+func postWebhook(delivery webhookDelivery) error {
+	req, err := http.NewRequest(http.MethodPost, delivery.URL, bytes.NewReader(delivery.Body))
+	if err != nil {
+		return err
+	}
+	timestamp := strconv.FormatInt(time.Now().Unix(), 10)
+	req.Header.Set(echo.HeaderContentType, echo.MIMEApplicationJSON)
+	req.Header.Set(webhookEventHeader, delivery.EventType)
+	req.Header.Set(webhookTimestampHeader, timestamp)
+	req.Header.Set(webhookSignatureHeader, signWebhookPayload(delivery.Secret, timestamp, delivery.Body))
+
+	resp, err := webhookHTTPClient.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
+		return fmt.Errorf("unexpected status code %d", resp.StatusCode)
+	}
+	return nil
+}
+
+// リプレイ対策にタイムスタンプも含めて署名する: HMAC-SHA256(secret, "<timestamp>.<body>")
+func signWebhookPayload(secret, timestamp string, body []byte) string {
+	mac := hmac.New(sha256.New, []byte(secret))
+	mac.Write([]byte(timestamp))
+	mac.Write([]byte("."))
+	mac.Write(body)
+	return "sha256=" + hex.EncodeToString(mac.Sum(nil))
+}
+
+func getWebhooks(ctx context.Context, userID UserID) ([]*WebhookModel, error) {
+	WebhooksByUserIDCacheMutex.RLock()
+	webhooks, ok := WebhooksByUserIDCache[userID]
+	WebhooksByUserIDCacheMutex.RUnlock()
+	if ok {
+		return webhooks, nil
+	}
+
+	webhooks = []*WebhookModel{}
+	if err := dbConn.SelectContext(ctx, &webhooks, "SELECT * FROM webhooks WHERE user_id = ? ORDER BY id", userID); err != nil {
+		return nil, err
+	}
+
+	WebhooksByUserIDCacheMutex.Lock()
+	WebhooksByUserIDCache[userID] = webhooks
+	WebhooksByUserIDCacheMutex.Unlock()
+
+	return webhooks, nil
+}
+
+// 自分のwebhook一覧API
+// GET /api/user/me/webhooks
+func getWebhooksHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	webhookModels, err := getWebhooks(ctx, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get webhooks: "+err.Error())
+	}
+
+	webhooks := make([]Webhook, len(webhookModels))
+	for i, webhookModel := range webhookModels {
+		webhooks[i] = fillWebhookResponse(webhookModel)
+	}
+
+	return c.JSON(http.StatusOK, webhooks)
+}
+
+// webhook登録API
+// POST /api/user/me/webhooks
+func postWebhookHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	var req *PostWebhookRequest
+	if err := decodeJSONBody(c, &req); err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidJSON, "failed to decode the request body as json")
+	}
+
+	u, err := url.Parse(req.URL)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "url must be an absolute http(s) url")
+	}
+	if err := validateWebhookHost(ctx, u.Hostname()); err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "url must point to a public host: "+err.Error())
+	}
+	if len(req.EventTypes) == 0 {
+		return echo.NewHTTPError(http.StatusBadRequest, "event_types must not be empty")
+	}
+	for _, eventType := range req.EventTypes {
+		if !slices.Contains(webhookEventTypes, eventType) {
+			return echo.NewHTTPError(http.StatusBadRequest, "unknown event type: "+eventType)
+		}
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to generate secret: "+err.Error())
+	}
+
+	webhookModel := WebhookModel{
+		UserID:     userID,
+		URL:        req.URL,
+		Secret:     hex.EncodeToString(secret),
+		EventTypes: strings.Join(slices.Compact(slices.Sorted(slices.Values(req.EventTypes))), ","),
+		CreatedAt:  time.Now().Unix(),
+	}
+	tx, err := dbConn.BeginTxx(ctx, nil)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to begin transaction: "+err.Error())
+	}
+	defer tx.Rollback()
+
+	// 同じユーザの登録を並べて数え漏れを防ぐ
+	var lockedUserID UserID
+	if err := tx.GetContext(ctx, &lockedUserID, "SELECT id FROM users WHERE id = ? FOR UPDATE", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to lock user: "+err.Error())
+	}
+	var webhookCount int
+	if err := tx.GetContext(ctx, &webhookCount, "SELECT COUNT(*) FROM webhooks WHERE user_id = ?", userID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to count webhooks: "+err.Error())
+	}
+	if webhookCount >= webhookMaxPerUser {
+		return newCodedHTTPError(http.StatusConflict, errorCodeConflict, fmt.Sprintf("too many webhooks (max %d)", webhookMaxPerUser))
+	}
+
+	rs, err := tx.NamedExecContext(ctx, "INSERT INTO webhooks (user_id, url, secret, event_types, created_at) VALUES (:user_id, :url, :secret, :event_types, :created_at)", &webhookModel)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to insert webhook: "+err.Error())
+	}
+	webhookID, err := rs.LastInsertId()
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get last inserted webhook id: "+err.Error())
+	}
+	webhookModel.ID = webhookID
+
+	if err := tx.Commit(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to commit: "+err.Error())
+	}
+
+	// 次回参照時にDBから読み直す
+	WebhooksByUserIDCacheMutex.Lock()
+	delete(WebhooksByUserIDCache, userID)
+	WebhooksByUserIDCacheMutex.Unlock()
+
+	return c.JSON(http.StatusCreated, PostWebhookResponse{
+		Webhook: fillWebhookResponse(&webhookModel),
+		Secret:  webhookModel.Secret,
+	})
+}
+
+// webhook削除API
+// DELETE /api/user/me/webhooks/:webhook_id
+func deleteWebhookHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	// error already checked
+	sess, _ := session.Get(defaultSessionIDKey, c)
+	// existence already checked
+	userID := UserID(sess.Values[defaultUserIDKey].(int64))
+
+	webhookID, err := strconv.ParseInt(c.Param("webhook_id"), 10, 64)
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "webhook_id in path must be integer")
+	}
+
+	rs, err := dbConn.ExecContext(ctx, "DELETE FROM webhooks WHERE id = ? AND user_id = ?", webhookID, userID)
+	if err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to delete webhook: "+err.Error())
+	}
+	if n, err := rs.RowsAffected(); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get affected rows: "+err.Error())
+	} else if n == 0 {
+		return echo.NewHTTPError(http.StatusNotFound, "webhook not found")
+	}
+
+	WebhooksByUserIDCacheMutex.Lock()
+	delete(WebhooksByUserIDCache, userID)
+	WebhooksByUserIDCacheMutex.Unlock()
+
+	return c.NoContent(http.StatusNoContent)
+}
+
+func fillWebhookResponse(webhookModel *WebhookModel) Webhook {
+	return Webhook{
+		ID:         webhookModel.ID,
+		URL:        webhookModel.URL,
+		EventTypes: strings.Split(webhookModel.EventTypes, ","),
+		CreatedAt:  webhookModel.CreatedAt,
+	}
+}
@@ -0,0 +1,110 @@
+package main
+
+import (
+	"context"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/labstack/echo/v4"
+	"golang.org/x/net/websocket"
+)
+
+const wsWriteTimeout = 5 * time.Second
+
+type WebSocketMessage struct {
+	Type string      `json:"type"`
+	Data interface{} `json:"data"`
+}
+
+// ライブコメント、リアクション、視聴者数をまとめて配信するWebSocket
+// GET /api/livestream/:livestream_id/ws
+func livestreamWebSocketHandler(c echo.Context) error {
+	ctx := c.Request().Context()
+
+	if err := verifyUserSession(c); err != nil {
+		// echo.NewHTTPErrorが返っているのでそのまま出力
+		return err
+	}
+
+	livestreamID, err := strconv.Atoi(c.Param("livestream_id"))
+	if err != nil {
+		return newCodedHTTPError(http.StatusBadRequest, errorCodeInvalidParameter, "livestream_id in path must be integer")
+	}
+
+	// SSEと同じく、無効の間はクライアントにポーリングへ戻ってもらう
+	if !featureEnabled(featureWebSocket) {
+		return newCodedHTTPError(http.StatusServiceUnavailable, errorCodeFeatureDisabled, "websocket is disabled")
+	}
+
+	var exists bool
+	if err := dbConn.GetContext(ctx, &exists, "SELECT EXISTS(SELECT 1 FROM livestreams WHERE id = ?)", livestreamID); err != nil {
+		return echo.NewHTTPError(http.StatusInternalServerError, "failed to get livestream: "+err.Error())
+	}
+	if !exists {
+		return newCodedHTTPError(http.StatusNotFound, errorCodeLivestreamNotFound, "livestream not found")
+	}
+
+	// Hijack後もサーバのタイムアウトが残るので先に解除する
+	clearConnDeadlines(c)
+
+	// HandshakeをnilにしてOriginチェックを行わない
+	websocket.Server{Handler: func(ws *websocket.Conn) {
+		defer ws.Close()
+
+		events, unsubscribe := livestreamEventHub.Subscribe(LivestreamID(livestreamID))
+		defer unsubscribe()
+
+		// クライアントからのメッセージは読み捨てて、切断の検知にだけ使う
+		closed := make(chan struct{})
+		go func() {
+			defer close(closed)
+			for {
+				var msg string
+				if err := websocket.Message.Receive(ws, &msg); err != nil {
+					return
+				}
+			}
+		}()
+
+		for {
+			select {
+			case <-closed:
+				return
+			case event, ok := <-events:
+				if !ok {
+					// 送信バッファが溢れたクライアントは切断する
+					return
+				}
+				ws.SetWriteDeadline(time.Now().Add(wsWriteTimeout))
+				if err := websocket.JSON.Send(ws, WebSocketMessage{Type: event.Type, Data: event.Data}); err != nil {
+					return
+				}
+			}
+		}
+	}}.ServeHTTP(c.Response(), c.Request())
+
+	return nil
+}
+
+// 購読者がいる場合だけ現在の視聴者数を数えて配信する
+func publishViewersCount(ctx context.Context, livestreamID LivestreamID) error {
+	if !livestreamEventHub.HasSubscribers(livestreamID) {
+		return nil
+	}
+
+	var viewersCount int64
+	if err := dbConn.GetContext(ctx, &viewersCount, "SELECT COUNT(*) FROM livestream_viewers_history WHERE livestream_id = ?", livestreamID); err != nil {
+		return err
+	}
+
+	livestreamEventHub.Publish(livestreamID, LivestreamEvent{
+		Type: livestreamEventViewersCount,
+		Data: ViewersCountEvent{
+			ViewersCount:           viewersCount,
+			ConcurrentViewersCount: getConcurrentViewersCount(livestreamID),
+		},
+	})
+
+	return nil
+}
@@ -1,25 +1,51 @@
 TRUNCATE TABLE themes;
 TRUNCATE TABLE icons;
+TRUNCATE TABLE emotes;
 TRUNCATE TABLE reservation_slots;
 TRUNCATE TABLE livestream_viewers_history;
 TRUNCATE TABLE livecomment_reports;
+TRUNCATE TABLE livecomment_report_counts;
 TRUNCATE TABLE ng_words;
 TRUNCATE TABLE reactions;
 TRUNCATE TABLE tags;
 TRUNCATE TABLE livestream_tags;
 TRUNCATE TABLE livecomments;
+TRUNCATE TABLE archives;
+TRUNCATE TABLE livestream_collaborators;
+TRUNCATE TABLE follows;
+TRUNCATE TABLE notifications;
+TRUNCATE TABLE webhooks;
+TRUNCATE TABLE user_blocks;
+TRUNCATE TABLE user_logins;
+TRUNCATE TABLE livestream_stream_keys;
+TRUNCATE TABLE livestream_chat_settings;
+TRUNCATE TABLE livestream_reports;
+TRUNCATE TABLE livestream_report_counts;
+TRUNCATE TABLE moderation_log;
+TRUNCATE TABLE tip_aggregates;
+TRUNCATE TABLE tip_events;
 TRUNCATE TABLE livestreams;
 TRUNCATE TABLE users;
 
 ALTER TABLE `themes` auto_increment = 1;
 ALTER TABLE `icons` auto_increment = 1;
+ALTER TABLE `emotes` auto_increment = 1;
 ALTER TABLE `reservation_slots` auto_increment = 1;
 ALTER TABLE `livestream_tags` auto_increment = 1;
 ALTER TABLE `livestream_viewers_history` auto_increment = 1;
 ALTER TABLE `livecomment_reports` auto_increment = 1;
+ALTER TABLE `livestream_reports` auto_increment = 1;
+ALTER TABLE `moderation_log` auto_increment = 1;
 ALTER TABLE `ng_words` auto_increment = 1;
 ALTER TABLE `reactions` auto_increment = 1;
 ALTER TABLE `tags` auto_increment = 1;
 ALTER TABLE `livecomments` auto_increment = 1;
+ALTER TABLE `archives` auto_increment = 1;
+ALTER TABLE `livestream_collaborators` auto_increment = 1;
+ALTER TABLE `follows` auto_increment = 1;
+ALTER TABLE `notifications` auto_increment = 1;
+ALTER TABLE `webhooks` auto_increment = 1;
+ALTER TABLE `user_blocks` auto_increment = 1;
+ALTER TABLE `tip_events` auto_increment = 1;
 ALTER TABLE `livestreams` auto_increment = 1;
 ALTER TABLE `users` auto_increment = 1;
\ No newline at end of file
@@ -7,6 +7,8 @@ CREATE TABLE `users` (
   `display_name` VARCHAR(255) NOT NULL,
   `password` VARCHAR(255) NOT NULL,
   `description` TEXT NOT NULL,
+  -- followsの件数 (フォロー/解除時に更新する)
+  `followers_count` BIGINT NOT NULL DEFAULT 0,
   UNIQUE `uniq_user_name` (`name`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 
@@ -14,15 +16,30 @@ CREATE TABLE `users` (
 CREATE TABLE `icons` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
-  `image` LONGBLOB NOT NULL
+  `image` LONGBLOB NOT NULL,
+  -- 過去のアイコンも残し、ユーザごとに1つだけ有効にする
+  `is_active` BOOLEAN NOT NULL DEFAULT TRUE
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX icons_user_id ON icons(`user_id`, `is_active`);
+
+-- 配信者ごとのカスタムエモート
+CREATE TABLE `emotes` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `name` VARCHAR(32) NOT NULL,
+  `image` LONGBLOB NOT NULL,
+  UNIQUE `uniq_emote_user_id_name` (`user_id`, `name`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
-CREATE INDEX icons_user_id ON icons(`user_id`);
 
 -- ユーザごとのカスタムテーマ
 CREATE TABLE `themes` (
   `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
   `user_id` BIGINT NOT NULL,
-  `dark_mode` BOOLEAN NOT NULL
+  `dark_mode` BOOLEAN NOT NULL,
+  -- #rrggbb。空ならフロントエンドのデフォルト
+  `accent_color` VARCHAR(7) NOT NULL DEFAULT '',
+  -- small, medium, large
+  `font_size` VARCHAR(16) NOT NULL DEFAULT 'medium'
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 CREATE INDEX themes_user_id ON themes(`user_id`);
 
@@ -35,9 +52,119 @@ CREATE TABLE `livestreams` (
   `playlist_url` VARCHAR(255) NOT NULL,
   `thumbnail_url` VARCHAR(255) NOT NULL,
   `start_at` BIGINT NOT NULL,
-  `end_at` BIGINT NOT NULL
+  `end_at` BIGINT NOT NULL,
+  -- upcoming, live, ended
+  `status` VARCHAR(16) NOT NULL DEFAULT 'upcoming'
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 CREATE INDEX livestreams_user_id ON livestreams(`user_id`);
+CREATE INDEX livestreams_status ON livestreams(`status`);
+-- タイトル・説明文の全文検索用 (日本語も引っかかるようにngramで分割する)
+CREATE FULLTEXT INDEX livestreams_title_description ON livestreams(`title`, `description`) WITH PARSER ngram;
+
+-- ライブ配信の共同配信者 (モデレーション権限を持つ)
+CREATE TABLE `livestream_collaborators` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_collaborator` (`livestream_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者のフォロー
+CREATE TABLE `follows` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `follower_id` BIGINT NOT NULL,
+  `streamer_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_follow` (`follower_id`, `streamer_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX follows_streamer_id ON follows(`streamer_id`);
+
+-- ユーザのブロック (ブロックしたユーザのコメント・リアクションを表示しない)
+CREATE TABLE `user_blocks` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `blocked_user_id` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_user_block` (`user_id`, `blocked_user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 最後にログインした時刻 (ログイン成功時に非同期で更新する)
+CREATE TABLE `user_logins` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `last_login_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信の取り込み (RTMP) 用のストリームキー。キー自体は保存せずハッシュのみ持つ
+CREATE TABLE `livestream_stream_keys` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `key_hash` CHAR(64) NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_stream_key_hash` (`key_hash`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとのチャットの設定 (行が無ければデフォルト)
+CREATE TABLE `livestream_chat_settings` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `slow_mode_seconds` INT NOT NULL DEFAULT 0,
+  `emote_only` BOOLEAN NOT NULL DEFAULT FALSE,
+  `followers_only` BOOLEAN NOT NULL DEFAULT FALSE
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信者ごとのチップの受け取り額。全体の合計はこの表の合計
+CREATE TABLE `tip_aggregates` (
+  `user_id` BIGINT NOT NULL PRIMARY KEY,
+  `total_tip` BIGINT NOT NULL DEFAULT 0
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- チップ1件ごとの履歴 (削除されたライブコメントのものは消す)
+CREATE TABLE `tip_events` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `streamer_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `livecomment_id` BIGINT NOT NULL,
+  `tipper_id` BIGINT NOT NULL,
+  `tip` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_tip_event_livecomment_id` (`livecomment_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX tip_events_streamer_id_created_at ON tip_events(`streamer_id`, `created_at` DESC, `id` DESC);
+CREATE INDEX tip_events_livestream_id ON tip_events(`livestream_id`);
+
+-- ユーザ宛ての通知
+CREATE TABLE `notifications` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  -- tip, livecomment_moderated, following_live
+  `type` VARCHAR(32) NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `livecomment_id` BIGINT NULL,
+  `amount` BIGINT NOT NULL DEFAULT 0,
+  `read_at` BIGINT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX notifications_user_id ON notifications(`user_id`, `id` DESC);
+
+-- 配信者が登録した外部通知先。event_typesはカンマ区切り
+CREATE TABLE `webhooks` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `url` VARCHAR(2048) NOT NULL,
+  `secret` VARCHAR(255) NOT NULL,
+  `event_types` VARCHAR(255) NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX webhooks_user_id ON webhooks(`user_id`);
+
+-- 終了したライブ配信の録画セグメント
+CREATE TABLE `archives` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `playlist_url` VARCHAR(255) NOT NULL,
+  `duration` BIGINT NOT NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX archives_live_id ON archives(`livestream_id`);
 
 -- ライブ配信予約枠
 CREATE TABLE `reservation_slots` (
@@ -79,9 +206,13 @@ CREATE TABLE `livecomments` (
   `livestream_id` BIGINT NOT NULL,
   `comment` VARCHAR(255) NOT NULL,
   `tip` BIGINT NOT NULL DEFAULT 0,
-  `created_at` BIGINT NOT NULL
+  `created_at` BIGINT NOT NULL,
+  -- モデレーションで削除された日時と、きっかけになったNGワード
+  `deleted_at` BIGINT NULL DEFAULT NULL,
+  `deleted_ng_word` VARCHAR(255) NULL DEFAULT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 CREATE INDEX livecomments_live_id_created_at ON livecomments(`livestream_id`, `created_at` DESC);
+CREATE INDEX livecomments_live_id_id ON livecomments(`livestream_id`, `id` DESC);
 
 -- ユーザからのライブコメントのスパム報告
 CREATE TABLE `livecomment_reports` (
@@ -91,6 +222,48 @@ CREATE TABLE `livecomment_reports` (
   `livecomment_id` BIGINT NOT NULL,
   `created_at` BIGINT NOT NULL
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX livecomment_reports_livecomment_id ON livecomment_reports(`livecomment_id`);
+
+-- ライブコメントごとの報告数 (報告のたびに数え直さない)
+CREATE TABLE `livecomment_report_counts` (
+  `livecomment_id` BIGINT NOT NULL PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `report_count` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX livecomment_report_counts_livestream_id ON livecomment_report_counts(`livestream_id`);
+
+-- 配信の報告 (利用規約違反など)。同じユーザは同じ配信を1回しか報告できない
+CREATE TABLE `livestream_reports` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `user_id` BIGINT NOT NULL,
+  `livestream_id` BIGINT NOT NULL,
+  `reason` VARCHAR(32) NOT NULL,
+  `detail` TEXT NOT NULL,
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_livestream_report` (`livestream_id`, `user_id`)
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+
+-- 配信ごとの報告数 (運営の確認キューの並び順に使う)
+CREATE TABLE `livestream_report_counts` (
+  `livestream_id` BIGINT NOT NULL PRIMARY KEY,
+  `report_count` BIGINT NOT NULL,
+  `last_reported_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX livestream_report_counts_report_count ON livestream_report_counts(`report_count` DESC, `last_reported_at` DESC);
+
+-- モデレーション操作の監査ログ (ng_word_added, livecomment_deleted, user_muted)
+-- actor_idはNGワードによる自動削除ではNULL
+CREATE TABLE `moderation_log` (
+  `id` BIGINT NOT NULL AUTO_INCREMENT PRIMARY KEY,
+  `livestream_id` BIGINT NOT NULL,
+  `actor_id` BIGINT NULL,
+  `action` VARCHAR(32) NOT NULL,
+  `target_user_id` BIGINT NULL,
+  `target_livecomment_id` BIGINT NULL,
+  `ng_word` VARCHAR(255) NULL,
+  `created_at` BIGINT NOT NULL
+) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
+CREATE INDEX moderation_log_livestream_id ON moderation_log(`livestream_id`, `id` DESC);
 
 -- 配信者からのNGワード登録
 CREATE TABLE `ng_words` (
@@ -110,6 +283,7 @@ CREATE TABLE `reactions` (
   `livestream_id` BIGINT NOT NULL,
   -- :innocent:, :tada:, etc...
   `emoji_name` VARCHAR(255) NOT NULL,
-  `created_at` BIGINT NOT NULL
+  `created_at` BIGINT NOT NULL,
+  UNIQUE `uniq_reaction_user_id_live_id_emoji_name` (`user_id`, `livestream_id`, `emoji_name`)
 ) ENGINE=InnoDB CHARACTER SET utf8mb4 COLLATE utf8mb4_bin;
 CREATE INDEX reactions_live_id_created_at ON reactions(`livestream_id`, `created_at` DESC);